@@ -14,47 +14,35 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/openshift/console/pkg/auth"
 	"github.com/openshift/console/pkg/bridge"
 	"github.com/openshift/console/pkg/knative"
+	"github.com/openshift/console/pkg/plugins"
 	"github.com/openshift/console/pkg/proxy"
+	"github.com/openshift/console/pkg/rangecache"
+	"github.com/openshift/console/pkg/recording"
 	"github.com/openshift/console/pkg/server"
 	"github.com/openshift/console/pkg/serverconfig"
 	"github.com/openshift/console/pkg/serverutils"
+	"github.com/openshift/console/pkg/tenancy"
 	oscrypto "github.com/openshift/library-go/pkg/crypto"
 
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 )
 
 const (
 	k8sInClusterCA          = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
 	k8sInClusterBearerToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
-	openshiftMeteringHost = "reporting-operator.openshift-metering.svc:8080"
-	openshiftGitOpsHost = "cluster.openshift-gitops.svc:8080"
-	clusterManagementURL = "https://api.openshift.com/"
+	clusterManagementURL    = "https://api.openshift.com/"
 )
 
 func main() {
-	// Well-known location of the tenant aware Thanos service for OpenShift exposing the query and query_range endpoints. This is only accessible in-cluster.
-	// Thanos proxies requests to both cluster monitoring and user workload monitoring prometheus instances.
-	openshiftThanosTenancyHost := ""
-
-	// Well-known location of the tenant aware Thanos service for OpenShift exposing the rules endpoint. This is only accessible in-cluster.
-	// Thanos proxies requests to the cluster monitoring and user workload monitoring prometheus instances as well as Thanos ruler instances.
-	openshiftThanosTenancyForRulesHost := ""
-
-	// Well-known location of the Thanos service for OpenShift. This is only accessible in-cluster.
-	// This is used for non-tenant global query requests
-	// proxying to both cluster monitoring and user workload monitoring prometheus instances.
-	openshiftThanosHost := ""
-
-	// Well-known location of Alert Manager service for OpenShift. This is only accessible in-cluster.
-	openshiftAlertManagerHost := ""
-
-	// Well-known location of the tenant aware Alert Manager service for OpenShift. This is only accessible in-cluster.
-	openshiftAlertManagerTenancyHost := ""
-
 	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
 	klog.InitFlags(fs)
 	defer klog.Flush()
@@ -76,9 +64,15 @@ func main() {
 	fUserAuthOIDCClientID := fs.String("user-auth-oidc-client-id", "", "The OIDC OAuth2 Client ID.")
 	fUserAuthOIDCClientSecret := fs.String("user-auth-oidc-client-secret", "", "The OIDC OAuth2 Client Secret.")
 	fUserAuthOIDCClientSecretFile := fs.String("user-auth-oidc-client-secret-file", "", "File containing the OIDC OAuth2 Client Secret.")
-	fUserAuthLogoutRedirect := fs.String("user-auth-logout-redirect", "", "Optional redirect URL on logout needed for some single sign-on identity providers.")
+	fUserAuthLogoutRedirect := fs.String("user-auth-logout-redirect", "", "Optional redirect URL on logout needed for some single sign-on identity providers. OIDC providers that support RP-initiated logout are sent it as post_logout_redirect_uri, so it must be registered with them.")
+	fUserAuthOIDCSessionStore := fs.String("user-auth-oidc-session-store", "memory", "memory | secret. Where to keep OIDC sessions. Sessions in memory are lost on restart and require routing users to the same replica, sessions in Secrets are shared by all replicas.")
+	fUserAuthOIDCSessionStoreNamespace := fs.String("user-auth-oidc-session-store-namespace", "", "Namespace of the Secrets of OIDC sessions. The console service account must be able to manage Secrets in it.")
+	fUserAuthOIDCSessionMaxAge := fs.Duration("user-auth-oidc-session-max-age", 0, "Maximum age of OIDC sessions including refreshes, e.g. 24h. 0 disables the limit.")
+	fUserAuthOIDCMaxSessionsPerUser := fs.Int("user-auth-oidc-max-sessions-per-user", 0, "Maximum number of OIDC sessions per user, logging in again logs out the oldest session of the user. 0 disables the limit.")
 
 	fInactivityTimeout := fs.Int("inactivity-timeout", 0, "Number of seconds, after which user will be logged out if inactive. Ignored if less than 300 seconds (5 minutes).")
+	fCookieEncryptionKeyFile := fs.String("cookie-encryption-key-file", "", "File with base64-encoded 16, 24 or 32 byte AES keys to encrypt OpenShift session cookies, one per line. The first key encrypts new cookies, the other keys are still accepted so that keys can be rotated. The file is reloaded every minute.")
+	fCookieEncryptionAcceptPlaintext := fs.Bool("cookie-encryption-accept-plaintext", true, "Accept plaintext OpenShift session cookies set before cookie encryption was enabled. Disable once those sessions have expired.")
 	fCookieDomain := fs.String("cookie-domain", "", "Domain attribute for cookies. If set to a domain starting with a dot (e.g. \".example.com\"), the cookie will be valid for all subdomains of that domain.")
 
 	fK8sMode := fs.String("k8s-mode", "in-cluster", "in-cluster | off-cluster")
@@ -113,6 +107,15 @@ func main() {
 
 	fMonitoringNamespace := fs.String("monitoring-namespace", "", "Namespace of prometheus monitoring stack.")
 	fDashboardsNamespace := fs.String("dashboards-namespace", "", "Namespace where to seek dashboards configmaps for embedded cluster observability.")
+	fPrometheusTenancyMaxRange := fs.Duration("prometheus-tenancy-max-range", 0, "Maximum time range of namespace-scoped Prometheus queries, e.g. 720h. 0 disables the limit.")
+	fPrometheusTenancyMinStep := fs.Duration("prometheus-tenancy-min-step", 0, "Minimum step of namespace-scoped Prometheus range queries, e.g. 15s. 0 disables the limit.")
+	fPrometheusTenancyQueryTimeout := fs.Duration("prometheus-tenancy-query-timeout", 0, "Maximum evaluation timeout of namespace-scoped Prometheus queries, e.g. 2m. 0 disables the limit.")
+	fPrometheusRangeCacheSize := fs.Int("prometheus-range-cache-size", 0, "Memory limit of the Prometheus range query cache in MiB. 0 disables the cache.")
+	fPrometheusRangeCacheFreshness := fs.Duration("prometheus-range-cache-freshness", 5*time.Minute, "Range query results newer than this are not cached, since Prometheus may still ingest samples for them.")
+	fPrometheusExportMaxRange := fs.Duration("prometheus-export-max-range", 7*24*time.Hour, "Maximum time range of Prometheus query exports. 0 disables the limit.")
+	fPrometheusExportMaxSeries := fs.Int("prometheus-export-max-series", 1000, "Maximum number of series of Prometheus query exports. 0 disables the limit.")
+	fAlertmanagerSilenceMaxDuration := fs.Duration("alertmanager-silence-max-duration", 30*24*time.Hour, "Maximum time silences created through the console silences API can be active. 0 disables the limit.")
+	fAlertStreamPollInterval := fs.Duration("alert-stream-poll-interval", 30*time.Second, "How often Alertmanager is polled for the alert stream while clients are connected. 0 disables the alert stream.")
 	fAlermanagerPublicURL := fs.String("alermanager-public-url", "", "Public URL of the cluster's AlertManager server.")
 	fGrafanaPublicURL := fs.String("grafana-public-url", "", "Public URL of the cluster's Grafana server.")
 	fPrometheusPublicURL := fs.String("prometheus-public-url", "", "Public URL of the cluster's Prometheus server.")
@@ -120,7 +123,17 @@ func main() {
 
 	consolePluginsFlags := serverconfig.MultiKeyValue{}
 	fs.Var(&consolePluginsFlags, "plugins", "List of plugin entries that are enabled for the console. Each entry consist of plugin-name as a key and plugin-endpoint as a value.")
+	localPluginsFlags := serverconfig.MultiKeyValue{}
+	fs.Var(&localPluginsFlags, "plugin-local", "List of plugin entries that are served from a local directory for plugin development. Each entry consist of plugin-name as a key and the directory of the built plugin as a value. Changes reload the console.")
+	fPluginAssetCacheSize := fs.Int("plugin-asset-cache-size", 50, "Memory limit of the plugin asset cache in MiB. Cached assets are revalidated with the plugin service on every request. 0 disables the cache.")
+	fPluginManifestCheckInterval := fs.Duration("plugin-manifest-check-interval", 5*time.Minute, "How often the manifests of the enabled plugins are validated. Plugins with invalid manifests or unmet dependencies are not loaded. 0 disables the checks.")
+	fPluginIntegrity := fs.Bool("plugin-integrity", false, "Pin the SHA-384 hash of each plugin's entry script when it is first loaded and reject entry scripts that don't match it.")
+	fPluginIntegrityPinsFile := fs.String("plugin-integrity-pins-file", "", "File that persists the plugin entry script pins across restarts. Pins are only kept in memory if empty.")
+	fPluginIntegrityRepin := fs.String("plugin-integrity-repin", "", "Comma-separated list of plugins whose entry scripts are pinned again, e.g. after an intentional upgrade. '*' re-pins all plugins.")
+	fPluginsDiscovery := fs.Bool("plugins-discovery", false, "Enable the plugins of ConsolePlugin resources that are enabled in the console operator config in addition to --plugins, without restarting.")
 	fPluginProxy := fs.String("plugin-proxy", "", "Defines various service types to which will console proxy plugins requests. (JSON as string)")
+	fLogsGatewayURL := fs.String("logs-gateway-url", "", "URL of the LokiStack gateway. Logs are proxied below /api/logs and /api/logs-tenancy if set.")
+	fUpstreams := fs.String("upstreams", "", "Backend services proxied by the console. Entries replace the default upstream of the same name. (JSON as string)")
 	fI18NamespacesFlags := fs.String("i18n-namespaces", "", "List of namespaces separated by comma. Example --i18n-namespaces=plugin__acm,plugin__kubevirt")
 
 	telemetryFlags := serverconfig.MultiKeyValue{}
@@ -137,6 +150,23 @@ func main() {
 	fControlPlaneTopology := fs.String("control-plane-topology-mode", "", "Defines the topology mode of the control/infra nodes (External | HighlyAvailable | SingleReplica)")
 	fReleaseVersion := fs.String("release-version", "", "Defines the release version of the cluster")
 
+	fProxyCompression := fs.Bool("proxy-compression", true, "Compress proxied JSON and YAML API responses for clients that accept brotli or gzip, unless the upstream already compressed them.")
+	fWebsocketCompression := fs.Bool("websocket-compression", true, "Negotiate the permessage-deflate extension for proxied websockets.")
+	fCompressionMinSize := fs.Int("compression-min-size", proxy.DefaultCompressionMinSize, "Minimum size in bytes of a proxied response or websocket message to be compressed.")
+
+	fWebsocketPingInterval := fs.Duration("websocket-ping-interval", proxy.DefaultWebsocketPingInterval, "Interval between pings sent to websocket clients to keep the connection open.")
+	fWebsocketTimeout := fs.Duration("websocket-timeout", proxy.DefaultWebsocketTimeout, "Timeout for writing websocket control messages to the client.")
+	fWebsocketMaxIdle := fs.Duration("websocket-max-idle", 0, "Close pod exec and attach sessions without traffic for this long, e.g. 10m. 0 disables the idle timeout.")
+	fWebsocketMaxSessionDuration := fs.Duration("websocket-max-session-duration", 0, "Close pod exec and attach sessions after this long, e.g. 8h. 0 disables the limit.")
+	fWebsocketMaxConnectionsPerUser := fs.Int("websocket-max-connections-per-user", 0, "Maximum number of concurrent proxied websockets per user. 0 means unlimited.")
+	fWebsocketMaxConnections := fs.Int("websocket-max-connections", 0, "Maximum number of concurrent proxied websockets. 0 means unlimited.")
+
+	fSessionRecordingDir := fs.String("session-recording-dir", "", "Directory to record pod exec and attach sessions to as asciinema casts. Sessions are not recorded if empty.")
+	fSessionRecordingMaxAge := fs.Duration("session-recording-max-age", 0, "Delete session recordings older than this, e.g. 720h. 0 keeps recordings forever.")
+	fSessionRecordingMaxRecordings := fs.Int("session-recording-max-recordings", 0, "Maximum number of session recordings to keep, the oldest are deleted first. 0 means unlimited.")
+
+	fImpersonationAccessReview := fs.Bool("impersonation-access-review", false, "Check that users are allowed to impersonate with a SelfSubjectAccessReview before proxying impersonated requests to the API server.")
+
 	if err := serverconfig.Parse(fs, os.Args[1:], "BRIDGE"); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -237,6 +267,16 @@ func main() {
 		}
 	}
 
+	for pluginName, dir := range localPluginsFlags {
+		if _, ok := consolePluginsFlags[pluginName]; ok {
+			bridge.FlagFatalf("plugin-local", "plugin %q is also enabled with --plugins", pluginName)
+		}
+		if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+			bridge.FlagFatalf("plugin-local", "%q of plugin %q is not a directory", dir, pluginName)
+		}
+		klog.Infof("Serving the %q plugin from %s", pluginName, dir)
+	}
+
 	i18nNamespaces := strings.Split(*fI18NamespacesFlags, ",")
 	if *fI18NamespacesFlags != "" {
 		for _, str := range i18nNamespaces {
@@ -267,6 +307,7 @@ func main() {
 		DevCatalogCategories:      *fDevCatalogCategories,
 		UserSettingsLocation:      *fUserSettingsLocation,
 		EnabledConsolePlugins:     consolePluginsFlags,
+		LocalConsolePlugins:       localPluginsFlags,
 		I18nNamespaces:            i18nNamespaces,
 		PluginProxy:               *fPluginProxy,
 		QuickStarts:               *fQuickStarts,
@@ -278,11 +319,134 @@ func main() {
 		ReleaseVersion:            *fReleaseVersion,
 	}
 
-	openshiftThanosTenancyHost = "thanos-querier." + srv.MonitoringNamespace + ".svc:9092"
-	openshiftThanosTenancyForRulesHost = "thanos-querier." + srv.MonitoringNamespace + ".svc:9093"
-	openshiftThanosHost = "thanos-querier." + srv.MonitoringNamespace + ".svc:9091"
-	openshiftAlertManagerHost = "monitoring-alertmanager." + srv.MonitoringNamespace + ".svc:9094"
-	openshiftAlertManagerTenancyHost = "monitoring-alertmanager." + srv.MonitoringNamespace + ".svc:9092"
+	if *fProxyCompression || *fWebsocketCompression {
+		if *fCompressionMinSize < 0 {
+			bridge.FlagFatalf("compression-min-size", "must not be negative")
+		}
+		srv.ProxyCompression = &proxy.CompressionConfig{
+			DisableHTTP:      !*fProxyCompression,
+			DisableWebsocket: !*fWebsocketCompression,
+			MinSize:          *fCompressionMinSize,
+		}
+	}
+
+	for flagName, value := range map[string]time.Duration{
+		"websocket-ping-interval":        *fWebsocketPingInterval,
+		"websocket-timeout":              *fWebsocketTimeout,
+		"websocket-max-idle":             *fWebsocketMaxIdle,
+		"websocket-max-session-duration": *fWebsocketMaxSessionDuration,
+	} {
+		if value < 0 {
+			bridge.FlagFatalf(flagName, "must not be negative")
+		}
+	}
+	for flagName, value := range map[string]int{
+		"websocket-max-connections-per-user": *fWebsocketMaxConnectionsPerUser,
+		"websocket-max-connections":          *fWebsocketMaxConnections,
+	} {
+		if value < 0 {
+			bridge.FlagFatalf(flagName, "must not be negative")
+		}
+	}
+	srv.WebsocketConfig = &proxy.WebsocketConfig{
+		PingInterval:       *fWebsocketPingInterval,
+		Timeout:            *fWebsocketTimeout,
+		MaxIdle:            *fWebsocketMaxIdle,
+		MaxSessionDuration: *fWebsocketMaxSessionDuration,
+		Limiter:            proxy.NewWebsocketLimiter(*fWebsocketMaxConnections, *fWebsocketMaxConnectionsPerUser),
+	}
+
+	for flagName, value := range map[string]time.Duration{
+		"prometheus-tenancy-max-range":     *fPrometheusTenancyMaxRange,
+		"prometheus-tenancy-min-step":      *fPrometheusTenancyMinStep,
+		"prometheus-tenancy-query-timeout": *fPrometheusTenancyQueryTimeout,
+	} {
+		if value < 0 {
+			bridge.FlagFatalf(flagName, "must not be negative")
+		}
+	}
+	srv.PrometheusTenancyLimits = tenancy.Limits{
+		MaxRange:     *fPrometheusTenancyMaxRange,
+		MinStep:      *fPrometheusTenancyMinStep,
+		QueryTimeout: *fPrometheusTenancyQueryTimeout,
+	}
+
+	if *fPluginAssetCacheSize < 0 {
+		bridge.FlagFatalf("plugin-asset-cache-size", "must not be negative")
+	}
+	if *fPluginAssetCacheSize > 0 {
+		srv.PluginAssetCache = plugins.NewAssetCache(int64(*fPluginAssetCacheSize) << 20)
+	}
+	if *fPluginManifestCheckInterval < 0 {
+		bridge.FlagFatalf("plugin-manifest-check-interval", "must not be negative")
+	}
+	srv.PluginManifestCheckInterval = *fPluginManifestCheckInterval
+
+	if *fPluginIntegrity {
+		var repin []string
+		if *fPluginIntegrityRepin != "" {
+			repin = strings.Split(*fPluginIntegrityRepin, ",")
+		}
+		pins, err := plugins.NewIntegrityPins(*fPluginIntegrityPinsFile, repin)
+		if err != nil {
+			bridge.FlagFatalf("plugin-integrity-pins-file", "%v", err)
+		}
+		srv.PluginIntegrityPins = pins
+	} else if *fPluginIntegrityPinsFile != "" || *fPluginIntegrityRepin != "" {
+		bridge.FlagFatalf("plugin-integrity", "must be set to pin plugin entry scripts")
+	}
+
+	if *fPrometheusRangeCacheSize < 0 {
+		bridge.FlagFatalf("prometheus-range-cache-size", "must not be negative")
+	}
+	if *fPrometheusRangeCacheFreshness < 0 {
+		bridge.FlagFatalf("prometheus-range-cache-freshness", "must not be negative")
+	}
+	if *fPrometheusRangeCacheSize > 0 {
+		srv.RangeQueryCache = rangecache.NewCache(int64(*fPrometheusRangeCacheSize)<<20, *fPrometheusRangeCacheFreshness)
+	}
+
+	if *fPrometheusExportMaxRange < 0 {
+		bridge.FlagFatalf("prometheus-export-max-range", "must not be negative")
+	}
+	if *fPrometheusExportMaxSeries < 0 {
+		bridge.FlagFatalf("prometheus-export-max-series", "must not be negative")
+	}
+	srv.PrometheusExportMaxRange = *fPrometheusExportMaxRange
+	srv.PrometheusExportMaxSeries = *fPrometheusExportMaxSeries
+
+	if *fAlertmanagerSilenceMaxDuration < 0 {
+		bridge.FlagFatalf("alertmanager-silence-max-duration", "must not be negative")
+	}
+	srv.SilenceMaxDuration = *fAlertmanagerSilenceMaxDuration
+	if *fAlertStreamPollInterval < 0 {
+		bridge.FlagFatalf("alert-stream-poll-interval", "must not be negative")
+	}
+	srv.AlertStreamPollInterval = *fAlertStreamPollInterval
+
+	srv.ImpersonationConfig = &proxy.ImpersonationConfig{
+		AccessReview: *fImpersonationAccessReview,
+	}
+
+	if *fSessionRecordingDir != "" {
+		if *fSessionRecordingMaxAge < 0 {
+			bridge.FlagFatalf("session-recording-max-age", "must not be negative")
+		}
+		if *fSessionRecordingMaxRecordings < 0 {
+			bridge.FlagFatalf("session-recording-max-recordings", "must not be negative")
+		}
+		store, err := recording.NewDirectoryStore(*fSessionRecordingDir)
+		if err != nil {
+			bridge.FlagFatalf("session-recording-dir", "%v", err)
+		}
+		srv.SessionRecorder = recording.NewRecorder(store, recording.Retention{
+			MaxAge:        *fSessionRecordingMaxAge,
+			MaxRecordings: *fSessionRecordingMaxRecordings,
+		})
+		if err := srv.SessionRecorder.Prune(); err != nil {
+			klog.Errorf("Failed to prune session recordings: %v", err)
+		}
+	}
 
 	managedClusterConfigs := []serverconfig.ManagedClusterConfig{}
 	if *fManagedClusterConfigs != "" {
@@ -326,9 +490,10 @@ func main() {
 			})
 
 			srv.K8sProxyConfigs[managedCluster.Name] = &proxy.Config{
-				TLSClientConfig: managedClusterTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        managedClusterAPIEndpointURL,
+				TLSClientConfig:  managedClusterTLSConfig,
+				HeaderBlacklist:  []string{"Cookie", "X-CSRFToken"},
+				Endpoint:         managedClusterAPIEndpointURL,
+				EnableProjection: true,
 			}
 
 			srv.K8sClients[managedCluster.Name] = &http.Client{
@@ -377,7 +542,11 @@ func main() {
 		klog.Warning("cookies are not secure because base-address is not https!")
 	}
 
-	var k8sEndpoint *url.URL
+	var (
+		k8sEndpoint       *url.URL
+		defaultEndpoints  serverconfig.DefaultUpstreamEndpoints
+		upstreamTLSConfig = oscrypto.SecureTLSConfig(&tls.Config{})
+	)
 	switch *fK8sMode {
 	case "in-cluster":
 		// #!!!
@@ -402,9 +571,10 @@ func main() {
 		}
 
 		srv.K8sProxyConfigs[serverutils.LocalClusterName] = &proxy.Config{
-			TLSClientConfig: tlsConfig,
-			HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-			Endpoint:        k8sEndpoint,
+			TLSClientConfig:  tlsConfig,
+			HeaderBlacklist:  []string{"Cookie", "X-CSRFToken"},
+			Endpoint:         k8sEndpoint,
+			EnableProjection: true,
 		}
 
 		k8sAuthServiceAccountBearerToken = string(bearerToken)
@@ -422,44 +592,11 @@ func main() {
 			serviceProxyTLSConfig := oscrypto.SecureTLSConfig(&tls.Config{
 				RootCAs: serviceProxyRootCAs,
 			})
-			srv.ThanosProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftThanosHost, Path: "/api"},
-			}
-			srv.ThanosTenancyProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftThanosTenancyHost, Path: "/api"},
-			}
-			srv.ThanosTenancyProxyForRulesConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftThanosTenancyForRulesHost, Path: "/api"},
-			}
-			srv.AlertManagerProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftAlertManagerHost, Path: "/api"},
-			}
-			srv.AlertManagerTenancyProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftAlertManagerTenancyHost, Path: "/api"},
-			}
-			srv.MeteringProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftMeteringHost, Path: "/api"},
-			}
 			srv.TerminalProxyTLSConfig = serviceProxyTLSConfig
 			srv.PluginsProxyTLSConfig = serviceProxyTLSConfig
 
-			srv.GitOpsProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        &url.URL{Scheme: "https", Host: openshiftGitOpsHost},
-			}
+			upstreamTLSConfig = serviceProxyTLSConfig
+			defaultEndpoints = serverconfig.InClusterUpstreamEndpoints(srv.MonitoringNamespace)
 		}
 
 	case "off-cluster":
@@ -468,66 +605,32 @@ func main() {
 			InsecureSkipVerify: *fK8sModeOffClusterSkipVerifyTLS,
 		})
 		srv.K8sProxyConfigs[serverutils.LocalClusterName] = &proxy.Config{
-			TLSClientConfig: serviceProxyTLSConfig,
-			HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-			Endpoint:        k8sEndpoint,
+			TLSClientConfig:  serviceProxyTLSConfig,
+			HeaderBlacklist:  []string{"Cookie", "X-CSRFToken"},
+			Endpoint:         k8sEndpoint,
+			EnableProjection: true,
 		}
 
+		srv.TerminalProxyTLSConfig = serviceProxyTLSConfig
+		srv.PluginsProxyTLSConfig = serviceProxyTLSConfig
+
+		upstreamTLSConfig = serviceProxyTLSConfig
 		if *fK8sModeOffClusterThanos != "" {
-			offClusterThanosURL := bridge.ValidateFlagIsURL("k8s-mode-off-cluster-thanos", *fK8sModeOffClusterThanos)
-			offClusterThanosURL.Path += "/api"
-			srv.ThanosTenancyProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterThanosURL,
-			}
-			srv.ThanosTenancyProxyForRulesConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterThanosURL,
-			}
-			srv.ThanosProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterThanosURL,
-			}
+			offClusterThanosURL := bridge.ValidateFlagIsURL("k8s-mode-off-cluster-thanos", *fK8sModeOffClusterThanos).String()
+			defaultEndpoints.Thanos = offClusterThanosURL
+			defaultEndpoints.ThanosTenancy = offClusterThanosURL
+			defaultEndpoints.ThanosTenancyForRules = offClusterThanosURL
 		}
-
 		if *fK8sModeOffClusterAlertmanager != "" {
-			offClusterAlertManagerURL := bridge.ValidateFlagIsURL("k8s-mode-off-cluster-alertmanager", *fK8sModeOffClusterAlertmanager)
-			offClusterAlertManagerURL.Path += "/api"
-			srv.AlertManagerProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterAlertManagerURL,
-			}
-			srv.AlertManagerTenancyProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterAlertManagerURL,
-			}
+			offClusterAlertManagerURL := bridge.ValidateFlagIsURL("k8s-mode-off-cluster-alertmanager", *fK8sModeOffClusterAlertmanager).String()
+			defaultEndpoints.Alertmanager = offClusterAlertManagerURL
+			defaultEndpoints.AlertmanagerTenancy = offClusterAlertManagerURL
 		}
-
 		if *fK8sModeOffClusterMetering != "" {
-			offClusterMeteringURL := bridge.ValidateFlagIsURL("k8s-mode-off-cluster-metering", *fK8sModeOffClusterMetering)
-			offClusterMeteringURL.Path += "/api"
-			srv.MeteringProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterMeteringURL,
-			}
+			defaultEndpoints.Metering = bridge.ValidateFlagIsURL("k8s-mode-off-cluster-metering", *fK8sModeOffClusterMetering).String()
 		}
-
-		srv.TerminalProxyTLSConfig = serviceProxyTLSConfig
-		srv.PluginsProxyTLSConfig = serviceProxyTLSConfig
-
 		if *fK8sModeOffClusterGitOps != "" {
-			offClusterGitOpsURL := bridge.ValidateFlagIsURL("k8s-mode-off-cluster-gitops", *fK8sModeOffClusterGitOps)
-			srv.GitOpsProxyConfig = &proxy.Config{
-				TLSClientConfig: serviceProxyTLSConfig,
-				HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
-				Endpoint:        offClusterGitOpsURL,
-			}
+			defaultEndpoints.GitOps = bridge.ValidateFlagIsURL("k8s-mode-off-cluster-gitops", *fK8sModeOffClusterGitOps).String()
 		}
 
 	default:
@@ -555,6 +658,21 @@ func main() {
 		Endpoint:        clusterManagementURL,
 	}
 
+	if *fLogsGatewayURL != "" {
+		defaultEndpoints.LokiGateway = bridge.ValidateFlagIsURL("logs-gateway-url", *fLogsGatewayURL).String()
+	}
+	configuredUpstreams, err := serverconfig.ParseUpstreams(*fUpstreams)
+	if err != nil {
+		bridge.FlagFatalf("upstreams", "%v", err)
+	}
+	upstreams := serverconfig.MergeUpstreams(serverconfig.DefaultUpstreams(defaultEndpoints), configuredUpstreams)
+	if err := serverconfig.ValidateUpstreams(upstreams); err != nil {
+		bridge.FlagFatalf("upstreams", "%v", err)
+	}
+	for _, upstream := range upstreams {
+		srv.Upstreams = append(srv.Upstreams, newUpstream(upstream, upstreamTLSConfig))
+	}
+
 	switch *fUserAuth {
 	case "oidc", "openshift":
 		bridge.ValidateFlagNotEmpty("base-address", *fBaseAddress)
@@ -584,6 +702,13 @@ func main() {
 		scopes := []string{"openid", "email", "profile", "groups"}
 		authSource := auth.AuthSourceTectonic
 
+		// Providers that support RP-initiated logout send users to the logout redirect. It must be
+		// registered with the provider, so the provider's default is used if it isn't set.
+		var postLogoutRedirectURL string
+		if *fUserAuthLogoutRedirect != "" {
+			postLogoutRedirectURL = logoutRedirect.String()
+		}
+
 		if *fUserAuth == "openshift" {
 			// Scopes come from OpenShift documentation
 			// https://access.redhat.com/documentation/en-us/openshift_container_platform/4.9/html/authentication_and_authorization/using-service-accounts-as-oauth-client
@@ -629,6 +754,8 @@ func main() {
 			RefererPath:   refererPath,
 			SecureCookies: secureCookies,
 			ClusterName:   serverutils.LocalClusterName,
+
+			PostLogoutRedirectURL: postLogoutRedirectURL,
 		}
 
 		// NOTE: This won't work when using the OpenShift auth mode.
@@ -646,6 +773,56 @@ func main() {
 
 		}
 
+		if *fUserAuthOIDCSessionMaxAge < 0 {
+			bridge.FlagFatalf("user-auth-oidc-session-max-age", "must not be negative")
+		}
+		if *fUserAuthOIDCMaxSessionsPerUser < 0 {
+			bridge.FlagFatalf("user-auth-oidc-max-sessions-per-user", "must not be negative")
+		}
+		sessionLimits := auth.SessionLimits{
+			MaxSessions:        auth.DefaultMaxSessions,
+			MaxSessionsPerUser: *fUserAuthOIDCMaxSessionsPerUser,
+			MaxAge:             *fUserAuthOIDCSessionMaxAge,
+		}
+		var newSessionStore func(clusterName string) auth.SessionStore
+		switch *fUserAuthOIDCSessionStore {
+		case "memory":
+			newSessionStore = func(string) auth.SessionStore {
+				return auth.NewMemorySessionStore(sessionLimits)
+			}
+		case "secret":
+			bridge.ValidateFlagIs("user-auth", *fUserAuth, "oidc")
+			bridge.ValidateFlagIs("k8s-mode", *fK8sMode, "in-cluster")
+			bridge.ValidateFlagNotEmpty("user-auth-oidc-session-store-namespace", *fUserAuthOIDCSessionStoreNamespace)
+			sessionsClient, err := kubernetes.NewForConfig(&rest.Config{
+				Host:        k8sEndpoint.String(),
+				BearerToken: k8sAuthServiceAccountBearerToken,
+				Transport: &http.Transport{
+					TLSClientConfig: srv.K8sProxyConfigs[serverutils.LocalClusterName].TLSClientConfig,
+				},
+			})
+			if err != nil {
+				klog.Fatalf("Failed to create a client for the session store: %v", err)
+			}
+			sessionSecrets := sessionsClient.CoreV1().Secrets(*fUserAuthOIDCSessionStoreNamespace)
+			newSessionStore = func(clusterName string) auth.SessionStore {
+				return auth.NewSecretSessionStore(sessionSecrets, clusterName, sessionLimits)
+			}
+		default:
+			bridge.FlagFatalf("user-auth-oidc-session-store", "must be one of: memory, secret")
+		}
+		oidcClientConfig.SessionStore = newSessionStore(serverutils.LocalClusterName)
+
+		var cookieKeyring *auth.CookieKeyring
+		if *fCookieEncryptionKeyFile != "" {
+			bridge.ValidateFlagIs("user-auth", *fUserAuth, "openshift")
+			if cookieKeyring, err = auth.NewCookieKeyring(*fCookieEncryptionKeyFile, *fCookieEncryptionAcceptPlaintext); err != nil {
+				klog.Fatalf("Failed to load cookie encryption keys: %v", err)
+			}
+			go cookieKeyring.Run(wait.NeverStop)
+		}
+		oidcClientConfig.CookieKeyring = cookieKeyring
+
 		srv.Authers = make(map[string]*auth.Authenticator)
 		if srv.Authers[serverutils.LocalClusterName], err = auth.NewAuthenticator(context.Background(), oidcClientConfig); err != nil {
 			klog.Fatalf("Error initializing authenticator: %v", err)
@@ -674,6 +851,10 @@ func main() {
 					RefererPath:   refererPath,
 					SecureCookies: secureCookies,
 					ClusterName:   managedCluster.Name,
+					SessionStore:  newSessionStore(managedCluster.Name),
+					CookieKeyring: cookieKeyring,
+
+					PostLogoutRedirectURL: postLogoutRedirectURL,
 				}
 
 				if srv.Authers[managedCluster.Name], err = auth.NewAuthenticator(context.Background(), managedClusterOIDCClientConfig); err != nil {
@@ -762,6 +943,20 @@ func main() {
 		knative.ChannelFilter,
 	)
 
+	if *fPluginsDiscovery {
+		pluginsDiscoveryClient, err := dynamic.NewForConfig(&rest.Config{
+			Host:        k8sEndpoint.String(),
+			BearerToken: srv.ServiceAccountToken,
+			Transport: &http.Transport{
+				TLSClientConfig: srv.K8sProxyConfigs[serverutils.LocalClusterName].TLSClientConfig,
+			},
+		})
+		if err != nil {
+			klog.Fatalf("Failed to create a client for plugin discovery: %v", err)
+		}
+		srv.PluginDiscovery = &plugins.Discovery{Client: pluginsDiscoveryClient}
+	}
+
 	listenURL := bridge.ValidateFlagIsURL("listen", *fListen)
 	switch listenURL.Scheme {
 	case "http":
@@ -808,3 +1003,40 @@ func main() {
 		klog.Fatal(httpsrv.ListenAndServe())
 	}
 }
+
+// newUpstream creates the proxy for a validated upstream. Upstreams without CA file use the given TLS config.
+func newUpstream(upstream serverconfig.Upstream, tlsConfig *tls.Config) *server.Upstream {
+	if upstream.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(upstream.CAFile)
+		if err != nil {
+			klog.Fatalf("failed to read CA file of upstream %q: %v", upstream.Name, err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			klog.Fatalf("no CA found in CA file of upstream %q", upstream.Name)
+		}
+		tlsConfig = oscrypto.SecureTLSConfig(&tls.Config{
+			RootCAs: rootCAs,
+		})
+	}
+	endpoint, err := url.Parse(upstream.Endpoint)
+	if err != nil {
+		klog.Fatalf("invalid endpoint of upstream %q: %v", upstream.Name, err)
+	}
+	return &server.Upstream{
+		Name:                       upstream.Name,
+		ConsolePath:                upstream.ConsolePath,
+		HandlerPaths:               upstream.HandlerPaths(),
+		ForwardToken:               upstream.Auth != serverconfig.UpstreamAuthNone,
+		JSGlobal:                   upstream.JSGlobal,
+		DisableWithManagedClusters: upstream.DisableWithManagedClusters,
+		PromQLTenancy:              upstream.PromQLTenancy,
+		CacheRangeQueries:          upstream.CacheRangeQueries,
+		LogQLTenancy:               upstream.LogQLTenancy,
+		ProxyConfig: &proxy.Config{
+			TLSClientConfig: tlsConfig,
+			HeaderBlacklist: []string{"Cookie", "X-CSRFToken"},
+			Endpoint:        endpoint,
+		},
+	}
+}
@@ -33,6 +33,8 @@ declare interface Window {
     loginURL: string;
     logoutRedirect: string;
     logoutURL: string;
+    logsBaseURL: string;
+    logsTenancyBaseURL: string;
     meteringBaseURL: string;
     prometheusBaseURL: string;
     prometheusTenancyBaseURL: string;
@@ -48,12 +50,14 @@ declare interface Window {
     userSettingsLocation: string;
     addPage: string; // JSON encoded configuration
     consolePlugins: string[]; // Console dynamic plugins enabled on the cluster
+    consolePluginIntegrity: { [pluginName: string]: string }; // Pinned hashes of plugin entry scripts
     i18nNamespaces: string[]; // Available i18n namespaces
     quickStarts: string;
     projectAccessClusterRoles: string;
     clusters: string[];
     controlPlaneTopology: string;
     telemetry: Record<string, string>;
+    upstreamBaseURLs: Record<string, string>;
   };
   windowError?: string;
   __REDUX_DEVTOOLS_EXTENSION_COMPOSE__?: Function;
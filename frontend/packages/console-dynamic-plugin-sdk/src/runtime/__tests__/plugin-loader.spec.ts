@@ -73,6 +73,13 @@ describe('loadDynamicPlugin', () => {
     expect(script.src).toBe('http://example.com/test/plugin-entry.js');
   });
 
+  it('sets the integrity attribute of the script element if given', () => {
+    const manifest = getPluginManifest('Test', '1.2.3');
+    loadDynamicPlugin('http://example.com/test/', manifest, 'sha384-abc');
+
+    expect(getScriptElement(manifest).integrity).toBe('sha384-abc');
+  });
+
   it('throws an error if a plugin with the same name is already registered', async () => {
     const manifest1 = getPluginManifest('Test', '1.2.3');
     const manifest2 = getPluginManifest('Test', '2.3.4');
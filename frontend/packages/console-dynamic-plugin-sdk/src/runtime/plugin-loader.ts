@@ -26,7 +26,11 @@ export const scriptIDPrefix = 'console-plugin';
 
 export const getScriptElementID = (m: ConsolePluginManifestJSON) => `${scriptIDPrefix}-${m.name}`;
 
-export const loadDynamicPlugin = (baseURL: string, manifest: ConsolePluginManifestJSON) =>
+export const loadDynamicPlugin = (
+  baseURL: string,
+  manifest: ConsolePluginManifestJSON,
+  integrity?: string,
+) =>
   new Promise<string>((resolve, reject) => {
     const pluginID = getPluginID(manifest);
 
@@ -50,6 +54,10 @@ export const loadDynamicPlugin = (baseURL: string, manifest: ConsolePluginManife
     script.src = resolveURL(baseURL, remoteEntryFile);
     script.async = true;
 
+    if (integrity) {
+      script.integrity = integrity;
+    }
+
     script.onload = () => {
       if (pluginMap.get(pluginID).entryCallbackFired) {
         resolve(pluginID);
@@ -130,7 +138,11 @@ export const loadAndEnablePlugin = async (
       pluginStore.getAllowedDynamicPluginNames(),
     );
 
-    const pluginID = await loadDynamicPlugin(url, manifest);
+    const pluginID = await loadDynamicPlugin(
+      url,
+      manifest,
+      window.SERVER_FLAGS.consolePluginIntegrity?.[pluginName],
+    );
     pluginStore.setDynamicPluginEnabled(pluginID, true);
   } catch (e) {
     console.error(`Error while loading plugin ${pluginName} from ${url}`, e);
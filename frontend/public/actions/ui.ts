@@ -251,7 +251,8 @@ export const startImpersonate = (kind: string, name: string) => async (dispatch,
     subprotocols = [`Impersonate-User.${encodedName}`];
   }
   if (kind === 'Group') {
-    subprotocols = [`Impersonate-Group.${encodedName}`];
+    // Kubernetes requires a user when impersonating groups, same as the HTTP headers.
+    subprotocols = [`Impersonate-User.${encodedName}`, `Impersonate-Group.${encodedName}`];
   }
 
   dispatch(beginImpersonate(kind, name, subprotocols));
@@ -336,7 +336,26 @@ const PollConsoleUpdates = React.memo(function PollConsoleUpdates() {
   const stateInitialized = _.isEmpty(pluginsError) && !_.isEmpty(prevPluginsData);
 
   const pluginsListChanged = !_.isEmpty(_.xor(prevPluginsData?.plugins, pluginsData?.plugins));
-  if (stateInitialized && pluginsListChanged && !pluginsChanged) {
+  // Plugins without a hash couldn't be reached, which doesn't mean they were upgraded.
+  const pluginManifestsChanged = _.some(
+    pluginsData?.pluginManifestHashes,
+    (hash, pluginName) =>
+      prevPluginsData?.pluginManifestHashes?.[pluginName] &&
+      prevPluginsData.pluginManifestHashes[pluginName] !== hash,
+  );
+  // Local plugins are served from disk while they are developed, reload right away when they change.
+  const localPluginsChanged = _.some(
+    pluginsData?.localPluginRevisions,
+    (revision, pluginName) =>
+      _.has(prevPluginsData?.localPluginRevisions, pluginName) &&
+      prevPluginsData.localPluginRevisions[pluginName] !== revision,
+  );
+  React.useEffect(() => {
+    if (localPluginsChanged) {
+      window.location.reload();
+    }
+  }, [localPluginsChanged]);
+  if (stateInitialized && (pluginsListChanged || pluginManifestsChanged) && !pluginsChanged) {
     setPluginsChanged(true);
   }
 
@@ -8,15 +8,57 @@ import { getLastLanguage } from '@console/app/src/components/user-preferences/la
 import { pluginStore } from './plugins';
 import { dateTimeFormatter, fromNow } from './components/utils/datetime';
 
+// i18next reads each namespace of each language separately. This backend batches the reads made
+// in the same tick into one request per language to the bulk locales endpoint.
+class MultiloadBackend {
+  constructor(services, options, i18nextOptions) {
+    this.backend = new httpBackend();
+    this.pending = {};
+    if (services) {
+      this.init(services, options, i18nextOptions);
+    }
+  }
+
+  init(services, options, i18nextOptions) {
+    this.backend.init(services, options, i18nextOptions);
+  }
+
+  read(language, namespace, callback) {
+    if (!this.pending[language]) {
+      this.pending[language] = [];
+      setTimeout(() => this.load(language));
+    }
+    this.pending[language].push({ namespace, callback });
+  }
+
+  load(language) {
+    const reads = this.pending[language];
+    delete this.pending[language];
+    const namespaces = [...new Set(reads.map((r) => r.namespace))];
+    this.backend.readMulti([language], namespaces, (err, data) => {
+      reads.forEach(({ namespace, callback }) => {
+        if (err) {
+          // data tells i18next whether to retry.
+          callback(err, data);
+          return;
+        }
+        // Namespaces without resources are left out of the response.
+        callback(null, (data && data[language] && data[language][namespace]) || {});
+      });
+    });
+  }
+}
+MultiloadBackend.type = 'backend';
+
 const params = new URLSearchParams(window.location.search);
 const pseudolocalizationEnabled = params.get('pseudolocalization') === 'true';
 
 export const init = () => {
   i18n
     .use(new Pseudo({ enabled: pseudolocalizationEnabled, wrapped: true }))
-    // fetch json files
+    // fetch json files in bulk
     // learn more: https://github.com/i18next/i18next-http-backend
-    .use(httpBackend)
+    .use(MultiloadBackend)
     // detect user language
     // learn more: https://github.com/i18next/i18next-browser-languageDetector
     .use(detector)
@@ -26,7 +68,9 @@ export const init = () => {
     // for all options read: https://www.i18next.com/overview/configuration-options
     .init({
       backend: {
-        loadPath: '/locales/resource.json?lng={{lng}}&ns={{ns}}',
+        // Namespaces are joined with '+', the response has the {lng: {ns: resources}} shape.
+        loadPath: '/locales/resources.json?lng={{lng}}&ns={{ns}}',
+        allowMultiLoading: true,
       },
       lng: getLastLanguage(),
       fallbackLng: 'en',
@@ -61,10 +61,14 @@ export const authSvc = {
       cluster ? `${window.SERVER_FLAGS.logoutURL}/${cluster}` : window.SERVER_FLAGS.logoutURL,
       { method: 'POST' },
     )
+      // OIDC providers that support RP-initiated logout return the URL to log out of the provider.
+      .then((response) => (response.status === 200 ? response.json() : {}))
       // eslint-disable-next-line no-console
       .catch((e) => console.error('Error logging out', e))
-      .then(() => {
-        if (window.SERVER_FLAGS.logoutRedirect && !next) {
+      .then((body) => {
+        if (body && body.logoutURL && !next) {
+          window.location = body.logoutURL;
+        } else if (window.SERVER_FLAGS.logoutRedirect && !next) {
           window.location = window.SERVER_FLAGS.logoutRedirect;
         } else {
           authSvc.login(cluster);
@@ -0,0 +1,534 @@
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/serverutils"
+	"github.com/openshift/console/pkg/tenancy"
+)
+
+const (
+	silencesPath = "/api/v2/silences"
+	silencePath  = "/api/v2/silence/"
+	extendSuffix = "/extend"
+
+	silenceStateExpired = "expired"
+
+	maxRequestBytes  = 1 << 20
+	maxResponseBytes = 10 << 20
+	requestTimeout   = 30 * time.Second
+)
+
+var (
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	userResource = schema.GroupVersionResource{
+		Group:    "user.openshift.io",
+		Version:  "v1",
+		Resource: "users",
+	}
+)
+
+// Matcher is a label matcher of a silence. IsEqual defaults to true like in the Alertmanager API.
+type Matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+func (m Matcher) isEqual() bool {
+	return m.IsEqual == nil || *m.IsEqual
+}
+
+func (m Matcher) String() string {
+	op := "="
+	switch {
+	case m.IsRegex && m.isEqual():
+		op = "=~"
+	case m.IsRegex:
+		op = "!~"
+	case !m.isEqual():
+		op = "!="
+	}
+	return fmt.Sprintf("%s%s%q", m.Name, op, m.Value)
+}
+
+type silenceStatus struct {
+	State string `json:"state"`
+}
+
+// Silence is a silence of the Alertmanager v2 API.
+type Silence struct {
+	ID        string         `json:"id,omitempty"`
+	Matchers  []Matcher      `json:"matchers"`
+	StartsAt  time.Time      `json:"startsAt"`
+	EndsAt    time.Time      `json:"endsAt"`
+	CreatedBy string         `json:"createdBy"`
+	Comment   string         `json:"comment"`
+	Status    *silenceStatus `json:"status,omitempty"`
+}
+
+// silenceRequest is the body of create and extend requests. The end is either EndsAt or Duration,
+// which is relative to the start for new silences and to the current end for extended silences.
+type silenceRequest struct {
+	Matchers []Matcher `json:"matchers,omitempty"`
+	StartsAt time.Time `json:"startsAt,omitempty"`
+	EndsAt   time.Time `json:"endsAt,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// Backend is an Alertmanager API that is called with the user's token.
+type Backend struct {
+	Endpoint *url.URL
+	Client   *http.Client
+}
+
+// url returns the URL of the Alertmanager API path, which starts with a slash.
+func (b *Backend) url(path string) url.URL {
+	endpoint := *b.Endpoint
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+	return endpoint
+}
+
+// SilenceHandler creates, extends and expires silences on behalf of users. Unlike the Alertmanager
+// proxy, it sets the creator of silences, enforces the namespace of namespace-scoped users and caps
+// the duration of silences. All changes are written to the audit log.
+type SilenceHandler struct {
+	// Alertmanager for cluster-wide requests, nil if it is not proxied.
+	Alertmanager *Backend
+	// Tenant aware Alertmanager for requests with a `namespace` query parameter, nil if it is not proxied.
+	AlertmanagerTenancy *Backend
+	// Maximum time silences can be active, 0 to not limit it.
+	MaxDuration time.Duration
+	// Used to look up the user name if the authenticator does not provide it.
+	K8sClient   *http.Client
+	K8sEndpoint string
+}
+
+// HandleSilences serves requests relative to the silences endpoint. POST / creates a silence,
+// POST /<id>/extend moves the end of a silence and DELETE /<id> expires it.
+func (h *SilenceHandler) HandleSilences(user *auth.User, w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get(tenancy.NamespaceLabel)
+	backend := h.Alertmanager
+	if namespace != "" {
+		if err := tenancy.ValidateNamespace(namespace); err != nil {
+			sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		backend = h.AlertmanagerTenancy
+	}
+	if backend == nil {
+		sendError(w, http.StatusNotFound, "Alertmanager is not available")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "":
+		if r.Method != http.MethodPost {
+			sendMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.createSilence(user, w, r, backend, namespace)
+	case strings.HasSuffix(path, extendSuffix) && !strings.Contains(strings.TrimSuffix(path, extendSuffix), "/"):
+		if r.Method != http.MethodPost {
+			sendMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.extendSilence(user, w, r, backend, namespace, strings.TrimSuffix(path, extendSuffix))
+	case !strings.Contains(path, "/"):
+		if r.Method != http.MethodDelete {
+			sendMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		h.expireSilence(user, w, r, backend, namespace, path)
+	default:
+		sendError(w, http.StatusNotFound, fmt.Sprintf("Unknown silences endpoint %q", r.URL.Path))
+	}
+}
+
+func (h *SilenceHandler) createSilence(user *auth.User, w http.ResponseWriter, r *http.Request, backend *Backend, namespace string) {
+	req, err := decodeSilenceRequest(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	matchers, err := validateMatchers(req.Matchers, namespace)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	comment := strings.TrimSpace(req.Comment)
+	if comment == "" {
+		sendError(w, http.StatusBadRequest, "A comment is required")
+		return
+	}
+
+	now := time.Now()
+	startsAt := req.StartsAt
+	if startsAt.IsZero() || startsAt.Before(now) {
+		startsAt = now
+	}
+	endsAt, err := silenceEnd(req, startsAt)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.checkDuration(startsAt, endsAt); err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	creator, err := h.username(r.Context(), user)
+	if err != nil {
+		sendError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	silence := &Silence{
+		Matchers:  matchers,
+		StartsAt:  startsAt,
+		EndsAt:    endsAt,
+		CreatedBy: creator,
+		Comment:   comment,
+	}
+	h.postSilence(w, r, backend, user, namespace, "create", silence)
+}
+
+func (h *SilenceHandler) extendSilence(user *auth.User, w http.ResponseWriter, r *http.Request, backend *Backend, namespace, id string) {
+	req, err := decodeSilenceRequest(r)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Matchers) > 0 || !req.StartsAt.IsZero() {
+		sendError(w, http.StatusBadRequest, "Only the end and the comment of a silence can be changed")
+		return
+	}
+
+	silence, code, err := h.getSilence(r.Context(), backend, user, namespace, id)
+	if err != nil {
+		sendError(w, code, err.Error())
+		return
+	}
+	if silence.Status != nil && silence.Status.State == silenceStateExpired {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Silence %s has expired", id))
+		return
+	}
+
+	endsAt, err := silenceEnd(req, silence.EndsAt)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !endsAt.After(silence.EndsAt) {
+		sendError(w, http.StatusBadRequest, "The new end must be after the current end of the silence")
+		return
+	}
+	startsAt := silence.StartsAt
+	if now := time.Now(); startsAt.Before(now) {
+		startsAt = now
+	}
+	if err := h.checkDuration(startsAt, endsAt); err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	creator, err := h.username(r.Context(), user)
+	if err != nil {
+		sendError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	silence.EndsAt = endsAt
+	silence.CreatedBy = creator
+	if comment := strings.TrimSpace(req.Comment); comment != "" {
+		silence.Comment = comment
+	}
+	silence.Status = nil
+	h.postSilence(w, r, backend, user, namespace, "extend", silence)
+}
+
+func (h *SilenceHandler) expireSilence(user *auth.User, w http.ResponseWriter, r *http.Request, backend *Backend, namespace, id string) {
+	silence, code, err := h.getSilence(r.Context(), backend, user, namespace, id)
+	if err != nil {
+		sendError(w, code, err.Error())
+		return
+	}
+	requester, err := h.username(r.Context(), user)
+	if err != nil {
+		sendError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	resp, body, err := h.call(r.Context(), backend, user, http.MethodDelete, silencePath+url.PathEscape(id), namespace, nil)
+	if err != nil {
+		auditSilence(r, requester, "expire", silence, namespace, "error")
+		sendError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	auditSilence(r, requester, "expire", silence, namespace, outcome(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		copyResponse(w, resp, body)
+		return
+	}
+	serverutils.SendResponse(w, http.StatusOK, struct {
+		SilenceID string `json:"silenceID"`
+	}{SilenceID: id})
+}
+
+// postSilence creates the silence or updates it if it has an ID.
+func (h *SilenceHandler) postSilence(w http.ResponseWriter, r *http.Request, backend *Backend, user *auth.User, namespace, action string, silence *Silence) {
+	resp, body, err := h.call(r.Context(), backend, user, http.MethodPost, silencesPath, namespace, silence)
+	if err != nil {
+		auditSilence(r, silence.CreatedBy, action, silence, namespace, "error")
+		sendError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		// Alertmanager replaces updated silences that already started with a new one.
+		result := struct {
+			SilenceID string `json:"silenceID"`
+		}{}
+		if err := json.Unmarshal(body, &result); err == nil && result.SilenceID != "" {
+			if silence.ID != "" && silence.ID != result.SilenceID {
+				action = fmt.Sprintf("%s replaced=%s", action, silence.ID)
+			}
+			silence.ID = result.SilenceID
+		}
+	}
+	auditSilence(r, silence.CreatedBy, action, silence, namespace, outcome(resp.StatusCode))
+	copyResponse(w, resp, body)
+}
+
+// getSilence returns the silence with the ID. The tenancy API can only list silences, and only
+// returns silences of the namespace.
+func (h *SilenceHandler) getSilence(ctx context.Context, backend *Backend, user *auth.User, namespace, id string) (*Silence, int, error) {
+	path := silencePath + url.PathEscape(id)
+	if namespace != "" {
+		path = silencesPath
+	}
+	resp, body, err := h.call(ctx, backend, user, http.MethodGet, path, namespace, nil)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, http.StatusNotFound, fmt.Errorf("Silence %s not found", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("Failed to get silence %s: %s", id, strings.TrimSpace(string(body)))
+	}
+
+	silences := []Silence{}
+	if namespace == "" {
+		silence := Silence{}
+		if err := json.Unmarshal(body, &silence); err != nil {
+			return nil, http.StatusBadGateway, fmt.Errorf("Failed to decode silence %s: %v", id, err)
+		}
+		silences = append(silences, silence)
+	} else if err := json.Unmarshal(body, &silences); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("Failed to decode silences: %v", err)
+	}
+	for i := range silences {
+		if silences[i].ID != id {
+			continue
+		}
+		if namespace != "" && !hasNamespaceMatcher(silences[i].Matchers, namespace) {
+			break
+		}
+		return &silences[i], http.StatusOK, nil
+	}
+	return nil, http.StatusNotFound, fmt.Errorf("Silence %s not found", id)
+}
+
+func (h *SilenceHandler) call(ctx context.Context, backend *Backend, user *auth.User, method, path, namespace string, body interface{}) (*http.Response, []byte, error) {
+	endpoint := backend.url(path)
+	if namespace != "" {
+		endpoint.RawQuery = url.Values{tenancy.NamespaceLabel: {namespace}}.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := backend.Client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to call Alertmanager: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read Alertmanager response: %v", err)
+	}
+	return resp, respBody, nil
+}
+
+func (h *SilenceHandler) checkDuration(startsAt, endsAt time.Time) error {
+	if !endsAt.After(startsAt) {
+		return fmt.Errorf("The end of the silence must be after its start")
+	}
+	if h.MaxDuration > 0 && endsAt.Sub(startsAt) > h.MaxDuration {
+		return fmt.Errorf("Silences can be active for at most %s", h.MaxDuration)
+	}
+	return nil
+}
+
+// username returns the name of the user. OpenShift OAuth does not provide user info, so the name is
+// looked up with the user's token in that case.
+func (h *SilenceHandler) username(ctx context.Context, user *auth.User) (string, error) {
+	if user.Username != "" {
+		return user.Username, nil
+	}
+	if h.K8sClient != nil {
+		client, err := dynamic.NewForConfig(&rest.Config{
+			Host:        h.K8sEndpoint,
+			BearerToken: user.Token,
+			Transport:   h.K8sClient.Transport,
+		})
+		if err != nil {
+			return "", err
+		}
+		userInfo, err := client.Resource(userResource).Get(ctx, "~", meta.GetOptions{})
+		if err == nil && userInfo.GetName() != "" {
+			return userInfo.GetName(), nil
+		}
+		klog.V(4).Infof("Failed to look up user for silence: %v", err)
+	}
+	if user.ID != "" {
+		return user.ID, nil
+	}
+	return "", fmt.Errorf("Failed to determine the user name")
+}
+
+func decodeSilenceRequest(r *http.Request) (*silenceRequest, error) {
+	req := &silenceRequest{}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		return nil, fmt.Errorf("Invalid silence request: %v", err)
+	}
+	return req, nil
+}
+
+// silenceEnd returns EndsAt of the request or the request duration added to from.
+func silenceEnd(req *silenceRequest, from time.Time) (time.Time, error) {
+	switch {
+	case !req.EndsAt.IsZero() && req.Duration != "":
+		return time.Time{}, fmt.Errorf("Only one of endsAt and duration can be set")
+	case !req.EndsAt.IsZero():
+		return req.EndsAt, nil
+	case req.Duration != "":
+		duration, err := tenancy.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			return time.Time{}, fmt.Errorf("Invalid duration %q", req.Duration)
+		}
+		return from.Add(duration), nil
+	default:
+		return time.Time{}, fmt.Errorf("Either endsAt or duration is required")
+	}
+}
+
+// validateMatchers checks the matchers and restricts them to the namespace if it is not empty.
+func validateMatchers(matchers []Matcher, namespace string) ([]Matcher, error) {
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("At least one matcher is required")
+	}
+	hasNamespace := false
+	for _, m := range matchers {
+		if !labelNameRegexp.MatchString(m.Name) {
+			return nil, fmt.Errorf("Invalid label name %q", m.Name)
+		}
+		if m.IsRegex {
+			if _, err := regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+				return nil, fmt.Errorf("Invalid regular expression for label %q: %v", m.Name, err)
+			}
+		}
+		if namespace == "" || m.Name != tenancy.NamespaceLabel {
+			continue
+		}
+		if m.IsRegex || !m.isEqual() || m.Value != namespace {
+			return nil, fmt.Errorf("Only the matcher %s=%q is allowed for the %q label", tenancy.NamespaceLabel, namespace, tenancy.NamespaceLabel)
+		}
+		hasNamespace = true
+	}
+	if namespace != "" && !hasNamespace {
+		matchers = append(matchers, Matcher{Name: tenancy.NamespaceLabel, Value: namespace})
+	}
+	return matchers, nil
+}
+
+func hasNamespaceMatcher(matchers []Matcher, namespace string) bool {
+	for _, m := range matchers {
+		if m.Name == tenancy.NamespaceLabel && !m.IsRegex && m.isEqual() && m.Value == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func auditSilence(r *http.Request, requester, action string, silence *Silence, namespace, outcome string) {
+	matchers := make([]string, 0, len(silence.Matchers))
+	for _, m := range silence.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	klog.Infof("AUDIT silence action=%s id=%q requester=%q createdBy=%q namespace=%q matchers=%q endsAt=%s path=%q outcome=%s",
+		action, silence.ID, requester, silence.CreatedBy, namespace, "{"+strings.Join(matchers, ",")+"}", silence.EndsAt.Format(time.RFC3339), r.URL.Path, outcome)
+}
+
+func outcome(code int) string {
+	if code == http.StatusOK {
+		return "succeeded"
+	}
+	return fmt.Sprintf("failed status=%d", code)
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response, body []byte) {
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(body); err != nil {
+		klog.Errorf("Failed sending HTTP response body: %v", err)
+	}
+}
+
+func sendError(w http.ResponseWriter, code int, msg string) {
+	serverutils.SendResponse(w, code, serverutils.ApiError{Err: msg})
+}
+
+func sendMethodNotAllowed(w http.ResponseWriter, method string) {
+	w.Header().Set("Allow", method)
+	sendError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Unsupported method, supported methods are %s", method))
+}
@@ -0,0 +1,222 @@
+package alertmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/console/pkg/auth"
+)
+
+type fakeAlertmanager struct {
+	silences []Silence
+	posted   []Silence
+	expired  []string
+	requests []string
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.String())
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == silencesPath:
+		json.NewEncoder(w).Encode(f.silences)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, silencePath):
+		for _, s := range f.silences {
+			if s.ID == strings.TrimPrefix(r.URL.Path, silencePath) {
+				json.NewEncoder(w).Encode(s)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPost && r.URL.Path == silencesPath:
+		silence := Silence{}
+		json.NewDecoder(r.Body).Decode(&silence)
+		f.posted = append(f.posted, silence)
+		fmt.Fprintf(w, `{"silenceID":"new-%d"}`, len(f.posted))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, silencePath):
+		f.expired = append(f.expired, strings.TrimPrefix(r.URL.Path, silencePath))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestSilenceHandler(t *testing.T, am *fakeAlertmanager) *SilenceHandler {
+	server := httptest.NewServer(am)
+	t.Cleanup(server.Close)
+	endpoint, _ := url.Parse(server.URL)
+	backend := &Backend{Endpoint: endpoint, Client: server.Client()}
+	return &SilenceHandler{
+		Alertmanager:        backend,
+		AlertmanagerTenancy: backend,
+		MaxDuration:         24 * time.Hour,
+	}
+}
+
+func serveSilences(h *SilenceHandler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.HandleSilences(&auth.User{Username: "alice", Token: "token"}, w, r)
+	return w
+}
+
+func TestCreateSilence(t *testing.T) {
+	am := &fakeAlertmanager{}
+	h := newTestSilenceHandler(t, am)
+
+	w := serveSilences(h, http.MethodPost, "/", `{
+		"matchers": [{"name": "alertname", "value": "Watchdog", "isRegex": false}],
+		"duration": "2h",
+		"comment": " maintenance "
+	}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "new-1") {
+		t.Fatalf("expected the silence ID, got %d %s", w.Code, w.Body.String())
+	}
+	if len(am.posted) != 1 {
+		t.Fatalf("expected one silence to be posted, got %v", am.posted)
+	}
+	silence := am.posted[0]
+	if silence.CreatedBy != "alice" || silence.Comment != "maintenance" {
+		t.Errorf("createdBy, comment == %q, %q, want %q, %q", silence.CreatedBy, silence.Comment, "alice", "maintenance")
+	}
+	if d := silence.EndsAt.Sub(silence.StartsAt); d != 2*time.Hour {
+		t.Errorf("duration == %v, want %v", d, 2*time.Hour)
+	}
+}
+
+func TestCreateNamespacedSilence(t *testing.T) {
+	am := &fakeAlertmanager{}
+	h := newTestSilenceHandler(t, am)
+
+	w := serveSilences(h, http.MethodPost, "/?namespace=ns", `{"matchers": [{"name": "alertname", "value": "X"}], "duration": "1h", "comment": "c"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if am.requests[0] != "POST /api/v2/silences?namespace=ns" {
+		t.Errorf("request == %q, want the tenancy API", am.requests[0])
+	}
+	if matchers := am.posted[0].Matchers; len(matchers) != 2 || matchers[1].String() != `namespace="ns"` {
+		t.Errorf("expected the namespace matcher to be added, got %v", matchers)
+	}
+}
+
+func TestCreateSilenceValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{
+			name: "missing comment",
+			path: "/",
+			body: `{"matchers": [{"name": "alertname", "value": "X"}], "duration": "1h"}`,
+		},
+		{
+			name: "missing matchers",
+			path: "/",
+			body: `{"duration": "1h", "comment": "c"}`,
+		},
+		{
+			name: "invalid regexp",
+			path: "/",
+			body: `{"matchers": [{"name": "alertname", "value": "(", "isRegex": true}], "duration": "1h", "comment": "c"}`,
+		},
+		{
+			name: "duration above the maximum",
+			path: "/",
+			body: `{"matchers": [{"name": "alertname", "value": "X"}], "duration": "2d", "comment": "c"}`,
+		},
+		{
+			name: "end before start",
+			path: "/",
+			body: `{"matchers": [{"name": "alertname", "value": "X"}], "endsAt": "2020-01-01T00:00:00Z", "comment": "c"}`,
+		},
+		{
+			name: "other namespace",
+			path: "/?namespace=ns",
+			body: `{"matchers": [{"name": "namespace", "value": "kube-system"}], "duration": "1h", "comment": "c"}`,
+		},
+		{
+			name: "namespace regexp",
+			path: "/?namespace=ns",
+			body: `{"matchers": [{"name": "namespace", "value": "ns|other", "isRegex": true}], "duration": "1h", "comment": "c"}`,
+		},
+		{
+			name: "creator set by the client",
+			path: "/",
+			body: `{"matchers": [{"name": "alertname", "value": "X"}], "duration": "1h", "comment": "c", "createdBy": "bob"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am := &fakeAlertmanager{}
+			h := newTestSilenceHandler(t, am)
+			w := serveSilences(h, http.MethodPost, tt.path, tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status == %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body.String())
+			}
+			if len(am.requests) != 0 {
+				t.Errorf("expected no request to Alertmanager, got %v", am.requests)
+			}
+		})
+	}
+}
+
+func TestExtendSilence(t *testing.T) {
+	endsAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	am := &fakeAlertmanager{silences: []Silence{{
+		ID:        "a",
+		Matchers:  []Matcher{{Name: "alertname", Value: "X"}},
+		StartsAt:  time.Now().Add(-time.Hour),
+		EndsAt:    endsAt,
+		CreatedBy: "bob",
+		Comment:   "original",
+		Status:    &silenceStatus{State: "active"},
+	}}}
+	h := newTestSilenceHandler(t, am)
+
+	w := serveSilences(h, http.MethodPost, "/a/extend", `{"duration": "3h"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	silence := am.posted[0]
+	if silence.ID != "a" || !silence.EndsAt.Equal(endsAt.Add(3*time.Hour)) {
+		t.Errorf("expected silence a to end at %v, got %s ending at %v", endsAt.Add(3*time.Hour), silence.ID, silence.EndsAt)
+	}
+	if silence.CreatedBy != "alice" || silence.Comment != "original" {
+		t.Errorf("createdBy, comment == %q, %q, want %q, %q", silence.CreatedBy, silence.Comment, "alice", "original")
+	}
+
+	if w := serveSilences(h, http.MethodPost, "/a/extend", `{"duration": "30h"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected extending beyond the maximum duration to fail, got %d", w.Code)
+	}
+	if w := serveSilences(h, http.MethodPost, "/missing/extend", `{"duration": "1h"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected extending a missing silence to fail, got %d", w.Code)
+	}
+}
+
+func TestExpireNamespacedSilence(t *testing.T) {
+	am := &fakeAlertmanager{silences: []Silence{
+		{ID: "own", Matchers: []Matcher{{Name: "namespace", Value: "ns"}}},
+		{ID: "other", Matchers: []Matcher{{Name: "namespace", Value: "other"}}},
+	}}
+	h := newTestSilenceHandler(t, am)
+
+	if w := serveSilences(h, http.MethodDelete, "/own?namespace=ns", ""); w.Code != http.StatusOK {
+		t.Errorf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if w := serveSilences(h, http.MethodDelete, "/other?namespace=ns", ""); w.Code != http.StatusNotFound {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if len(am.expired) != 1 || am.expired[0] != "own" {
+		t.Errorf("expired == %v, want [own]", am.expired)
+	}
+}
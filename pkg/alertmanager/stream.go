@@ -0,0 +1,388 @@
+package alertmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/serverutils"
+	"github.com/openshift/console/pkg/tenancy"
+)
+
+const (
+	consoleAlertStreamClientsMetric = "console_alert_stream_clients"
+
+	alertsPath = "/api/v2/alerts"
+
+	alertEventFiring   = "firing"
+	alertEventResolved = "resolved"
+
+	// Events buffered per client. Clients that fall further behind are disconnected and get the
+	// current alerts again when they reconnect.
+	clientBufferSize = 100
+	// Connections per user, the oldest one is closed when a user opens more.
+	maxClientsPerUser = 5
+	heartbeatInterval = 30 * time.Second
+
+	accessTTL       = time.Minute
+	accessCacheSize = 10000
+)
+
+var consoleAlertStreamClients = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: consoleAlertStreamClientsMetric,
+		Help: "Number of clients connected to the alert stream.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(consoleAlertStreamClients)
+}
+
+// Alert is an alert as sent to stream clients.
+type Alert struct {
+	Fingerprint  string            `json:"fingerprint"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+type alertEvent struct {
+	event string
+	alert Alert
+}
+
+type streamClient struct {
+	events    chan alertEvent
+	closed    chan struct{}
+	closeOnce sync.Once
+	connected time.Time
+}
+
+func (c *streamClient) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// streamUser groups the connections of a user, so that access is checked once per user and event.
+// Access is checked with the token of the last connection.
+type streamUser struct {
+	token   string
+	clients map[*streamClient]bool
+}
+
+// AlertStream pushes firing and resolved alerts to connected users as server-sent events. Alertmanager
+// is only polled while clients are connected. Users only receive alerts of namespaces in which they can
+// read PrometheusRules, and alerts without namespace if they can read them in all namespaces.
+type AlertStream struct {
+	Backend *Backend
+	// Token used to poll Alertmanager, which must be allowed to read all alerts.
+	Token        string
+	PollInterval time.Duration
+	// Used for the access reviews of users.
+	K8sClient   *http.Client
+	K8sEndpoint string
+
+	mux        sync.Mutex
+	users      map[string]*streamUser
+	alerts     map[string]Alert
+	cancelPoll context.CancelFunc
+
+	accessMux sync.Mutex
+	access    map[string]accessResult
+}
+
+type accessResult struct {
+	allowed bool
+	expires time.Time
+}
+
+// HandleStream streams alert events to the user until the request is done. Clients first receive a
+// firing event for every alert that is currently firing.
+func (s *AlertStream) HandleStream(user *auth.User, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	key := streamUserKey(user)
+	client, snapshot := s.subscribe(key, user.Token)
+	defer s.unsubscribe(key, client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep proxies like nginx from buffering events.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, alert := range snapshot {
+		if s.canAccess(r.Context(), user.Token, alert.Labels[tenancy.NamespaceLabel]) {
+			if err := writeEvent(w, alertEvent{event: alertEventFiring, alert: alert}); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.closed:
+			return
+		case event := <-client.events:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event alertEvent) error {
+	data, err := json.Marshal(event.alert)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.event, data)
+	return err
+}
+
+// streamUserKey identifies a user by name, or by token if the name isn't known, e.g. for OpenShift
+// sessions. Users with several tokens then have several entries.
+func streamUserKey(user *auth.User) string {
+	if user.Username != "" {
+		return "user:" + user.Username
+	}
+	return "token:" + tokenHash(user.Token)
+}
+
+// subscribe registers a client of the user with the key and returns the currently firing alerts. The
+// first client starts polling.
+func (s *AlertStream) subscribe(key, token string) (*streamClient, []Alert) {
+	client := &streamClient{
+		events:    make(chan alertEvent, clientBufferSize),
+		closed:    make(chan struct{}),
+		connected: time.Now(),
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.users == nil {
+		s.users = map[string]*streamUser{}
+	}
+	user, ok := s.users[key]
+	if !ok {
+		user = &streamUser{clients: map[*streamClient]bool{}}
+		s.users[key] = user
+	}
+	user.token = token
+	if len(user.clients) >= maxClientsPerUser {
+		var oldest *streamClient
+		for c := range user.clients {
+			if oldest == nil || c.connected.Before(oldest.connected) {
+				oldest = c
+			}
+		}
+		delete(user.clients, oldest)
+		oldest.close()
+		consoleAlertStreamClients.Dec()
+	}
+	user.clients[client] = true
+	consoleAlertStreamClients.Inc()
+
+	if s.cancelPoll == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancelPoll = cancel
+		s.alerts = nil
+		go s.poll(ctx)
+	}
+	snapshot := make([]Alert, 0, len(s.alerts))
+	for _, alert := range s.alerts {
+		snapshot = append(snapshot, alert)
+	}
+	return client, snapshot
+}
+
+// unsubscribe removes a client. Polling stops when the last client is gone.
+func (s *AlertStream) unsubscribe(key string, client *streamClient) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	user, ok := s.users[key]
+	if !ok || !user.clients[client] {
+		return
+	}
+	delete(user.clients, client)
+	consoleAlertStreamClients.Dec()
+	if len(user.clients) == 0 {
+		delete(s.users, key)
+	}
+	if len(s.users) == 0 && s.cancelPoll != nil {
+		s.cancelPoll()
+		s.cancelPoll = nil
+	}
+}
+
+func (s *AlertStream) poll(ctx context.Context) {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.update(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("Failed to poll alerts for the alert stream: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update fetches the firing alerts and sends events for new and resolved alerts.
+func (s *AlertStream) update(ctx context.Context) error {
+	alerts, err := s.fetchAlerts(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	if ctx.Err() != nil {
+		// Polling stopped while the request was running.
+		s.mux.Unlock()
+		return nil
+	}
+	events := []alertEvent{}
+	for fingerprint, alert := range alerts {
+		if _, ok := s.alerts[fingerprint]; !ok {
+			events = append(events, alertEvent{event: alertEventFiring, alert: alert})
+		}
+	}
+	for fingerprint, alert := range s.alerts {
+		if _, ok := alerts[fingerprint]; !ok {
+			events = append(events, alertEvent{event: alertEventResolved, alert: alert})
+		}
+	}
+	s.alerts = alerts
+	users := make([]*streamUser, 0, len(s.users))
+	for _, user := range s.users {
+		clients := map[*streamClient]bool{}
+		for c := range user.clients {
+			clients[c] = true
+		}
+		users = append(users, &streamUser{token: user.token, clients: clients})
+	}
+	s.mux.Unlock()
+
+	for _, user := range users {
+		for _, event := range events {
+			if !s.canAccess(ctx, user.token, event.alert.Labels[tenancy.NamespaceLabel]) {
+				continue
+			}
+			for client := range user.clients {
+				select {
+				case client.events <- event:
+				default:
+					klog.V(4).Info("Disconnecting slow alert stream client")
+					client.close()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *AlertStream) fetchAlerts(ctx context.Context) (map[string]Alert, error) {
+	endpoint := s.Backend.url(alertsPath)
+	endpoint.RawQuery = "active=true&silenced=false&inhibited=false"
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	resp, err := s.Backend.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	list := []Alert{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode alerts: %v", err)
+	}
+	alerts := make(map[string]Alert, len(list))
+	for _, alert := range list {
+		alerts[alert.Fingerprint] = alert
+	}
+	return alerts, nil
+}
+
+// canAccess returns whether the user can read alerts of the namespace, or of all namespaces if it is
+// empty. Reviews are cached, since every event is checked for every user.
+func (s *AlertStream) canAccess(ctx context.Context, token, namespace string) bool {
+	key := tokenHash(token) + "\x00" + namespace
+	now := time.Now()
+	s.accessMux.Lock()
+	result, ok := s.access[key]
+	s.accessMux.Unlock()
+	if ok && now.Before(result.expires) {
+		return result.allowed
+	}
+
+	allowed, err := s.reviewAccess(ctx, token, namespace)
+	if err != nil {
+		klog.V(4).Infof("Failed to review alert access for namespace %q: %v", namespace, err)
+		return false
+	}
+
+	s.accessMux.Lock()
+	defer s.accessMux.Unlock()
+	if s.access == nil || len(s.access) >= accessCacheSize {
+		s.access = map[string]accessResult{}
+	}
+	s.access[key] = accessResult{allowed: allowed, expires: now.Add(accessTTL)}
+	return allowed
+}
+
+func (s *AlertStream) reviewAccess(ctx context.Context, token, namespace string) (bool, error) {
+	config := &rest.Config{
+		Host:        s.K8sEndpoint,
+		BearerToken: token,
+		Transport:   s.K8sClient.Transport,
+	}
+	return serverutils.SelfSubjectAccessReview(ctx, config, authv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "get",
+		Group:     "monitoring.coreos.com",
+		Resource:  "prometheusrules",
+	})
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
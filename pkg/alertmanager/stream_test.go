@@ -0,0 +1,165 @@
+package alertmanager
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authorization/v1"
+
+	"github.com/openshift/console/pkg/auth"
+)
+
+type fakeAlerts struct {
+	mux    sync.Mutex
+	alerts []Alert
+}
+
+func (f *fakeAlerts) set(alerts ...Alert) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.alerts = alerts
+}
+
+func (f *fakeAlerts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if r.URL.Path != alertsPath || r.Header.Get("Authorization") != "Bearer sa-token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	json.NewEncoder(w).Encode(f.alerts)
+}
+
+// newTestAlertStream returns a stream whose users can only read alerts of the namespace "ns".
+func newTestAlertStream(t *testing.T, alerts *fakeAlerts) *AlertStream {
+	amServer := httptest.NewServer(alerts)
+	t.Cleanup(amServer.Close)
+	k8sServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sar := &authv1.SelfSubjectAccessReview{}
+		json.NewDecoder(r.Body).Decode(sar)
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Namespace == "ns"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sar)
+	}))
+	t.Cleanup(k8sServer.Close)
+
+	// Endpoints may be configured with a trailing slash.
+	endpoint, _ := url.Parse(amServer.URL + "/")
+	return &AlertStream{
+		Backend:      &Backend{Endpoint: endpoint, Client: amServer.Client()},
+		Token:        "sa-token",
+		PollInterval: 10 * time.Millisecond,
+		K8sClient:    k8sServer.Client(),
+		K8sEndpoint:  k8sServer.URL,
+	}
+}
+
+func testAlert(fingerprint, namespace string) Alert {
+	labels := map[string]string{"alertname": fingerprint}
+	if namespace != "" {
+		labels["namespace"] = namespace
+	}
+	return Alert{Fingerprint: fingerprint, Labels: labels}
+}
+
+func TestAlertStream(t *testing.T) {
+	alerts := &fakeAlerts{}
+	alerts.set(testAlert("a", "ns"), testAlert("b", "other"), testAlert("c", ""))
+	stream := newTestAlertStream(t, alerts)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream.HandleStream(&auth.User{Token: "user-token"}, w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("content type == %q, want %q", contentType, "text/event-stream")
+	}
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				alert := Alert{}
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &alert)
+				events <- event + " " + alert.Fingerprint
+			}
+		}
+		close(events)
+	}()
+	nextEvent := func() string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for an event")
+			return ""
+		}
+	}
+
+	if event := nextEvent(); event != "firing a" {
+		t.Errorf("event == %q, want %q", event, "firing a")
+	}
+	alerts.set(testAlert("b", "other"), testAlert("c", ""))
+	if event := nextEvent(); event != "resolved a" {
+		t.Errorf("event == %q, want %q", event, "resolved a")
+	}
+
+	resp.Body.Close()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		stream.mux.Lock()
+		stopped := stream.cancelPoll == nil
+		stream.mux.Unlock()
+		if stopped {
+			return
+		}
+	}
+	t.Errorf("expected polling to stop after the last client disconnected")
+}
+
+func TestAlertStreamLimitsClientsPerUser(t *testing.T) {
+	stream := newTestAlertStream(t, &fakeAlerts{})
+	clients := []*streamClient{}
+	for i := 0; i <= maxClientsPerUser; i++ {
+		// Clients of the same user are grouped even if they have different tokens.
+		user := &auth.User{Username: "alice", Token: fmt.Sprintf("token-%d", i)}
+		client, _ := stream.subscribe(streamUserKey(user), user.Token)
+		clients = append(clients, client)
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-clients[0].closed:
+	default:
+		t.Errorf("expected the oldest client to be closed")
+	}
+	key := streamUserKey(&auth.User{Username: "alice"})
+	if len(stream.users) != 1 || len(stream.users[key].clients) != maxClientsPerUser {
+		t.Errorf("expected %d clients of one user, got %v", maxClientsPerUser, stream.users)
+	}
+	if token := stream.users[key].token; token != fmt.Sprintf("token-%d", maxClientsPerUser) {
+		t.Errorf("expected the token of the last client, got %q", token)
+	}
+	for _, client := range clients {
+		stream.unsubscribe(key, client)
+	}
+	if stream.cancelPoll != nil {
+		t.Errorf("expected polling to stop")
+	}
+}
@@ -2,13 +2,11 @@ package auth
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -19,6 +17,7 @@ import (
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
 
+	"github.com/openshift/console/pkg/serverutils"
 	oscrypto "github.com/openshift/library-go/pkg/crypto"
 
 	"k8s.io/klog"
@@ -57,6 +56,12 @@ type Authenticator struct {
 	// HTTP client for every call.
 	userFunc func(*http.Request) (*User, error)
 
+	// sessions is nil unless sessions are kept by the console, which is only the case for OIDC.
+	sessions SessionStore
+	// logoutTokenFunc returns the user and the provider session of a back-channel logout token. It's
+	// nil unless the console keeps the sessions.
+	logoutTokenFunc func(ctx context.Context, logoutToken string) (userID string, sid string, err error)
+
 	errorURL      string
 	successURL    string
 	cookiePath    string
@@ -79,8 +84,9 @@ type SpecialAuthURLs struct {
 // support. It should not be made public or exposed to other packages.
 type loginMethod interface {
 	// login turns on oauth2 token response into a user session and associates a
-	// cookie with the user.
-	login(http.ResponseWriter, *oauth2.Token) (*loginState, error)
+	// cookie with the user. The nonce of the login request is checked if the token
+	// response contains an ID token.
+	login(w http.ResponseWriter, token *oauth2.Token, nonce string) (*loginState, error)
 	// logout deletes any cookies associated with the user.
 	logout(http.ResponseWriter, *http.Request)
 	getSpecialURLs() SpecialAuthURLs
@@ -118,6 +124,13 @@ type Config struct {
 	// CookieDomain is the domain for the session cookie. If set to a domain starting with a dot
 	// (e.g. ".example.com"), the cookie will be valid for all subdomains of that domain.
 	CookieDomain  string
+	// SessionStore keeps OIDC sessions. Sessions are kept in memory if it is nil.
+	SessionStore SessionStore
+	// PostLogoutRedirectURL is where OIDC providers that support RP-initiated logout send users
+	// after logging them out. Providers use their default if it is empty.
+	PostLogoutRedirectURL string
+	// CookieKeyring encrypts OpenShift session cookies. Cookies hold the plaintext access token if it is nil.
+	CookieKeyring *CookieKeyring
 }
 
 func newHTTPClient(issuerCA string, includeSystemRoots bool) (*http.Client, error) {
@@ -188,7 +201,9 @@ func NewAuthenticator(ctx context.Context, c *Config) (*Authenticator, error) {
 		var authSourceFunc func() (oauth2.Endpoint, loginMethod, error)
 		switch c.AuthSource {
 		case AuthSourceOpenShift:
-			a.userFunc = getOpenShiftUser
+			a.userFunc = func(r *http.Request) (*User, error) {
+				return getOpenShiftUser(r, c.CookieKeyring)
+			}
 			authSourceFunc = func() (oauth2.Endpoint, loginMethod, error) {
 				// Use the k8s CA for OAuth metadata discovery.
 				k8sClient, errK8Client := newHTTPClient(c.K8sCA, true)
@@ -204,6 +219,7 @@ func NewAuthenticator(ctx context.Context, c *Config) (*Authenticator, error) {
 					secureCookies: c.SecureCookies,
 					clusterName:   c.ClusterName,
 					cookieDomain:  c.CookieDomain,
+					cookieKeyring: c.CookieKeyring,
 				})
 			}
 		default:
@@ -215,7 +231,16 @@ func NewAuthenticator(ctx context.Context, c *Config) (*Authenticator, error) {
 				cookiePath:    c.CookiePath,
 				secureCookies: c.SecureCookies,
 				cookieDomain:  c.CookieDomain,
+				clusterName:   c.ClusterName,
+				sessions:      c.SessionStore,
+
+				postLogoutRedirectURL: c.PostLogoutRedirectURL,
 			})
+			if oidcAuthSource != nil {
+				oidcAuthSource.oauth2Config = a.getOAuth2Config
+				a.sessions = oidcAuthSource.sessions
+				a.logoutTokenFunc = oidcAuthSource.verifyLogoutToken
+			}
 			a.userFunc = func(r *http.Request) (*User, error) {
 				if oidcAuthSource == nil {
 					return nil, fmt.Errorf("OIDC auth source is not intialized")
@@ -322,29 +347,26 @@ func (a *Authenticator) Authenticate(r *http.Request) (*User, error) {
 	return a.userFunc(r)
 }
 
-// LoginFunc redirects to the OIDC provider for user login.
+// LoginFunc redirects to the OIDC provider for user login. The optional returnTo query
+// parameter is where users are sent after logging in, it must be a URL of the console.
 func (a *Authenticator) LoginFunc(w http.ResponseWriter, r *http.Request) {
-	var randData [4]byte
-	if _, err := io.ReadFull(rand.Reader, randData[:]); err != nil {
-		panic(err)
-	}
-	state := hex.EncodeToString(randData[:])
-
-	cookie := http.Cookie{
-		Name:     stateCookieName,
-		Value:    state,
-		HttpOnly: true,
-		Secure:   a.secureCookies,
-		// Make sure cookie path matches multi-cluster login paths
-		Path: "/",
+	var returnTo string
+	if rawReturnTo := r.URL.Query().Get("returnTo"); rawReturnTo != "" {
+		var err error
+		if returnTo, err = validateReturnURL(a.refererURL, rawReturnTo); err != nil {
+			klog.Warningf("Ignoring return URL: %v", err)
+		}
 	}
 
-	// Set the cookie domain if configured
-	if a.cookieDomain != "" {
-		cookie.Domain = a.cookieDomain
+	state := newAuthState(returnTo, time.Now())
+	value, err := state.encode()
+	if err != nil {
+		klog.Errorf("failed to encode login state: %v", err)
+		a.redirectAuthError(w, errorInternal)
+		return
 	}
-	http.SetCookie(w, &cookie)
-	http.Redirect(w, r, a.getOAuth2Config().AuthCodeURL(state), http.StatusSeeOther)
+	a.setAuthStateCookie(w, value, int(authStateMaxAge.Seconds()))
+	http.Redirect(w, r, a.getOAuth2Config().AuthCodeURL(state.State, state.authCodeOptions()...), http.StatusSeeOther)
 }
 
 // LogoutFunc cleans up session cookies.
@@ -352,6 +374,68 @@ func (a *Authenticator) LogoutFunc(w http.ResponseWriter, r *http.Request) {
 	a.getLoginMethod().logout(w, r)
 }
 
+// ErrSessionsUnsupported is returned when revoking sessions kept by the OAuth server instead of the console.
+var ErrSessionsUnsupported = errors.New("sessions are not kept by the console with this authentication source")
+
+// RevokeUserSessions logs out all sessions of a user and returns how many sessions were revoked.
+func (a *Authenticator) RevokeUserSessions(userID string) (int, error) {
+	if a.sessions == nil {
+		return 0, ErrSessionsUnsupported
+	}
+	n, err := a.sessions.deleteUserSessions(userID)
+	if err == nil {
+		klog.Infof("Revoked %v sessions of user %q", n, userID)
+	}
+	return n, err
+}
+
+type backChannelLogoutError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// BackChannelLogoutFunc logs out the sessions of the logout token that OIDC providers send when users log
+// out at the provider.
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#BCRequest
+func (a *Authenticator) BackChannelLogoutFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Unsupported method, supported methods are POST"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if a.logoutTokenFunc == nil {
+		serverutils.SendResponse(w, http.StatusNotImplemented, serverutils.ApiError{Err: ErrSessionsUnsupported.Error()})
+		return
+	}
+	logoutToken := r.PostFormValue("logout_token")
+	if logoutToken == "" {
+		serverutils.SendResponse(w, http.StatusBadRequest, backChannelLogoutError{Error: "invalid_request", Description: "missing logout_token"})
+		return
+	}
+	userID, sid, err := a.logoutTokenFunc(r.Context(), logoutToken)
+	if err != nil {
+		klog.Warningf("Rejecting back-channel logout: %v", err)
+		serverutils.SendResponse(w, http.StatusBadRequest, backChannelLogoutError{Error: "invalid_request", Description: fmt.Sprintf("invalid logout token: %v", err)})
+		return
+	}
+
+	var revoked int
+	if sid != "" {
+		revoked, err = a.sessions.deleteProviderSessions(userID, sid)
+	} else {
+		revoked, err = a.sessions.deleteUserSessions(userID)
+	}
+	if err != nil {
+		klog.Errorf("Failed to revoke sessions of back-channel logout: %v", err)
+		// The spec only allows 400 for failed logouts, the provider may retry them.
+		serverutils.SendResponse(w, http.StatusBadRequest, backChannelLogoutError{Error: "server_error", Description: fmt.Sprintf("failed to revoke sessions: %v", err)})
+		return
+	}
+	klog.Infof("Back-channel logout revoked %v sessions of user %q", revoked, userID)
+	w.WriteHeader(http.StatusOK)
+}
+
 // GetKubeAdminLogoutURL returns the logout URL for the special kube:admin user in OpenShift
 func (a *Authenticator) GetSpecialURLs() SpecialAuthURLs {
 	return a.getLoginMethod().getSpecialURLs()
@@ -385,29 +469,45 @@ func (a *Authenticator) CallbackFunc(fn func(loginInfo LoginJSON, successURL str
 			return
 		}
 
-		if urlState != cookieState.Value {
-			klog.Error("state in url does not match State cookie")
+		state, err := decodeAuthState(cookieState.Value)
+		if err != nil {
+			klog.Errorf("failed to decode state cookie: %v", err)
+			a.redirectAuthError(w, errorInvalidState)
+			return
+		}
+		if err := state.verify(urlState, time.Now()); err != nil {
+			klog.Error(err)
 			a.redirectAuthError(w, errorInvalidState)
 			return
 		}
+		// The state can only be used once.
+		a.setAuthStateCookie(w, "", -1)
+
 		ctx := oidc.ClientContext(context.TODO(), a.clientFunc())
 		oauthConfig, lm := a.authFunc()
-		token, err := oauthConfig.Exchange(ctx, code)
+		token, err := oauthConfig.Exchange(ctx, code, state.exchangeOptions()...)
 		if err != nil {
 			klog.Errorf("unable to verify auth code with issuer: %v", err)
 			a.redirectAuthError(w, errorInvalidCode)
 			return
 		}
 
-		ls, err := lm.login(w, token)
+		ls, err := lm.login(w, token, state.Nonce)
 		if err != nil {
 			klog.Errorf("error constructing login state: %v", err)
 			a.redirectAuthError(w, errorInternal)
 			return
 		}
 
-		klog.Infof("oauth success, redirecting to: %q", a.successURL)
-		fn(ls.toLoginJSON(), a.successURL, w)
+		successURL := a.successURL
+		// The return URL was validated when starting the login, but the cookie could have been changed since.
+		if state.ReturnTo != "" {
+			if returnTo, err := validateReturnURL(a.refererURL, state.ReturnTo); err == nil {
+				successURL = returnTo
+			}
+		}
+		klog.Infof("oauth success, redirecting to: %q", successURL)
+		fn(ls.toLoginJSON(), successURL, w)
 	}
 }
 
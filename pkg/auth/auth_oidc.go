@@ -2,22 +2,46 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+const (
+	// Sessions with a refresh token are refreshed this long before their ID token expires.
+	tokenRefreshMargin  = 5 * time.Minute
+	tokenRefreshTimeout = 30 * time.Second
+
+	backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	// Logout tokens issued longer ago are rejected, so that replayed tokens can't log out sessions
+	// created after the logout.
+	maxLogoutTokenAge = 2 * time.Minute
 )
 
 type oidcAuth struct {
 	verifier *oidc.IDTokenVerifier
+	client   *http.Client
+	// oauth2Config returns the client configuration used to refresh sessions.
+	oauth2Config func() *oauth2.Config
 
-	// This preserves the old logic of associating users with session keys
-	// and requires smart routing when running multiple backend instances.
-	sessions *SessionStore
+	// The in-memory session store requires smart routing when running multiple backend instances.
+	sessions SessionStore
+
+	clientID string
+	// endSessionEndpoint is empty if the provider doesn't support RP-initiated logout.
+	endSessionEndpoint    string
+	postLogoutRedirectURL string
 
 	cookiePath    string
 	secureCookies bool
@@ -31,6 +55,10 @@ type oidcConfig struct {
 	cookiePath    string
 	secureCookies bool
 	cookieDomain  string
+	clusterName   string
+	sessions      SessionStore
+	// postLogoutRedirectURL is where the provider sends users after logging out.
+	postLogoutRedirectURL string
 }
 
 func newOIDCAuth(ctx context.Context, c *oidcConfig) (oauth2.Endpoint, *oidcAuth, error) {
@@ -40,18 +68,50 @@ func newOIDCAuth(ctx context.Context, c *oidcConfig) (oauth2.Endpoint, *oidcAuth
 		return oauth2.Endpoint{}, nil, err
 	}
 
+	// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#OPMetadata
+	var metadata struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := p.Claims(&metadata); err != nil {
+		return oauth2.Endpoint{}, nil, fmt.Errorf("failed to decode provider metadata: %v", err)
+	}
+	if metadata.EndSessionEndpoint != "" {
+		if err := validateAbsURL(metadata.EndSessionEndpoint); err != nil {
+			klog.Warningf("Ignoring invalid end_session_endpoint of the OIDC provider, users won't be logged out of the provider: %v", err)
+			metadata.EndSessionEndpoint = ""
+		}
+	}
+
+	sessions := c.sessions
+	if sessions == nil {
+		sessions = NewMemorySessionStore(SessionLimits{MaxSessions: DefaultMaxSessions})
+	}
+	go wait.Until(func() {
+		count, users, err := sessions.pruneSessions()
+		if err != nil {
+			klog.Errorf("Failed to prune sessions: %v", err)
+			return
+		}
+		consoleAuthSessions.WithLabelValues(c.clusterName).Set(float64(count))
+		consoleAuthSessionUsers.WithLabelValues(c.clusterName).Set(float64(users))
+	}, sessionPruneInterval, ctx.Done())
+
 	return p.Endpoint(), &oidcAuth{
 		verifier: p.Verifier(&oidc.Config{
 			ClientID: c.clientID,
 		}),
-		sessions:      NewSessionStore(32768),
-		cookiePath:    c.cookiePath,
-		secureCookies: c.secureCookies,
-		cookieDomain:  c.cookieDomain,
+		client:                c.client,
+		sessions:              sessions,
+		clientID:              c.clientID,
+		endSessionEndpoint:    metadata.EndSessionEndpoint,
+		postLogoutRedirectURL: c.postLogoutRedirectURL,
+		cookiePath:            c.cookiePath,
+		secureCookies:         c.secureCookies,
+		cookieDomain:          c.cookieDomain,
 	}, nil
 }
 
-func (o *oidcAuth) login(w http.ResponseWriter, token *oauth2.Token) (*loginState, error) {
+func (o *oidcAuth) login(w http.ResponseWriter, token *oauth2.Token, nonce string) (*loginState, error) {
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
 		return nil, errors.New("token response did not have an id_token field")
@@ -61,6 +121,9 @@ func (o *oidcAuth) login(w http.ResponseWriter, token *oauth2.Token) (*loginStat
 	if err != nil {
 		return nil, err
 	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce does not match the login request")
+	}
 	var c json.RawMessage
 	if err := idToken.Claims(&c); err != nil {
 		return nil, fmt.Errorf("parsing claims: %v", err)
@@ -69,6 +132,7 @@ func (o *oidcAuth) login(w http.ResponseWriter, token *oauth2.Token) (*loginStat
 	if err != nil {
 		return nil, err
 	}
+	ls.refreshToken = token.RefreshToken
 	if err := o.sessions.addSession(ls); err != nil {
 		return nil, err
 	}
@@ -81,6 +145,11 @@ func (o *oidcAuth) login(w http.ResponseWriter, token *oauth2.Token) (*loginStat
 		Path:     o.cookiePath,
 		Secure:   o.secureCookies,
 	}
+	// Refreshable sessions outlive their ID token, so the cookie lasts for the browser session and
+	// the server decides when the session expires.
+	if ls.refreshToken != "" {
+		cookie.MaxAge = 0
+	}
 
 	// Set the cookie domain if configured
 	if o.cookieDomain != "" {
@@ -88,15 +157,26 @@ func (o *oidcAuth) login(w http.ResponseWriter, token *oauth2.Token) (*loginStat
 	}
 
 	http.SetCookie(w, &cookie)
-
-	o.sessions.pruneSessions()
 	return ls, nil
 }
 
+// logoutResponse is returned if users have to be sent to the provider to log out there as well.
+type logoutResponse struct {
+	LogoutURL string `json:"logoutURL"`
+}
+
+// logout deletes the session. If the provider supports RP-initiated logout, the response contains the
+// URL of the provider that ends the session of the user at the provider as well.
 func (o *oidcAuth) logout(w http.ResponseWriter, r *http.Request) {
+	var logoutURL string
 	// The returned login state can be nil even if err == nil.
 	if ls, _ := o.getLoginState(r); ls != nil {
 		o.sessions.deleteSession(ls.sessionToken)
+		if o.endSessionEndpoint != "" {
+			ls.mux.Lock()
+			logoutURL = o.endSessionURL(ls.rawToken)
+			ls.mux.Unlock()
+		}
 	}
 	// Delete session cookie
 	cookie := http.Cookie{
@@ -114,9 +194,68 @@ func (o *oidcAuth) logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	http.SetCookie(w, &cookie)
+	if logoutURL != "" {
+		serverutils.SendResponse(w, http.StatusOK, logoutResponse{LogoutURL: logoutURL})
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// endSessionURL returns the URL of the RP-initiated logout. The ID token hint tells the provider which
+// session to end, even if the ID token expired.
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+func (o *oidcAuth) endSessionURL(idToken string) string {
+	u, err := url.Parse(o.endSessionEndpoint)
+	if err != nil {
+		// The endpoint was validated when discovering it.
+		return o.endSessionEndpoint
+	}
+	q := u.Query()
+	q.Set("id_token_hint", idToken)
+	q.Set("client_id", o.clientID)
+	if o.postLogoutRedirectURL != "" {
+		q.Set("post_logout_redirect_uri", o.postLogoutRedirectURL)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// verifyLogoutToken validates a logout token sent by the provider, and returns the user and the
+// provider session it logs out. Either of them can be empty. A replayed token without sid would log out
+// all sessions of the user, including ones created after the logout, so only recently issued tokens
+// are accepted.
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+func (o *oidcAuth) verifyLogoutToken(ctx context.Context, rawLogoutToken string) (string, string, error) {
+	// The logout token is a JWT signed by the provider for this client, like ID tokens.
+	logoutToken, err := o.verifier.Verify(oidc.ClientContext(ctx, o.client), rawLogoutToken)
+	if err != nil {
+		return "", "", err
+	}
+	if logoutToken.Nonce != "" {
+		return "", "", errors.New("logout token must not contain a nonce")
+	}
+	var claims struct {
+		SessionID string                     `json:"sid"`
+		Events    map[string]json.RawMessage `json:"events"`
+	}
+	if err := logoutToken.Claims(&claims); err != nil {
+		return "", "", fmt.Errorf("parsing claims: %v", err)
+	}
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return "", "", errors.New("logout token does not contain a back-channel logout event")
+	}
+	if logoutToken.Subject == "" && claims.SessionID == "" {
+		return "", "", errors.New("logout token must contain a sub or sid claim")
+	}
+	if logoutToken.IssuedAt.IsZero() {
+		return "", "", errors.New("logout token must contain an iat claim")
+	}
+	if age := time.Since(logoutToken.IssuedAt); age > maxLogoutTokenAge {
+		return "", "", fmt.Errorf("logout token was issued %v ago, at most %v are accepted", age.Round(time.Second), maxLogoutTokenAge)
+	}
+	return logoutToken.Subject, claims.SessionID, nil
+}
+
 func (o *oidcAuth) getLoginState(r *http.Request) (*loginState, error) {
 	sessionCookie, err := r.Cookie(openshiftAccessTokenCookieName)
 	if err != nil {
@@ -127,7 +266,10 @@ func (o *oidcAuth) getLoginState(r *http.Request) (*loginState, error) {
 	if ls == nil {
 		return nil, fmt.Errorf("No session found on server")
 	}
-	if ls.exp.Sub(ls.now()) < 0 {
+	ls.mux.Lock()
+	expired := ls.sessionExpiry().Sub(ls.now()) < 0
+	ls.mux.Unlock()
+	if expired {
 		o.sessions.deleteSession(sessionToken)
 		return nil, fmt.Errorf("Session is expired.")
 	}
@@ -140,6 +282,40 @@ func (o *oidcAuth) authenticate(r *http.Request) (*User, error) {
 		return nil, err
 	}
 
+	// Concurrent requests of the session wait for a single refresh.
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	needsRefresh := func() bool {
+		return ls.refreshToken != "" && ls.exp.Sub(ls.now()) < tokenRefreshMargin
+	}
+	if needsRefresh() {
+		// Another replica might have refreshed the session already.
+		if err := o.sessions.syncSession(ls); err != nil {
+			klog.Warningf("Failed to reload session of user %q: %v", ls.UserID, err)
+		}
+	}
+	if needsRefresh() {
+		refreshToken := ls.refreshToken
+		if err := o.refresh(ls); err != nil {
+			// The provider rejects invalid and revoked refresh tokens with client errors.
+			var retrieveErr *oauth2.RetrieveError
+			rejected := errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode < http.StatusInternalServerError
+			if rejected && o.sessions.syncSession(ls) == nil && ls.refreshToken != refreshToken {
+				// Another replica refreshed the session at the same time, and the provider rotated the
+				// refresh token.
+				klog.V(4).Infof("Session of user %q was refreshed by another replica", ls.UserID)
+			} else if !rejected && ls.exp.Sub(ls.now()) > 0 {
+				// Retry with the next request while the ID token is still valid.
+				klog.Warningf("Failed to refresh session of user %q, retrying later: %v", ls.UserID, err)
+			} else {
+				klog.Infof("Failed to refresh session of user %q, revoking it: %v", ls.UserID, err)
+				ls.refreshToken = ""
+				o.sessions.deleteSession(ls.sessionToken)
+				return nil, fmt.Errorf("Session refresh failed: %v", err)
+			}
+		}
+	}
+
 	return &User{
 		ID:       ls.UserID,
 		Username: ls.Name,
@@ -147,6 +323,53 @@ func (o *oidcAuth) authenticate(r *http.Request) (*User, error) {
 	}, nil
 }
 
+// refresh replaces the ID token of the session using its refresh token. Providers that rotate refresh
+// tokens return a new one, which replaces the old one. The caller must hold the session lock.
+func (o *oidcAuth) refresh(ls *loginState) error {
+	if o.oauth2Config == nil {
+		return fmt.Errorf("no OAuth2 client configured for refreshing sessions")
+	}
+	ctx, cancel := context.WithTimeout(oidc.ClientContext(context.Background(), o.client), tokenRefreshTimeout)
+	defer cancel()
+	// The token source keeps the old refresh token if the response doesn't contain a new one.
+	token, err := o.oauth2Config().TokenSource(ctx, &oauth2.Token{RefreshToken: ls.refreshToken}).Token()
+	if err != nil {
+		return err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return errors.New("refresh token response did not have an id_token field")
+	}
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return err
+	}
+	var c json.RawMessage
+	if err := idToken.Claims(&c); err != nil {
+		return fmt.Errorf("parsing claims: %v", err)
+	}
+	refreshed, err := newLoginState(rawIDToken, []byte(c))
+	if err != nil {
+		return err
+	}
+	if refreshed.UserID != ls.UserID {
+		return fmt.Errorf("refreshed ID token is for user %q", refreshed.UserID)
+	}
+
+	ls.rawToken = rawIDToken
+	ls.refreshToken = token.RefreshToken
+	ls.exp = refreshed.exp
+	ls.Name = refreshed.Name
+	ls.Email = refreshed.Email
+	// The session is refreshed even if storing it fails, other replicas will fail to refresh it and log the
+	// user out.
+	if err := o.sessions.updateSession(ls); err != nil {
+		klog.Errorf("Failed to store refreshed session of user %q: %v", ls.UserID, err)
+	}
+	klog.V(4).Infof("Refreshed session of user %q until %s", ls.UserID, ls.exp)
+	return nil
+}
+
 func (o *oidcAuth) getSpecialURLs() SpecialAuthURLs {
 	return SpecialAuthURLs{}
 }
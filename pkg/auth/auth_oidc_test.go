@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// fakeKeySet accepts all signatures, the tests only cover what happens with verified tokens.
+type fakeKeySet struct{}
+
+func (fakeKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.Split(jwt, ".")[1])
+}
+
+func fakeIDToken(t *testing.T, subject string, exp time.Time) string {
+	return fakeIDTokenWithNonce(t, subject, exp, "")
+}
+
+func fakeIDTokenWithNonce(t *testing.T, subject string, exp time.Time, nonce string) string {
+	c := map[string]interface{}{
+		"sub": subject,
+		"exp": exp.Unix(),
+	}
+	if nonce != "" {
+		c["nonce"] = nonce
+	}
+	return fakeJWT(t, c)
+}
+
+// fakeJWT returns a token of the fake issuer for the console client with the given claims.
+func fakeJWT(t *testing.T, c map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	c["iss"] = "https://issuer.example.com"
+	c["aud"] = "console"
+	claims, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return header + "." + base64.RawURLEncoding.EncodeToString(claims) + "." + base64.RawURLEncoding.EncodeToString([]byte("signature"))
+}
+
+// fakeTokenEndpoint answers refresh token grants with the configured status, and rotates the refresh token.
+type fakeTokenEndpoint struct {
+	t             *testing.T
+	mux           sync.Mutex
+	status        int
+	subject       string
+	refreshTokens []string
+}
+
+func (f *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	r.ParseForm()
+	f.refreshTokens = append(f.refreshTokens, r.PostForm.Get("refresh_token"))
+	if f.status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.status)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  "access",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": fmt.Sprintf("refresh-%d", len(f.refreshTokens)+1),
+		"id_token":      fakeIDToken(f.t, f.subject, time.Now().Add(time.Hour)),
+	})
+}
+
+func newTestOIDCAuth(t *testing.T, endpoint *fakeTokenEndpoint) *oidcAuth {
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+	return &oidcAuth{
+		verifier: oidc.NewVerifier("https://issuer.example.com", fakeKeySet{}, &oidc.Config{ClientID: "console"}),
+		client:   server.Client(),
+		oauth2Config: func() *oauth2.Config {
+			return &oauth2.Config{ClientID: "console", Endpoint: oauth2.Endpoint{TokenURL: server.URL + "/token"}}
+		},
+		sessions:   NewMemorySessionStore(SessionLimits{MaxSessions: 10}),
+		cookiePath: "/",
+	}
+}
+
+func loginWithRefreshToken(t *testing.T, o *oidcAuth, exp time.Time) (*loginState, *http.Request) {
+	token := (&oauth2.Token{AccessToken: "access", RefreshToken: "refresh-1"}).WithExtra(map[string]interface{}{
+		"id_token": fakeIDTokenWithNonce(t, "user", exp, "nonce"),
+	})
+	w := httptest.NewRecorder()
+	ls, err := o.login(w, token, "nonce")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != 0 {
+		t.Fatalf("expected a browser session cookie, got %v", cookies)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/kubernetes/", nil)
+	r.AddCookie(cookies[0])
+	return ls, r
+}
+
+func TestOIDCSessionRefresh(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{t: t, status: http.StatusOK, subject: "user"}
+	o := newTestOIDCAuth(t, endpoint)
+	ls, r := loginWithRefreshToken(t, o, time.Now().Add(time.Minute))
+	loginToken := ls.rawToken
+
+	// The ID token expires within the refresh margin.
+	user, err := o.authenticate(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Token == loginToken {
+		t.Errorf("expected the refreshed ID token")
+	}
+	if ls.refreshToken != "refresh-2" {
+		t.Errorf("expected the rotated refresh token, got %q", ls.refreshToken)
+	}
+	if _, err := o.authenticate(r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(endpoint.refreshTokens) != 1 || endpoint.refreshTokens[0] != "refresh-1" {
+		t.Errorf("expected a single refresh with the original refresh token, got %v", endpoint.refreshTokens)
+	}
+
+	// Server errors are retried while the ID token is valid.
+	ls.mux.Lock()
+	ls.exp = time.Now().Add(time.Minute)
+	ls.mux.Unlock()
+	endpoint.status = http.StatusServiceUnavailable
+	if _, err := o.authenticate(r); err != nil {
+		t.Errorf("expected the session to be used until its ID token expires: %v", err)
+	}
+
+	// Rejected refresh tokens revoke the session.
+	endpoint.status = http.StatusBadRequest
+	if _, err := o.authenticate(r); err == nil {
+		t.Errorf("expected an error")
+	}
+	if o.sessions.getSession(ls.sessionToken) != nil {
+		t.Errorf("expected the session to be revoked")
+	}
+}
+
+func TestOIDCSessionRefreshAfterExpiry(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{t: t, status: http.StatusOK, subject: "user"}
+	o := newTestOIDCAuth(t, endpoint)
+	expire := func(ls *loginState) {
+		ls.mux.Lock()
+		defer ls.mux.Unlock()
+		ls.exp = time.Now().Add(-time.Minute)
+	}
+
+	ls, r := loginWithRefreshToken(t, o, time.Now().Add(time.Hour))
+	expire(ls)
+	if _, err := o.authenticate(r); err != nil {
+		t.Errorf("expected expired sessions to be refreshed: %v", err)
+	}
+
+	// Sessions can't be refreshed into another user's session.
+	endpoint.subject = "other"
+	ls, r = loginWithRefreshToken(t, o, time.Now().Add(time.Hour))
+	expire(ls)
+	if _, err := o.authenticate(r); err == nil {
+		t.Errorf("expected an error")
+	}
+	if o.sessions.getSession(ls.sessionToken) != nil {
+		t.Errorf("expected the session to be revoked")
+	}
+}
+
+func TestOIDCLoginNonce(t *testing.T) {
+	o := newTestOIDCAuth(t, &fakeTokenEndpoint{t: t, status: http.StatusOK, subject: "user"})
+	login := func(tokenNonce, nonce string) error {
+		token := (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{
+			"id_token": fakeIDTokenWithNonce(t, "user", time.Now().Add(time.Hour), tokenNonce),
+		})
+		_, err := o.login(httptest.NewRecorder(), token, nonce)
+		return err
+	}
+	if err := login("nonce", "nonce"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := login("other", "nonce"); err == nil {
+		t.Error("expected ID tokens of other login requests to be rejected")
+	}
+	if err := login("", "nonce"); err == nil {
+		t.Error("expected ID tokens without nonce to be rejected")
+	}
+}
+
+func TestOIDCLogoutEndSession(t *testing.T) {
+	o := newTestOIDCAuth(t, &fakeTokenEndpoint{t: t, status: http.StatusOK, subject: "user"})
+	ls, r := loginWithRefreshToken(t, o, time.Now().Add(time.Hour))
+	w := httptest.NewRecorder()
+	o.logout(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected no content without an end session endpoint, got %d", w.Code)
+	}
+
+	o.clientID = "console"
+	o.endSessionEndpoint = "https://issuer.example.com/logout?tenant=console"
+	o.postLogoutRedirectURL = "http://example.com/"
+	ls, r = loginWithRefreshToken(t, o, time.Now().Add(time.Hour))
+	w = httptest.NewRecorder()
+	o.logout(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the logout URL, got %d", w.Code)
+	}
+	var resp logoutResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	u, err := url.Parse(resp.LogoutURL)
+	if err != nil {
+		t.Fatalf("failed to parse logout URL: %v", err)
+	}
+	q := u.Query()
+	if u.Host != "issuer.example.com" || u.Path != "/logout" || q.Get("tenant") != "console" {
+		t.Errorf("expected the end session endpoint, got %q", resp.LogoutURL)
+	}
+	if q.Get("id_token_hint") != ls.rawToken || q.Get("client_id") != "console" || q.Get("post_logout_redirect_uri") != "http://example.com/" {
+		t.Errorf("unexpected logout parameters %v", q)
+	}
+	if o.sessions.getSession(ls.sessionToken) != nil {
+		t.Error("expected the session to be deleted")
+	}
+
+	// Providers only accept registered redirect URLs, so none is sent unless it is configured.
+	o.postLogoutRedirectURL = ""
+	if u, err := url.Parse(o.endSessionURL(ls.rawToken)); err != nil || u.Query().Has("post_logout_redirect_uri") {
+		t.Errorf("expected no post logout redirect, got %v", u)
+	}
+}
+
+func TestOIDCBackChannelLogout(t *testing.T) {
+	o := newTestOIDCAuth(t, &fakeTokenEndpoint{t: t, status: http.StatusOK, subject: "user"})
+	a := &Authenticator{sessions: o.sessions, logoutTokenFunc: o.verifyLogoutToken}
+	login := func(subject, sid string) *loginState {
+		token := (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{
+			"id_token": fakeJWT(t, map[string]interface{}{"sub": subject, "sid": sid, "nonce": "nonce", "exp": time.Now().Add(time.Hour).Unix()}),
+		})
+		ls, err := o.login(httptest.NewRecorder(), token, "nonce")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ls
+	}
+	logout := func(claims map[string]interface{}) int {
+		form := url.Values{}
+		if claims != nil {
+			form.Set("logout_token", fakeJWT(t, claims))
+		}
+		r := httptest.NewRequest(http.MethodPost, "/auth/backchannel-logout", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		a.BackChannelLogoutFunc(w, r)
+		return w.Code
+	}
+	events := map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}}
+	exp := time.Now().Add(time.Minute).Unix()
+	iat := time.Now().Unix()
+
+	session1 := login("user", "sid-1")
+	session2 := login("user", "sid-2")
+	other := login("other", "sid-3")
+	for name, claims := range map[string]map[string]interface{}{
+		"missing token": nil,
+		"no event":      {"sub": "user", "exp": exp},
+		"nonce":         {"sub": "user", "events": events, "nonce": "nonce", "exp": exp},
+		"no sub or sid": {"events": events, "exp": exp},
+		"expired":       {"sub": "user", "events": events, "exp": time.Now().Add(-time.Minute).Unix(), "iat": iat},
+		"no iat":        {"sub": "user", "events": events, "exp": exp},
+		"old iat":       {"sub": "user", "events": events, "exp": exp, "iat": time.Now().Add(-maxLogoutTokenAge - time.Minute).Unix()},
+	} {
+		if code := logout(claims); code != http.StatusBadRequest {
+			t.Errorf("%s: expected the logout token to be rejected, got %d", name, code)
+		}
+	}
+	if o.sessions.getSession(session1.sessionToken) == nil {
+		t.Fatal("expected rejected logout tokens to keep sessions")
+	}
+
+	if code := logout(map[string]interface{}{"sub": "user", "sid": "sid-1", "events": events, "exp": exp, "iat": iat}); code != http.StatusOK {
+		t.Errorf("expected the logout to succeed, got %d", code)
+	}
+	if o.sessions.getSession(session1.sessionToken) != nil || o.sessions.getSession(session2.sessionToken) == nil {
+		t.Error("expected only the session with the logged out sid to be deleted")
+	}
+	if code := logout(map[string]interface{}{"sid": "sid-3", "events": events, "exp": exp, "iat": iat}); code != http.StatusOK {
+		t.Errorf("expected the logout to succeed, got %d", code)
+	}
+	if o.sessions.getSession(other.sessionToken) != nil {
+		t.Error("expected sessions to be logged out by sid alone")
+	}
+	login("user", "sid-4")
+	if code := logout(map[string]interface{}{"sub": "user", "events": events, "exp": exp, "iat": iat}); code != http.StatusOK {
+		t.Errorf("expected the logout to succeed, got %d", code)
+	}
+	if n, _ := o.sessions.deleteUserSessions("user"); n != 0 {
+		t.Errorf("expected all sessions of the user to be logged out, %d were left", n)
+	}
+
+	a.sessions = &failingSessionStore{SessionStore: o.sessions}
+	if code := logout(map[string]interface{}{"sub": "user", "sid": "sid-5", "events": events, "exp": exp, "iat": iat}); code != http.StatusBadRequest {
+		t.Errorf("expected session store failures to fail the logout, got %d", code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/backchannel-logout", nil)
+	w := httptest.NewRecorder()
+	a.BackChannelLogoutFunc(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected only POST requests, got %d", w.Code)
+	}
+}
+
+// failingSessionStore fails to delete sessions, like a secret store that can't reach the API server.
+type failingSessionStore struct {
+	SessionStore
+}
+
+func (ss *failingSessionStore) deleteUserSessions(userID string) (int, error) {
+	return 0, fmt.Errorf("connection refused")
+}
+
+func (ss *failingSessionStore) deleteProviderSessions(userID, sid string) (int, error) {
+	return 0, fmt.Errorf("connection refused")
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"golang.org/x/oauth2"
+	"k8s.io/klog"
 
 	"github.com/openshift/console/pkg/proxy"
 	"github.com/openshift/console/pkg/serverutils"
@@ -23,6 +24,8 @@ type openShiftAuth struct {
 	specialURLs   SpecialAuthURLs
 	clusterName   string
 	cookieDomain  string
+	// cookieKeyring encrypts session cookies if set.
+	cookieKeyring *CookieKeyring
 }
 
 type openShiftConfig struct {
@@ -33,6 +36,7 @@ type openShiftConfig struct {
 	secureCookies bool
 	clusterName   string
 	cookieDomain  string
+	cookieKeyring *CookieKeyring
 }
 
 func validateAbsURL(value string) error {
@@ -121,10 +125,12 @@ func newOpenShiftAuth(ctx context.Context, c *openShiftConfig) (oauth2.Endpoint,
 			},
 			c.clusterName,
 			c.cookieDomain,
+			c.cookieKeyring,
 		}, nil
 }
 
-func (o *openShiftAuth) login(w http.ResponseWriter, token *oauth2.Token) (*loginState, error) {
+// login ignores the nonce, since the OpenShift OAuth server doesn't issue ID tokens.
+func (o *openShiftAuth) login(w http.ResponseWriter, token *oauth2.Token, _ string) (*loginState, error) {
 	if token.AccessToken == "" {
 		return nil, fmt.Errorf("token response did not contain an access token %#v", token)
 	}
@@ -146,9 +152,17 @@ func (o *openShiftAuth) login(w http.ResponseWriter, token *oauth2.Token) (*logi
 	// NOTE: in the future we'll have to avoid the use of cookies. This should likely switch to frontend
 	// only logic using the OAuth2 implicit flow.
 	// https://tools.ietf.org/html/rfc6749#section-4.2
+	cookieName := GetCookieName(o.clusterName)
+	value := ls.rawToken
+	if o.cookieKeyring != nil {
+		var err error
+		if value, err = o.cookieKeyring.seal(cookieName, ls.rawToken); err != nil {
+			return nil, err
+		}
+	}
 	cookie := http.Cookie{
-		Name:     GetCookieName(o.clusterName),
-		Value:    ls.rawToken,
+		Name:     cookieName,
+		Value:    value,
 		MaxAge:   int(expiresIn),
 		HttpOnly: true,
 		Path:     o.cookiePath,
@@ -186,12 +200,12 @@ func (o *openShiftAuth) logout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func getOpenShiftUser(r *http.Request) (*User, error) {
+// getOpenShiftUser returns the user of the session cookie. Without a keyring, the cookie holds the
+// plaintext access token, which isn't validated with the assumption that the API server will reject
+// tokens it doesn't recognize.
+func getOpenShiftUser(r *http.Request, keyring *CookieKeyring) (*User, error) {
 	cluster := serverutils.GetCluster(r)
 	cookieName := GetCookieName(cluster)
-	// TODO: This doesn't do any validation of the cookie with the assumption that the
-	// API server will reject tokens it doesn't recognize. If we want to keep some backend
-	// state we should sign this cookie. If not there's not much we can do.
 	cookie, err := r.Cookie(cookieName)
 	if err != nil {
 		return nil, err
@@ -200,8 +214,16 @@ func getOpenShiftUser(r *http.Request) (*User, error) {
 		return nil, fmt.Errorf("unauthenticated, no value for cookie %s", cookieName)
 	}
 
+	token := cookie.Value
+	if keyring != nil {
+		if token, err = keyring.open(cookieName, cookie.Value); err != nil {
+			klog.Warningf("Rejecting cookie %s from %s: %v", cookieName, r.RemoteAddr, err)
+			return nil, fmt.Errorf("unauthenticated, invalid cookie %s: %v", cookieName, err)
+		}
+	}
+
 	return &User{
-		Token: cookie.Value,
+		Token: token,
 	}, nil
 }
 
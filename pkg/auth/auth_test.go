@@ -2,10 +2,13 @@ package auth
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -311,3 +314,87 @@ func TestCSRF(t *testing.T) {
 	testCSRF(t, "", "b", false)
 	testCSRF(t, "", "", false)
 }
+
+func TestLoginCallback(t *testing.T) {
+	p := &mockOpenShiftProvider{}
+	var challenge, verifier string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.handleDiscovery)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifier = r.PostForm.Get("code_verifier")
+		sum := sha256.Sum256([]byte(verifier))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"sha256~token","token_type":"Bearer","expires_in":3600}`)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	p.issuer = s.URL
+
+	a, err := NewAuthenticator(context.Background(), &Config{
+		AuthSource:   AuthSourceOpenShift,
+		ClientID:     "fake-client-id",
+		ClientSecret: "fake-secret",
+		RedirectURL:  "http://example.com/auth/callback",
+		IssuerURL:    p.issuer,
+		ErrorURL:     "http://example.com/error",
+		SuccessURL:   "http://example.com/",
+		CookiePath:   "/",
+		RefererPath:  "http://example.com/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(returnTo string) (*http.Cookie, url.Values) {
+		rr := httptest.NewRecorder()
+		a.LoginFunc(rr, httptest.NewRequest("GET", "http://example.com/auth/login?returnTo="+url.QueryEscape(returnTo), nil))
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("failed to parse location header: %v", err)
+		}
+		q := u.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" {
+			t.Errorf("expected a PKCE challenge and a nonce, got %v", q)
+		}
+		challenge = q.Get("code_challenge")
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != stateCookieName {
+			t.Fatalf("expected the state cookie, got %v", cookies)
+		}
+		return cookies[0], q
+	}
+	callback := func(cookie *http.Cookie, state string) (string, string) {
+		var successURL string
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/auth/callback?code=code&state="+url.QueryEscape(state), nil)
+		r.AddCookie(cookie)
+		a.CallbackFunc(func(loginInfo LoginJSON, url string, w http.ResponseWriter) {
+			successURL = url
+		})(rr, r)
+		return successURL, rr.Header().Get("Location")
+	}
+
+	cookie, q := login("/k8s/cluster/nodes")
+	if successURL, location := callback(cookie, "other"); successURL != "" || !strings.Contains(location, errorInvalidState) {
+		t.Errorf("expected states of other logins to be rejected, got %q", location)
+	}
+	successURL, location := callback(cookie, q.Get("state"))
+	if successURL != "http://example.com/k8s/cluster/nodes" {
+		t.Errorf("expected the return URL, got %q (location %q)", successURL, location)
+	}
+	if verifier == "" {
+		t.Error("expected the PKCE verifier to be sent")
+	}
+
+	cookie, q = login("https://evil.example.com/")
+	if successURL, _ := callback(cookie, q.Get("state")); successURL != "http://example.com/" {
+		t.Errorf("expected return URLs outside of the console to be ignored, got %q", successURL)
+	}
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// Logins have to be completed within this time after being redirected to the provider.
+const authStateMaxAge = 10 * time.Minute
+
+// authState is kept in the state cookie of the browser that started the login. The callback is only
+// accepted from the same browser, since the state parameter has to match the cookie.
+type authState struct {
+	State string `json:"state"`
+	// Verifier is the PKCE code verifier, the provider only gets its S256 challenge.
+	Verifier string `json:"verifier"`
+	// Nonce has to match the nonce claim of the ID token, so that ID tokens can't be replayed.
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"returnTo,omitempty"`
+	Exp      int64  `json:"exp"`
+}
+
+func newAuthState(returnTo string, now time.Time) *authState {
+	return &authState{
+		State:    randomURLSafeString(32),
+		Verifier: randomURLSafeString(32),
+		Nonce:    randomURLSafeString(32),
+		ReturnTo: returnTo,
+		Exp:      now.Add(authStateMaxAge).Unix(),
+	}
+}
+
+func (s *authState) encode() (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeAuthState(value string) (*authState, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var s authState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// verify checks the state parameter of the callback against the state of the browser.
+func (s *authState) verify(state string, now time.Time) error {
+	if s.State == "" || subtle.ConstantTimeCompare([]byte(s.State), []byte(state)) != 1 {
+		return fmt.Errorf("state in url does not match state cookie")
+	}
+	if now.Unix() > s.Exp {
+		return fmt.Errorf("login state expired")
+	}
+	return nil
+}
+
+// authCodeOptions adds the PKCE challenge and the OIDC nonce to the authorization request.
+func (s *authState) authCodeOptions() []oauth2.AuthCodeOption {
+	challenge := sha256.Sum256([]byte(s.Verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oidc.Nonce(s.Nonce),
+	}
+}
+
+// exchangeOptions adds the PKCE verifier to the token request.
+func (s *authState) exchangeOptions() []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_verifier", s.Verifier),
+	}
+}
+
+func (a *Authenticator) setAuthStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	cookie := http.Cookie{
+		Name:     stateCookieName,
+		Value:    value,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+		// Make sure cookie path matches multi-cluster login paths
+		Path: "/",
+	}
+
+	// Set the cookie domain if configured
+	if a.cookieDomain != "" {
+		cookie.Domain = a.cookieDomain
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// validateReturnURL resolves a post-login return URL against the console base URL, and rejects URLs
+// outside of the console to avoid open redirects.
+func validateReturnURL(baseURL *url.URL, returnTo string) (string, error) {
+	if baseURL == nil {
+		return "", fmt.Errorf("no base URL to validate return URLs")
+	}
+	// Browsers treat backslashes like slashes, "/\evil.com" would be a protocol-relative URL.
+	if strings.Contains(returnTo, `\`) || strings.IndexFunc(returnTo, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("invalid return URL %q", returnTo)
+	}
+	u, err := baseURL.Parse(returnTo)
+	if err != nil {
+		return "", fmt.Errorf("invalid return URL %q: %v", returnTo, err)
+	}
+	basePath := baseURL.Path
+	if !strings.HasSuffix(basePath, "/") {
+		basePath += "/"
+	}
+	if u.Scheme != baseURL.Scheme || u.Host != baseURL.Host || u.User != nil || !strings.HasPrefix(u.Path+"/", basePath) {
+		return "", fmt.Errorf("return URL %q is outside of the console", returnTo)
+	}
+	return u.String(), nil
+}
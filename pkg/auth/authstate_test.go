@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestValidateReturnURL(t *testing.T) {
+	baseURL, _ := url.Parse("https://console.example.com/console/")
+	for _, tt := range []struct {
+		returnTo string
+		want     string
+	}{
+		{"/console/k8s/ns/default/pods?rowFilter=running", "https://console.example.com/console/k8s/ns/default/pods?rowFilter=running"},
+		{"k8s/cluster/nodes", "https://console.example.com/console/k8s/cluster/nodes"},
+		{"https://console.example.com/console/monitoring#alerts", "https://console.example.com/console/monitoring#alerts"},
+		{"/console", "https://console.example.com/console"},
+		{"https://evil.example.com/console/", ""},
+		{"//evil.example.com/console/", ""},
+		{`/\evil.example.com`, ""},
+		{"/console/../other", ""},
+		{"/consoles", ""},
+		{"http://console.example.com/console/", ""},
+		{"https://user@console.example.com/console/", ""},
+		{"javascript:alert(1)", ""},
+		{"/console/\nfoo", ""},
+	} {
+		got, err := validateReturnURL(baseURL, tt.returnTo)
+		if tt.want == "" && err == nil {
+			t.Errorf("%q: expected an error, got %q", tt.returnTo, got)
+		}
+		if tt.want != "" && got != tt.want {
+			t.Errorf("%q: got %q, want %q (error: %v)", tt.returnTo, got, tt.want, err)
+		}
+	}
+}
+
+func TestAuthState(t *testing.T) {
+	now := time.Now()
+	state := newAuthState("https://console.example.com/", now)
+	value, err := state.encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded, err := decodeAuthState(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *decoded != *state {
+		t.Errorf("decoded state %+v, want %+v", decoded, state)
+	}
+
+	if err := decoded.verify(state.State, now); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := decoded.verify("other", now); err == nil {
+		t.Error("expected states of other browsers to be rejected")
+	}
+	if err := decoded.verify(state.State, now.Add(authStateMaxAge+time.Second)); err == nil {
+		t.Error("expected expired states to be rejected")
+	}
+	if err := (&authState{}).verify("", now); err == nil {
+		t.Error("expected empty states to be rejected")
+	}
+}
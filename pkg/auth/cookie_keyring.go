@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// Encrypted cookies look like "v1.<key ID>.<base64url(nonce || ciphertext)>". OpenShift access tokens
+	// never contain dots, so cookies without the prefix are plaintext cookies set before encryption was
+	// enabled.
+	encryptedCookiePrefix = "v1."
+
+	cookieKeyReloadInterval = time.Minute
+)
+
+var errPlaintextCookie = errors.New("plaintext cookies are not accepted")
+
+type cookieKey struct {
+	// id is a short hash of the key, so that cookies can be decrypted with the key that encrypted them.
+	id   string
+	aead cipher.AEAD
+}
+
+// CookieKeyring encrypts and authenticates OpenShift session cookies with AES-GCM. The first key of
+// the key file encrypts new cookies, the other keys only decrypt cookies, so that keys can be rotated
+// by adding a new first key and removing the old key once its cookies have expired.
+type CookieKeyring struct {
+	path string
+	// acceptPlaintext accepts cookies set before cookie encryption was enabled.
+	acceptPlaintext bool
+
+	// data is the last loaded content of the key file, it's only used by reload.
+	data []byte
+
+	mux  sync.RWMutex
+	keys []cookieKey
+}
+
+// NewCookieKeyring loads the base64-encoded AES keys in the given file, one key per line.
+func NewCookieKeyring(path string, acceptPlaintext bool) (*CookieKeyring, error) {
+	k := &CookieKeyring{
+		path:            path,
+		acceptPlaintext: acceptPlaintext,
+	}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Run reloads the key file periodically until stopCh is closed. Keys are kept if the file is invalid.
+func (k *CookieKeyring) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := k.reload(); err != nil {
+			klog.Errorf("Failed to reload cookie encryption keys, keeping the current keys: %v", err)
+		}
+	}, cookieKeyReloadInterval, stopCh)
+}
+
+func (k *CookieKeyring) reload() error {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read cookie encryption key file %s: %v", k.path, err)
+	}
+	if k.data != nil && bytes.Equal(data, k.data) {
+		return nil
+	}
+	keys, err := parseCookieKeys(data)
+	if err != nil {
+		return fmt.Errorf("invalid cookie encryption key file %s: %v", k.path, err)
+	}
+	k.data = data
+	k.mux.Lock()
+	k.keys = keys
+	k.mux.Unlock()
+	klog.Infof("Loaded %d cookie encryption keys, encrypting cookies with key %s.", len(keys), keys[0].id)
+	return nil
+}
+
+func parseCookieKeys(data []byte) ([]cookieKey, error) {
+	var keys []cookieKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		secret, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key is not base64-encoded: %v", i+1, err)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: keys must be 16, 24 or 32 bytes long: %v", i+1, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		hash := sha256.Sum256(secret)
+		keys = append(keys, cookieKey{id: hex.EncodeToString(hash[:4]), aead: aead})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keys, nil
+}
+
+// seal encrypts the value of the cookie with the given name with the current key. The name is
+// authenticated as well, so that cookies of one cluster can't be used for another.
+func (k *CookieKeyring) seal(name, value string) (string, error) {
+	k.mux.RLock()
+	key := k.keys[0]
+	k.mux.RUnlock()
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate cookie nonce: %v", err)
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return encryptedCookiePrefix + key.id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open returns the decrypted value of the cookie with the given name, or its plaintext value if
+// plaintext cookies are accepted.
+func (k *CookieKeyring) open(name, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedCookiePrefix) {
+		if !k.acceptPlaintext {
+			return "", errPlaintextCookie
+		}
+		klog.V(4).Infof("Accepting plaintext cookie %s until it is replaced by an encrypted cookie on the next login.", name)
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedCookiePrefix), ".", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted cookie")
+	}
+	k.mux.RLock()
+	var key *cookieKey
+	for i := range k.keys {
+		if k.keys[i].id == parts[0] {
+			key = &k.keys[i]
+			break
+		}
+	}
+	k.mux.RUnlock()
+	if key == nil {
+		return "", fmt.Errorf("cookie was encrypted with unknown key %q, it was set by another console or its key was removed", parts[0])
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < key.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted cookie")
+	}
+	nonceSize := key.aead.NonceSize()
+	plaintext, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("cookie failed authentication, it was tampered with or set for another cluster")
+	}
+	return string(plaintext), nil
+}
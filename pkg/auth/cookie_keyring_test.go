@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+func testCookieKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func writeCookieKeys(t *testing.T, path string, keys ...string) {
+	if err := ioutil.WriteFile(path, []byte(strings.Join(keys, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+}
+
+func TestCookieKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	writeCookieKeys(t, path, testCookieKey('a'))
+	k, err := NewCookieKeyring(path, false)
+	if err != nil {
+		t.Fatalf("NewCookieKeyring error: %v", err)
+	}
+
+	sealed, err := k.seal("openshift-session-token", "sha256~token")
+	if err != nil {
+		t.Fatalf("seal error: %v", err)
+	}
+	if !strings.HasPrefix(sealed, encryptedCookiePrefix) || strings.Contains(sealed, "sha256~token") {
+		t.Fatalf("expected an encrypted cookie, got %q", sealed)
+	}
+	if token, err := k.open("openshift-session-token", sealed); err != nil || token != "sha256~token" {
+		t.Errorf("expected the token, got %q and error %v", token, err)
+	}
+	if _, err := k.open("openshift-session-token-managed", sealed); err == nil {
+		t.Error("expected cookies of other clusters to be rejected")
+	}
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+	if _, err := k.open("openshift-session-token", tampered); err == nil {
+		t.Error("expected tampered cookies to be rejected")
+	}
+	if _, err := k.open("openshift-session-token", "v1.garbage"); err == nil {
+		t.Error("expected malformed cookies to be rejected")
+	}
+	if _, err := k.open("openshift-session-token", "sha256~token"); err != errPlaintextCookie {
+		t.Errorf("expected plaintext cookies to be rejected, got %v", err)
+	}
+
+	// Cookies of the old key are accepted after rotation, until the old key is removed.
+	writeCookieKeys(t, path, testCookieKey('b'), testCookieKey('a'))
+	if err := k.reload(); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if token, err := k.open("openshift-session-token", sealed); err != nil || token != "sha256~token" {
+		t.Errorf("expected cookies of the old key to be accepted, got %q and error %v", token, err)
+	}
+	rotated, err := k.seal("openshift-session-token", "sha256~token")
+	if err != nil {
+		t.Fatalf("seal error: %v", err)
+	}
+	writeCookieKeys(t, path, testCookieKey('b'))
+	if err := k.reload(); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if _, err := k.open("openshift-session-token", sealed); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("expected cookies of removed keys to be rejected, got %v", err)
+	}
+	if _, err := k.open("openshift-session-token", rotated); err != nil {
+		t.Errorf("expected cookies of the new key to be accepted, got %v", err)
+	}
+
+	// Invalid key files keep the current keys.
+	writeCookieKeys(t, path, "not base64!")
+	if err := k.reload(); err == nil {
+		t.Error("expected an error for invalid keys")
+	}
+	if _, err := k.open("openshift-session-token", rotated); err != nil {
+		t.Errorf("expected the current keys to be kept, got %v", err)
+	}
+}
+
+func TestCookieKeyringInvalidKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	for _, keys := range []string{
+		"",
+		base64.StdEncoding.EncodeToString([]byte("short")),
+		"not base64!",
+	} {
+		writeCookieKeys(t, path, keys)
+		if _, err := NewCookieKeyring(path, true); err == nil {
+			t.Errorf("expected keys %q to be rejected", keys)
+		}
+	}
+}
+
+func TestOpenShiftCookieEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	writeCookieKeys(t, path, testCookieKey('a'))
+	k, err := NewCookieKeyring(path, true)
+	if err != nil {
+		t.Fatalf("NewCookieKeyring error: %v", err)
+	}
+	o := &openShiftAuth{cookiePath: "/", clusterName: serverutils.LocalClusterName, cookieKeyring: k}
+
+	rr := httptest.NewRecorder()
+	if _, err := o.login(rr, &oauth2.Token{AccessToken: "sha256~token", Expiry: time.Now().Add(time.Hour)}, ""); err != nil {
+		t.Fatalf("login error: %v", err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value == "sha256~token" {
+		t.Fatalf("expected an encrypted session cookie, got %v", cookies)
+	}
+
+	getUser := func(value string) (*User, error) {
+		r := httptest.NewRequest("GET", "http://example.com/api/kubernetes/", nil)
+		r.AddCookie(&http.Cookie{Name: openshiftAccessTokenCookieName, Value: value})
+		return getOpenShiftUser(r, k)
+	}
+	if user, err := getUser(cookies[0].Value); err != nil || user.Token != "sha256~token" {
+		t.Errorf("expected the access token, got %v and error %v", user, err)
+	}
+	if user, err := getUser("sha256~legacy"); err != nil || user.Token != "sha256~legacy" {
+		t.Errorf("expected legacy plaintext cookies to be accepted, got %v and error %v", user, err)
+	}
+	if _, err := getUser(encryptedCookiePrefix + "00000000.AAAA"); err == nil {
+		t.Error("expected cookies of other consoles to be rejected")
+	}
+}
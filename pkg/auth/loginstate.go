@@ -3,9 +3,14 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 )
 
+// Refreshable sessions are kept this long after their ID token expired, so that users returning after a
+// break don't have to log in again while their refresh token is still valid.
+const refreshableSessionGracePeriod = 24 * time.Hour
+
 // loginState represents the current login state of a user.
 // None of the serializable fields contain any sensitive information,
 // and should be safe to send as a non-http-only cookie.
@@ -17,6 +22,15 @@ type loginState struct {
 	now          nowFunc
 	sessionToken string
 	rawToken     string
+	// createdAt is when the user logged in, refreshing the session doesn't change it.
+	createdAt time.Time
+	// providerSessionID is the sid claim, which identifies the session at the provider for back-channel
+	// logouts. Like createdAt, it never changes.
+	providerSessionID string
+	// refreshToken is only kept server-side, and is empty if the provider didn't issue one.
+	refreshToken string
+	// mux guards the token fields, which change when the session is refreshed.
+	mux sync.Mutex
 }
 
 type LoginJSON struct {
@@ -38,6 +52,7 @@ func newLoginState(rawToken string, claims []byte) (*loginState, error) {
 		Expiry  jsonTime `json:"exp"`
 		Email   string   `json:"email"`
 		Name    string   `json:"name"`
+		Session string   `json:"sid"`
 	}
 
 	if err := json.Unmarshal(claims, &c); err != nil {
@@ -52,9 +67,20 @@ func newLoginState(rawToken string, claims []byte) (*loginState, error) {
 	ls.Email = c.Email
 	ls.exp = time.Time(c.Expiry)
 	ls.Name = c.Name
+	ls.providerSessionID = c.Session
+	ls.createdAt = ls.now()
 	return ls, nil
 }
 
+// sessionExpiry returns when the session expires. The caller must hold the lock once the session is
+// shared.
+func (ls *loginState) sessionExpiry() time.Time {
+	if ls.refreshToken != "" {
+		return ls.exp.Add(refreshableSessionGracePeriod)
+	}
+	return ls.exp
+}
+
 func (ls *loginState) toLoginJSON() LoginJSON {
 	return LoginJSON{
 		UserID: ls.UserID,
@@ -1,96 +1,347 @@
 package auth
 
 import (
+	"container/heap"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 )
 
-const openshiftAccessTokenCookieName = "openshift-session-token"
+const (
+	openshiftAccessTokenCookieName = "openshift-session-token"
+
+	// DefaultMaxSessions is the number of OIDC sessions kept before sessions are pruned.
+	DefaultMaxSessions = 32768
+
+	sessionPruneInterval = time.Minute
+
+	consoleAuthSessionsMetric     = "console_auth_sessions"
+	consoleAuthSessionUsersMetric = "console_auth_session_users"
+	consoleAuthClusterLabel       = "cluster"
+)
+
+var (
+	consoleAuthSessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: consoleAuthSessionsMetric,
+			Help: "Number of active OIDC sessions as of the last pruning, by cluster.",
+		},
+		[]string{consoleAuthClusterLabel},
+	)
+	consoleAuthSessionUsers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: consoleAuthSessionUsersMetric,
+			Help: "Number of users with active OIDC sessions as of the last pruning, by cluster.",
+		},
+		[]string{consoleAuthClusterLabel},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(consoleAuthSessions)
+	prometheus.MustRegister(consoleAuthSessionUsers)
+}
+
+// SessionLimits configures which sessions are pruned.
+type SessionLimits struct {
+	// MaxSessions is the number of sessions kept. Users with the most sessions lose their oldest ones
+	// first, so that a single user can't log out everyone else.
+	MaxSessions int
+	// MaxSessionsPerUser is the number of sessions kept per user, logging in again logs out the oldest
+	// session of the user. Zero disables the limit.
+	MaxSessionsPerUser int
+	// MaxAge limits how long sessions last including refreshes. Zero disables the limit.
+	MaxAge time.Duration
+}
+
+// SessionStore keeps the login state of OIDC sessions by session token. Sessions are pruned in the
+// background, after they expired or once there are too many of them.
+type SessionStore interface {
+	// addSession sets sessionToken to a random value and stores the login state.
+	addSession(ls *loginState) error
+	// getSession returns nil if the session doesn't exist or is older than the maximum session age.
+	getSession(token string) *loginState
+	// updateSession stores the tokens of a refreshed session. The caller must hold the session lock.
+	updateSession(ls *loginState) error
+	// syncSession reloads the tokens of a session that might have been refreshed by another replica.
+	// The caller must hold the session lock.
+	syncSession(ls *loginState) error
+	deleteSession(token string) error
+	// deleteUserSessions deletes all sessions of a user and returns how many were deleted.
+	deleteUserSessions(userID string) (int, error)
+	// deleteProviderSessions deletes the sessions with the given provider session ID, only among the
+	// sessions of userID if it is set, and returns how many were deleted.
+	deleteProviderSessions(userID, sid string) (int, error)
+	// pruneSessions returns the number of remaining sessions and users.
+	pruneSessions() (sessions int, users int, err error)
+}
+
+// sessionExpiry returns when a session expires, which is at most maxAge after login if maxAge is set.
+// The caller must hold the session lock once the session is shared.
+func sessionExpiry(ls *loginState, maxAge time.Duration) time.Time {
+	exp := ls.sessionExpiry()
+	if maxAge > 0 && ls.createdAt.Add(maxAge).Before(exp) {
+		return ls.createdAt.Add(maxAge)
+	}
+	return exp
+}
+
+// exceedsMaxAge is safe to call without the session lock, since createdAt never changes.
+func exceedsMaxAge(ls *loginState, maxAge time.Duration, now time.Time) bool {
+	return maxAge > 0 && now.Sub(ls.createdAt) > maxAge
+}
+
+// prunableSession identifies a session by its token or by the name of its Secret.
+type prunableSession struct {
+	key    string
+	userID string
+	exp    time.Time
+	// sid is the provider session ID, which is only needed for back-channel logouts.
+	sid string
+}
+
+// selectPrunedSessions returns the sessions to prune, and the number of remaining sessions and users.
+// Sessions must be ordered from oldest to newest. Expired sessions are pruned first, then the oldest
+// sessions of users over the per-user limit, and then the oldest sessions of the users with the most
+// sessions until there are at most MaxSessions.
+func selectPrunedSessions(sessions []prunableSession, limits SessionLimits, now time.Time) (map[string]bool, int, int) {
+	prune := make(map[string]bool)
+	// Indexes into sessions, from oldest to newest.
+	byUser := make(map[string][]int)
+	for i, s := range sessions {
+		if s.exp.Sub(now) < 0 {
+			prune[s.key] = true
+			continue
+		}
+		byUser[s.userID] = append(byUser[s.userID], i)
+	}
+	if len(prune) > 0 {
+		klog.V(4).Infof("Pruning %v expired sessions.", len(prune))
+	}
+
+	remaining := len(sessions) - len(prune)
+	if limits.MaxSessionsPerUser > 0 {
+		for userID, indexes := range byUser {
+			if toRemove := len(indexes) - limits.MaxSessionsPerUser; toRemove > 0 {
+				klog.V(4).Infof("Pruning oldest %v sessions of user %q.", toRemove, userID)
+				for _, i := range indexes[:toRemove] {
+					prune[sessions[i].key] = true
+				}
+				byUser[userID] = indexes[toRemove:]
+				remaining -= toRemove
+			}
+		}
+	}
+
+	if remaining > limits.MaxSessions {
+		klog.V(4).Infof("Still too many sessions. Pruning %v sessions of the users with the most sessions...", remaining-limits.MaxSessions)
+	}
+	users := make(userSessionsHeap, 0, len(byUser))
+	for _, indexes := range byUser {
+		users = append(users, &userSessions{indexes: indexes})
+	}
+	heap.Init(&users)
+	for ; remaining > limits.MaxSessions; remaining-- {
+		// Prune the oldest session of the user with the most sessions.
+		user := users[0]
+		prune[sessions[user.indexes[0]].key] = true
+		if user.indexes = user.indexes[1:]; len(user.indexes) == 0 {
+			heap.Pop(&users)
+		} else {
+			heap.Fix(&users, 0)
+		}
+	}
+	return prune, remaining, len(users)
+}
+
+// userSessions holds the indexes of a user's sessions, from oldest to newest.
+type userSessions struct {
+	indexes []int
+}
+
+// userSessionsHeap orders users by their number of sessions, and then by their oldest session.
+type userSessionsHeap []*userSessions
+
+func (h userSessionsHeap) Len() int { return len(h) }
+func (h userSessionsHeap) Less(i, j int) bool {
+	if len(h[i].indexes) != len(h[j].indexes) {
+		return len(h[i].indexes) > len(h[j].indexes)
+	}
+	return h[i].indexes[0] < h[j].indexes[0]
+}
+func (h userSessionsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *userSessionsHeap) Push(x interface{}) { *h = append(*h, x.(*userSessions)) }
+func (h *userSessionsHeap) Pop() interface{} {
+	old := *h
+	user := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return user
+}
 
 type oldSession struct {
-	token string
-	exp   time.Time
+	token  string
+	userID string
+	exp    time.Time
 }
 
-type SessionStore struct {
-	byToken     map[string]*loginState
-	byAge       []oldSession
-	maxSessions int
-	now         nowFunc
-	mux         sync.Mutex
+// MemorySessionStore keeps sessions in memory. Sessions are lost on restart, and running more than one
+// replica requires routing each user to the same replica.
+type MemorySessionStore struct {
+	byToken map[string]*loginState
+	byAge   []oldSession
+	// byUser holds the session tokens of each user, from oldest to newest.
+	byUser map[string][]string
+	limits SessionLimits
+	now    nowFunc
+	mux    sync.Mutex
 }
 
-func NewSessionStore(maxSessions int) *SessionStore {
-	return &SessionStore{
-		byToken:     make(map[string]*loginState),
-		maxSessions: maxSessions,
-		now:         defaultNow,
+// NewMemorySessionStore returns an in-memory session store.
+func NewMemorySessionStore(limits SessionLimits) *MemorySessionStore {
+	return &MemorySessionStore{
+		byToken: make(map[string]*loginState),
+		byUser:  make(map[string][]string),
+		limits:  limits,
+		now:     defaultNow,
 	}
 }
 
-// addSession sets sessionToken to a random value and adds loginState to session data structures
-func (ss *SessionStore) addSession(ls *loginState) error {
+func (ss *MemorySessionStore) addSession(ls *loginState) error {
 	sessionToken := randomString(128)
-	if ss.byToken[sessionToken] != nil {
+	if ss.getSession(sessionToken) != nil {
 		ss.deleteSession(sessionToken)
 		return fmt.Errorf("Session token collision! THIS SHOULD NEVER HAPPEN! Token: %s", sessionToken)
 	}
 	ls.sessionToken = sessionToken
+	exp := sessionExpiry(ls, ss.limits.MaxAge)
 	ss.mux.Lock()
+	defer ss.mux.Unlock()
 	ss.byToken[sessionToken] = ls
 	// Assume token expiration is always the same time in the future. Should be close enough for government work.
-	ss.byAge = append(ss.byAge, oldSession{sessionToken, ls.exp})
-	ss.mux.Unlock()
+	ss.byAge = append(ss.byAge, oldSession{sessionToken, ls.UserID, exp})
+	ss.byUser[ls.UserID] = append(ss.byUser[ls.UserID], sessionToken)
+	if tokens := ss.byUser[ls.UserID]; ss.limits.MaxSessionsPerUser > 0 && len(tokens) > ss.limits.MaxSessionsPerUser {
+		evicted := tokens[:len(tokens)-ss.limits.MaxSessionsPerUser]
+		klog.V(4).Infof("User %q has too many sessions, deleting the oldest %v sessions.", ls.UserID, len(evicted))
+		ss.removeSessions(toSet(evicted))
+	}
 	return nil
 }
 
-func (ss *SessionStore) getSession(token string) *loginState {
+func toSet(tokens []string) map[string]bool {
+	set := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		set[token] = true
+	}
+	return set
+}
+
+// removeSessions must be called with the store lock held.
+func (ss *MemorySessionStore) removeSessions(tokens map[string]bool) {
+	remaining := make([]oldSession, 0, len(ss.byAge))
+	for _, s := range ss.byAge {
+		if !tokens[s.token] {
+			remaining = append(remaining, s)
+			continue
+		}
+		delete(ss.byToken, s.token)
+		userTokens := ss.byUser[s.userID]
+		for i, token := range userTokens {
+			if token == s.token {
+				userTokens = append(userTokens[:i:i], userTokens[i+1:]...)
+				break
+			}
+		}
+		if len(userTokens) == 0 {
+			delete(ss.byUser, s.userID)
+		} else {
+			ss.byUser[s.userID] = userTokens
+		}
+	}
+	ss.byAge = remaining
+}
+
+func (ss *MemorySessionStore) getSession(token string) *loginState {
 	ss.mux.Lock()
-	defer ss.mux.Unlock()
-	return ss.byToken[token]
+	ls := ss.byToken[token]
+	ss.mux.Unlock()
+	if ls == nil || exceedsMaxAge(ls, ss.limits.MaxAge, ss.now()) {
+		return nil
+	}
+	return ls
 }
 
-func (ss *SessionStore) deleteSession(token string) error {
+func (ss *MemorySessionStore) updateSession(ls *loginState) error {
+	exp := sessionExpiry(ls, ss.limits.MaxAge)
 	ss.mux.Lock()
 	defer ss.mux.Unlock()
-	delete(ss.byToken, token)
-	for i := 0; i < len(ss.byAge); i++ {
-		s := ss.byAge[i]
-		if s.token == token {
-			ss.byAge = append(ss.byAge[:i], ss.byAge[i+1:]...)
+	for i := range ss.byAge {
+		if ss.byAge[i].token == ls.sessionToken {
+			ss.byAge[i].exp = exp
 			return nil
 		}
 	}
-	klog.Errorf("ss.byAge did not contain session %v", token)
-	return fmt.Errorf("ss.byAge did not contain session %v", token)
+	return fmt.Errorf("ss.byAge did not contain session %v", ls.sessionToken)
+}
+
+// syncSession does nothing, sessions in memory are only refreshed by this replica.
+func (ss *MemorySessionStore) syncSession(ls *loginState) error {
+	return nil
 }
 
-func (ss *SessionStore) pruneSessions() {
+func (ss *MemorySessionStore) deleteSession(token string) error {
 	ss.mux.Lock()
 	defer ss.mux.Unlock()
-	expired := 0
-	for i := 0; i < len(ss.byAge); i++ {
-		s := ss.byAge[i]
-		if s.exp.Sub(ss.now()) < 0 {
-			delete(ss.byToken, s.token)
-			ss.byAge = append(ss.byAge[:i], ss.byAge[i+1:]...)
-			expired++
-		}
+	if ss.byToken[token] == nil {
+		klog.Errorf("ss.byToken did not contain session %v", token)
+		return fmt.Errorf("ss.byToken did not contain session %v", token)
 	}
-	klog.V(4).Infof("Pruned %v expired sessions.", expired)
-	toRemove := len(ss.byAge) - ss.maxSessions
-	if toRemove > 0 {
-		klog.V(4).Infof("Still too many sessions. Pruning oldest %v sessions...", toRemove)
-		// TODO: account for user ids when pruning old sessions. Otherwise one user could log in 16k times and boot out everyone else.
-		for _, s := range ss.byAge[:toRemove] {
-			delete(ss.byToken, s.token)
+	ss.removeSessions(map[string]bool{token: true})
+	return nil
+}
+
+func (ss *MemorySessionStore) deleteUserSessions(userID string) (int, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	tokens := ss.byUser[userID]
+	ss.removeSessions(toSet(tokens))
+	return len(tokens), nil
+}
+
+func (ss *MemorySessionStore) deleteProviderSessions(userID, sid string) (int, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	tokens := make(map[string]bool)
+	for _, s := range ss.byAge {
+		if (userID == "" || s.userID == userID) && ss.byToken[s.token].providerSessionID == sid {
+			tokens[s.token] = true
 		}
-		ss.byAge = ss.byAge[toRemove:]
 	}
-	if expired+toRemove > 0 {
-		klog.V(4).Infof("Pruned %v old sessions.", expired+toRemove)
+	ss.removeSessions(tokens)
+	return len(tokens), nil
+}
+
+func (ss *MemorySessionStore) pruneSessions() (int, int, error) {
+	// Select the sessions to prune from a copy, so that logins and requests aren't blocked while
+	// checking every session.
+	ss.mux.Lock()
+	sessions := make([]prunableSession, len(ss.byAge))
+	for i, s := range ss.byAge {
+		sessions[i] = prunableSession{key: s.token, userID: s.userID, exp: s.exp}
 	}
+	ss.mux.Unlock()
+
+	prune, remaining, users := selectPrunedSessions(sessions, ss.limits, ss.now())
+	if len(prune) == 0 {
+		return remaining, users, nil
+	}
+	ss.mux.Lock()
+	ss.removeSessions(prune)
+	// Sessions added in the meantime are counted with the next pruning.
+	ss.mux.Unlock()
+	klog.V(4).Infof("Pruned %v old sessions.", len(prune))
+	return remaining, users, nil
 }
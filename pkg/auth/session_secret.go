@@ -0,0 +1,487 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	sessionSecretPrefix = "console-session-"
+	sessionSecretKey    = "session"
+	// sessionClusterLabel keeps the sessions of the authenticators of managed clusters apart.
+	sessionClusterLabel = "console.openshift.io/session-cluster"
+	// sessionUserLabel holds a hash of the user ID, which isn't necessarily a valid label value.
+	sessionUserLabel = "console.openshift.io/session-user"
+
+	// Sessions are re-read from their Secret at most this often, so that refreshes by other replicas
+	// are picked up without reading the Secret on every request.
+	sessionSecretCacheTTL  = 10 * time.Second
+	sessionSecretTimeout   = 10 * time.Second
+	sessionSecretListLimit = 500
+	// Conflicting updates of a session are retried this many times.
+	sessionUpdateRetries = 3
+)
+
+// storedSession is the content of a session Secret.
+type storedSession struct {
+	UserID       string    `json:"userID"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Exp          time.Time `json:"exp"`
+	CreatedAt    time.Time `json:"createdAt"`
+	RawToken     string    `json:"rawToken"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	SessionID    string    `json:"sid,omitempty"`
+}
+
+type cachedSession struct {
+	ls              *loginState
+	resourceVersion string
+	fetched         time.Time
+}
+
+// SecretSessionStore keeps every session in a Secret, so that sessions survive restarts and are shared by
+// all replicas. Sessions used by this replica are cached for a few seconds.
+type SecretSessionStore struct {
+	secrets     corev1client.SecretInterface
+	clusterName string
+	limits      SessionLimits
+	now         nowFunc
+	// mux guards the cache. When both are needed, the session lock is taken first.
+	mux   sync.Mutex
+	cache map[string]*cachedSession
+}
+
+// NewSecretSessionStore returns a session store that keeps sessions of the given cluster in Secrets.
+func NewSecretSessionStore(secrets corev1client.SecretInterface, clusterName string, limits SessionLimits) *SecretSessionStore {
+	return &SecretSessionStore{
+		secrets:     secrets,
+		clusterName: clusterName,
+		limits:      limits,
+		now:         defaultNow,
+		cache:       make(map[string]*cachedSession),
+	}
+}
+
+// sessionSecretName hashes the session token, which would otherwise show up in audit logs and events.
+func sessionSecretName(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return sessionSecretPrefix + hex.EncodeToString(sum[:])
+}
+
+func sessionUserLabelValue(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (ss *SecretSessionStore) labels(userID string) map[string]string {
+	return map[string]string{
+		sessionClusterLabel: ss.clusterName,
+		sessionUserLabel:    sessionUserLabelValue(userID),
+	}
+}
+
+func (ss *SecretSessionStore) selector(userID string) string {
+	selector := sessionClusterLabel + "=" + ss.clusterName
+	if userID != "" {
+		selector += "," + sessionUserLabel + "=" + sessionUserLabelValue(userID)
+	}
+	return selector
+}
+
+// encodeSession must be called with the session lock held once the session is shared.
+func encodeSession(ls *loginState) ([]byte, error) {
+	return json.Marshal(storedSession{
+		UserID:       ls.UserID,
+		Name:         ls.Name,
+		Email:        ls.Email,
+		Exp:          ls.exp,
+		CreatedAt:    ls.createdAt,
+		RawToken:     ls.rawToken,
+		RefreshToken: ls.refreshToken,
+		SessionID:    ls.providerSessionID,
+	})
+}
+
+func decodeSession(secret *corev1.Secret) (*storedSession, error) {
+	var s storedSession
+	if err := json.Unmarshal(secret.Data[sessionSecretKey], &s); err != nil {
+		return nil, fmt.Errorf("failed to decode session Secret %q: %v", secret.Name, err)
+	}
+	return &s, nil
+}
+
+// apply copies the stored fields that change when refreshing to the login state. The caller must hold
+// the session lock once the session is shared.
+func (s *storedSession) apply(ls *loginState) {
+	ls.Name = s.Name
+	ls.Email = s.Email
+	ls.exp = s.Exp
+	ls.rawToken = s.RawToken
+	ls.refreshToken = s.RefreshToken
+}
+
+func (ss *SecretSessionStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), sessionSecretTimeout)
+}
+
+func (ss *SecretSessionStore) addSession(ls *loginState) error {
+	data, err := encodeSession(ls)
+	if err != nil {
+		return err
+	}
+	sessionToken := randomString(128)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   sessionSecretName(sessionToken),
+			Labels: ss.labels(ls.UserID),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{sessionSecretKey: data},
+	}
+	ctx, cancel := ss.context()
+	defer cancel()
+	created, err := ss.secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("Session token collision! THIS SHOULD NEVER HAPPEN! Token: %s", sessionToken)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store session: %v", err)
+	}
+
+	ls.sessionToken = sessionToken
+	ss.mux.Lock()
+	ss.cache[sessionToken] = &cachedSession{ls: ls, resourceVersion: created.ResourceVersion, fetched: ss.now()}
+	ss.mux.Unlock()
+
+	if ss.limits.MaxSessionsPerUser > 0 {
+		ss.pruneUserSessions(ctx, ls.UserID)
+	}
+	return nil
+}
+
+// pruneUserSessions deletes the oldest sessions of a user over the per-user limit.
+func (ss *SecretSessionStore) pruneUserSessions(ctx context.Context, userID string) {
+	sessions, err := ss.listSessions(ctx, userID)
+	if err != nil {
+		klog.Errorf("Failed to list sessions of user %q: %v", userID, err)
+		return
+	}
+	if toRemove := len(sessions) - ss.limits.MaxSessionsPerUser; toRemove > 0 {
+		klog.V(4).Infof("User %q has too many sessions, deleting the oldest %v sessions.", userID, toRemove)
+		for _, s := range sessions[:toRemove] {
+			ss.deleteSecret(ctx, s.key)
+		}
+	}
+}
+
+func (ss *SecretSessionStore) getSession(token string) *loginState {
+	ss.mux.Lock()
+	cached := ss.cache[token]
+	var resourceVersion string
+	if cached != nil {
+		resourceVersion = cached.resourceVersion
+		if ss.now().Sub(cached.fetched) < sessionSecretCacheTTL {
+			ss.mux.Unlock()
+			return ss.checkMaxAge(cached.ls)
+		}
+	}
+	ss.mux.Unlock()
+
+	ctx, cancel := ss.context()
+	defer cancel()
+	secret, err := ss.secrets.Get(ctx, sessionSecretName(token), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && secret.Labels[sessionClusterLabel] != ss.clusterName) {
+		ss.forget(token)
+		return nil
+	}
+	if err != nil {
+		klog.Errorf("Failed to get session: %v", err)
+		// Keep using the cached session while the API server is unavailable.
+		if cached != nil {
+			return ss.checkMaxAge(cached.ls)
+		}
+		return nil
+	}
+	stored, err := decodeSession(secret)
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+
+	if cached == nil {
+		ls := &loginState{now: ss.now, sessionToken: token, UserID: stored.UserID, createdAt: stored.CreatedAt, providerSessionID: stored.SessionID}
+		stored.apply(ls)
+		ss.mux.Lock()
+		// Concurrent requests of the session must share its login state, so that it is refreshed once.
+		if c := ss.cache[token]; c != nil {
+			cached = c
+		} else {
+			ss.cache[token] = &cachedSession{ls: ls, resourceVersion: secret.ResourceVersion, fetched: ss.now()}
+		}
+		ss.mux.Unlock()
+		if cached == nil {
+			return ss.checkMaxAge(ls)
+		}
+	}
+
+	cached.ls.mux.Lock()
+	ss.mux.Lock()
+	// Skip the update if this replica changed the session since it was read.
+	if cached.resourceVersion == resourceVersion {
+		if secret.ResourceVersion != resourceVersion {
+			stored.apply(cached.ls)
+			cached.resourceVersion = secret.ResourceVersion
+		}
+		cached.fetched = ss.now()
+	}
+	ss.mux.Unlock()
+	cached.ls.mux.Unlock()
+	return ss.checkMaxAge(cached.ls)
+}
+
+func (ss *SecretSessionStore) checkMaxAge(ls *loginState) *loginState {
+	if exceedsMaxAge(ls, ss.limits.MaxAge, ss.now()) {
+		return nil
+	}
+	return ls
+}
+
+func (ss *SecretSessionStore) forget(token string) {
+	ss.mux.Lock()
+	delete(ss.cache, token)
+	ss.mux.Unlock()
+}
+
+func (ss *SecretSessionStore) updateSession(ls *loginState) error {
+	data, err := encodeSession(ls)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := ss.context()
+	defer cancel()
+	ss.mux.Lock()
+	var resourceVersion string
+	if cached := ss.cache[ls.sessionToken]; cached != nil {
+		resourceVersion = cached.resourceVersion
+	}
+	ss.mux.Unlock()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sessionSecretName(ls.sessionToken),
+			Labels:          ss.labels(ls.UserID),
+			ResourceVersion: resourceVersion,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{sessionSecretKey: data},
+	}
+	updated, err := ss.secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	for attempt := 0; apierrors.IsConflict(err) && attempt < sessionUpdateRetries; attempt++ {
+		// Another replica refreshed the session at the same time. Keep the stored session if it expires
+		// later, so that a slower refresh doesn't replace newer tokens.
+		var current *corev1.Secret
+		if current, err = ss.secrets.Get(ctx, secret.Name, metav1.GetOptions{}); err != nil {
+			break
+		}
+		if stored, decodeErr := decodeSession(current); decodeErr == nil && !stored.Exp.Before(ls.exp) {
+			stored.apply(ls)
+			updated = current
+			break
+		}
+		secret.ResourceVersion = current.ResourceVersion
+		updated, err = ss.secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store refreshed session: %v", err)
+	}
+
+	ss.mux.Lock()
+	if cached := ss.cache[ls.sessionToken]; cached != nil {
+		cached.resourceVersion = updated.ResourceVersion
+		cached.fetched = ss.now()
+	}
+	ss.mux.Unlock()
+	return nil
+}
+
+func (ss *SecretSessionStore) syncSession(ls *loginState) error {
+	ctx, cancel := ss.context()
+	defer cancel()
+	secret, err := ss.secrets.Get(ctx, sessionSecretName(ls.sessionToken), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	stored, err := decodeSession(secret)
+	if err != nil {
+		return err
+	}
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	cached := ss.cache[ls.sessionToken]
+	if cached == nil || cached.ls != ls {
+		return fmt.Errorf("session is not cached")
+	}
+	if cached.resourceVersion != secret.ResourceVersion {
+		stored.apply(ls)
+		cached.resourceVersion = secret.ResourceVersion
+	}
+	cached.fetched = ss.now()
+	return nil
+}
+
+func (ss *SecretSessionStore) deleteSession(token string) error {
+	ss.forget(token)
+	ctx, cancel := ss.context()
+	defer cancel()
+	return ss.deleteSecret(ctx, sessionSecretName(token))
+}
+
+func (ss *SecretSessionStore) deleteSecret(ctx context.Context, name string) error {
+	if err := ss.secrets.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		klog.Errorf("Failed to delete session Secret %q: %v", name, err)
+		return err
+	}
+	return nil
+}
+
+func (ss *SecretSessionStore) deleteUserSessions(userID string) (int, error) {
+	ctx, cancel := ss.context()
+	defer cancel()
+	sessions, err := ss.listSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		if err := ss.deleteSecret(ctx, s.key); err != nil {
+			return 0, err
+		}
+	}
+
+	// Other replicas drop their cached sessions once the cache expires.
+	ss.mux.Lock()
+	for token, cached := range ss.cache {
+		if cached.ls.UserID == userID {
+			delete(ss.cache, token)
+		}
+	}
+	ss.mux.Unlock()
+	return len(sessions), nil
+}
+
+func (ss *SecretSessionStore) deleteProviderSessions(userID, sid string) (int, error) {
+	ctx, cancel := ss.context()
+	defer cancel()
+	sessions, err := ss.listSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, s := range sessions {
+		if s.sid != sid {
+			continue
+		}
+		if err := ss.deleteSecret(ctx, s.key); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+
+	ss.mux.Lock()
+	for token, cached := range ss.cache {
+		if cached.ls.providerSessionID == sid && (userID == "" || cached.ls.UserID == userID) {
+			delete(ss.cache, token)
+		}
+	}
+	ss.mux.Unlock()
+	return deleted, nil
+}
+
+// listSessions returns the sessions of the cluster, or of a single user if userID is set, ordered from
+// oldest to newest. Sessions that can't be decoded are returned as expired.
+func (ss *SecretSessionStore) listSessions(ctx context.Context, userID string) ([]prunableSession, error) {
+	type session struct {
+		prunableSession
+		createdAt time.Time
+	}
+	var sessions []session
+	opts := metav1.ListOptions{
+		LabelSelector: ss.selector(userID),
+		Limit:         sessionSecretListLimit,
+	}
+	for {
+		secrets, err := ss.secrets.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range secrets.Items {
+			secret := &secrets.Items[i]
+			stored, err := decodeSession(secret)
+			if err != nil {
+				klog.Error(err)
+				sessions = append(sessions, session{prunableSession: prunableSession{key: secret.Name}})
+				continue
+			}
+			ls := &loginState{exp: stored.Exp, createdAt: stored.CreatedAt, refreshToken: stored.RefreshToken}
+			sessions = append(sessions, session{
+				prunableSession: prunableSession{key: secret.Name, userID: stored.UserID, exp: sessionExpiry(ls, ss.limits.MaxAge), sid: stored.SessionID},
+				createdAt:       stored.CreatedAt,
+			})
+		}
+		if secrets.Continue == "" {
+			break
+		}
+		opts.Continue = secrets.Continue
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].createdAt.Before(sessions[j].createdAt)
+	})
+	result := make([]prunableSession, len(sessions))
+	for i, s := range sessions {
+		result[i] = s.prunableSession
+	}
+	return result, nil
+}
+
+// pruneSessions deletes the Secrets of the sessions to prune. All replicas prune sessions, deleting a
+// Secret twice is harmless.
+func (ss *SecretSessionStore) pruneSessions() (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionPruneInterval)
+	defer cancel()
+	now := ss.now()
+	sessions, err := ss.listSessions(ctx, "")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	prune, remaining, users := selectPrunedSessions(sessions, ss.limits, now)
+	for name := range prune {
+		ss.deleteSecret(ctx, name)
+	}
+
+	// Drop sessions that weren't used recently from the cache.
+	ss.mux.Lock()
+	for token, cached := range ss.cache {
+		if now.Sub(cached.fetched) > sessionPruneInterval {
+			delete(ss.cache, token)
+		}
+	}
+	ss.mux.Unlock()
+	if len(prune) > 0 {
+		klog.V(4).Infof("Pruned %v old sessions.", len(prune))
+	}
+	return remaining, users, nil
+}
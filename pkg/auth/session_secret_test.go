@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeSecrets returns a Secret client that sets resource versions like the API server.
+func newFakeSecrets() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	version := 0
+	setResourceVersion := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		version++
+		obj := action.(interface{ GetObject() runtime.Object }).GetObject().(metav1.Object)
+		obj.SetResourceVersion(strconv.Itoa(version))
+		return false, nil, nil
+	}
+	client.PrependReactor("create", "secrets", setResourceVersion)
+	client.PrependReactor("update", "secrets", setResourceVersion)
+	// Reject updates of outdated resource versions, which is checked before setting the new one.
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		update := action.(k8stesting.UpdateAction)
+		obj := update.GetObject().(metav1.Object)
+		current, err := client.Tracker().Get(update.GetResource(), update.GetNamespace(), obj.GetName())
+		if err == nil && obj.GetResourceVersion() != "" && obj.GetResourceVersion() != current.(metav1.Object).GetResourceVersion() {
+			return true, nil, apierrors.NewConflict(update.GetResource().GroupResource(), obj.GetName(), fmt.Errorf("outdated resource version"))
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+func newTestLoginState(t *testing.T, user string, exp time.Time) *loginState {
+	ls, err := newLoginState("raw-"+user, []byte(fmt.Sprintf(`{"sub": %q, "exp": %d}`, user, exp.Unix())))
+	if err != nil {
+		t.Fatalf("newLoginState error: %v", err)
+	}
+	return ls
+}
+
+func TestSecretSessionStore(t *testing.T) {
+	client := newFakeSecrets()
+	now := time.Now()
+	replica1 := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 10})
+	replica2 := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 10})
+	replica1.now = func() time.Time { return now }
+	replica2.now = func() time.Time { return now }
+	otherCluster := NewSecretSessionStore(client.CoreV1().Secrets("console"), "managed-cluster", SessionLimits{MaxSessions: 10})
+
+	ls := newTestLoginState(t, "user", now.Add(time.Hour))
+	ls.refreshToken = "refresh-1"
+	if err := replica1.addSession(ls); err != nil {
+		t.Fatalf("addSession error: %v", err)
+	}
+	shared := replica2.getSession(ls.sessionToken)
+	if shared == nil || shared.UserID != "user" || shared.rawToken != "raw-user" || shared.refreshToken != "refresh-1" {
+		t.Fatalf("expected the session to be shared, got %+v", shared)
+	}
+	if replica2.getSession(ls.sessionToken) != shared {
+		t.Errorf("expected requests of the session to share the login state")
+	}
+	if otherCluster.getSession(ls.sessionToken) != nil {
+		t.Errorf("expected sessions of other clusters to be ignored")
+	}
+
+	// Refreshes are picked up by other replicas once their cache expires, or when syncing the session.
+	ls.mux.Lock()
+	ls.rawToken = "refreshed"
+	ls.refreshToken = "refresh-2"
+	if err := replica1.updateSession(ls); err != nil {
+		t.Fatalf("updateSession error: %v", err)
+	}
+	ls.mux.Unlock()
+	if shared := replica2.getSession(ls.sessionToken); shared.rawToken != "raw-user" {
+		t.Errorf("expected the cached session, got token %q", shared.rawToken)
+	}
+	now = now.Add(sessionSecretCacheTTL)
+	if shared := replica2.getSession(ls.sessionToken); shared.rawToken != "refreshed" || shared.refreshToken != "refresh-2" {
+		t.Errorf("expected the refreshed session, got tokens %q and %q", shared.rawToken, shared.refreshToken)
+	}
+
+	ls.mux.Lock()
+	ls.refreshToken = "refresh-3"
+	if err := replica1.updateSession(ls); err != nil {
+		t.Fatalf("updateSession error: %v", err)
+	}
+	ls.mux.Unlock()
+	shared.mux.Lock()
+	if err := replica2.syncSession(shared); err != nil {
+		t.Errorf("syncSession error: %v", err)
+	}
+	if shared.refreshToken != "refresh-3" {
+		t.Errorf("expected the synced refresh token, got %q", shared.refreshToken)
+	}
+	shared.mux.Unlock()
+
+	if err := replica2.deleteSession(ls.sessionToken); err != nil {
+		t.Fatalf("deleteSession error: %v", err)
+	}
+	now = now.Add(sessionSecretCacheTTL)
+	if replica1.getSession(ls.sessionToken) != nil {
+		t.Errorf("expected the session to be deleted")
+	}
+}
+
+func TestSecretSessionStoreConcurrentRefresh(t *testing.T) {
+	client := newFakeSecrets()
+	now := time.Now()
+	replica1 := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 10})
+	replica2 := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 10})
+	replica2.now = func() time.Time { return now }
+
+	ls := newTestLoginState(t, "user", now.Add(time.Hour))
+	if err := replica1.addSession(ls); err != nil {
+		t.Fatalf("addSession error: %v", err)
+	}
+	shared := replica2.getSession(ls.sessionToken)
+
+	// Both replicas refresh the session, replica2 stores its refresh first.
+	shared.mux.Lock()
+	shared.rawToken = "newer"
+	shared.exp = now.Add(3 * time.Hour)
+	if err := replica2.updateSession(shared); err != nil {
+		t.Fatalf("updateSession error: %v", err)
+	}
+	shared.mux.Unlock()
+	ls.mux.Lock()
+	ls.rawToken = "older"
+	ls.exp = now.Add(2 * time.Hour)
+	if err := replica1.updateSession(ls); err != nil {
+		t.Fatalf("updateSession error: %v", err)
+	}
+	if ls.rawToken != "newer" || !ls.exp.Equal(shared.exp) {
+		t.Errorf("expected the stored session that expires later, got token %q", ls.rawToken)
+	}
+
+	// Refreshes that expire later replace the stored session despite the conflict.
+	ls.rawToken = "newest"
+	ls.exp = now.Add(4 * time.Hour)
+	replica1.cache[ls.sessionToken].resourceVersion = "outdated"
+	if err := replica1.updateSession(ls); err != nil {
+		t.Fatalf("updateSession error: %v", err)
+	}
+	ls.mux.Unlock()
+	now = now.Add(sessionSecretCacheTTL)
+	if shared := replica2.getSession(ls.sessionToken); shared.rawToken != "newest" {
+		t.Errorf("expected the newest session to be stored, got token %q", shared.rawToken)
+	}
+}
+
+func TestSecretSessionStorePrune(t *testing.T) {
+	client := newFakeSecrets()
+	ss := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 2})
+	now := time.Now()
+	var tokens []string
+	for i, exp := range []time.Duration{-time.Hour, time.Hour, time.Hour, time.Hour} {
+		ls := newTestLoginState(t, fmt.Sprintf("user-%d", i), now.Add(exp))
+		ls.createdAt = now.Add(time.Duration(i) * time.Minute)
+		if err := ss.addSession(ls); err != nil {
+			t.Fatalf("addSession error: %v", err)
+		}
+		tokens = append(tokens, ls.sessionToken)
+	}
+
+	ss.pruneSessions()
+	secrets, err := client.CoreV1().Secrets("console").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(secrets.Items) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(secrets.Items))
+	}
+	for i, token := range tokens {
+		// The expired session and the oldest one are pruned.
+		kept := i >= 2
+		if _, err := client.CoreV1().Secrets("console").Get(context.Background(), sessionSecretName(token), metav1.GetOptions{}); (err == nil) != kept {
+			t.Errorf("session %d: expected kept == %v, got error %v", i, kept, err)
+		}
+	}
+}
+
+func TestSecretSessionStoreUserSessions(t *testing.T) {
+	client := newFakeSecrets()
+	ss := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 10, MaxSessionsPerUser: 2})
+	now := time.Now()
+	ss.now = func() time.Time { return now }
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		ls := newTestLoginState(t, "user", now.Add(time.Hour))
+		ls.createdAt = now.Add(time.Duration(i) * time.Minute)
+		if err := ss.addSession(ls); err != nil {
+			t.Fatalf("addSession error: %v", err)
+		}
+		tokens = append(tokens, ls.sessionToken)
+	}
+	addTestSessions(t, ss, "other", 1)
+
+	now = now.Add(sessionSecretCacheTTL)
+	if ss.getSession(tokens[0]) != nil {
+		t.Error("expected the oldest session of the user to be evicted")
+	}
+	n, err := ss.deleteUserSessions("user")
+	if err != nil {
+		t.Fatalf("deleteUserSessions error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 revoked sessions, got %d", n)
+	}
+	if ss.getSession(tokens[2]) != nil {
+		t.Error("expected the sessions of the user to be revoked")
+	}
+	sessions, users, err := ss.pruneSessions()
+	if err != nil {
+		t.Fatalf("pruneSessions error: %v", err)
+	}
+	if sessions != 1 || users != 1 {
+		t.Errorf("expected 1 session of 1 user, got %d sessions of %d users", sessions, users)
+	}
+}
+
+func TestSecretSessionStoreProviderSessions(t *testing.T) {
+	client := newFakeSecrets()
+	ss := NewSecretSessionStore(client.CoreV1().Secrets("console"), "local-cluster", SessionLimits{MaxSessions: 10})
+	now := time.Now()
+	ss.now = func() time.Time { return now }
+	var tokens []string
+	for _, sid := range []string{"sid-1", "sid-2"} {
+		ls := newTestLoginState(t, "user", now.Add(time.Hour))
+		ls.providerSessionID = sid
+		if err := ss.addSession(ls); err != nil {
+			t.Fatalf("addSession error: %v", err)
+		}
+		tokens = append(tokens, ls.sessionToken)
+	}
+
+	n, err := ss.deleteProviderSessions("", "sid-1")
+	if err != nil {
+		t.Fatalf("deleteProviderSessions error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 revoked session, got %d", n)
+	}
+	if ss.getSession(tokens[0]) != nil {
+		t.Error("expected the session of the provider session to be revoked")
+	}
+	if ls := ss.getSession(tokens[1]); ls == nil || ls.providerSessionID != "sid-2" {
+		t.Errorf("expected the other session to be kept, got %+v", ls)
+	}
+	if n, _ := ss.deleteProviderSessions("other", "sid-2"); n != 0 {
+		t.Errorf("expected sessions of other users to be kept, %d were revoked", n)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"time"
 )
 
-func checkSessions(t *testing.T, ss *SessionStore) {
+func checkSessions(t *testing.T, ss *MemorySessionStore) {
 	if len(ss.byAge) != len(ss.byToken) {
 		t.Fatalf("age: %v != token %v", len(ss.byAge), len(ss.byToken))
 	}
@@ -16,10 +16,22 @@ func checkSessions(t *testing.T, ss *SessionStore) {
 			t.Fatalf("ss.byAge %v not in ss.byToken", s.token)
 		}
 	}
+	byUser := 0
+	for userID, tokens := range ss.byUser {
+		for _, token := range tokens {
+			if ls := ss.byToken[token]; ls == nil || ls.UserID != userID {
+				t.Fatalf("ss.byUser %v of user %v not in ss.byToken", token, userID)
+			}
+		}
+		byUser += len(tokens)
+	}
+	if byUser != len(ss.byToken) {
+		t.Fatalf("user: %v != token %v", byUser, len(ss.byToken))
+	}
 }
 
 func TestSessions(t *testing.T) {
-	ss := NewSessionStore(3)
+	ss := NewMemorySessionStore(SessionLimits{MaxSessions: 3})
 	notExpired := time.Now().Add(time.Duration(3600) * time.Second)
 	expired := time.Now().Add(time.Duration(3600) * time.Second * -1)
 	fakeTokens := []struct {
@@ -73,3 +85,85 @@ func TestSessions(t *testing.T) {
 		t.Fatal("ss.byAge != 2")
 	}
 }
+
+func TestSessionMaxAge(t *testing.T) {
+	ss := NewMemorySessionStore(SessionLimits{MaxSessions: 3, MaxAge: time.Hour})
+	now := time.Now()
+	ss.now = func() time.Time { return now }
+	ls := newTestLoginState(t, "user", now.Add(2*time.Hour))
+	if err := ss.addSession(ls); err != nil {
+		t.Fatalf("addSession error: %v", err)
+	}
+	if ss.getSession(ls.sessionToken) != ls {
+		t.Fatal("expected the session")
+	}
+
+	now = now.Add(time.Hour + time.Minute)
+	if ss.getSession(ls.sessionToken) != nil {
+		t.Error("expected sessions older than the maximum age to be ignored")
+	}
+	ss.pruneSessions()
+	checkSessions(t, ss)
+	if len(ss.byAge) != 0 {
+		t.Errorf("expected sessions older than the maximum age to be pruned, got %d sessions", len(ss.byAge))
+	}
+}
+
+func addTestSessions(t *testing.T, ss SessionStore, user string, count int) []string {
+	var tokens []string
+	for i := 0; i < count; i++ {
+		ls := newTestLoginState(t, user, time.Now().Add(time.Hour))
+		if err := ss.addSession(ls); err != nil {
+			t.Fatalf("addSession error: %v", err)
+		}
+		tokens = append(tokens, ls.sessionToken)
+	}
+	return tokens
+}
+
+func TestSessionsPerUser(t *testing.T) {
+	ss := NewMemorySessionStore(SessionLimits{MaxSessions: 5, MaxSessionsPerUser: 2})
+	tokens := addTestSessions(t, ss, "user", 3)
+	checkSessions(t, ss)
+	if ss.getSession(tokens[0]) != nil {
+		t.Error("expected the oldest session of the user to be evicted")
+	}
+	if ss.getSession(tokens[1]) == nil || ss.getSession(tokens[2]) == nil {
+		t.Error("expected the newest sessions of the user to be kept")
+	}
+
+	addTestSessions(t, ss, "other", 2)
+	n, err := ss.deleteUserSessions("user")
+	if err != nil {
+		t.Fatalf("deleteUserSessions error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 revoked sessions, got %d", n)
+	}
+	checkSessions(t, ss)
+	if len(ss.byToken) != 2 || len(ss.byUser["other"]) != 2 {
+		t.Errorf("expected only the sessions of the other user to remain, got %v", ss.byUser)
+	}
+}
+
+func TestSessionsFairPruning(t *testing.T) {
+	ss := NewMemorySessionStore(SessionLimits{MaxSessions: 4})
+	first := addTestSessions(t, ss, "first", 1)
+	busy := addTestSessions(t, ss, "busy", 4)
+	last := addTestSessions(t, ss, "last", 1)
+
+	sessions, users, err := ss.pruneSessions()
+	if err != nil {
+		t.Fatalf("pruneSessions error: %v", err)
+	}
+	if sessions != 4 || users != 3 {
+		t.Errorf("expected 4 sessions of 3 users, got %d sessions of %d users", sessions, users)
+	}
+	checkSessions(t, ss)
+	if ss.getSession(first[0]) == nil || ss.getSession(last[0]) == nil {
+		t.Error("expected the sessions of other users to be kept")
+	}
+	if ss.getSession(busy[0]) != nil || ss.getSession(busy[1]) != nil {
+		t.Error("expected the oldest sessions of the user with the most sessions to be pruned")
+	}
+}
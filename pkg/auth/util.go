@@ -29,6 +29,15 @@ func randomString(length int) string {
 	return base64.StdEncoding.EncodeToString(bytes)
 }
 
+// randomURLSafeString returns length random bytes encoded for use in URLs, as required for PKCE verifiers.
+func randomURLSafeString(length int) string {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(fmt.Sprintf("FATAL ERROR: Unable to get random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
 func GetCookieName(clusterName string) string {
 	if clusterName == serverutils.LocalClusterName {
 		return openshiftAccessTokenCookieName
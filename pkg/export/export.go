@@ -0,0 +1,336 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/serverutils"
+	"github.com/openshift/console/pkg/tenancy"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+
+	queryRangePath = "/api/v1/query_range"
+
+	maxFilenameLength = 64
+	timestampFormat   = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var filenameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// Upstream is a Prometheus API that is queried with the user's token.
+type Upstream struct {
+	Endpoint *url.URL
+	Client   *http.Client
+}
+
+// Handler runs range queries for users and streams the result as CSV or newline-delimited JSON.
+// Requests with a `namespace` parameter are restricted to the namespace like tenancy proxy requests.
+type Handler struct {
+	Prometheus        *Upstream
+	PrometheusTenancy *Upstream
+	TenancyLimits     tenancy.Limits
+	// Maximum time range of exports, 0 to not limit it.
+	MaxRange time.Duration
+	// Exports fail if the result has more series, 0 to not limit it.
+	MaxSeries int
+}
+
+type series struct {
+	Metric map[string]string    `json:"metric"`
+	Values [][2]json.RawMessage `json:"values"`
+}
+
+type prometheusError struct {
+	Error string `json:"error"`
+}
+
+// HandleExport serves GET requests with the query, start, end and step parameters of range queries
+// and a format of csv (the default) or ndjson.
+func (h *Handler) HandleExport(user *auth.User, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Unsupported method, supported methods are GET"})
+		return
+	}
+
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = FormatCSV
+	}
+	if format != FormatCSV && format != FormatNDJSON {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported format %q, supported formats are %s and %s", format, FormatCSV, FormatNDJSON))
+		return
+	}
+	if params.Get("query") == "" {
+		sendError(w, http.StatusBadRequest, "The query parameter is required")
+		return
+	}
+	start, err := tenancy.ParseTime(params.Get("start"))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid start %q", params.Get("start")))
+		return
+	}
+	end, err := tenancy.ParseTime(params.Get("end"))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid end %q", params.Get("end")))
+		return
+	}
+	if end.Before(start) {
+		sendError(w, http.StatusBadRequest, "The end must not be before the start")
+		return
+	}
+	if h.MaxRange > 0 && end.Sub(start) > h.MaxRange {
+		sendError(w, http.StatusBadRequest, fmt.Sprintf("Exports can cover at most %s", h.MaxRange))
+		return
+	}
+
+	filename := Filename(params.Get("query"), format)
+	params.Del("format")
+	upstream := h.Prometheus
+	namespace := params.Get(tenancy.NamespaceLabel)
+	if namespace != "" {
+		upstream = h.PrometheusTenancy
+	}
+	if upstream == nil {
+		sendError(w, http.StatusNotFound, "Prometheus is not available")
+		return
+	}
+
+	query := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: queryRangePath, RawQuery: params.Encode()},
+		Header: http.Header{},
+	}
+	query = query.WithContext(r.Context())
+	var next http.Handler = http.HandlerFunc(func(w http.ResponseWriter, query *http.Request) {
+		h.export(w, query, user, upstream, format, filename)
+	})
+	if namespace != "" {
+		// The namespace is enforced the same way as on the tenancy proxy.
+		next = &tenancy.PrometheusHandler{Limits: h.TenancyLimits, Next: next}
+	}
+	next.ServeHTTP(w, query)
+}
+
+func (h *Handler) export(w http.ResponseWriter, query *http.Request, user *auth.User, upstream *Upstream, format, filename string) {
+	endpoint := *upstream.Endpoint
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + queryRangePath
+	req, err := http.NewRequestWithContext(query.Context(), http.MethodPost, endpoint.String(), strings.NewReader(query.URL.RawQuery))
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if namespace := query.URL.Query().Get(tenancy.NamespaceLabel); namespace != "" {
+		// The tenancy API reads the namespace from the URL.
+		req.URL.RawQuery = url.Values{tenancy.NamespaceLabel: {namespace}}.Encode()
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+
+	resp, err := upstream.Client.Do(req)
+	if err != nil {
+		sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to query Prometheus: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		message := strings.TrimSpace(string(body))
+		promErr := prometheusError{}
+		if json.Unmarshal(body, &promErr) == nil && promErr.Error != "" {
+			message = promErr.Error
+		}
+		sendError(w, resp.StatusCode, fmt.Sprintf("Prometheus query failed: %s", message))
+		return
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	if err := seekResult(decoder); err != nil {
+		sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to read Prometheus response: %v", err))
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	if format == FormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	writer := newRowWriter(out, format)
+	count := 0
+	for decoder.More() {
+		s := series{}
+		if err := decoder.Decode(&s); err != nil {
+			abort(fmt.Errorf("failed to decode series: %v", err))
+		}
+		count++
+		if h.MaxSeries > 0 && count > h.MaxSeries {
+			// The status is already sent, so fail the download instead of returning partial data.
+			abort(fmt.Errorf("query %q returned more than %d series", query.URL.Query().Get("query"), h.MaxSeries))
+		}
+		labels := formatLabels(s.Metric)
+		for _, value := range s.Values {
+			timestamp, err := parseTimestamp(value[0])
+			if err != nil {
+				abort(err)
+			}
+			var sampleValue string
+			if err := json.Unmarshal(value[1], &sampleValue); err != nil {
+				abort(fmt.Errorf("invalid sample value %s", value[1]))
+			}
+			if err := writer.write(timestamp, s.Metric, labels, sampleValue); err != nil {
+				klog.V(4).Infof("Failed to write export: %v", err)
+				return
+			}
+		}
+	}
+	if err := writer.flush(); err != nil {
+		klog.V(4).Infof("Failed to write export: %v", err)
+	}
+}
+
+// seekResult moves the decoder into the result array of a matrix response.
+func seekResult(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		case string:
+			if depth == 2 && t == "resultType" {
+				if resultType, err := decoder.Token(); err != nil || resultType != "matrix" {
+					return fmt.Errorf("expected a matrix result, got %v", resultType)
+				}
+			}
+			if depth == 2 && t == "result" {
+				if delim, err := decoder.Token(); err != nil || delim != json.Delim('[') {
+					return fmt.Errorf("expected the result to be an array")
+				}
+				return nil
+			}
+		}
+	}
+}
+
+type rowWriter struct {
+	out    *bufio.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+func newRowWriter(out *bufio.Writer, format string) *rowWriter {
+	rw := &rowWriter{out: out}
+	if format == FormatCSV {
+		rw.csv = csv.NewWriter(out)
+	}
+	return rw
+}
+
+func (rw *rowWriter) write(timestamp time.Time, metric map[string]string, labels, value string) error {
+	formatted := timestamp.UTC().Format(timestampFormat)
+	if rw.csv == nil {
+		line, err := json.Marshal(struct {
+			Timestamp string            `json:"timestamp"`
+			Labels    map[string]string `json:"labels"`
+			Value     string            `json:"value"`
+		}{formatted, metric, value})
+		if err != nil {
+			return err
+		}
+		if _, err := rw.out.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		return nil
+	}
+	if !rw.header {
+		rw.header = true
+		if err := rw.csv.Write([]string{"timestamp", "labels", "value"}); err != nil {
+			return err
+		}
+	}
+	return rw.csv.Write([]string{formatted, labels, value})
+}
+
+func (rw *rowWriter) flush() error {
+	if rw.csv != nil {
+		if !rw.header {
+			rw.csv.Write([]string{"timestamp", "labels", "value"})
+		}
+		rw.csv.Flush()
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return rw.out.Flush()
+}
+
+// formatLabels formats a label set in PromQL notation with sorted label names.
+func formatLabels(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, metric[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func parseTimestamp(raw json.RawMessage) (time.Time, error) {
+	if _, err := strconv.ParseFloat(string(raw), 64); err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", raw)
+	}
+	return tenancy.ParseTime(string(raw))
+}
+
+// Filename returns the download file name for the query, e.g. sum_rate_http_requests_total_5m.csv.
+func Filename(query, format string) string {
+	name := strings.Trim(filenameInvalidChars.ReplaceAllString(query, "_"), "_")
+	if len(name) > maxFilenameLength {
+		name = strings.TrimRight(name[:maxFilenameLength], "_")
+	}
+	if name == "" {
+		name = "query"
+	}
+	return name + "." + format
+}
+
+func abort(err error) {
+	klog.Errorf("Aborting Prometheus export: %v", err)
+	panic(http.ErrAbortHandler)
+}
+
+func sendError(w http.ResponseWriter, code int, msg string) {
+	serverutils.SendResponse(w, code, serverutils.ApiError{Err: msg})
+}
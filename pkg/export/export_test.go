@@ -0,0 +1,168 @@
+package export
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openshift/console/pkg/auth"
+)
+
+const testMatrix = `{"status":"success","data":{"resultType":"matrix","result":[
+	{"metric":{"job":"a","__name__":"up"},"values":[[1600000000,"1"],[1600000060.5,"0"]]},
+	{"metric":{"job":"b"},"values":[[1600000000,"NaN"]]}
+]}}`
+
+func newTestHandler(t *testing.T, forms *[]url.Values) *Handler {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != queryRangePath || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		form.Set("namespace", r.URL.Query().Get("namespace"))
+		*forms = append(*forms, form)
+		if form.Get("query") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			return
+		}
+		w.Write([]byte(testMatrix))
+	}))
+	t.Cleanup(server.Close)
+	endpoint, _ := url.Parse(server.URL)
+	upstream := &Upstream{Endpoint: endpoint, Client: server.Client()}
+	return &Handler{
+		Prometheus:        upstream,
+		PrometheusTenancy: upstream,
+		MaxRange:          24 * time.Hour,
+		MaxSeries:         10,
+	}
+}
+
+func serveExport(h *Handler, params string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/console/prometheus/export?"+params, nil)
+	w := httptest.NewRecorder()
+	h.HandleExport(&auth.User{Token: "token"}, w, r)
+	return w
+}
+
+func TestExportCSV(t *testing.T) {
+	forms := []url.Values{}
+	h := newTestHandler(t, &forms)
+	w := serveExport(h, "query="+url.QueryEscape("sum(rate(up[5m]))")+"&start=1600000000&end=1600003600&step=60")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	expected := `timestamp,labels,value
+2020-09-13T12:26:40.000Z,"{__name__=""up"",job=""a""}",1
+2020-09-13T12:27:40.500Z,"{__name__=""up"",job=""a""}",0
+2020-09-13T12:26:40.000Z,"{job=""b""}",NaN
+`
+	if w.Body.String() != expected {
+		t.Errorf("body == %s, want %s", w.Body.String(), expected)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="sum_rate_up_5m.csv"` {
+		t.Errorf("Content-Disposition == %q", disposition)
+	}
+	if len(forms) != 1 || forms[0].Get("step") != "60" || forms[0].Get("format") != "" {
+		t.Errorf("unexpected upstream request %v", forms)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	forms := []url.Values{}
+	h := newTestHandler(t, &forms)
+	w := serveExport(h, "query=up&start=1600000000&end=1600003600&step=60&format=ndjson")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || lines[0] != `{"timestamp":"2020-09-13T12:26:40.000Z","labels":{"__name__":"up","job":"a"},"value":"1"}` {
+		t.Errorf("unexpected NDJSON export %s", w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Content-Type == %q, want %q", contentType, "application/x-ndjson")
+	}
+}
+
+func TestExportEnforcesNamespace(t *testing.T) {
+	forms := []url.Values{}
+	h := newTestHandler(t, &forms)
+	w := serveExport(h, "query=up&start=1600000000&end=1600003600&step=60&namespace=ns")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if forms[0].Get("query") != `up{namespace="ns"}` || forms[0].Get("namespace") != "ns" {
+		t.Errorf("expected the namespace to be enforced, got %v", forms[0])
+	}
+
+	w = serveExport(h, "query="+url.QueryEscape(`up{namespace="other"}`)+"&start=1600000000&end=1600003600&step=60&namespace=ns")
+	if w.Code != http.StatusBadRequest || len(forms) != 1 {
+		t.Errorf("expected a query for another namespace to be rejected, got %d", w.Code)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		params       string
+		expectedCode int
+	}{
+		{
+			name:         "missing query",
+			params:       "start=1600000000&end=1600003600&step=60",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "unsupported format",
+			params:       "query=up&start=1600000000&end=1600003600&step=60&format=xlsx",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "range above the maximum",
+			params:       "query=up&start=1600000000&end=1600200000&step=60",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "query error",
+			params:       "query=bad&start=1600000000&end=1600003600&step=60",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forms := []url.Values{}
+			w := serveExport(newTestHandler(t, &forms), tt.params)
+			if w.Code != tt.expectedCode {
+				t.Errorf("status == %d, want %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestExportAbortsAboveMaxSeries(t *testing.T) {
+	forms := []url.Values{}
+	h := newTestHandler(t, &forms)
+	h.MaxSeries = 1
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("expected the export to be aborted, got %v", r)
+		}
+	}()
+	serveExport(h, "query=up&start=1600000000&end=1600003600&step=60")
+}
+
+func TestFilename(t *testing.T) {
+	for query, expected := range map[string]string{
+		`sum(rate(http_requests_total{code="500"}[5m]))`: "sum_rate_http_requests_total_code_500_5m.csv",
+		`{}`:                     "query.csv",
+		strings.Repeat("a", 100): strings.Repeat("a", maxFilenameLength) + ".csv",
+	} {
+		if actual := Filename(query, FormatCSV); actual != expected {
+			t.Errorf("Filename(%q) == %q, want %q", query, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package plugins
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/console/pkg/proxy"
+)
+
+const (
+	consolePluginAssetCacheRequestsTotalMetric = "console_plugin_asset_cache_requests_total"
+	consolePluginAssetCacheBytesMetric         = "console_plugin_asset_cache_bytes"
+
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+var (
+	consolePluginAssetCacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: consolePluginAssetCacheRequestsTotalMetric,
+			Help: "Plugin asset requests by whether the plugin service confirmed the cached asset.",
+		},
+		[]string{"result"},
+	)
+	consolePluginAssetCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: consolePluginAssetCacheBytesMetric,
+			Help: "Size of the cached plugin assets.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(consolePluginAssetCacheRequestsTotal)
+	prometheus.MustRegister(consolePluginAssetCacheBytes)
+}
+
+// Request headers that are replaced by the cache's own revalidation. Without Accept-Encoding, the client
+// decompresses responses, so that cached assets can be served to all clients.
+var cacheRequestHeaders = []string{"Accept-Encoding", "If-Match", "If-None-Match", "If-Modified-Since", "If-Range", "If-Unmodified-Since", "Range"}
+
+type cachedAsset struct {
+	key          string
+	header       http.Header
+	body         []byte
+	etag         string
+	lastModified string
+}
+
+// AssetCache is an LRU cache of plugin assets bounded by their size. Assets are revalidated with the
+// plugin service on every request using their ETag or Last-Modified header, so only assets that have
+// one of them are cached.
+type AssetCache struct {
+	maxBytes int64
+
+	mux     sync.Mutex
+	bytes   int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// NewAssetCache returns a cache that holds at most maxBytes of assets.
+func NewAssetCache(maxBytes int64) *AssetCache {
+	return &AssetCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// fetch sends the request with the validators of the cached asset. It returns the asset if the plugin
+// service confirmed it or sent a cacheable one, or else the response, which the caller must close.
+func (c *AssetCache) fetch(client *http.Client, req *http.Request) (*cachedAsset, *http.Response, error) {
+	key := req.URL.String()
+	for _, h := range cacheRequestHeaders {
+		req.Header.Del(h)
+	}
+	cached := c.get(key)
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		consolePluginAssetCacheRequestsTotal.WithLabelValues(cacheResultHit).Inc()
+		return cached, nil, nil
+	}
+	consolePluginAssetCacheRequestsTotal.WithLabelValues(cacheResultMiss).Inc()
+	if cached != nil {
+		c.delete(key)
+	}
+	if resp.StatusCode != http.StatusOK || !cacheable(resp.Header) || resp.ContentLength > c.maxBytes {
+		return nil, resp, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if int64(len(body)) > c.maxBytes {
+		// Pass on the part that was already read with the rest of the body.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, resp, nil
+	}
+	resp.Body.Close()
+
+	proxy.FilterHeaders(resp)
+	asset := &cachedAsset{
+		key:          key,
+		header:       resp.Header,
+		body:         body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	asset.header.Set("Content-Length", strconv.Itoa(len(body)))
+	c.put(asset)
+	return asset, nil, nil
+}
+
+// cacheable reports whether the response can be cached and served to all users. Private responses and
+// responses that vary by request headers, other than the Accept-Encoding the cache removes, may be
+// specific to the user that requested them.
+func cacheable(header http.Header) bool {
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(directive, "=", 2)[0]))
+		if name == "no-store" || name == "private" {
+			return false
+		}
+	}
+	for _, field := range strings.Split(strings.Join(header.Values("Vary"), ","), ",") {
+		if field = strings.TrimSpace(field); field != "" && !strings.EqualFold(field, "Accept-Encoding") {
+			return false
+		}
+	}
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+func (c *AssetCache) get(key string) *cachedAsset {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedAsset)
+}
+
+func (c *AssetCache) put(asset *cachedAsset) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if element, ok := c.entries[asset.key]; ok {
+		c.remove(element)
+	}
+	c.entries[asset.key] = c.lru.PushFront(asset)
+	c.bytes += asset.size()
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	consolePluginAssetCacheBytes.Set(float64(c.bytes))
+}
+
+func (c *AssetCache) delete(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+		consolePluginAssetCacheBytes.Set(float64(c.bytes))
+	}
+}
+
+func (c *AssetCache) remove(element *list.Element) {
+	asset := c.lru.Remove(element).(*cachedAsset)
+	delete(c.entries, asset.key)
+	c.bytes -= asset.size()
+}
+
+func (a *cachedAsset) size() int64 {
+	return int64(len(a.key) + len(a.body))
+}
+
+// writeCachedAsset serves the asset, or 304 Not Modified if the client already has it.
+func writeCachedAsset(w http.ResponseWriter, r *http.Request, asset *cachedAsset) {
+	for key, values := range asset.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	if asset.etag != "" && r.Header.Get("If-None-Match") == asset.etag {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(asset.body)
+}
@@ -0,0 +1,184 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePluginService serves its assets with an ETag derived from the content, except for nocache.js.
+type fakePluginService struct {
+	assets   map[string]string
+	requests []string
+}
+
+func (f *fakePluginService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.URL.Path)
+	content, ok := f.assets[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.URL.Path != "/nocache.js" {
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+	}
+	w.Write([]byte(content))
+}
+
+func newTestPluginsHandler(t *testing.T, service *fakePluginService, cache *AssetCache) *PluginsHandler {
+	server := httptest.NewServer(service)
+	t.Cleanup(server.Close)
+	handler := NewPluginsHandler(server.Client(), map[string]string{"foo": server.URL + "/"}, "")
+	handler.AssetCache = cache
+	return handler
+}
+
+func getPluginAsset(h *PluginsHandler, asset string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/plugins/foo/"+asset, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	// The handler is served below the plugins endpoint, which is stripped.
+	r.URL.Path = "foo/" + asset
+	w := httptest.NewRecorder()
+	h.HandlePluginAssets(w, r)
+	return w
+}
+
+func TestAssetCache(t *testing.T) {
+	service := &fakePluginService{assets: map[string]string{"main.js": "v1", "nocache.js": "n"}}
+	h := newTestPluginsHandler(t, service, NewAssetCache(1<<20))
+
+	for i := 0; i < 2; i++ {
+		w := getPluginAsset(h, "main.js", nil)
+		if w.Code != http.StatusOK || w.Body.String() != "v1" {
+			t.Fatalf("request %d: expected v1, got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if entries := len(h.AssetCache.entries); entries != 1 {
+		t.Errorf("expected one cached asset, got %d", entries)
+	}
+
+	etag := getPluginAsset(h, "main.js", nil).Header().Get("ETag")
+	if w := getPluginAsset(h, "main.js", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	service.assets["main.js"] = "v2"
+	if w := getPluginAsset(h, "main.js", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK || w.Body.String() != "v2" {
+		t.Errorf("expected the changed asset, got %d %q", w.Code, w.Body.String())
+	}
+
+	getPluginAsset(h, "nocache.js", nil)
+	if _, ok := h.AssetCache.entries[assetURL(h, "nocache.js")]; ok {
+		t.Errorf("expected assets without validators not to be cached")
+	}
+	// Every request is revalidated with the plugin service.
+	if len(service.requests) != 6 {
+		t.Errorf("expected 6 requests to the plugin service, got %v", service.requests)
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		expected bool
+	}{
+		{header: http.Header{"Etag": {`"a"`}}, expected: true},
+		{header: http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, expected: true},
+		{header: http.Header{}, expected: false},
+		{header: http.Header{"Etag": {`"a"`}, "Cache-Control": {"No-Store"}}, expected: false},
+		{header: http.Header{"Etag": {`"a"`}, "Cache-Control": {"max-age=60, private"}}, expected: false},
+		{header: http.Header{"Etag": {`"a"`}, "Cache-Control": {"public", `private="Set-Cookie"`}}, expected: false},
+		{header: http.Header{"Etag": {`"a"`}, "Vary": {"accept-encoding"}}, expected: true},
+		{header: http.Header{"Etag": {`"a"`}, "Vary": {"Accept-Encoding, Authorization"}}, expected: false},
+		{header: http.Header{"Etag": {`"a"`}, "Vary": {"*"}}, expected: false},
+	}
+	for _, tt := range tests {
+		if cacheable(tt.header) != tt.expected {
+			t.Errorf("cacheable(%v) != %v", tt.header, tt.expected)
+		}
+	}
+}
+
+func assetURL(h *PluginsHandler, asset string) string {
+	return h.PluginsEndpointMap["foo"] + asset
+}
+
+func TestAssetCacheEviction(t *testing.T) {
+	service := &fakePluginService{assets: map[string]string{
+		"a.js": strings.Repeat("a", 400),
+		"b.js": strings.Repeat("b", 400),
+		"c.js": strings.Repeat("c", 2000),
+		"d.js": strings.Repeat("d", 400),
+	}}
+	h := newTestPluginsHandler(t, service, NewAssetCache(1000))
+
+	getPluginAsset(h, "a.js", nil)
+	getPluginAsset(h, "b.js", nil)
+	getPluginAsset(h, "a.js", nil)
+	if w := getPluginAsset(h, "c.js", nil); w.Body.Len() != 2000 {
+		t.Errorf("expected assets above the cache size to be passed on, got %d bytes", w.Body.Len())
+	}
+	getPluginAsset(h, "d.js", nil)
+	if _, ok := h.AssetCache.entries[assetURL(h, "b.js")]; ok {
+		t.Errorf("expected the least recently used asset to be evicted")
+	}
+	if _, ok := h.AssetCache.entries[assetURL(h, "a.js")]; !ok {
+		t.Errorf("expected the recently used asset to stay cached")
+	}
+	if h.AssetCache.bytes > 1000 {
+		t.Errorf("cache size %d exceeds the limit", h.AssetCache.bytes)
+	}
+}
+
+func TestCheckUpdatesManifestHashes(t *testing.T) {
+	service := &fakePluginService{assets: map[string]string{pluginManifestFile: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`}}
+	h := newTestPluginsHandler(t, service, NewAssetCache(1<<20))
+	h.SetPluginsEndpointMap(map[string]string{"foo": h.PluginsEndpointMap["foo"], "unreachable": "http://127.0.0.1:0/"})
+
+	checkUpdates := func() map[string]string {
+		w := httptest.NewRecorder()
+		h.HandleCheckUpdates(w, httptest.NewRequest(http.MethodGet, "/api/check-updates", nil))
+		response := struct {
+			PluginManifestHashes map[string]string `json:"pluginManifestHashes"`
+		}{}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.PluginManifestHashes
+	}
+
+	hashes := checkUpdates()
+	sum := sha256.Sum256([]byte(service.assets[pluginManifestFile]))
+	if len(hashes) != 1 || hashes["foo"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected manifest hashes %v", hashes)
+	}
+	requests := len(service.requests)
+	service.assets[pluginManifestFile] = `{"name":"foo","version":"1.1.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`
+	if updated := checkUpdates(); updated["foo"] != hashes["foo"] || len(service.requests) != requests {
+		t.Errorf("expected the hash to be served until it expires, got %v", updated)
+	}
+
+	h.manifestHashes["foo"] = manifestHash{hash: hashes["foo"], fetchedAt: time.Now().Add(-manifestHashTTL)}
+	if updated := checkUpdates(); updated["foo"] == hashes["foo"] {
+		t.Errorf("expected the hash to change with the manifest")
+	}
+	// Manifest checks record the hashes as well.
+	service.assets[pluginManifestFile] = `{"name":"foo","version":"1.2.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`
+	h.CheckManifests(context.Background())
+	sum = sha256.Sum256([]byte(service.assets[pluginManifestFile]))
+	if updated := checkUpdates(); updated["foo"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the hash of the last manifest check, got %v", updated)
+	}
+}
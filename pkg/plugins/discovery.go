@@ -0,0 +1,206 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverconfig"
+)
+
+const (
+	// ProxyServicePathPrefix is the console path below which the proxy services of discovered plugins are served.
+	ProxyServicePathPrefix = "/api/proxy/plugin/"
+
+	consoleOperatorConfigName = "cluster"
+	proxyTypeService          = "Service"
+)
+
+var (
+	ConsolePluginResource = schema.GroupVersionResource{
+		Group:    "console.openshift.io",
+		Version:  "v1alpha1",
+		Resource: "consoleplugins",
+	}
+	ConsoleOperatorConfigResource = schema.GroupVersionResource{
+		Group:    "operator.openshift.io",
+		Version:  "v1",
+		Resource: "consoles",
+	}
+)
+
+type consolePluginSpec struct {
+	Service consolePluginService `json:"service"`
+	Proxy   []consolePluginProxy `json:"proxy,omitempty"`
+}
+
+type consolePluginService struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Port      int32  `json:"port"`
+	BasePath  string `json:"basePath,omitempty"`
+}
+
+type consolePluginProxy struct {
+	Type          string               `json:"type"`
+	Alias         string               `json:"alias"`
+	Authorize     bool                 `json:"authorize,omitempty"`
+	CACertificate string               `json:"caCertificate,omitempty"`
+	Service       consolePluginService `json:"service"`
+}
+
+// Discovery watches ConsolePlugin resources and the plugins enabled in the console operator config, so
+// that plugins can be enabled without restarting the console.
+type Discovery struct {
+	Client dynamic.Interface
+	// OnChange is called with the endpoints and proxy services of the enabled plugins whenever they change.
+	OnChange func(endpoints map[string]string, services []serverconfig.ProxyService)
+
+	mux           sync.Mutex
+	pluginStore   cache.Store
+	configStore   cache.Store
+	synced        bool
+	lastEndpoints map[string]string
+	lastServices  []serverconfig.ProxyService
+}
+
+// Run watches the resources until the context is done.
+func (d *Discovery) Run(ctx context.Context) {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { d.sync() },
+		UpdateFunc: func(interface{}, interface{}) { d.sync() },
+		DeleteFunc: func(interface{}) { d.sync() },
+	}
+	var pluginController, configController cache.Controller
+	d.mux.Lock()
+	d.pluginStore, pluginController = cache.NewInformer(
+		listWatch(d.Client.Resource(ConsolePluginResource), ""),
+		&unstructured.Unstructured{}, 0, handler,
+	)
+	d.configStore, configController = cache.NewInformer(
+		listWatch(d.Client.Resource(ConsoleOperatorConfigResource), "metadata.name="+consoleOperatorConfigName),
+		&unstructured.Unstructured{}, 0, handler,
+	)
+	d.mux.Unlock()
+
+	go pluginController.Run(ctx.Done())
+	go configController.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), pluginController.HasSynced, configController.HasSynced) {
+		return
+	}
+	d.mux.Lock()
+	d.synced = true
+	d.mux.Unlock()
+	d.sync()
+	<-ctx.Done()
+}
+
+func listWatch(client dynamic.ResourceInterface, fieldSelector string) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return client.List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return client.Watch(context.TODO(), options)
+		},
+	}
+}
+
+// sync derives the enabled plugins from the stores and reports them if they changed.
+func (d *Discovery) sync() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	// Partial lists would briefly disable plugins, so wait until both resources are listed.
+	if !d.synced {
+		return
+	}
+
+	enabled := []string{}
+	if obj, exists, _ := d.configStore.GetByKey(consoleOperatorConfigName); exists {
+		enabled, _, _ = unstructured.NestedStringSlice(obj.(*unstructured.Unstructured).Object, "spec", "plugins")
+	}
+	endpoints := map[string]string{}
+	services := []serverconfig.ProxyService{}
+	for _, name := range enabled {
+		obj, exists, _ := d.pluginStore.GetByKey(name)
+		if !exists {
+			klog.V(4).Infof("Enabled plugin %q has no ConsolePlugin resource yet", name)
+			continue
+		}
+		endpoint, pluginServices, err := pluginFromResource(obj.(*unstructured.Unstructured))
+		if err != nil {
+			klog.Errorf("Ignoring ConsolePlugin %q: %v", name, err)
+			continue
+		}
+		endpoints[name] = endpoint
+		services = append(services, pluginServices...)
+	}
+
+	if d.lastEndpoints != nil && reflect.DeepEqual(endpoints, d.lastEndpoints) && reflect.DeepEqual(services, d.lastServices) {
+		return
+	}
+	d.lastEndpoints, d.lastServices = endpoints, services
+	klog.Infof("Discovered %d enabled console plugins with %d proxy services", len(endpoints), len(services))
+	if d.OnChange != nil {
+		d.OnChange(endpoints, services)
+	}
+}
+
+// pluginFromResource returns the endpoint and proxy services of a ConsolePlugin, derived the same way as
+// by the console operator.
+func pluginFromResource(obj *unstructured.Unstructured) (string, []serverconfig.ProxyService, error) {
+	specObj, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	spec := consolePluginSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(specObj, &spec); err != nil {
+		return "", nil, fmt.Errorf("invalid spec: %v", err)
+	}
+	endpoint, err := serviceEndpoint(spec.Service)
+	if err != nil {
+		return "", nil, err
+	}
+	basePath := spec.Service.BasePath
+	if !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+
+	services := []serverconfig.ProxyService{}
+	for _, p := range spec.Proxy {
+		if p.Type != proxyTypeService {
+			return "", nil, fmt.Errorf("unsupported proxy type %q", p.Type)
+		}
+		if p.Alias == "" || strings.Contains(p.Alias, "/") {
+			return "", nil, fmt.Errorf("invalid proxy alias %q", p.Alias)
+		}
+		proxyEndpoint, err := serviceEndpoint(p.Service)
+		if err != nil {
+			return "", nil, fmt.Errorf("proxy %q: %v", p.Alias, err)
+		}
+		services = append(services, serverconfig.ProxyService{
+			Endpoint:       proxyEndpoint,
+			ConsoleAPIPath: fmt.Sprintf("%s%s/%s/", ProxyServicePathPrefix, obj.GetName(), p.Alias),
+			CACertificate:  p.CACertificate,
+			Authorize:      p.Authorize,
+		})
+	}
+	return endpoint + basePath, services, nil
+}
+
+func serviceEndpoint(service consolePluginService) (string, error) {
+	if service.Name == "" || service.Namespace == "" || service.Port <= 0 {
+		return "", fmt.Errorf("service name, namespace and port are required")
+	}
+	return fmt.Sprintf("https://%s.%s.svc.cluster.local:%d", service.Name, service.Namespace, service.Port), nil
+}
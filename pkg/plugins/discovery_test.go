@@ -0,0 +1,185 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/openshift/console/pkg/serverconfig"
+)
+
+func testConsolePlugin(name string, proxy ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "console.openshift.io/v1alpha1",
+		"kind":       "ConsolePlugin",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"service": map[string]interface{}{
+				"name":      name,
+				"namespace": "plugins",
+				"port":      int64(9443),
+				"basePath":  "/",
+			},
+			"proxy": proxy,
+		},
+	}}
+}
+
+func testConsoleOperatorConfig(plugins ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "operator.openshift.io/v1",
+		"kind":       "Console",
+		"metadata":   map[string]interface{}{"name": "cluster"},
+		"spec":       map[string]interface{}{"plugins": plugins},
+	}}
+}
+
+type discoveredPlugins struct {
+	endpoints map[string]string
+	services  []serverconfig.ProxyService
+}
+
+func TestDiscovery(t *testing.T) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		ConsolePluginResource:         "ConsolePluginList",
+		ConsoleOperatorConfigResource: "ConsoleList",
+	},
+		testConsolePlugin("foo", map[string]interface{}{
+			"type":      "Service",
+			"alias":     "backend",
+			"authorize": true,
+			"service":   map[string]interface{}{"name": "foo-backend", "namespace": "plugins", "port": int64(8443)},
+		}),
+		testConsolePlugin("bar"),
+		testConsolePlugin("disabled"),
+		testConsoleOperatorConfig("foo", "missing"),
+	)
+	changes := make(chan discoveredPlugins, 10)
+	discovery := &Discovery{
+		Client: client,
+		OnChange: func(endpoints map[string]string, services []serverconfig.ProxyService) {
+			changes <- discoveredPlugins{endpoints, services}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go discovery.Run(ctx)
+	nextChange := func() discoveredPlugins {
+		select {
+		case change := <-changes:
+			return change
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for discovered plugins")
+			return discoveredPlugins{}
+		}
+	}
+
+	change := nextChange()
+	expectedEndpoints := map[string]string{"foo": "https://foo.plugins.svc.cluster.local:9443/"}
+	if !reflect.DeepEqual(change.endpoints, expectedEndpoints) {
+		t.Errorf("endpoints == %v, want %v", change.endpoints, expectedEndpoints)
+	}
+	expectedServices := []serverconfig.ProxyService{{
+		Endpoint:       "https://foo-backend.plugins.svc.cluster.local:8443",
+		ConsoleAPIPath: "/api/proxy/plugin/foo/backend/",
+		Authorize:      true,
+	}}
+	if !reflect.DeepEqual(change.services, expectedServices) {
+		t.Errorf("services == %v, want %v", change.services, expectedServices)
+	}
+
+	_, err := client.Resource(ConsoleOperatorConfigResource).Update(context.TODO(), testConsoleOperatorConfig("foo", "bar"), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	change = nextChange()
+	expectedEndpoints["bar"] = "https://bar.plugins.svc.cluster.local:9443/"
+	if !reflect.DeepEqual(change.endpoints, expectedEndpoints) {
+		t.Errorf("endpoints == %v, want %v", change.endpoints, expectedEndpoints)
+	}
+
+	// Changes of plugins that are not enabled are not reported.
+	if err := client.Resource(ConsolePluginResource).Delete(context.TODO(), "disabled", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.Resource(ConsolePluginResource).Delete(context.TODO(), "bar", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	change = nextChange()
+	delete(expectedEndpoints, "bar")
+	if !reflect.DeepEqual(change.endpoints, expectedEndpoints) {
+		t.Errorf("endpoints == %v, want %v", change.endpoints, expectedEndpoints)
+	}
+}
+
+func TestPluginFromResourceValidation(t *testing.T) {
+	for name, plugin := range map[string]*unstructured.Unstructured{
+		"unsupported proxy type": testConsolePlugin("foo", map[string]interface{}{
+			"type":    "External",
+			"alias":   "backend",
+			"service": map[string]interface{}{"name": "foo-backend", "namespace": "plugins", "port": int64(8443)},
+		}),
+		"proxy without alias": testConsolePlugin("foo", map[string]interface{}{
+			"type":    "Service",
+			"service": map[string]interface{}{"name": "foo-backend", "namespace": "plugins", "port": int64(8443)},
+		}),
+		"proxy without port": testConsolePlugin("foo", map[string]interface{}{
+			"type":    "Service",
+			"alias":   "backend",
+			"service": map[string]interface{}{"name": "foo-backend", "namespace": "plugins"},
+		}),
+	} {
+		if _, _, err := pluginFromResource(plugin); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCheckUpdatesReportsEnabledPlugins(t *testing.T) {
+	handler := NewPluginsHandler(http.DefaultClient, map[string]string{"foo": "https://foo"}, "")
+	handler.SetPluginsEndpointMap(map[string]string{"foo": "https://foo", "bar": "https://bar"})
+
+	w := httptest.NewRecorder()
+	handler.HandleCheckUpdates(w, httptest.NewRequest(http.MethodGet, "/api/check-updates", nil))
+	response := struct {
+		Plugins []string `json:"plugins"`
+	}{}
+	json.NewDecoder(w.Body).Decode(&response)
+	if !reflect.DeepEqual(response.Plugins, []string{"bar", "foo"}) {
+		t.Errorf("plugins == %v, want %v", response.Plugins, []string{"bar", "foo"})
+	}
+}
+
+func TestProxyRouter(t *testing.T) {
+	router := &ProxyRouter{}
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	router.SetRoutes(map[string]http.Handler{
+		"/api/proxy/plugin/foo/":         named("foo"),
+		"/api/proxy/plugin/foo/backend/": named("backend"),
+	})
+	for path, expected := range map[string]string{
+		"/api/proxy/plugin/foo/backend/metrics": "backend",
+		"/api/proxy/plugin/foo/other":           "foo",
+		"/api/proxy/plugin/bar/backend/":        "404 page not found\n",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Body.String() != expected {
+			t.Errorf("%s: body == %q, want %q", path, w.Body.String(), expected)
+		}
+	}
+}
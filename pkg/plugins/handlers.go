@@ -1,16 +1,23 @@
 package plugins
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/klog"
 
@@ -20,16 +27,58 @@ import (
 	oscrypto "github.com/openshift/library-go/pkg/crypto"
 )
 
+const (
+	pluginManifestFile = "plugin-manifest.json"
+	// Manifests are small, larger ones are rejected.
+	maxManifestBytes = 1 << 20
+	assetTimeout     = 10 * time.Second
+	// Manifest hashes are served for this long before HandleCheckUpdates fetches the manifest again.
+	manifestHashTTL = time.Minute
+)
+
 type PluginsHandler struct {
-	Client             *http.Client
+	Client *http.Client
+	// PluginsEndpointMap maps enabled plugins to their service endpoint. Use SetPluginsEndpointMap to
+	// change it while requests are served.
 	PluginsEndpointMap map[string]string
 	PublicDir          string
+	// LocalPlugins maps plugins that are served from disk to their directory. They are enabled in
+	// addition to PluginsEndpointMap.
+	LocalPlugins map[string]string
+	// AssetCache caches plugin assets, nil disables caching.
+	AssetCache *AssetCache
+	// IntegrityPins pins the entry scripts of the plugins, nil disables pinning.
+	IntegrityPins *IntegrityPins
+	// ConsoleVersion is checked against the plugin API dependency of the plugin manifests.
+	ConsoleVersion string
+	mux            sync.RWMutex
+	pluginStatuses map[string]*PluginStatus
+	manifestChecks chan struct{}
+	// localPluginRevisions counts the changes of the local plugins.
+	localPluginRevisions map[string]int
+	// manifestHashes are the hashes of the last fetched manifests.
+	manifestHashes map[string]manifestHash
+}
+
+type manifestHash struct {
+	hash      string
+	fetchedAt time.Time
 }
 
 type PluginsProxyServiceHandler struct {
 	ConsoleEndpoint string
 	ProxyConfig     *proxy.Config
 	Authorize       bool
+	// AuthorizationHeader is the header the user's token is forwarded in, Authorization if empty.
+	AuthorizationHeader string
+	// ServiceAccountToken is sent as bearer token instead of the user's token if it is set.
+	ServiceAccountToken string
+	Headers             http.Header
+	PathRewrites        []serverconfig.ProxyServicePathRewrite
+	// AllowedMethods are the accepted request methods, all methods are accepted if empty.
+	AllowedMethods  []string
+	MaxRequestBytes int64
+	Timeout         time.Duration
 }
 
 func NewPluginsProxyServiceHandler(consoleEndpoint string, serviceEndpoint *url.URL, tlsClientConfig *tls.Config, authorize bool) *PluginsProxyServiceHandler {
@@ -39,6 +88,8 @@ func NewPluginsProxyServiceHandler(consoleEndpoint string, serviceEndpoint *url.
 			TLSClientConfig: tlsClientConfig,
 			HeaderBlacklist: proxy.HeaderBlacklist,
 			Endpoint:        serviceEndpoint,
+			// Requests that exceed the timeout of the service are answered with 504 Gateway Timeout.
+			ErrorHandler: proxy.TimeoutErrorHandler,
 		},
 		Authorize: authorize,
 	}
@@ -52,6 +103,42 @@ func NewPluginsHandler(client *http.Client, pluginsEndpointMap map[string]string
 	}
 }
 
+// SetPluginsEndpointMap replaces the enabled plugins.
+func (p *PluginsHandler) SetPluginsEndpointMap(pluginsEndpointMap map[string]string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.PluginsEndpointMap = pluginsEndpointMap
+	p.requestManifestCheck()
+}
+
+// requestManifestCheck starts a manifest check if the checks are running and none is pending. The
+// caller must hold the lock.
+func (p *PluginsHandler) requestManifestCheck() {
+	if p.manifestChecks != nil {
+		select {
+		case p.manifestChecks <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// EnabledPlugins returns the sorted names of the enabled plugins, including the local plugins.
+func (p *PluginsHandler) EnabledPlugins() []string {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	pluginsList := make([]string, 0, len(p.PluginsEndpointMap)+len(p.LocalPlugins))
+	for k := range p.PluginsEndpointMap {
+		if _, ok := p.LocalPlugins[k]; !ok {
+			pluginsList = append(pluginsList, k)
+		}
+	}
+	for k := range p.LocalPlugins {
+		pluginsList = append(pluginsList, k)
+	}
+	sort.Strings(pluginsList)
+	return pluginsList
+}
+
 func ParsePluginProxyConfig(proxyConfig string) (*serverconfig.Proxy, error) {
 	pluginProxy := &serverconfig.Proxy{}
 	err := json.Unmarshal([]byte(proxyConfig), pluginProxy)
@@ -63,7 +150,7 @@ func ParsePluginProxyConfig(proxyConfig string) (*serverconfig.Proxy, error) {
 	return pluginProxy, nil
 }
 
-func GetPluginProxyServiceHandlers(proxyConfig *serverconfig.Proxy, defaultTLSConfig *tls.Config, pluginProxyEndpoint string) ([]*PluginsProxyServiceHandler, error) {
+func GetPluginProxyServiceHandlers(proxyConfig *serverconfig.Proxy, defaultTLSConfig *tls.Config, pluginProxyEndpoint string, serviceAccountToken string) ([]*PluginsProxyServiceHandler, error) {
 	var proxyServiceHandlers []*PluginsProxyServiceHandler
 	for _, service := range proxyConfig.Services {
 		pluginProxyTLS := defaultTLSConfig.Clone()
@@ -85,7 +172,13 @@ func GetPluginProxyServiceHandlers(proxyConfig *serverconfig.Proxy, defaultTLSCo
 			klog.Error(errMsg)
 			return nil, fmt.Errorf(errMsg)
 		}
-		proxyServiceHandlers = append(proxyServiceHandlers, NewPluginsProxyServiceHandler(service.ConsoleAPIPath, serviceEndpoint, pluginProxyTLS, service.Authorize))
+		proxyServiceHandler := NewPluginsProxyServiceHandler(service.ConsoleAPIPath, serviceEndpoint, pluginProxyTLS, service.Authorize)
+		if err := configureProxyService(proxyServiceHandler, service, serviceAccountToken); err != nil {
+			errMsg := fmt.Sprintf("Error configuring %q service proxy: %v", service.ConsoleAPIPath, err)
+			klog.Error(errMsg)
+			return nil, fmt.Errorf(errMsg)
+		}
+		proxyServiceHandlers = append(proxyServiceHandlers, proxyServiceHandler)
 	}
 	return proxyServiceHandlers, nil
 }
@@ -116,6 +209,10 @@ func (p *PluginsHandler) HandleI18nResources(w http.ResponseWriter, r *http.Requ
 	// In case of dynamic-plugin we need to trim the "plugin__" prefix, since we are using the ConsolePlugin CR's name
 	// as key when looking for the plugin's Service endpoint.
 	pluginName := strings.TrimPrefix(namespace, "plugin__")
+	if dir, ok := p.localPlugin(pluginName); ok {
+		serveLocalFile(w, r, dir, path.Join("locales", lang, fmt.Sprintf("%s.json", namespace)))
+		return
+	}
 
 	pluginServiceRequestURL, err := p.getServiceRequestURL(pluginName)
 	if err != nil {
@@ -136,6 +233,10 @@ func (p *PluginsHandler) HandlePluginAssets(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	pluginName, pluginAssetPath := parsePluginNameAndAssetPath(r.URL.Path)
+	if dir, ok := p.localPlugin(pluginName); ok {
+		serveLocalFile(w, r, dir, pluginAssetPath)
+		return
+	}
 	pluginServiceRequestURL, err := p.getServiceRequestURL(pluginName)
 	if err != nil {
 		errMsg := err.Error()
@@ -145,6 +246,11 @@ func (p *PluginsHandler) HandlePluginAssets(w http.ResponseWriter, r *http.Reque
 	}
 	pluginServiceRequestURL.Path = path.Join(pluginServiceRequestURL.Path, pluginAssetPath)
 
+	// Compare the cleaned path, since e.g. `./plugin-entry.js` is the same script.
+	if p.IntegrityPins != nil && path.Clean("/"+pluginAssetPath) == "/"+pluginEntryFile {
+		p.proxyEntryScript(pluginServiceRequestURL, pluginName, w, r)
+		return
+	}
 	p.proxyPluginRequest(pluginServiceRequestURL, pluginName, w, r)
 }
 
@@ -159,13 +265,17 @@ func (p *PluginsHandler) proxyPluginRequest(requestURL *url.URL, pluginName stri
 
 	proxy.CopyRequestHeaders(orignalRequest, newRequest)
 
-	resp, err := p.Client.Do(newRequest)
+	asset, resp, err := p.fetch(newRequest)
 	if err != nil {
 		errMsg := fmt.Sprintf("GET request for %q plugin failed: %v", pluginName, err)
 		klog.Error(errMsg)
 		serverutils.SendResponse(w, http.StatusBadGateway, serverutils.ApiError{Err: errMsg})
 		return
 	}
+	if asset != nil {
+		writeCachedAsset(w, orignalRequest, asset)
+		return
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
@@ -193,27 +303,156 @@ func (p *PluginsHandler) proxyPluginRequest(requestURL *url.URL, pluginName stri
 	}
 }
 
+// fetch requests an asset from a plugin service, through the asset cache if it is enabled. Either the
+// cached asset or the response of the plugin service is returned.
+func (p *PluginsHandler) fetch(req *http.Request) (*cachedAsset, *http.Response, error) {
+	if p.AssetCache != nil {
+		return p.AssetCache.fetch(p.Client, req)
+	}
+	resp, err := p.Client.Do(req)
+	return nil, resp, err
+}
+
+// HandleCheckUpdates reports the console commit, the enabled plugins that are not known to be
+// incompatible and a SHA-256 hash of each plugin's manifest, so that clients can detect console and
+// plugin upgrades. Manifests are fetched again when their hash is older than manifestHashTTL, plugins
+// whose manifest couldn't be fetched yet have no hash. The revisions of the local plugins change with
+// any of their files, so that clients reload while plugins are developed.
 func (p *PluginsHandler) HandleCheckUpdates(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		w.Header().Set("Allow", "GET")
 		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Method unsupported, the only supported methods is GET"})
 		return
 	}
-	pluginsList := make([]string, 0, len(p.PluginsEndpointMap))
-	for k := range p.PluginsEndpointMap {
-		pluginsList = append(pluginsList, k)
+	pluginsList := p.CompatiblePlugins()
+	p.refreshManifestHashes(r.Context(), pluginsList)
+	p.mux.RLock()
+	manifestHashes := make(map[string]string, len(pluginsList))
+	for _, pluginName := range pluginsList {
+		if h := p.manifestHashes[pluginName]; h.hash != "" {
+			manifestHashes[pluginName] = h.hash
+		}
 	}
+	p.mux.RUnlock()
+
 	serverutils.SendResponse(w, http.StatusOK, struct {
-		ConsoleCommit string   `json:"consoleCommit"`
-		Plugins       []string `json:"plugins"`
+		ConsoleCommit        string            `json:"consoleCommit"`
+		Plugins              []string          `json:"plugins"`
+		PluginManifestHashes map[string]string `json:"pluginManifestHashes"`
+		LocalPluginRevisions map[string]int    `json:"localPluginRevisions,omitempty"`
 	}{
-		ConsoleCommit: os.Getenv("SOURCE_GIT_COMMIT"),
-		Plugins:       pluginsList,
+		ConsoleCommit:        os.Getenv("SOURCE_GIT_COMMIT"),
+		Plugins:              pluginsList,
+		PluginManifestHashes: manifestHashes,
+		LocalPluginRevisions: p.LocalPluginRevisions(),
 	})
 }
 
+// refreshManifestHashes fetches the manifests of the plugins whose hash is missing or expired.
+// Concurrent requests serve the previous hashes while the manifests are fetched.
+func (p *PluginsHandler) refreshManifestHashes(ctx context.Context, pluginsList []string) {
+	now := time.Now()
+	expired := []string{}
+	p.mux.Lock()
+	hashes := make(map[string]manifestHash, len(pluginsList))
+	for _, pluginName := range pluginsList {
+		h := p.manifestHashes[pluginName]
+		if now.Sub(h.fetchedAt) >= manifestHashTTL {
+			h.fetchedAt = now
+			expired = append(expired, pluginName)
+		}
+		hashes[pluginName] = h
+	}
+	p.manifestHashes = hashes
+	p.mux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, pluginName := range expired {
+		wg.Add(1)
+		go func(pluginName string) {
+			defer wg.Done()
+			if _, err := p.getManifest(ctx, pluginName); err != nil {
+				klog.V(4).Infof("Failed to fetch manifest of %q plugin: %v", pluginName, err)
+			}
+		}(pluginName)
+	}
+	wg.Wait()
+}
+
+// getManifest fetches the manifest of the plugin and records its hash for HandleCheckUpdates.
+func (p *PluginsHandler) getManifest(ctx context.Context, pluginName string) ([]byte, error) {
+	manifest, err := p.fetchManifest(ctx, pluginName)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(manifest)
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.manifestHashes == nil {
+		p.manifestHashes = map[string]manifestHash{}
+	}
+	p.manifestHashes[pluginName] = manifestHash{hash: hex.EncodeToString(sum[:]), fetchedAt: time.Now()}
+	return manifest, nil
+}
+
+func (p *PluginsHandler) fetchManifest(ctx context.Context, pluginName string) ([]byte, error) {
+	if dir, ok := p.localPlugin(pluginName); ok {
+		return readLocalManifest(dir)
+	}
+	manifestURL, err := p.getServiceRequestURL(pluginName)
+	if err != nil {
+		return nil, err
+	}
+	manifestURL.Path = path.Join(manifestURL.Path, pluginManifestFile)
+	manifest, _, err := p.getAsset(ctx, manifestURL, maxManifestBytes)
+	return manifest, err
+}
+
+// assetStatusError is returned for plugin service responses other than 200 OK.
+type assetStatusError struct {
+	resp *http.Response
+}
+
+func (e *assetStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.resp.Status)
+}
+
+// getAsset fetches an asset of up to maxBytes from a plugin service, through the asset cache if it is
+// enabled. It returns the asset with the filtered response headers.
+func (p *PluginsHandler) getAsset(ctx context.Context, assetURL *url.URL, maxBytes int64) ([]byte, http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, assetTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, assetURL.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	asset, resp, err := p.fetch(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if asset != nil {
+		return asset.body, asset.header.Clone(), nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &assetStatusError{resp: resp}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, nil, fmt.Errorf("asset exceeds %d bytes", maxBytes)
+	}
+	proxy.FilterHeaders(resp)
+	return body, resp.Header, nil
+}
+
 func (p *PluginsHandler) getServiceRequestURL(pluginName string) (*url.URL, error) {
+	p.mux.RLock()
 	pluginEndpoint, ok := p.PluginsEndpointMap[pluginName]
+	p.mux.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("failed to get endpoint for %q plugin", pluginName)
 	}
@@ -0,0 +1,215 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+const (
+	defaultFallbackLanguage = "en"
+	maxBulkI18nNamespaces   = 100
+	maxLocaleBytes          = 5 << 20
+	// Language tags are short in practice, longer ones are rejected.
+	maxI18nLanguageLength = 35
+	// Languages fall back to at most this many of their variants before the fallback language.
+	maxLanguageVariants = 3
+)
+
+// Languages and namespaces are used in paths, so only a safe subset is accepted.
+var i18nNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// errLocaleNotFound is returned when a namespace has no resources for a language.
+var errLocaleNotFound = fmt.Errorf("locale not found")
+
+// HandleI18nBulkResources serves several namespaces of one language in a single response, e.g.
+// `?lng=pt-BR&ns=public,plugin__foo`. Missing keys of each namespace are filled in from the fallback
+// chain of the language: `pt-BR` falls back to `pt` and then to `fallbackLng`, `en` by default.
+// The response has the shape `{"pt-BR": {"public": {...}, "plugin__foo": {...}}}` that i18next backends
+// expect for multiple namespaces, and namespaces without resources in any language are left out.
+func (p *PluginsHandler) HandleI18nBulkResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Method unsupported, the only supported methods is GET"})
+		return
+	}
+
+	query := r.URL.Query()
+	lang := query.Get("lng")
+	namespaces := splitI18nList(query.Get("ns"))
+	fallbackLang := query.Get("fallbackLng")
+	if fallbackLang == "" {
+		fallbackLang = defaultFallbackLanguage
+	}
+	if lang == "" || len(namespaces) == 0 {
+		serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: fmt.Sprintf("GET request %q is missing 'lng' or 'ns' query parameter", r.URL.String())})
+		return
+	}
+	if len(namespaces) > maxBulkI18nNamespaces {
+		serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: fmt.Sprintf("at most %d namespaces can be requested at once", maxBulkI18nNamespaces)})
+		return
+	}
+	for _, l := range []string{lang, fallbackLang} {
+		if len(l) > maxI18nLanguageLength {
+			serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: fmt.Sprintf("languages can have at most %d characters", maxI18nLanguageLength)})
+			return
+		}
+	}
+	for _, name := range append([]string{lang, fallbackLang}, namespaces...) {
+		if !i18nNamePattern.MatchString(name) {
+			serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: fmt.Sprintf("invalid language or namespace %q", name)})
+			return
+		}
+	}
+
+	languages := fallbackChain(lang, fallbackLang)
+	var wg sync.WaitGroup
+	var resultsMux sync.Mutex
+	resources := make(map[string]map[string]interface{}, len(namespaces))
+	for _, namespace := range namespaces {
+		wg.Add(1)
+		go func(namespace string) {
+			defer wg.Done()
+			merged := p.getMergedLocale(r.Context(), languages, namespace)
+			if merged == nil {
+				return
+			}
+			resultsMux.Lock()
+			defer resultsMux.Unlock()
+			resources[namespace] = merged
+		}(namespace)
+	}
+	wg.Wait()
+
+	body, err := json.Marshal(map[string]interface{}{lang: resources})
+	if err != nil {
+		serverutils.SendResponse(w, http.StatusInternalServerError, serverutils.ApiError{Err: err.Error()})
+		return
+	}
+	// The merged resources aren't cached themselves, but clients can revalidate them cheaply.
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func splitI18nList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == '+' || r == ' '
+	})
+}
+
+// fallbackChain returns the language followed by its less specific variants and the fallback
+// language, e.g. `pt-BR`, `pt`, `en`. Only the maxLanguageVariants most specific variants are used.
+func fallbackChain(lang string, fallbackLang string) []string {
+	chain := []string{}
+	add := func(l string) {
+		for _, existing := range chain {
+			if strings.EqualFold(existing, l) {
+				return
+			}
+		}
+		chain = append(chain, l)
+	}
+	parts := strings.FieldsFunc(lang, func(r rune) bool { return r == '-' || r == '_' })
+	for i := len(parts); i > 0 && len(chain) < maxLanguageVariants; i-- {
+		add(strings.Join(parts[:i], "-"))
+	}
+	add(fallbackLang)
+	return chain
+}
+
+// getMergedLocale merges the resources of the namespace in the languages of the chain, where more
+// specific languages take precedence. It returns nil if no language has resources for the namespace.
+func (p *PluginsHandler) getMergedLocale(ctx context.Context, languages []string, namespace string) map[string]interface{} {
+	var merged map[string]interface{}
+	for i := len(languages) - 1; i >= 0; i-- {
+		content, err := p.getLocale(ctx, languages[i], namespace)
+		if err != nil {
+			if err != errLocaleNotFound {
+				klog.V(4).Infof("Failed to get %q locale of %q namespace: %v", languages[i], namespace, err)
+			}
+			continue
+		}
+		resources := map[string]interface{}{}
+		if err := json.Unmarshal(content, &resources); err != nil {
+			klog.Errorf("Invalid %q locale of %q namespace: %v", languages[i], namespace, err)
+			continue
+		}
+		if merged == nil {
+			merged = resources
+			continue
+		}
+		mergeResources(merged, resources)
+	}
+	return merged
+}
+
+// mergeResources copies the resources from src to dst, merging nested objects.
+func mergeResources(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcObject, srcIsObject := value.(map[string]interface{})
+		dstObject, dstIsObject := dst[key].(map[string]interface{})
+		if srcIsObject && dstIsObject {
+			mergeResources(dstObject, srcObject)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// getLocale reads the resources of a core namespace from the public directory, or fetches the
+// resources of a plugin namespace from the plugin, through the asset cache if it is enabled.
+func (p *PluginsHandler) getLocale(ctx context.Context, lang string, namespace string) ([]byte, error) {
+	localeFile := path.Join("locales", lang, fmt.Sprintf("%s.json", namespace))
+	if !strings.HasPrefix(namespace, "plugin__") {
+		content, err := ioutil.ReadFile(filepath.Join(p.PublicDir, filepath.FromSlash(localeFile)))
+		if os.IsNotExist(err) {
+			return nil, errLocaleNotFound
+		}
+		return content, err
+	}
+
+	pluginName := strings.TrimPrefix(namespace, "plugin__")
+	if dir, ok := p.localPlugin(pluginName); ok {
+		f, err := openLocalFile(dir, localeFile)
+		if os.IsNotExist(err) {
+			return nil, errLocaleNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ioutil.ReadAll(io.LimitReader(f, maxLocaleBytes))
+	}
+
+	localeURL, err := p.getServiceRequestURL(pluginName)
+	if err != nil {
+		return nil, err
+	}
+	localeURL.Path = path.Join(localeURL.Path, localeFile)
+	content, _, err := p.getAsset(ctx, localeURL, maxLocaleBytes)
+	if statusErr, ok := err.(*assetStatusError); ok && statusErr.resp.StatusCode == http.StatusNotFound {
+		return nil, errLocaleNotFound
+	}
+	return content, err
+}
@@ -0,0 +1,108 @@
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getBulkLocales(h *PluginsHandler, query string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/locales/resources.json?"+query, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.HandleI18nBulkResources(w, r)
+	return w
+}
+
+func TestHandleI18nBulkResources(t *testing.T) {
+	publicDir := t.TempDir()
+	for name, content := range map[string]string{
+		"locales/en/public.json":    `{"Save":"Save","Cancel":"Cancel","Nested":{"a":"A","b":"B"}}`,
+		"locales/pt/public.json":    `{"Save":"Salvar","Nested":{"a":"A (pt)"}}`,
+		"locales/pt-BR/public.json": `{"Save":"Salvar (BR)"}`,
+		"locales/en/olm.json":       `{"Install":"Install"}`,
+	} {
+		file := filepath.Join(publicDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	service := &fakePluginService{assets: map[string]string{
+		"locales/en/plugin__foo.json": `{"Hello":"Hello","Bye":"Bye"}`,
+		"locales/pt/plugin__foo.json": `{"Hello":"Olá"}`,
+	}}
+	h := newTestPluginsHandler(t, service, NewAssetCache(1<<20))
+	h.PublicDir = publicDir
+
+	w := getBulkLocales(h, "lng=pt-BR&ns=public,olm,plugin__foo,missing", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	actual := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"pt-BR": map[string]interface{}{
+			"public": map[string]interface{}{
+				"Save":   "Salvar (BR)",
+				"Cancel": "Cancel",
+				"Nested": map[string]interface{}{"a": "A (pt)", "b": "B"},
+			},
+			"olm":         map[string]interface{}{"Install": "Install"},
+			"plugin__foo": map[string]interface{}{"Hello": "Olá", "Bye": "Bye"},
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("resources == %v, want %v", actual, expected)
+	}
+
+	etag := w.Header().Get("ETag")
+	if w := getBulkLocales(h, "lng=pt-BR&ns=public,olm,plugin__foo,missing", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusNotModified)
+	}
+	// The plugin locales are revalidated with the plugin service.
+	service.assets["locales/pt/plugin__foo.json"] = `{"Hello":"Oi"}`
+	if w := getBulkLocales(h, "lng=pt-BR&ns=public,olm,plugin__foo,missing", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for query, expectedStatus := range map[string]int{
+		"lng=en":                          http.StatusBadRequest,
+		"ns=public":                       http.StatusBadRequest,
+		"lng=../en&ns=public":             http.StatusBadRequest,
+		"lng=en&ns=../../public":          http.StatusBadRequest,
+		"lng=en&ns=public&fallbackLng=ja": http.StatusOK,
+		"lng=" + strings.Repeat("a-", 18) + "a&ns=public":         http.StatusBadRequest,
+		"lng=en&ns=public&fallbackLng=" + strings.Repeat("a", 36): http.StatusBadRequest,
+	} {
+		if w := getBulkLocales(h, query, nil); w.Code != expectedStatus {
+			t.Errorf("%s: status == %d, want %d", query, w.Code, expectedStatus)
+		}
+	}
+}
+
+func TestFallbackChain(t *testing.T) {
+	for lang, expected := range map[string][]string{
+		"pt-BR":      {"pt-BR", "pt", "en"},
+		"en-US":      {"en-US", "en"},
+		"en":         {"en"},
+		"zh_Hans_CN": {"zh-Hans-CN", "zh-Hans", "zh", "en"},
+		"a-b-c-d-e":  {"a-b-c-d-e", "a-b-c-d", "a-b-c", "en"},
+	} {
+		if chain := fallbackChain(lang, "en"); !reflect.DeepEqual(chain, expected) {
+			t.Errorf("%s: chain == %v, want %v", lang, chain, expected)
+		}
+	}
+}
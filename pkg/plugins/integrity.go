@@ -0,0 +1,182 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+const (
+	// pluginEntryFile is the script that loads a plugin, which loads all its other chunks.
+	pluginEntryFile     = "plugin-entry.js"
+	maxEntryScriptBytes = 10 << 20
+	// RepinAllPlugins drops the pins of all plugins.
+	RepinAllPlugins = "*"
+)
+
+// IntegrityPins pins the SHA-384 hash of each plugin's entry script the first time it is loaded, so
+// that a changed entry script is rejected until the plugin is re-pinned. The other chunks aren't
+// pinned, so this detects unexpected upgrades rather than protecting against a compromised plugin
+// service. The hashes are in the `sha384-<base64>` format of the script integrity attribute.
+type IntegrityPins struct {
+	// file persists the pins across restarts, empty keeps them in memory only.
+	file string
+	mux  sync.Mutex
+	pins map[string]string
+}
+
+// NewIntegrityPins loads the pins from the file if it is set, and drops the pins of the plugins to
+// repin, e.g. after intentional plugin upgrades. RepinAllPlugins drops all pins.
+func NewIntegrityPins(file string, repin []string) (*IntegrityPins, error) {
+	i := &IntegrityPins{file: file, pins: map[string]string{}}
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read plugin integrity pins: %v", err)
+		}
+		if len(content) > 0 {
+			if err := json.Unmarshal(content, &i.pins); err != nil {
+				return nil, fmt.Errorf("failed to parse plugin integrity pins %q: %v", file, err)
+			}
+		}
+	}
+	if len(repin) == 0 {
+		return i, nil
+	}
+	for _, pluginName := range repin {
+		if pluginName == RepinAllPlugins {
+			i.pins = map[string]string{}
+			break
+		}
+		delete(i.pins, pluginName)
+	}
+	klog.Infof("Re-pinning the entry scripts of plugins %v", repin)
+	if err := i.save(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Pins returns the pinned hashes by plugin.
+func (i *IntegrityPins) Pins() map[string]string {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	pins := make(map[string]string, len(i.pins))
+	for pluginName, pin := range i.pins {
+		pins[pluginName] = pin
+	}
+	return pins
+}
+
+// verify pins the entry script of the plugin if it isn't pinned yet, or else checks it against the pin.
+func (i *IntegrityPins) verify(pluginName string, script []byte) error {
+	sum := sha512.Sum384(script)
+	hash := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	pin, ok := i.pins[pluginName]
+	if ok && pin != hash {
+		return fmt.Errorf("entry script of %q plugin does not match the pinned hash %s", pluginName, pin)
+	}
+	if ok {
+		return nil
+	}
+	klog.Infof("Pinning the entry script of %q plugin to %s", pluginName, hash)
+	i.pins[pluginName] = hash
+	if err := i.save(); err != nil {
+		klog.Errorf("Failed to persist plugin integrity pins: %v", err)
+	}
+	return nil
+}
+
+// save writes the pins to the file if it is set. The caller must hold the lock.
+func (i *IntegrityPins) save() error {
+	if i.file == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(i.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replace the file atomically, so that a crash doesn't lose all pins.
+	tmp, err := ioutil.TempFile(filepath.Dir(i.file), filepath.Base(i.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), i.file)
+}
+
+// PluginIntegrity returns the pinned hashes of the entry scripts of the enabled plugins, for the
+// integrity attributes of their script elements. Local plugins aren't pinned.
+func (p *PluginsHandler) PluginIntegrity() map[string]string {
+	if p.IntegrityPins == nil {
+		return nil
+	}
+	pins := p.IntegrityPins.Pins()
+	integrity := map[string]string{}
+	for _, pluginName := range p.EnabledPlugins() {
+		if _, ok := p.localPlugin(pluginName); ok {
+			continue
+		}
+		if pin, ok := pins[pluginName]; ok {
+			integrity[pluginName] = pin
+		}
+	}
+	return integrity
+}
+
+// pinEntryScript fetches the entry script of the plugin to pin or verify it.
+func (p *PluginsHandler) pinEntryScript(ctx context.Context, pluginName string) error {
+	entryURL, err := p.getServiceRequestURL(pluginName)
+	if err != nil {
+		return err
+	}
+	entryURL.Path = path.Join(entryURL.Path, pluginEntryFile)
+	script, _, err := p.getAsset(ctx, entryURL, maxEntryScriptBytes)
+	if err != nil {
+		klog.V(4).Infof("Failed to fetch the entry script of %q plugin: %v", pluginName, err)
+		return nil
+	}
+	return p.IntegrityPins.verify(pluginName, script)
+}
+
+// proxyEntryScript serves the entry script of the plugin only if it matches its pin.
+func (p *PluginsHandler) proxyEntryScript(requestURL *url.URL, pluginName string, w http.ResponseWriter, r *http.Request) {
+	script, header, err := p.getAsset(r.Context(), requestURL, maxEntryScriptBytes)
+	if err != nil {
+		errMsg := fmt.Sprintf("GET request for %q plugin failed: %v", pluginName, err)
+		klog.Error(errMsg)
+		serverutils.SendResponse(w, http.StatusBadGateway, serverutils.ApiError{Err: errMsg})
+		return
+	}
+	if err := p.IntegrityPins.verify(pluginName, script); err != nil {
+		klog.Error(err)
+		serverutils.SendResponse(w, http.StatusBadGateway, serverutils.ApiError{Err: err.Error()})
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(script)))
+	writeCachedAsset(w, r, &cachedAsset{header: header, body: script, etag: header.Get("ETag")})
+}
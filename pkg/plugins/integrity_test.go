@@ -0,0 +1,87 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func sha384Integrity(content string) string {
+	sum := sha512.Sum384([]byte(content))
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestIntegrityPins(t *testing.T) {
+	service := &fakePluginService{assets: map[string]string{pluginEntryFile: "entry v1", "chunk.js": "chunk"}}
+	h := newTestPluginsHandler(t, service, NewAssetCache(1<<20))
+	pinsFile := filepath.Join(t.TempDir(), "pins.json")
+	pins, err := NewIntegrityPins(pinsFile, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.IntegrityPins = pins
+
+	if w := getPluginAsset(h, pluginEntryFile, nil); w.Code != http.StatusOK || w.Body.String() != "entry v1" {
+		t.Fatalf("expected the entry script to be pinned and served, got %d %q", w.Code, w.Body.String())
+	}
+	expected := map[string]string{"foo": sha384Integrity("entry v1")}
+	if integrity := h.PluginIntegrity(); !reflect.DeepEqual(integrity, expected) {
+		t.Errorf("integrity == %v, want %v", integrity, expected)
+	}
+
+	service.assets[pluginEntryFile] = "entry v2"
+	for _, asset := range []string{pluginEntryFile, "./" + pluginEntryFile, "/" + pluginEntryFile, "chunks/../" + pluginEntryFile} {
+		if w := getPluginAsset(h, asset, nil); w.Code != http.StatusBadGateway {
+			t.Errorf("%s: status == %d, want %d", asset, w.Code, http.StatusBadGateway)
+		}
+	}
+	// Only the entry script is pinned.
+	service.assets["chunk.js"] = "changed chunk"
+	if w := getPluginAsset(h, "chunk.js", nil); w.Code != http.StatusOK {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// The pins are persisted, until the plugin is re-pinned.
+	reloaded, err := NewIntegrityPins(pinsFile, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(reloaded.Pins(), expected) {
+		t.Errorf("pins == %v, want %v", reloaded.Pins(), expected)
+	}
+	repinned, err := NewIntegrityPins(pinsFile, []string{"foo"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.IntegrityPins = repinned
+	if w := getPluginAsset(h, pluginEntryFile, nil); w.Code != http.StatusOK || w.Body.String() != "entry v2" {
+		t.Errorf("expected the upgraded entry script to be pinned, got %d %q", w.Code, w.Body.String())
+	}
+	if pin := repinned.Pins()["foo"]; pin != sha384Integrity("entry v2") {
+		t.Errorf("pin == %q, want %q", pin, sha384Integrity("entry v2"))
+	}
+}
+
+func TestCheckManifestsPinsEntryScripts(t *testing.T) {
+	service := &fakePluginService{assets: map[string]string{
+		pluginManifestFile: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`,
+		pluginEntryFile:    "entry v1",
+	}}
+	h := newTestPluginsHandler(t, service, nil)
+	h.IntegrityPins, _ = NewIntegrityPins("", nil)
+
+	h.CheckManifests(context.Background())
+	if pin := h.IntegrityPins.Pins()["foo"]; pin != sha384Integrity("entry v1") {
+		t.Errorf("pin == %q, want %q", pin, sha384Integrity("entry v1"))
+	}
+
+	service.assets[pluginEntryFile] = "entry v2"
+	h.CheckManifests(context.Background())
+	if compatible := h.CompatiblePlugins(); len(compatible) != 0 {
+		t.Errorf("expected the plugin with a changed entry script to be excluded, got %v", compatible)
+	}
+}
@@ -0,0 +1,143 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+// serveLocalFile serves an asset of a local plugin from its directory. Local plugins change while they
+// are developed, so browsers have to revalidate them on every request.
+func serveLocalFile(w http.ResponseWriter, r *http.Request, dir string, assetPath string) {
+	f, err := openLocalFile(dir, assetPath)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to open %q: %v", assetPath, err)
+		klog.Error(errMsg)
+		serverutils.SendResponse(w, http.StatusNotFound, serverutils.ApiError{Err: errMsg})
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		serverutils.SendResponse(w, http.StatusInternalServerError, serverutils.ApiError{Err: err.Error()})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
+
+// openLocalFile opens a regular file below dir. http.Dir rejects paths that would escape it.
+func openLocalFile(dir string, assetPath string) (http.File, error) {
+	f, err := http.Dir(dir).Open("/" + assetPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%q is a directory", assetPath)
+	}
+	return f, nil
+}
+
+func readLocalManifest(dir string) ([]byte, error) {
+	f, err := openLocalFile(dir, pluginManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(io.LimitReader(f, maxManifestBytes))
+}
+
+// localPlugin returns the directory of the plugin if it is served from disk.
+func (p *PluginsHandler) localPlugin(pluginName string) (string, bool) {
+	dir, ok := p.LocalPlugins[pluginName]
+	return dir, ok
+}
+
+// WatchLocalPlugins watches the directories of the local plugins until the context is done. Every
+// change increments the plugin's revision, which is reported by the check-updates endpoint to reload
+// the clients.
+func (p *PluginsHandler) WatchLocalPlugins(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for pluginName, dir := range p.LocalPlugins {
+		if err := watchDir(watcher, dir); err != nil {
+			return fmt.Errorf("failed to watch %q plugin directory: %v", pluginName, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			klog.Errorf("Error watching local plugins: %v", err)
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Create != 0 {
+				// New directories aren't watched by their parent's watch.
+				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+					if err := watchDir(watcher, event.Name); err != nil {
+						klog.Errorf("Failed to watch %q: %v", event.Name, err)
+					}
+				}
+			}
+			for pluginName, dir := range p.LocalPlugins {
+				if event.Name == dir || strings.HasPrefix(event.Name, filepath.Clean(dir)+string(filepath.Separator)) {
+					klog.V(4).Infof("Local %q plugin changed: %s", pluginName, event)
+					p.localPluginChanged(pluginName)
+				}
+			}
+		}
+	}
+}
+
+func watchDir(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return watcher.Add(path)
+	})
+}
+
+func (p *PluginsHandler) localPluginChanged(pluginName string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.localPluginRevisions == nil {
+		p.localPluginRevisions = map[string]int{}
+	}
+	p.localPluginRevisions[pluginName]++
+	p.requestManifestCheck()
+}
+
+// LocalPluginRevisions returns how often each local plugin changed since the bridge started.
+func (p *PluginsHandler) LocalPluginRevisions() map[string]int {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	revisions := make(map[string]int, len(p.LocalPlugins))
+	for pluginName := range p.LocalPlugins {
+		revisions[pluginName] = p.localPluginRevisions[pluginName]
+	}
+	return revisions
+}
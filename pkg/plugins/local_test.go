@@ -0,0 +1,123 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLocalPluginsHandler(t *testing.T) (*PluginsHandler, string) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "locales", "en"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, content := range map[string]string{
+		pluginManifestFile:            `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`,
+		"main.js":                     "main",
+		"locales/en/plugin__foo.json": `{"Hello":"Hello"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	handler := NewPluginsHandler(http.DefaultClient, map[string]string{"bar": "https://bar"}, "")
+	handler.LocalPlugins = map[string]string{"foo": dir}
+	return handler, dir
+}
+
+func TestLocalPlugins(t *testing.T) {
+	h, _ := newLocalPluginsHandler(t)
+
+	if plugins := h.EnabledPlugins(); !reflect.DeepEqual(plugins, []string{"bar", "foo"}) {
+		t.Errorf("plugins == %v, want %v", plugins, []string{"bar", "foo"})
+	}
+	for asset, expected := range map[string]int{
+		"main.js":          http.StatusOK,
+		"missing.js":       http.StatusNotFound,
+		"locales":          http.StatusNotFound,
+		"../../etc/passwd": http.StatusNotFound,
+	} {
+		w := getPluginAsset(h, asset, nil)
+		if w.Code != expected {
+			t.Errorf("%s: status == %d, want %d", asset, w.Code, expected)
+		}
+	}
+	if w := getPluginAsset(h, "main.js", nil); w.Body.String() != "main" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("unexpected response %q with headers %v", w.Body.String(), w.Header())
+	}
+
+	w := httptest.NewRecorder()
+	h.HandleI18nResources(w, httptest.NewRequest(http.MethodGet, "/locales/resource.json?lng=en&ns=plugin__foo", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"Hello":"Hello"}` {
+		t.Errorf("unexpected locale response %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleCheckUpdates(w, httptest.NewRequest(http.MethodGet, "/api/check-updates", nil))
+	if !strings.Contains(w.Body.String(), `"pluginManifestHashes":{"foo":`) {
+		t.Errorf("expected the manifest of the local plugin to be hashed, got %s", w.Body.String())
+	}
+}
+
+func TestWatchLocalPlugins(t *testing.T) {
+	h, dir := newLocalPluginsHandler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watching := make(chan error, 1)
+	go func() {
+		watching <- h.WatchLocalPlugins(ctx)
+	}()
+
+	checkUpdates := func() map[string]int {
+		w := httptest.NewRecorder()
+		h.HandleCheckUpdates(w, httptest.NewRequest(http.MethodGet, "/api/check-updates", nil))
+		response := struct {
+			LocalPluginRevisions map[string]int `json:"localPluginRevisions"`
+		}{}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.LocalPluginRevisions
+	}
+	if revisions := checkUpdates(); !reflect.DeepEqual(revisions, map[string]int{"foo": 0}) {
+		t.Errorf("revisions == %v, want %v", revisions, map[string]int{"foo": 0})
+	}
+
+	waitForChange := func(change func()) {
+		revision := h.LocalPluginRevisions()["foo"]
+		for deadline := time.Now().Add(5 * time.Second); h.LocalPluginRevisions()["foo"] == revision; {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the change to be detected")
+			}
+			// Changes are repeated, since the watcher may not be running yet.
+			change()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitForChange(func() {
+		ioutil.WriteFile(filepath.Join(dir, "main.js"), []byte("changed"), 0644)
+	})
+	nested := filepath.Join(dir, "chunks")
+	waitForChange(func() {
+		os.Mkdir(nested, 0755)
+	})
+	// Files in new directories are watched as well.
+	time.Sleep(100 * time.Millisecond)
+	waitForChange(func() {
+		ioutil.WriteFile(filepath.Join(nested, "chunk.js"), []byte("chunk"), 0644)
+	})
+	if revisions := checkUpdates(); revisions["foo"] < 3 {
+		t.Errorf("expected at least 3 revisions, got %v", revisions)
+	}
+
+	cancel()
+	if err := <-watching; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
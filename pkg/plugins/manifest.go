@@ -0,0 +1,270 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+const (
+	PluginStatusCompatible   = "Compatible"
+	PluginStatusIncompatible = "Incompatible"
+	// The manifest couldn't be fetched or wasn't checked yet. Such plugins are not excluded, since the
+	// plugin service may just not be ready yet.
+	PluginStatusUnknown = "Unknown"
+
+	pluginAPIDependency = "@console/pluginAPI"
+)
+
+// PluginStatus is the result of the last manifest check of an enabled plugin.
+type PluginStatus struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version,omitempty"`
+	Status    string    `json:"status"`
+	Reasons   []string  `json:"reasons,omitempty"`
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+}
+
+type pluginManifest struct {
+	Name                 string              `json:"name"`
+	Version              string              `json:"version"`
+	Dependencies         map[string]string   `json:"dependencies"`
+	DisableStaticPlugins []string            `json:"disableStaticPlugins,omitempty"`
+	Extensions           []manifestExtension `json:"extensions"`
+}
+
+type manifestExtension struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// validateManifest checks the manifest of the plugin against the manifest schema, and the plugin API
+// dependency against the console version if it is a valid semver version.
+func validateManifest(pluginName string, content []byte, consoleVersion *semver.Version) (*pluginManifest, []string) {
+	manifest := &pluginManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, []string{fmt.Sprintf("invalid manifest: %v", err)}
+	}
+
+	reasons := []string{}
+	if manifest.Name != pluginName {
+		reasons = append(reasons, fmt.Sprintf("manifest name %q does not match the plugin name", manifest.Name))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(manifest.Name) {
+		reasons = append(reasons, fmt.Sprintf("invalid manifest name: %s", msg))
+	}
+	if _, err := semver.StrictNewVersion(manifest.Version); err != nil {
+		reasons = append(reasons, fmt.Sprintf("invalid version %q: %v", manifest.Version, err))
+	}
+
+	if _, ok := manifest.Dependencies[pluginAPIDependency]; !ok {
+		reasons = append(reasons, fmt.Sprintf("missing dependency on %s", pluginAPIDependency))
+	}
+	dependencyNames := make([]string, 0, len(manifest.Dependencies))
+	for name := range manifest.Dependencies {
+		dependencyNames = append(dependencyNames, name)
+	}
+	sort.Strings(dependencyNames)
+	for _, name := range dependencyNames {
+		constraint, err := semver.NewConstraint(manifest.Dependencies[name])
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("invalid version range %q of dependency %s: %v", manifest.Dependencies[name], name, err))
+			continue
+		}
+		if name == pluginAPIDependency && consoleVersion != nil && !satisfies(constraint, consoleVersion) {
+			reasons = append(reasons, fmt.Sprintf("unmet dependency %s: required %s, current %s", name, manifest.Dependencies[name], consoleVersion))
+		}
+	}
+
+	if manifest.Extensions == nil {
+		reasons = append(reasons, "missing extensions")
+	}
+	ids := map[string]int{}
+	for i, extension := range manifest.Extensions {
+		if extension.Type == "" {
+			reasons = append(reasons, fmt.Sprintf("extension %d has no type", i))
+		}
+		if extension.Properties == nil {
+			reasons = append(reasons, fmt.Sprintf("extension %d has no properties", i))
+		}
+		id, ok := extension.Properties["id"].(string)
+		if !ok {
+			continue
+		}
+		key := extension.Type + "/" + id
+		if first, duplicate := ids[key]; duplicate {
+			reasons = append(reasons, fmt.Sprintf("extensions %d and %d of type %s have the same ID %q", first, i, extension.Type, id))
+			continue
+		}
+		ids[key] = i
+	}
+	return manifest, reasons
+}
+
+// satisfies checks the version including prereleases like the frontend does, e.g. 4.11.0-0.nightly
+// satisfies >=4.11.0-0 and ~4.11.
+func satisfies(constraint *semver.Constraints, version *semver.Version) bool {
+	if constraint.Check(version) {
+		return true
+	}
+	release, err := version.SetPrerelease("")
+	return err == nil && constraint.Check(&release)
+}
+
+// RunManifestChecks checks the manifests of the enabled plugins now, then every interval and whenever
+// the enabled plugins change, until the context is done.
+func (p *PluginsHandler) RunManifestChecks(ctx context.Context, interval time.Duration) {
+	p.mux.Lock()
+	p.manifestChecks = make(chan struct{}, 1)
+	p.mux.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.CheckManifests(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.manifestChecks:
+		}
+	}
+}
+
+// CheckManifests fetches and validates the manifests of the enabled plugins. Plugins with invalid
+// manifests and plugins with unmet dependencies on other plugins are incompatible.
+func (p *PluginsHandler) CheckManifests(ctx context.Context) {
+	pluginsList := p.EnabledPlugins()
+	var consoleVersion *semver.Version
+	if v, err := semver.NewVersion(p.ConsoleVersion); err == nil {
+		consoleVersion = v
+	}
+
+	var wg sync.WaitGroup
+	var resultsMux sync.Mutex
+	manifests := map[string]*pluginManifest{}
+	statuses := map[string]*PluginStatus{}
+	for _, pluginName := range pluginsList {
+		wg.Add(1)
+		go func(pluginName string) {
+			defer wg.Done()
+			status := &PluginStatus{Name: pluginName, Status: PluginStatusCompatible, CheckedAt: time.Now()}
+			content, err := p.getManifest(ctx, pluginName)
+			var manifest *pluginManifest
+			if err != nil {
+				status.Status = PluginStatusUnknown
+				status.Reasons = []string{fmt.Sprintf("failed to fetch manifest: %v", err)}
+			} else if manifest, status.Reasons = validateManifest(pluginName, content, consoleVersion); len(status.Reasons) > 0 {
+				status.Status = PluginStatusIncompatible
+			}
+			if manifest != nil {
+				status.Version = manifest.Version
+			}
+			if _, local := p.localPlugin(pluginName); status.Status == PluginStatusCompatible && p.IntegrityPins != nil && !local {
+				if err := p.pinEntryScript(ctx, pluginName); err != nil {
+					status.Status = PluginStatusIncompatible
+					status.Reasons = []string{err.Error()}
+				}
+			}
+			resultsMux.Lock()
+			defer resultsMux.Unlock()
+			statuses[pluginName] = status
+			if status.Status == PluginStatusCompatible {
+				manifests[pluginName] = manifest
+			}
+		}(pluginName)
+	}
+	wg.Wait()
+	checkPluginDependencies(manifests, statuses)
+
+	for _, status := range statuses {
+		if status.Status == PluginStatusIncompatible {
+			klog.Warningf("Excluding incompatible %q plugin: %v", status.Name, status.Reasons)
+		}
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.pluginStatuses = statuses
+}
+
+// checkPluginDependencies marks plugins incompatible whose dependencies on other plugins aren't met by
+// compatible plugins, until all remaining plugins have their dependencies.
+func checkPluginDependencies(manifests map[string]*pluginManifest, statuses map[string]*PluginStatus) {
+	for changed := true; changed; {
+		changed = false
+		for name, manifest := range manifests {
+			reasons := []string{}
+			for dependency, versionRange := range manifest.Dependencies {
+				if dependency == pluginAPIDependency {
+					continue
+				}
+				if status, ok := statuses[dependency]; ok && status.Status == PluginStatusUnknown {
+					// Let the frontend resolve dependencies on plugins that couldn't be checked.
+					continue
+				}
+				required, ok := manifests[dependency]
+				if !ok {
+					reasons = append(reasons, fmt.Sprintf("dependency %s is not available", dependency))
+					continue
+				}
+				constraint, _ := semver.NewConstraint(versionRange)
+				version, _ := semver.NewVersion(required.Version)
+				if !satisfies(constraint, version) {
+					reasons = append(reasons, fmt.Sprintf("unmet dependency %s: required %s, current %s", dependency, versionRange, required.Version))
+				}
+			}
+			if len(reasons) > 0 {
+				sort.Strings(reasons)
+				statuses[name].Status = PluginStatusIncompatible
+				statuses[name].Reasons = reasons
+				delete(manifests, name)
+				changed = true
+			}
+		}
+	}
+}
+
+// CompatiblePlugins returns the sorted names of the enabled plugins that are not known to be incompatible.
+func (p *PluginsHandler) CompatiblePlugins() []string {
+	pluginsList := p.EnabledPlugins()
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	compatible := make([]string, 0, len(pluginsList))
+	for _, pluginName := range pluginsList {
+		if status, ok := p.pluginStatuses[pluginName]; !ok || status.Status != PluginStatusIncompatible {
+			compatible = append(compatible, pluginName)
+		}
+	}
+	return compatible
+}
+
+// HandlePluginsStatus serves the manifest check results of the enabled plugins.
+func (p *PluginsHandler) HandlePluginsStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Method unsupported, the only supported methods is GET"})
+		return
+	}
+	pluginsList := p.EnabledPlugins()
+	p.mux.RLock()
+	statuses := make([]PluginStatus, 0, len(pluginsList))
+	for _, pluginName := range pluginsList {
+		status, ok := p.pluginStatuses[pluginName]
+		if !ok {
+			status = &PluginStatus{Name: pluginName, Status: PluginStatusUnknown, Reasons: []string{"not checked yet"}}
+		}
+		statuses = append(statuses, *status)
+	}
+	p.mux.RUnlock()
+	serverutils.SendResponse(w, http.StatusOK, statuses)
+}
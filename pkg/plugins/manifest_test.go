@@ -0,0 +1,146 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+func TestValidateManifest(t *testing.T) {
+	consoleVersion := semver.MustParse("4.11.0-0.nightly-2022-06-01")
+	tests := []struct {
+		name     string
+		manifest string
+		valid    bool
+	}{
+		{
+			name:     "valid",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"~4.11"},"extensions":[{"type":"console.flag","properties":{}}]}`,
+			valid:    true,
+		},
+		{
+			name:     "prerelease range",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":">=4.11.0-0"},"extensions":[]}`,
+			valid:    true,
+		},
+		{
+			name:     "not json",
+			manifest: `<html></html>`,
+		},
+		{
+			name:     "name mismatch",
+			manifest: `{"name":"bar","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`,
+		},
+		{
+			name:     "invalid version",
+			manifest: `{"name":"foo","version":"1.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`,
+		},
+		{
+			name:     "missing plugin API dependency",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{},"extensions":[]}`,
+		},
+		{
+			name:     "invalid range",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"not a range"},"extensions":[]}`,
+		},
+		{
+			name:     "unmet plugin API dependency",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":">=4.12"},"extensions":[]}`,
+		},
+		{
+			name:     "missing extensions",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"}}`,
+		},
+		{
+			name:     "extension without type",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[{"properties":{}}]}`,
+		},
+		{
+			name: "duplicate extension IDs",
+			manifest: `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[
+				{"type":"console.navigation/href","properties":{"id":"home"}},
+				{"type":"console.navigation/href","properties":{"id":"home"}}
+			]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, reasons := validateManifest("foo", []byte(tt.manifest), consoleVersion)
+			if valid := len(reasons) == 0; valid != tt.valid {
+				t.Errorf("valid == %t, want %t, reasons: %v", valid, tt.valid, reasons)
+			}
+		})
+	}
+
+	// The plugin API dependency isn't checked if the console version isn't semver.
+	manifest := `{"name":"foo","version":"1.0.0","dependencies":{"@console/pluginAPI":">=4.12"},"extensions":[]}`
+	if _, reasons := validateManifest("foo", []byte(manifest), nil); len(reasons) != 0 {
+		t.Errorf("unexpected reasons %v", reasons)
+	}
+}
+
+func TestCheckManifests(t *testing.T) {
+	manifests := map[string]string{
+		"foo":     `{"name":"foo","version":"1.2.0","dependencies":{"@console/pluginAPI":"*"},"extensions":[]}`,
+		"bar":     `{"name":"bar","version":"1.0.0","dependencies":{"@console/pluginAPI":"*","foo":"^1.1.0"},"extensions":[]}`,
+		"baz":     `{"name":"baz","version":"1.0.0","dependencies":{"@console/pluginAPI":"*","bar":"^2.0.0"},"extensions":[]}`,
+		"qux":     `{"name":"qux","version":"1.0.0","dependencies":{"@console/pluginAPI":"*","baz":"*"},"extensions":[]}`,
+		"invalid": `{"name":"invalid"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		manifest, ok := manifests[r.URL.Path[1:len(r.URL.Path)-len(pluginManifestFile)-1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(manifest))
+	}))
+	defer server.Close()
+	endpoints := map[string]string{"unreachable": server.URL + "/unreachable/"}
+	for name := range manifests {
+		endpoints[name] = server.URL + "/" + name + "/"
+	}
+	h := NewPluginsHandler(server.Client(), endpoints, "")
+	h.ConsoleVersion = "4.11.0"
+
+	if compatible := h.CompatiblePlugins(); len(compatible) != len(endpoints) {
+		t.Errorf("expected unchecked plugins to be compatible, got %v", compatible)
+	}
+	h.CheckManifests(context.Background())
+
+	// baz needs bar 2.x, and qux needs the incompatible baz.
+	expected := []string{"bar", "foo", "unreachable"}
+	if compatible := h.CompatiblePlugins(); !reflect.DeepEqual(compatible, expected) {
+		t.Errorf("compatible plugins == %v, want %v", compatible, expected)
+	}
+
+	w := httptest.NewRecorder()
+	h.HandlePluginsStatus(w, httptest.NewRequest(http.MethodGet, "/api/plugins-status", nil))
+	statuses := []PluginStatus{}
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	actual := map[string]string{}
+	for _, status := range statuses {
+		actual[status.Name] = status.Status
+		if status.Status != PluginStatusCompatible && len(status.Reasons) == 0 {
+			t.Errorf("expected reasons for %s plugin", status.Name)
+		}
+	}
+	expectedStatuses := map[string]string{
+		"foo":         PluginStatusCompatible,
+		"bar":         PluginStatusCompatible,
+		"baz":         PluginStatusIncompatible,
+		"qux":         PluginStatusIncompatible,
+		"invalid":     PluginStatusIncompatible,
+		"unreachable": PluginStatusUnknown,
+	}
+	if !reflect.DeepEqual(actual, expectedStatuses) {
+		t.Errorf("statuses == %v, want %v", actual, expectedStatuses)
+	}
+}
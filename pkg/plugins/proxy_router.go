@@ -0,0 +1,51 @@
+package plugins
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProxyRouter serves the proxy services of discovered plugins, which change while the console runs.
+type ProxyRouter struct {
+	mux    sync.RWMutex
+	routes []proxyRoute
+}
+
+type proxyRoute struct {
+	path    string
+	handler http.Handler
+}
+
+// SetRoutes replaces the routes, which map request path prefixes to handlers.
+func (r *ProxyRouter) SetRoutes(routes map[string]http.Handler) {
+	sorted := make([]proxyRoute, 0, len(routes))
+	for path, handler := range routes {
+		sorted = append(sorted, proxyRoute{path: path, handler: handler})
+	}
+	// Match the most specific route first.
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i].path) > len(sorted[j].path)
+	})
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.routes = sorted
+}
+
+func (r *ProxyRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.RLock()
+	var handler http.Handler
+	for _, route := range r.routes {
+		if strings.HasPrefix(req.URL.Path, route.path) {
+			handler = route.handler
+			break
+		}
+	}
+	r.mux.RUnlock()
+	if handler == nil {
+		http.NotFound(w, req)
+		return
+	}
+	handler.ServeHTTP(w, req)
+}
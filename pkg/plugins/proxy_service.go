@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openshift/console/pkg/serverconfig"
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+// configureProxyService validates the service settings and applies them to the handler.
+func configureProxyService(h *PluginsProxyServiceHandler, service serverconfig.ProxyService, serviceAccountToken string) error {
+	if !service.Authorize && (service.ServiceAccountToken || service.AuthorizationHeader != "") {
+		return fmt.Errorf("serviceAccountToken and authorizationHeader require authorize")
+	}
+	if service.ServiceAccountToken {
+		if serviceAccountToken == "" {
+			return fmt.Errorf("no service account token is available")
+		}
+		h.ServiceAccountToken = serviceAccountToken
+	}
+	h.AuthorizationHeader = http.CanonicalHeaderKey(service.AuthorizationHeader)
+
+	h.Headers = http.Header{}
+	for _, header := range service.Headers {
+		if header.Name == "" {
+			return fmt.Errorf("headers must have a name")
+		}
+		value := header.Value
+		if header.ValueFile != "" {
+			if value != "" {
+				return fmt.Errorf("header %q has both a value and a value file", header.Name)
+			}
+			content, err := ioutil.ReadFile(header.ValueFile)
+			if err != nil {
+				return fmt.Errorf("failed to read value of header %q: %v", header.Name, err)
+			}
+			value = strings.TrimSpace(string(content))
+		}
+		h.Headers.Set(header.Name, value)
+	}
+
+	for _, rewrite := range service.PathRewrites {
+		if !strings.HasPrefix(rewrite.Prefix, "/") {
+			return fmt.Errorf("path rewrite prefix %q must start with a slash", rewrite.Prefix)
+		}
+	}
+	h.PathRewrites = service.PathRewrites
+
+	for _, method := range service.AllowedMethods {
+		h.AllowedMethods = append(h.AllowedMethods, strings.ToUpper(method))
+	}
+
+	if service.MaxRequestBytes < 0 || service.MaxResponseBytes < 0 || service.TimeoutSeconds < 0 || service.Retries < 0 {
+		return fmt.Errorf("limits, timeouts and retries must not be negative")
+	}
+	h.MaxRequestBytes = service.MaxRequestBytes
+	h.Timeout = time.Duration(service.TimeoutSeconds) * time.Second
+	h.ProxyConfig.MaxResponseBytes = service.MaxResponseBytes
+	h.ProxyConfig.Retries = service.Retries
+	return nil
+}
+
+// Handler applies the service settings to requests below the console endpoint and passes them to the
+// service proxy. Authorized requests must already carry the user's token in the Authorization header.
+func (h *PluginsProxyServiceHandler) Handler(serviceProxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(h.AllowedMethods) > 0 && !h.allowsMethod(r.Method) {
+			allowed := strings.Join(h.AllowedMethods, ", ")
+			w.Header().Set("Allow", allowed)
+			serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: fmt.Sprintf("Unsupported method, supported methods are %s", allowed)})
+			return
+		}
+
+		if h.MaxRequestBytes > 0 {
+			if r.ContentLength > h.MaxRequestBytes {
+				serverutils.SendResponse(w, http.StatusRequestEntityTooLarge, serverutils.ApiError{Err: fmt.Sprintf("Request body exceeds the limit of %d bytes", h.MaxRequestBytes)})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, h.MaxRequestBytes)
+		}
+
+		if h.Authorize {
+			if h.ServiceAccountToken != "" {
+				r.Header.Set("Authorization", "Bearer "+h.ServiceAccountToken)
+			} else if h.AuthorizationHeader != "" && h.AuthorizationHeader != "Authorization" {
+				token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				r.Header.Del("Authorization")
+				r.Header.Set(h.AuthorizationHeader, token)
+			}
+		}
+		for name, values := range h.Headers {
+			r.Header[name] = values
+		}
+
+		for _, rewrite := range h.PathRewrites {
+			if strings.HasPrefix(r.URL.Path, rewrite.Prefix) {
+				r.URL.Path = rewrite.Replacement + strings.TrimPrefix(r.URL.Path, rewrite.Prefix)
+				r.URL.RawPath = ""
+				break
+			}
+		}
+
+		// Websocket sessions are long-lived and limited by the websocket settings instead.
+		if h.Timeout > 0 && !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		serviceProxy.ServeHTTP(w, r)
+	})
+}
+
+func (h *PluginsProxyServiceHandler) allowsMethod(method string) bool {
+	for _, allowed := range h.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openshift/console/pkg/serverconfig"
+)
+
+// echoHandler records the request it receives instead of proxying it.
+type echoHandler struct {
+	request *http.Request
+}
+
+func (e *echoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ioutil.ReadAll(r.Body)
+	e.request = r
+}
+
+func newTestProxyServiceHandler(t *testing.T, service serverconfig.ProxyService) *PluginsProxyServiceHandler {
+	service.Endpoint = "https://service.ns.svc:9443"
+	service.ConsoleAPIPath = "/api/proxy/plugin/foo/bar/"
+	handlers, err := GetPluginProxyServiceHandlers(&serverconfig.Proxy{Services: []serverconfig.ProxyService{service}}, &tls.Config{}, "/api/proxy/", "sa-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return handlers[0]
+}
+
+func TestProxyServiceHeaders(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		service         serverconfig.ProxyService
+		expectedHeaders map[string]string
+	}{
+		{
+			name:            "user token",
+			service:         serverconfig.ProxyService{Authorize: true},
+			expectedHeaders: map[string]string{"Authorization": "Bearer user-token"},
+		},
+		{
+			name:            "user token in custom header",
+			service:         serverconfig.ProxyService{Authorize: true, AuthorizationHeader: "x-forwarded-access-token"},
+			expectedHeaders: map[string]string{"Authorization": "", "X-Forwarded-Access-Token": "user-token"},
+		},
+		{
+			name:            "service account token",
+			service:         serverconfig.ProxyService{Authorize: true, ServiceAccountToken: true},
+			expectedHeaders: map[string]string{"Authorization": "Bearer sa-token"},
+		},
+		{
+			name: "static headers",
+			service: serverconfig.ProxyService{Headers: []serverconfig.ProxyServiceHeader{
+				{Name: "X-Tenant", Value: "console"},
+				{Name: "X-Api-Key", ValueFile: secretFile},
+			}},
+			expectedHeaders: map[string]string{"X-Tenant": "console", "X-Api-Key": "secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := &echoHandler{}
+			h := newTestProxyServiceHandler(t, tt.service).Handler(echo)
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.Header.Set("Authorization", "Bearer user-token")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			for name, expected := range tt.expectedHeaders {
+				if actual := echo.request.Header.Get(name); actual != expected {
+					t.Errorf("header %s == %q, want %q", name, actual, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyServiceRequests(t *testing.T) {
+	echo := &echoHandler{}
+	handler := newTestProxyServiceHandler(t, serverconfig.ProxyService{
+		PathRewrites:    []serverconfig.ProxyServicePathRewrite{{Prefix: "/v1/", Replacement: "/api/v2/"}},
+		AllowedMethods:  []string{"get", "post"},
+		MaxRequestBytes: 4,
+		TimeoutSeconds:  10,
+		Retries:         2,
+	})
+	if handler.ProxyConfig.Retries != 2 {
+		t.Errorf("retries == %d, want %d", handler.ProxyConfig.Retries, 2)
+	}
+	h := handler.Handler(echo)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/items", nil))
+	if echo.request.URL.Path != "/api/v2/items" {
+		t.Errorf("path == %q, want %q", echo.request.URL.Path, "/api/v2/items")
+	}
+	if _, ok := echo.request.Context().Deadline(); !ok {
+		t.Errorf("expected the request to have a deadline")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/v1/items", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("expected DELETE to be rejected, got %d with Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/items", strings.NewReader("too large")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestProxyServiceValidation(t *testing.T) {
+	for name, service := range map[string]serverconfig.ProxyService{
+		"service account token without authorize": {ServiceAccountToken: true},
+		"header without name":                     {Headers: []serverconfig.ProxyServiceHeader{{Value: "v"}}},
+		"missing header value file":               {Headers: []serverconfig.ProxyServiceHeader{{Name: "X-Api-Key", ValueFile: "/does/not/exist"}}},
+		"relative rewrite prefix":                 {PathRewrites: []serverconfig.ProxyServicePathRewrite{{Prefix: "v1"}}},
+		"negative timeout":                        {TimeoutSeconds: -1},
+	} {
+		service.Endpoint = "https://service.ns.svc:9443"
+		if _, err := GetPluginProxyServiceHandlers(&serverconfig.Proxy{Services: []serverconfig.ProxyService{service}}, &tls.Config{}, "/api/proxy/", "sa-token"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultCompressionMinSize is the smallest response (or websocket message) in bytes that gets compressed.
+const DefaultCompressionMinSize = 1024
+
+// brotliLevel trades some compression for speed, since responses are compressed on the fly.
+const brotliLevel = 4
+
+// CompressionConfig controls compression of proxied responses and websocket messages.
+type CompressionConfig struct {
+	// DisableHTTP turns off compression of proxied HTTP responses.
+	DisableHTTP bool
+	// DisableWebsocket turns off the permessage-deflate websocket extension.
+	DisableWebsocket bool
+	// MinSize is the minimum size in bytes of a response or websocket message to be compressed.
+	// Responses with unknown length (e.g. watches) are always compressed.
+	MinSize int
+}
+
+func (c *CompressionConfig) httpEnabled() bool {
+	return c != nil && !c.DisableHTTP
+}
+
+func (c *CompressionConfig) websocketEnabled() bool {
+	return c != nil && !c.DisableWebsocket
+}
+
+func (c *CompressionConfig) minSize() int {
+	if c == nil || c.MinSize <= 0 {
+		return DefaultCompressionMinSize
+	}
+	return c.MinSize
+}
+
+// contentEncoder creates a compressing writer for a content-coding.
+type contentEncoder struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return gz
+	},
+}
+
+var brotliWriterPool = sync.Pool{
+	New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotliLevel)
+	},
+}
+
+// Supported content-codings in order of preference, brotli compresses JSON better than gzip.
+var contentEncoders = []contentEncoder{
+	{
+		name: "br",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			br := brotliWriterPool.Get().(*brotli.Writer)
+			br.Reset(w)
+			return &pooledBrotliWriter{br}
+		},
+	},
+	{
+		name: "gzip",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			gz := gzipWriterPool.Get().(*gzip.Writer)
+			gz.Reset(w)
+			return &pooledGzipWriter{gz}
+		},
+	},
+}
+
+type pooledBrotliWriter struct {
+	*brotli.Writer
+}
+
+func (w *pooledBrotliWriter) Close() error {
+	err := w.Writer.Close()
+	brotliWriterPool.Put(w.Writer)
+	return err
+}
+
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	gzipWriterPool.Put(w.Writer)
+	return err
+}
+
+// negotiateEncoding picks the preferred content-coding accepted by the client, honoring q=0.
+func negotiateEncoding(acceptEncoding string) *contentEncoder {
+	if acceptEncoding == "" {
+		return nil
+	}
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q > 0
+	}
+	for i := range contentEncoders {
+		encoder := &contentEncoders[i]
+		if ok, found := accepted[encoder.name]; found {
+			if ok {
+				return encoder
+			}
+			continue
+		}
+		if accepted["*"] {
+			return encoder
+		}
+	}
+	return nil
+}
+
+// isCompressibleContentType reports whether the media type is JSON or YAML, including
+// Kubernetes specific variants like application/merge-patch+json or application/apply-patch+yaml.
+func isCompressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "application/json", mediaType == "application/yaml",
+		mediaType == "application/x-yaml", mediaType == "text/yaml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+yaml"):
+		return true
+	}
+	return false
+}
+
+// compressResponseWriter compresses the response body if the upstream response is
+// compressible and was not already encoded by the upstream.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoder     *contentEncoder
+	minSize     int
+	writer      io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if w.shouldCompress(statusCode) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoder.name)
+		w.writer = w.encoder.newWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *compressResponseWriter) shouldCompress(statusCode int) bool {
+	h := w.Header()
+	if statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || !isCompressibleContentType(h.Get("Content-Type")) {
+		return false
+	}
+	if contentLength := h.Get("Content-Length"); contentLength != "" {
+		length, err := strconv.Atoi(contentLength)
+		if err == nil && length < w.minSize {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.writer.Write(b)
+}
+
+// Flush is needed by httputil.ReverseProxy to stream watch responses.
+func (w *compressResponseWriter) Flush() {
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("response writer does not support hijacking")
+}
+
+func (w *compressResponseWriter) Close() error {
+	if w.writer == nil {
+		return nil
+	}
+	return w.writer.Close()
+}
+
+// compressHandler serves the request with next, compressing the response if the client allows it.
+func compressHandler(config *CompressionConfig, w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	encoder := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoder == nil || r.Method == http.MethodHead {
+		next(w, r)
+		return
+	}
+	cw := &compressResponseWriter{
+		ResponseWriter: w,
+		encoder:        encoder,
+		minSize:        config.minSize(),
+	}
+	defer cw.Close()
+	next(cw, r)
+}
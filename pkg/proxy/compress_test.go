@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{acceptEncoding: "", expected: ""},
+		{acceptEncoding: "gzip, deflate, br", expected: "br"},
+		{acceptEncoding: "gzip, deflate", expected: "gzip"},
+		{acceptEncoding: "br;q=0, gzip", expected: "gzip"},
+		{acceptEncoding: "GZIP", expected: "gzip"},
+		{acceptEncoding: "gzip;q=0, deflate", expected: ""},
+		{acceptEncoding: "identity", expected: ""},
+		{acceptEncoding: "*", expected: "br"},
+		{acceptEncoding: "*, br;q=0", expected: "gzip"},
+		{acceptEncoding: "*, br;q=0, gzip;q=0", expected: ""},
+	}
+	for _, tt := range tests {
+		encoder := negotiateEncoding(tt.acceptEncoding)
+		actual := ""
+		if encoder != nil {
+			actual = encoder.name
+		}
+		if actual != tt.expected {
+			t.Errorf("negotiateEncoding(%q) == %q, expected %q", tt.acceptEncoding, actual, tt.expected)
+		}
+	}
+}
+
+func TestIsCompressibleContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "application/json", expected: true},
+		{contentType: "application/json; charset=utf-8", expected: true},
+		{contentType: "application/yaml", expected: true},
+		{contentType: "application/merge-patch+json", expected: true},
+		{contentType: "application/vnd.kubernetes.protobuf", expected: false},
+		{contentType: "text/html", expected: false},
+		{contentType: "", expected: false},
+	}
+	for _, tt := range tests {
+		if actual := isCompressibleContentType(tt.contentType); actual != tt.expected {
+			t.Errorf("isCompressibleContentType(%q) == %v, expected %v", tt.contentType, actual, tt.expected)
+		}
+	}
+}
+
+func TestProxyCompression(t *testing.T) {
+	largeBody := `{"items":"` + strings.Repeat("a", 4096) + `"}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(largeBody))
+	})
+	mux.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(strings.Repeat("a", 4096)))
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	proxyServer := httptest.NewServer(NewProxy(&Config{
+		Endpoint:    targetURL,
+		Compression: &CompressionConfig{},
+	}))
+	defer proxyServer.Close()
+
+	// Disable transparent decompression to inspect the raw response.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path string, acceptEncoding string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		return res
+	}
+
+	res := get("/large", "gzip")
+	defer res.Body.Close()
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoded response, got Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("failed to create gzip reader: %v", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to read gzip body: %v", err)
+	}
+	if string(body) != largeBody {
+		t.Errorf("decompressed body does not match upstream body")
+	}
+
+	res = get("/large", "gzip, br")
+	defer res.Body.Close()
+	if res.Header.Get("Content-Encoding") != "br" {
+		t.Fatalf("expected brotli encoded response, got Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+	body, err = ioutil.ReadAll(brotli.NewReader(res.Body))
+	if err != nil {
+		t.Fatalf("failed to read brotli body: %v", err)
+	}
+	if string(body) != largeBody {
+		t.Errorf("decompressed brotli body does not match upstream body")
+	}
+
+	for _, path := range []string{"/small", "/html"} {
+		res := get(path, "gzip, br")
+		res.Body.Close()
+		if res.Header.Get("Content-Encoding") != "" {
+			t.Errorf("expected %s not to be compressed, got Content-Encoding %q", path, res.Header.Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestProxyWebsocketCompression(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lower", lowercaseServer(t))
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	proxyServer := httptest.NewServer(NewProxy(&Config{
+		Endpoint:    targetURL,
+		Compression: &CompressionConfig{MinSize: 1},
+	}))
+	defer proxyServer.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	headers := http.Header{}
+	headers.Add("Origin", "http://localhost")
+	ws, res, err := dialer.Dial(toWSScheme(proxyServer.URL)+"/lower", headers)
+	if err != nil {
+		t.Fatalf("error connecting to proxy as websocket: %v", err)
+	}
+	defer ws.Close()
+
+	if !strings.Contains(res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Errorf("expected permessage-deflate to be negotiated, got %q", res.Header.Get("Sec-Websocket-Extensions"))
+	}
+
+	ws.WriteMessage(websocket.TextMessage, []byte("HELLO"))
+	msg, err := readStringFromWS(ws)
+	if err != nil {
+		t.Fatalf("error reading from websocket: %v", err)
+	}
+	if msg != "hello" {
+		t.Errorf("msg == %v, want %v", msg, "hello")
+	}
+}
@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+const (
+	impersonateUserHeader        = "Impersonate-User"
+	impersonateGroupHeader       = "Impersonate-Group"
+	impersonateExtraHeaderPrefix = "Impersonate-Extra-"
+
+	// Websocket clients can't set headers, so browsers send impersonation as subprotocols:
+	// `Impersonate-User.<name>`, `Impersonate-Group.<name>` and `Impersonate-Extra.<key>.<value>`,
+	// with every part encoded as described in decodeSubprotocol.
+	impersonateUserProtocolPrefix  = "Impersonate-User."
+	impersonateGroupProtocolPrefix = "Impersonate-Group."
+	impersonateExtraProtocolPrefix = "Impersonate-Extra."
+
+	maxImpersonationValueLength = 1024
+	maxImpersonationGroups      = 100
+
+	impersonationReviewCacheTTL  = 30 * time.Second
+	impersonationReviewCacheSize = 10000
+	impersonationReviewTimeout   = 10 * time.Second
+
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+	authenticatedGroup           = "system:authenticated"
+)
+
+// ImpersonationConfig controls the checks done for requests that impersonate another user.
+type ImpersonationConfig struct {
+	// AccessReview checks with a SelfSubjectAccessReview that the user is allowed to impersonate
+	// the requested user, groups and extras before the request is proxied. This rejects websockets
+	// with a readable error instead of a failed handshake.
+	AccessReview bool
+}
+
+// impersonation is a validated set of identities to impersonate.
+type impersonation struct {
+	user   string
+	groups []string
+	extra  map[string][]string
+}
+
+func (i *impersonation) String() string {
+	return fmt.Sprintf("user=%q groups=%q extra=%q", i.user, i.groups, i.extra)
+}
+
+// parseImpersonation reads impersonation headers and, for websockets, subprotocols. It returns nil if the
+// request does not impersonate anyone, and the subprotocols that are not impersonation related.
+func parseImpersonation(header http.Header, isWebsocket bool) (*impersonation, []string, error) {
+	imp := &impersonation{extra: map[string][]string{}}
+	if values := header.Values(impersonateUserHeader); len(values) > 0 {
+		if len(values) > 1 {
+			return nil, nil, fmt.Errorf("only one %s header is allowed", impersonateUserHeader)
+		}
+		imp.user = values[0]
+	}
+	imp.groups = append(imp.groups, header.Values(impersonateGroupHeader)...)
+	for name, values := range header {
+		if !strings.HasPrefix(name, impersonateExtraHeaderPrefix) {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimPrefix(name, impersonateExtraHeaderPrefix))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s header %q: %v", impersonateExtraHeaderPrefix, name, err)
+		}
+		key = strings.ToLower(key)
+		imp.extra[key] = append(imp.extra[key], values...)
+	}
+
+	var protocols []string
+	if isWebsocket {
+		for _, value := range header.Values("Sec-Websocket-Protocol") {
+			for _, protocol := range strings.Split(value, ",") {
+				protocol = strings.TrimSpace(protocol)
+				if protocol == "" {
+					continue
+				}
+				handled, err := imp.parseSubprotocol(protocol)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !handled {
+					protocols = append(protocols, protocol)
+				}
+			}
+		}
+	}
+
+	if imp.user == "" && len(imp.groups) == 0 && len(imp.extra) == 0 {
+		return nil, protocols, nil
+	}
+	if err := imp.validate(); err != nil {
+		return nil, nil, err
+	}
+	return imp, protocols, nil
+}
+
+// parseSubprotocol adds the identity from an impersonation subprotocol and reports whether the
+// subprotocol was an impersonation subprotocol.
+func (i *impersonation) parseSubprotocol(protocol string) (bool, error) {
+	switch {
+	case strings.HasPrefix(protocol, impersonateUserProtocolPrefix):
+		user, err := decodeSubprotocol(strings.TrimPrefix(protocol, impersonateUserProtocolPrefix))
+		if err != nil {
+			return true, fmt.Errorf("error decoding Impersonate-User subprotocol: %v", err)
+		}
+		i.user = user
+	case strings.HasPrefix(protocol, impersonateGroupProtocolPrefix):
+		group, err := decodeSubprotocol(strings.TrimPrefix(protocol, impersonateGroupProtocolPrefix))
+		if err != nil {
+			return true, fmt.Errorf("error decoding Impersonate-Group subprotocol: %v", err)
+		}
+		i.groups = append(i.groups, group)
+	case strings.HasPrefix(protocol, impersonateExtraProtocolPrefix):
+		parts := strings.Split(strings.TrimPrefix(protocol, impersonateExtraProtocolPrefix), ".")
+		if len(parts) != 2 {
+			return true, fmt.Errorf("invalid Impersonate-Extra subprotocol, expected Impersonate-Extra.<key>.<value>")
+		}
+		key, err := decodeSubprotocol(parts[0])
+		if err != nil {
+			return true, fmt.Errorf("error decoding Impersonate-Extra subprotocol key: %v", err)
+		}
+		value, err := decodeSubprotocol(parts[1])
+		if err != nil {
+			return true, fmt.Errorf("error decoding Impersonate-Extra subprotocol value: %v", err)
+		}
+		key = strings.ToLower(key)
+		i.extra[key] = append(i.extra[key], value)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// validate trims surrounding whitespace and rejects values that could be used to smuggle headers or
+// confuse audit logs. Kubernetes requires a user whenever groups or extras are impersonated.
+func (i *impersonation) validate() error {
+	var err error
+	if i.user, err = sanitizeImpersonationValue("user", i.user); err != nil {
+		return err
+	}
+	if i.user == "" {
+		return fmt.Errorf("%s is required when impersonating groups or extras", impersonateUserHeader)
+	}
+
+	if len(i.groups) > maxImpersonationGroups {
+		return fmt.Errorf("at most %d groups can be impersonated", maxImpersonationGroups)
+	}
+	groups := make([]string, 0, len(i.groups))
+	seen := map[string]bool{}
+	for _, group := range i.groups {
+		if group, err = sanitizeImpersonationValue("group", group); err != nil {
+			return err
+		}
+		if group == "" {
+			return fmt.Errorf("impersonated group must not be empty")
+		}
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	i.groups = groups
+
+	for key, values := range i.extra {
+		if !isValidExtraKey(key) {
+			return fmt.Errorf("invalid impersonated extra key %q", key)
+		}
+		for j, value := range values {
+			if values[j], err = sanitizeImpersonationValue("extra "+key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sanitizeImpersonationValue(field, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > maxImpersonationValueLength {
+		return "", fmt.Errorf("impersonated %s is longer than %d characters", field, maxImpersonationValueLength)
+	}
+	if !utf8.ValidString(value) {
+		return "", fmt.Errorf("impersonated %s is not valid UTF-8", field)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("impersonated %s must not contain control characters", field)
+		}
+	}
+	return value, nil
+}
+
+// apply replaces all impersonation headers with the validated values. `system:authenticated` is
+// added when impersonating groups so that basic requests that all users can run like self-subject
+// access reviews work.
+func (i *impersonation) apply(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, impersonateExtraHeaderPrefix) {
+			header.Del(name)
+		}
+	}
+	header.Set(impersonateUserHeader, i.user)
+	header.Del(impersonateGroupHeader)
+	if len(i.groups) > 0 {
+		for _, group := range i.groups {
+			header.Add(impersonateGroupHeader, group)
+		}
+		if !containsString(i.groups, authenticatedGroup) {
+			header.Add(impersonateGroupHeader, authenticatedGroup)
+		}
+	}
+	for key, values := range i.extra {
+		for _, value := range values {
+			header.Add(impersonateExtraHeaderPrefix+escapeHeaderKey(key), value)
+		}
+	}
+}
+
+// resourceAttributes returns the checks the API server does for the impersonation, see
+// k8s.io/apiserver/pkg/endpoints/filters/impersonation.go.
+func (i *impersonation) resourceAttributes() []authv1.ResourceAttributes {
+	var attributes []authv1.ResourceAttributes
+	if strings.HasPrefix(i.user, serviceAccountUsernamePrefix) && strings.Count(i.user, ":") == 3 {
+		parts := strings.Split(strings.TrimPrefix(i.user, serviceAccountUsernamePrefix), ":")
+		attributes = append(attributes, authv1.ResourceAttributes{Verb: "impersonate", Resource: "serviceaccounts", Namespace: parts[0], Name: parts[1]})
+	} else {
+		attributes = append(attributes, authv1.ResourceAttributes{Verb: "impersonate", Resource: "users", Name: i.user})
+	}
+	groups := i.groups
+	if len(groups) > 0 && !containsString(groups, authenticatedGroup) {
+		groups = append(append([]string{}, groups...), authenticatedGroup)
+	}
+	for _, group := range groups {
+		attributes = append(attributes, authv1.ResourceAttributes{Verb: "impersonate", Resource: "groups", Name: group})
+	}
+	keys := make([]string, 0, len(i.extra))
+	for key := range i.extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range i.extra[key] {
+			attributes = append(attributes, authv1.ResourceAttributes{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: key, Name: value})
+		}
+	}
+	return attributes
+}
+
+// auditImpersonation logs who impersonated whom for every proxied request.
+func auditImpersonation(r *http.Request, imp *impersonation, outcome string) {
+	requester := getUserKey(r)
+	if requester == "" {
+		requester = "unknown"
+	}
+	klog.Infof("AUDIT impersonation requester=%q %s method=%s path=%q outcome=%s", requester, imp, r.Method, r.URL.Path, outcome)
+}
+
+// impersonationReviewer checks impersonation permissions with the requester's credentials.
+type impersonationReviewer struct {
+	endpoint  *url.URL
+	transport http.RoundTripper
+
+	mux   sync.Mutex
+	cache map[string]time.Time
+}
+
+func newImpersonationReviewer(endpoint *url.URL, transport http.RoundTripper) *impersonationReviewer {
+	return &impersonationReviewer{
+		endpoint:  endpoint,
+		transport: transport,
+		cache:     map[string]time.Time{},
+	}
+}
+
+// review returns an error if the requester is not allowed to impersonate all requested identities.
+// Allowed reviews are cached briefly since the frontend sends many requests while impersonating.
+func (ir *impersonationReviewer) review(r *http.Request, imp *impersonation) error {
+	authorization := r.Header.Get("Authorization")
+	for _, attributes := range imp.resourceAttributes() {
+		key := impersonationReviewCacheKey(authorization, attributes)
+		if ir.cached(key) {
+			continue
+		}
+		allowed, err := ir.selfSubjectAccessReview(r.Context(), authorization, attributes)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("not allowed to impersonate %s %q", attributes.Resource, attributes.Name)
+		}
+		ir.store(key)
+	}
+	return nil
+}
+
+func (ir *impersonationReviewer) selfSubjectAccessReview(ctx context.Context, authorization string, attributes authv1.ResourceAttributes) (bool, error) {
+	config := &rest.Config{
+		Host:        ir.endpoint.String(),
+		BearerToken: strings.TrimPrefix(authorization, "Bearer "),
+		Transport:   ir.transport,
+		Timeout:     impersonationReviewTimeout,
+	}
+	allowed, err := serverutils.SelfSubjectAccessReview(ctx, config, attributes)
+	if err != nil {
+		return false, fmt.Errorf("failed to check impersonation permission: %v", err)
+	}
+	return allowed, nil
+}
+
+func (ir *impersonationReviewer) cached(key string) bool {
+	ir.mux.Lock()
+	defer ir.mux.Unlock()
+	expires, ok := ir.cache[key]
+	return ok && time.Now().Before(expires)
+}
+
+func (ir *impersonationReviewer) store(key string) {
+	ir.mux.Lock()
+	defer ir.mux.Unlock()
+	now := time.Now()
+	if len(ir.cache) >= impersonationReviewCacheSize {
+		for k, expires := range ir.cache {
+			if now.After(expires) {
+				delete(ir.cache, k)
+			}
+		}
+		if len(ir.cache) >= impersonationReviewCacheSize {
+			ir.cache = map[string]time.Time{}
+		}
+	}
+	ir.cache[key] = now.Add(impersonationReviewCacheTTL)
+}
+
+func impersonationReviewCacheKey(authorization string, attributes authv1.ResourceAttributes) string {
+	sum := sha256.Sum256([]byte(authorization))
+	return strings.Join([]string{hex.EncodeToString(sum[:]), attributes.Group, attributes.Resource, attributes.Subresource, attributes.Namespace, attributes.Name}, "\x00")
+}
+
+// escapeHeaderKey percent-encodes all characters that aren't allowed in header names, the same way
+// client-go encodes Impersonate-Extra keys.
+func escapeHeaderKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isTokenChar(c) && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// isValidExtraKey allows printable ASCII, the characters that aren't allowed in header names are escaped.
+func isValidExtraKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r >= utf8.RuneSelf || unicode.IsControl(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&'*+-.^_`|~", c) >= 0
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	authv1 "k8s.io/api/authorization/v1"
+)
+
+func encodeTestSubprotocol(s string) string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(s))
+	encoded = strings.Replace(encoded, "=", "_", -1)
+	return strings.Replace(encoded, "/", "-", -1)
+}
+
+func TestParseImpersonation(t *testing.T) {
+	tests := []struct {
+		name              string
+		header            http.Header
+		isWebsocket       bool
+		expected          *impersonation
+		expectedProtocols []string
+		expectErr         bool
+	}{
+		{
+			name:   "no impersonation",
+			header: http.Header{"Authorization": {"Bearer token"}},
+		},
+		{
+			name: "user and multiple groups from headers",
+			header: http.Header{
+				"Impersonate-User":  {" alice "},
+				"Impersonate-Group": {"devs", "ops", "devs"},
+			},
+			expected: &impersonation{user: "alice", groups: []string{"devs", "ops"}, extra: map[string][]string{}},
+		},
+		{
+			name: "extras from headers",
+			header: http.Header{
+				"Impersonate-User": {"alice"},
+				"Impersonate-Extra-Scopes.authorization.openshift.io": {"user:info", "user:check-access"},
+			},
+			expected: &impersonation{user: "alice", groups: []string{}, extra: map[string][]string{
+				"scopes.authorization.openshift.io": {"user:info", "user:check-access"},
+			}},
+		},
+		{
+			name: "group subprotocol does not impersonate the group as user",
+			header: http.Header{"Sec-Websocket-Protocol": {
+				"Impersonate-User." + encodeTestSubprotocol("alice") + ", Impersonate-Group." + encodeTestSubprotocol("devs") + ", base64.channel.k8s.io",
+			}},
+			isWebsocket:       true,
+			expected:          &impersonation{user: "alice", groups: []string{"devs"}, extra: map[string][]string{}},
+			expectedProtocols: []string{"base64.channel.k8s.io"},
+		},
+		{
+			name: "extra subprotocol",
+			header: http.Header{"Sec-Websocket-Protocol": {
+				"Impersonate-User." + encodeTestSubprotocol("alice") + ",Impersonate-Extra." + encodeTestSubprotocol("reason") + "." + encodeTestSubprotocol("debugging"),
+			}},
+			isWebsocket: true,
+			expected:    &impersonation{user: "alice", groups: []string{}, extra: map[string][]string{"reason": {"debugging"}}},
+		},
+		{
+			name:      "group without user",
+			header:    http.Header{"Impersonate-Group": {"devs"}},
+			expectErr: true,
+		},
+		{
+			name: "group subprotocol without user",
+			header: http.Header{"Sec-Websocket-Protocol": {
+				"Impersonate-Group." + encodeTestSubprotocol("devs"),
+			}},
+			isWebsocket: true,
+			expectErr:   true,
+		},
+		{
+			name: "newline in subprotocol user",
+			header: http.Header{"Sec-Websocket-Protocol": {
+				"Impersonate-User." + encodeTestSubprotocol("alice\r\nImpersonate-Group: system:masters"),
+			}},
+			isWebsocket: true,
+			expectErr:   true,
+		},
+		{
+			name:      "multiple users",
+			header:    http.Header{"Impersonate-User": {"alice", "bob"}},
+			expectErr: true,
+		},
+		{
+			name:      "invalid subprotocol encoding",
+			header:    http.Header{"Sec-Websocket-Protocol": {"Impersonate-User.!!!"}},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imp, protocols, err := parseImpersonation(tt.header, tt.isWebsocket || tt.expectErr)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", imp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(imp, tt.expected) {
+				t.Errorf("impersonation == %v, want %v", imp, tt.expected)
+			}
+			if !reflect.DeepEqual(protocols, tt.expectedProtocols) {
+				t.Errorf("protocols == %v, want %v", protocols, tt.expectedProtocols)
+			}
+		})
+	}
+}
+
+func TestImpersonationApply(t *testing.T) {
+	header := http.Header{
+		"Impersonate-User":        {"ignored"},
+		"Impersonate-Extra-Stale": {"value"},
+	}
+	imp := &impersonation{
+		user:   "alice",
+		groups: []string{"devs"},
+		extra:  map[string][]string{"example.com/reason": {"debugging"}},
+	}
+	imp.apply(header)
+
+	// Header names are canonicalized, the API server lowercases extra keys before unescaping them.
+	expected := http.Header{}
+	expected.Add("Impersonate-User", "alice")
+	expected.Add("Impersonate-Group", "devs")
+	expected.Add("Impersonate-Group", "system:authenticated")
+	expected.Add("Impersonate-Extra-example.com%2Freason", "debugging")
+	if !reflect.DeepEqual(header, expected) {
+		t.Errorf("header == %v, want %v", header, expected)
+	}
+}
+
+func TestProxyImpersonationAccessReview(t *testing.T) {
+	var reviews int32
+	var upstreamHeader http.Header
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reviews, 1)
+		review := authv1.SelfSubjectAccessReview{}
+		json.NewDecoder(r.Body).Decode(&review)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = r.Header.Get("Authorization") == "Bearer admin" && attributes.Verb == "impersonate" &&
+			attributes.Name != "system:masters"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	})
+	mux.HandleFunc("/api/v1/pods", func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.Write([]byte("ok"))
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	proxyServer := httptest.NewServer(NewProxy(&Config{
+		Endpoint:      targetURL,
+		Impersonation: &ImpersonationConfig{AccessReview: true},
+	}))
+	defer proxyServer.Close()
+
+	get := func(token string, groups ...string) int {
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+"/api/v1/pods", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Impersonate-User", "alice")
+		for _, group := range groups {
+			req.Header.Add("Impersonate-Group", group)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := get("admin", "devs"); code != http.StatusOK {
+		t.Fatalf("status == %d, want %d", code, http.StatusOK)
+	}
+	if !reflect.DeepEqual(upstreamHeader.Values("Impersonate-Group"), []string{"devs", "system:authenticated"}) {
+		t.Errorf("upstream groups == %v", upstreamHeader.Values("Impersonate-Group"))
+	}
+	// user, devs and system:authenticated
+	if reviews != 3 {
+		t.Errorf("reviews == %d, want 3", reviews)
+	}
+	if code := get("admin", "devs"); code != http.StatusOK || reviews != 3 {
+		t.Errorf("expected cached reviews, got status %d and %d reviews", code, reviews)
+	}
+	if code := get("admin", "system:masters"); code != http.StatusForbidden {
+		t.Errorf("status == %d, want %d", code, http.StatusForbidden)
+	}
+	if code := get("developer"); code != http.StatusForbidden {
+		t.Errorf("status == %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestProxyWebsocketImpersonation(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		silentServer(w, r)
+	}))
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	proxyServer := httptest.NewServer(NewProxy(&Config{Endpoint: targetURL}))
+	defer proxyServer.Close()
+
+	protocols := []string{
+		"Impersonate-User." + encodeTestSubprotocol("alice"),
+		"Impersonate-Group." + encodeTestSubprotocol("devs"),
+		"Impersonate-Group." + encodeTestSubprotocol("ops"),
+	}
+	dialer := &websocket.Dialer{Subprotocols: protocols}
+	ws, res, err := dialer.Dial(toWSScheme(proxyServer.URL)+"/watch", nil)
+	if err != nil {
+		t.Fatalf("error connecting to proxy as websocket: %v", err)
+	}
+	defer ws.Close()
+
+	if res.Header.Get("Sec-Websocket-Protocol") != protocols[2] {
+		t.Errorf("negotiated subprotocol == %q, want %q", res.Header.Get("Sec-Websocket-Protocol"), protocols[2])
+	}
+	if upstreamHeader.Get("Impersonate-User") != "alice" {
+		t.Errorf("Impersonate-User == %q, want %q", upstreamHeader.Get("Impersonate-User"), "alice")
+	}
+	expectedGroups := []string{"devs", "ops", "system:authenticated"}
+	if !reflect.DeepEqual(upstreamHeader.Values("Impersonate-Group"), expectedGroups) {
+		t.Errorf("Impersonate-Group == %v, want %v", upstreamHeader.Values("Impersonate-Group"), expectedGroups)
+	}
+	if upstreamHeader.Get("Sec-Websocket-Protocol") != "" {
+		t.Errorf("expected impersonation subprotocols not to be sent upstream, got %q", upstreamHeader.Get("Sec-Websocket-Protocol"))
+	}
+}
@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+const (
+	// ProjectionFieldsParam is a comma separated list of JSONPath-like field paths (e.g. `{.status.phase},spec.nodeName`)
+	// that list and watch responses should be trimmed to.
+	ProjectionFieldsParam = "fields"
+	// ProjectionParam selects a predefined projection. The only supported value is "metadata".
+	ProjectionParam    = "projection"
+	projectionMetadata = "metadata"
+
+	partialObjectMetadataListAccept = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1,application/json"
+	partialObjectMetadataAccept     = "application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1,application/json"
+)
+
+// Fields that are always kept so that the frontend can key table rows and resume watches.
+var projectionRequiredFields = [][]string{
+	{"apiVersion"},
+	{"kind"},
+	{"metadata", "name"},
+	{"metadata", "namespace"},
+	{"metadata", "uid"},
+	{"metadata", "resourceVersion"},
+}
+
+type projectionContextKey struct{}
+
+// projection describes which fields of the objects in a list or watch response are sent to the client.
+type projection struct {
+	fields       [][]string
+	metadataOnly bool
+	watch        bool
+}
+
+// parseProjection reads the projection query parameters and removes them from the query,
+// since the API server does not know about them. It returns nil if no projection was requested.
+func parseProjection(query url.Values) (*projection, error) {
+	rawFields := query.Get(ProjectionFieldsParam)
+	rawProjection := query.Get(ProjectionParam)
+	query.Del(ProjectionFieldsParam)
+	query.Del(ProjectionParam)
+
+	if rawFields == "" && rawProjection == "" {
+		return nil, nil
+	}
+	if rawFields != "" && rawProjection != "" {
+		return nil, fmt.Errorf("%q and %q query parameters are mutually exclusive", ProjectionFieldsParam, ProjectionParam)
+	}
+
+	watch := query.Get("watch")
+	p := &projection{
+		fields: append([][]string{}, projectionRequiredFields...),
+		watch:  watch == "true" || watch == "1",
+	}
+
+	if rawProjection != "" {
+		if rawProjection != projectionMetadata {
+			return nil, fmt.Errorf("unsupported projection %q, only %q is supported", rawProjection, projectionMetadata)
+		}
+		p.metadataOnly = true
+		p.fields = append(p.fields, []string{"metadata"})
+		return p, nil
+	}
+
+	for _, field := range strings.Split(rawFields, ",") {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		if path != nil {
+			p.fields = append(p.fields, path)
+		}
+	}
+	return p, nil
+}
+
+// parseFieldPath accepts both the `{.metadata.name}` JSONPath form and the plain `metadata.name` form.
+// Array indexes are not supported, arrays are traversed and every element is projected instead.
+func parseFieldPath(field string) ([]string, error) {
+	field = strings.TrimSpace(field)
+	field = strings.TrimPrefix(field, "{")
+	field = strings.TrimSuffix(field, "}")
+	field = strings.TrimPrefix(field, "$")
+	field = strings.TrimPrefix(field, ".")
+	if field == "" {
+		return nil, nil
+	}
+	segments := strings.Split(field, ".")
+	for i, segment := range segments {
+		segment = strings.TrimSuffix(segment, "[*]")
+		if segment == "" || strings.ContainsAny(segment, "[]{}()?@*,'\"") {
+			return nil, fmt.Errorf("invalid field path %q", field)
+		}
+		segments[i] = segment
+	}
+	return segments, nil
+}
+
+// acceptHeader returns the Accept header to send upstream, or an empty string if
+// the original one should be kept. Asking for PartialObjectMetadata lets the API server
+// do the trimming for us when only metadata is needed.
+func (p *projection) acceptHeader() string {
+	if !p.metadataOnly {
+		return ""
+	}
+	if p.watch {
+		return partialObjectMetadataAccept
+	}
+	return partialObjectMetadataListAccept
+}
+
+func (p *projection) project(obj interface{}) interface{} {
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return obj
+	}
+	projected := map[string]interface{}{}
+	for _, path := range p.fields {
+		copyField(projected, m, path)
+	}
+	return projected
+}
+
+// copyField copies the value at path from src to dst, creating intermediate objects as needed.
+func copyField(dst, src map[string]interface{}, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := dst[path[0]].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			dst[path[0]] = child
+		}
+		copyField(child, v, path[1:])
+	case []interface{}:
+		children, ok := dst[path[0]].([]interface{})
+		if !ok || len(children) != len(v) {
+			children = make([]interface{}, len(v))
+			dst[path[0]] = children
+		}
+		for i, item := range v {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			child, ok := children[i].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				children[i] = child
+			}
+			copyField(child, itemMap, path[1:])
+		}
+	}
+}
+
+// projectList streams a list response from src to dst, decoding one item at a time
+// so that memory use is bounded by the size of the largest item instead of the whole list.
+func (p *projection) projectList(dst io.Writer, src io.Reader) error {
+	decoder := json.NewDecoder(src)
+	decoder.UseNumber()
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(dst, "{"); err != nil {
+		return err
+	}
+
+	first := true
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v in list response", token)
+		}
+		if !first {
+			if _, err := io.WriteString(dst, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		encodedKey, _ := json.Marshal(key)
+		if _, err := dst.Write(append(encodedKey, ':')); err != nil {
+			return err
+		}
+
+		if key != "items" {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return err
+			}
+			if _, err := dst.Write(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := p.projectItems(dst, decoder); err != nil {
+			return err
+		}
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return err
+	}
+	_, err := io.WriteString(dst, "}")
+	return err
+}
+
+func (p *projection) projectItems(dst io.Writer, decoder *json.Decoder) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		_, err := io.WriteString(dst, "null")
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected items to be an array, got %v", token)
+	}
+	if _, err := io.WriteString(dst, "["); err != nil {
+		return err
+	}
+	for i := 0; decoder.More(); i++ {
+		var item interface{}
+		if err := decoder.Decode(&item); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(p.project(item))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(dst, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(encoded); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(decoder, ']'); err != nil {
+		return err
+	}
+	_, err = io.WriteString(dst, "]")
+	return err
+}
+
+// projectWatch rewrites a stream of watch events, one event at a time.
+func (p *projection) projectWatch(dst io.Writer, src io.Reader) error {
+	decoder := json.NewDecoder(src)
+	decoder.UseNumber()
+	for {
+		var event struct {
+			Type   string      `json:"type"`
+			Object interface{} `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Error events carry a Status object, which should reach the client untouched.
+		if event.Type != "ERROR" {
+			event.Object = p.project(event.Object)
+		}
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(append(encoded, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+func expectDelim(decoder *json.Decoder, expected json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return fmt.Errorf("expected %q, got %v", expected, token)
+	}
+	return nil
+}
+
+// Subresources of namespaces, which the API server doesn't mistake for namespaced resources.
+var namespaceSubresources = map[string]bool{"status": true, "finalize": true}
+
+// parseCollectionPath reports whether a Kubernetes API path names a collection of resources, which list
+// and watch requests are made against, and whether it is a legacy /watch/ path.
+func parseCollectionPath(path string) (collection bool, watch bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return false, false
+	}
+	if len(parts) > 0 && parts[0] == "watch" {
+		watch = true
+		parts = parts[1:]
+	}
+	if len(parts) > 2 && parts[0] == "namespaces" && !namespaceSubresources[parts[2]] {
+		parts = parts[2:]
+	}
+	return len(parts) == 1 && parts[0] != "", watch
+}
+
+// prepareProjection strips the projection parameters from the request and, if a projection was
+// requested, returns a request carrying it in its context for modifyResponse to pick up. Projections
+// are only supported for list and watch requests.
+func prepareProjection(r *http.Request) (*http.Request, error) {
+	query := r.URL.Query()
+	p, err := parseProjection(query)
+	if err != nil || p == nil {
+		return r, err
+	}
+	collection, watchPath := parseCollectionPath(r.URL.Path)
+	if r.Method != http.MethodGet || !collection {
+		return r, fmt.Errorf("%q and %q query parameters are only supported for list and watch requests", ProjectionFieldsParam, ProjectionParam)
+	}
+	p.watch = p.watch || watchPath
+	r.URL.RawQuery = query.Encode()
+
+	if accept := p.acceptHeader(); accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	// Let the transport negotiate and transparently decode compression, since the body is rewritten.
+	r.Header.Del("Accept-Encoding")
+
+	return r.WithContext(context.WithValue(r.Context(), projectionContextKey{}, p)), nil
+}
+
+// applyProjection replaces the response body with a projected stream if the request asked for it.
+func applyProjection(r *http.Response) {
+	if r.Request == nil || r.StatusCode != http.StatusOK {
+		return
+	}
+	p, ok := r.Request.Context().Value(projectionContextKey{}).(*projection)
+	if !ok || p == nil {
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || r.Header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	src := r.Body
+	reader, writer := io.Pipe()
+	go func() {
+		defer src.Close()
+		var err error
+		if p.watch {
+			err = p.projectWatch(writer, src)
+		} else {
+			err = p.projectList(writer, src)
+		}
+		if err != nil {
+			klog.Errorf("failed to project response for %v: %v", r.Request.URL, err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	r.Body = reader
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+}
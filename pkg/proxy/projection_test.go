@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPodList = `{
+	"kind": "PodList",
+	"apiVersion": "v1",
+	"metadata": {"resourceVersion": "42", "continue": "abc"},
+	"items": [
+		{
+			"metadata": {"name": "a", "namespace": "ns", "uid": "1", "resourceVersion": "40", "labels": {"app": "a"}},
+			"spec": {"nodeName": "node-1", "containers": [{"name": "c1", "image": "i1"}, {"name": "c2", "image": "i2"}]},
+			"status": {"phase": "Running", "podIP": "10.0.0.1"}
+		},
+		{
+			"metadata": {"name": "b", "namespace": "ns", "uid": "2", "resourceVersion": "41"},
+			"spec": {"nodeName": "node-2", "containers": []},
+			"status": {"phase": "Pending"}
+		}
+	]
+}`
+
+func TestParseProjection(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectNil      bool
+		expectErr      bool
+		expectFields   [][]string
+		expectWatch    bool
+		expectMetaOnly bool
+		expectQuery    string
+	}{
+		{
+			name:        "no projection",
+			query:       "limit=250",
+			expectNil:   true,
+			expectQuery: "limit=250",
+		},
+		{
+			name:         "jsonpath and dotted fields",
+			query:        "fields=%7B.status.phase%7D,spec.containers[*].name&limit=250",
+			expectFields: append(append([][]string{}, projectionRequiredFields...), []string{"status", "phase"}, []string{"spec", "containers", "name"}),
+			expectQuery:  "limit=250",
+		},
+		{
+			name:           "metadata projection on watch",
+			query:          "projection=metadata&watch=true",
+			expectFields:   append(append([][]string{}, projectionRequiredFields...), []string{"metadata"}),
+			expectWatch:    true,
+			expectMetaOnly: true,
+			expectQuery:    "watch=true",
+		},
+		{
+			name:      "unknown projection",
+			query:     "projection=spec",
+			expectErr: true,
+		},
+		{
+			name:      "fields and projection together",
+			query:     "projection=metadata&fields=status.phase",
+			expectErr: true,
+		},
+		{
+			name:      "filter expressions are rejected",
+			query:     "fields=" + url.QueryEscape("{.items[?(@.x)]}"),
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("invalid test query: %v", err)
+			}
+			p, err := parseProjection(query)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if query.Encode() != tt.expectQuery {
+				t.Errorf("query was %q, expected %q", query.Encode(), tt.expectQuery)
+			}
+			if tt.expectNil {
+				if p != nil {
+					t.Errorf("expected no projection, got %v", p)
+				}
+				return
+			}
+			if !reflect.DeepEqual(p.fields, tt.expectFields) {
+				t.Errorf("fields were %v, expected %v", p.fields, tt.expectFields)
+			}
+			if p.watch != tt.expectWatch {
+				t.Errorf("watch was %v, expected %v", p.watch, tt.expectWatch)
+			}
+			if p.metadataOnly != tt.expectMetaOnly {
+				t.Errorf("metadataOnly was %v, expected %v", p.metadataOnly, tt.expectMetaOnly)
+			}
+		})
+	}
+}
+
+func TestProjectList(t *testing.T) {
+	query, _ := url.ParseQuery("fields=status.phase,spec.containers.name")
+	p, err := parseProjection(query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := p.projectList(&out, strings.NewReader(testPodList)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{
+		"kind": "PodList",
+		"apiVersion": "v1",
+		"metadata": {"resourceVersion": "42", "continue": "abc"},
+		"items": [
+			{
+				"metadata": {"name": "a", "namespace": "ns", "uid": "1", "resourceVersion": "40"},
+				"spec": {"containers": [{"name": "c1"}, {"name": "c2"}]},
+				"status": {"phase": "Running"}
+			},
+			{
+				"metadata": {"name": "b", "namespace": "ns", "uid": "2", "resourceVersion": "41"},
+				"spec": {"containers": []},
+				"status": {"phase": "Pending"}
+			}
+		]
+	}`
+	assertJSONEqual(t, out.Bytes(), []byte(expected))
+}
+
+func TestProjectWatch(t *testing.T) {
+	query, _ := url.ParseQuery("fields=status.phase&watch=1")
+	p, err := parseProjection(query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	events := `{"type":"ADDED","object":{"metadata":{"name":"a","labels":{"x":"y"}},"status":{"phase":"Running","podIP":"1"}}}
+{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired"}}
+`
+	var out bytes.Buffer
+	if err := p.projectWatch(&out, strings.NewReader(events)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, got %d: %q", len(lines), out.String())
+	}
+	assertJSONEqual(t, []byte(lines[0]), []byte(`{"type":"ADDED","object":{"metadata":{"name":"a"},"status":{"phase":"Running"}}}`))
+	assertJSONEqual(t, []byte(lines[1]), []byte(`{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired"}}`))
+}
+
+func TestProxyProjection(t *testing.T) {
+	var upstreamQuery, upstreamAccept string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamQuery = r.URL.RawQuery
+		upstreamAccept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testPodList))
+	}))
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	p := NewProxy(&Config{
+		Endpoint:         targetURL,
+		EnableProjection: true,
+	})
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	res, err := http.Get(proxyServer.URL + "/api/v1/pods?projection=metadata&limit=10")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if upstreamQuery != "limit=10" {
+		t.Errorf("upstream query was %q, expected projection parameters to be stripped", upstreamQuery)
+	}
+	if upstreamAccept != partialObjectMetadataListAccept {
+		t.Errorf("upstream Accept was %q, expected %q", upstreamAccept, partialObjectMetadataListAccept)
+	}
+
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("unexpected error decoding %q: %v", string(body), err)
+	}
+	if len(list.Items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(list.Items))
+	}
+	for _, item := range list.Items {
+		if _, ok := item["spec"]; ok {
+			t.Errorf("expected spec to be projected away: %v", item)
+		}
+		if _, ok := item["metadata"]; !ok {
+			t.Errorf("expected metadata to be kept: %v", item)
+		}
+	}
+
+	res, err = http.Get(proxyServer.URL + "/api/v1/pods?projection=bogus")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid projection, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+
+	upstreamQuery = ""
+	res, err = http.Get(proxyServer.URL + "/api/v1/namespaces/default/pods/pod-a?projection=metadata")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || upstreamQuery != "" {
+		t.Errorf("expected projections of single objects to be rejected, got status %d", res.StatusCode)
+	}
+	res, err = http.Post(proxyServer.URL+"/api/v1/namespaces/default/pods?fields=spec.nodeName", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected projections of non-GET requests to be rejected, got status %d", res.StatusCode)
+	}
+}
+
+func TestParseCollectionPath(t *testing.T) {
+	for _, tt := range []struct {
+		path       string
+		collection bool
+		watch      bool
+	}{
+		{path: "/api/v1/pods", collection: true},
+		{path: "/api/v1/namespaces", collection: true},
+		{path: "/api/v1/namespaces/default", collection: false},
+		{path: "/api/v1/namespaces/default/status", collection: false},
+		{path: "/api/v1/namespaces/default/pods", collection: true},
+		{path: "/api/v1/namespaces/default/pods/pod-a", collection: false},
+		{path: "/api/v1/namespaces/default/pods/pod-a/log", collection: false},
+		{path: "/apis/apps/v1/namespaces/default/deployments", collection: true},
+		{path: "/apis/apps/v1/deployments/", collection: true},
+		{path: "/api/v1/watch/namespaces/default/pods", collection: true, watch: true},
+		{path: "/apis/apps/v1", collection: false},
+		{path: "/version", collection: false},
+	} {
+		collection, watch := parseCollectionPath(tt.path)
+		if collection != tt.collection || watch != tt.watch {
+			t.Errorf("%s: expected collection %v and watch %v, got %v and %v", tt.path, tt.collection, tt.watch, collection, watch)
+		}
+	}
+}
+
+func assertJSONEqual(t *testing.T, actual, expected []byte) {
+	t.Helper()
+	var a, e interface{}
+	if err := json.Unmarshal(actual, &a); err != nil {
+		t.Fatalf("invalid JSON %q: %v", string(actual), err)
+	}
+	if err := json.Unmarshal(expected, &e); err != nil {
+		t.Fatalf("invalid JSON %q: %v", string(expected), err)
+	}
+	if !reflect.DeepEqual(a, e) {
+		t.Errorf("JSON does not match expectation:\n%s\nbut got\n%s", string(expected), string(actual))
+	}
+}
@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -11,25 +14,44 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"k8s.io/klog"
 )
 
-var websocketPingInterval = 30 * time.Second
-var websocketTimeout = 30 * time.Second
-
 type Config struct {
 	HeaderBlacklist []string
 	Endpoint        *url.URL
 	TLSClientConfig *tls.Config
 	Origin          string
+	// EnableProjection allows clients to trim list and watch responses with the
+	// `fields` and `projection` query parameters.
+	EnableProjection bool
+	// Compression configures compression of responses and websocket messages, nil disables it.
+	Compression *CompressionConfig
+	// Websocket configures keepalives, session timeouts and connection limits. Defaults are used if nil.
+	Websocket *WebsocketConfig
+	// Recorder records websocket sessions. Sessions are not recorded if nil.
+	Recorder WebsocketRecorder
+	// Impersonation configures checks for impersonated requests. Impersonation headers are
+	// validated and audited even if nil.
+	Impersonation *ImpersonationConfig
+	// Retries is how often idempotent requests without a body are retried after connection errors and
+	// 502, 503 or 504 responses.
+	Retries int
+	// MaxResponseBytes fails responses with larger bodies, 0 to not limit them.
+	MaxResponseBytes int64
+	// ErrorHandler responds to requests that failed to be proxied. The reverse proxy responds with
+	// 502 Bad Gateway to all of them if it is nil.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
 }
 
 type Proxy struct {
-	reverseProxy *httputil.ReverseProxy
-	config       *Config
+	reverseProxy          *httputil.ReverseProxy
+	config                *Config
+	impersonationReviewer *impersonationReviewer
 }
 
 // These headers aren't things that proxies should pass along. Some are forbidden by http2.
@@ -57,16 +79,79 @@ func NewProxy(cfg *Config) *Proxy {
 	reverseProxy := httputil.NewSingleHostReverseProxy(cfg.Endpoint)
 	reverseProxy.FlushInterval = time.Millisecond * 100
 	reverseProxy.Transport = transport
+	if cfg.Retries > 0 {
+		reverseProxy.Transport = &retryTransport{next: transport, retries: cfg.Retries}
+	}
+	reverseProxy.ErrorHandler = cfg.ErrorHandler
 	reverseProxy.ModifyResponse = FilterHeaders
+	if cfg.EnableProjection || cfg.MaxResponseBytes > 0 {
+		reverseProxy.ModifyResponse = func(r *http.Response) error {
+			if cfg.MaxResponseBytes > 0 {
+				if err := limitResponse(r, cfg.MaxResponseBytes); err != nil {
+					return err
+				}
+			}
+			if cfg.EnableProjection {
+				applyProjection(r)
+			}
+			return FilterHeaders(r)
+		}
+	}
 
 	proxy := &Proxy{
 		reverseProxy: reverseProxy,
 		config:       cfg,
 	}
+	if cfg.Impersonation != nil && cfg.Impersonation.AccessReview {
+		proxy.impersonationReviewer = newImpersonationReviewer(cfg.Endpoint, transport)
+	}
 
 	return proxy
 }
 
+// TimeoutErrorHandler responds like the default error handler of the reverse proxy, but with 504 Gateway
+// Timeout if the request timed out.
+func TimeoutErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("http: proxy error: %v", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// limitResponse rejects responses that announce a larger body than maxBytes and fails reading bodies
+// of unknown length once they exceed it, which aborts the response to the client.
+func limitResponse(r *http.Response, maxBytes int64) error {
+	if r.ContentLength > maxBytes {
+		r.Body.Close()
+		return fmt.Errorf("response body of %d bytes exceeds the limit of %d bytes", r.ContentLength, maxBytes)
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, remaining: maxBytes}
+	return nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("response body exceeds the size limit")
+	}
+	// Read one byte more than allowed to tell bodies at the limit from larger ones.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("response body exceeds the size limit")
+	}
+	return n, err
+}
+
 func SingleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -124,10 +209,22 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Header.Del(h)
 	}
 
-	// Include `system:authenticated` when impersonating groups so that basic requests that all
-	// users can run like self-subject access reviews work.
-	if len(r.Header["Impersonate-Group"]) > 0 {
-		r.Header.Add("Impersonate-Group", "system:authenticated")
+	imp, protocols, err := parseImpersonation(r.Header, isWebsocket)
+	if err != nil {
+		klog.Warningf("Rejecting request to %v with invalid impersonation: %v", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if imp != nil {
+		if p.impersonationReviewer != nil {
+			if err := p.impersonationReviewer.review(r, imp); err != nil {
+				auditImpersonation(r, imp, "denied")
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		imp.apply(r.Header)
+		auditImpersonation(r, imp, "proxied")
 	}
 
 	r.Host = p.config.Endpoint.Host
@@ -135,6 +232,17 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.URL.Scheme = p.config.Endpoint.Scheme
 
 	if !isWebsocket {
+		if p.config.EnableProjection {
+			var err error
+			if r, err = prepareProjection(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if p.config.Compression.httpEnabled() {
+			compressHandler(p.config.Compression, w, r, p.reverseProxy.ServeHTTP)
+			return
+		}
 		p.reverseProxy.ServeHTTP(w, r)
 		return
 	}
@@ -147,47 +255,18 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL.Scheme = "ws"
 	}
 
+	// The client must get back one of the subprotocols it offered. Impersonation subprotocols are
+	// bridge specific and never sent to the backend, but are the only ones offered by watches.
 	subProtocol := ""
-	proxiedHeader := make(http.Header, len(r.Header))
-	for key, value := range r.Header {
-		if key != "Sec-Websocket-Protocol" {
-			// Do not proxy the subprotocol to the API server because k8s does not understand what we're sending
-			proxiedHeader.Set(key, r.Header.Get(key))
-			continue
-		}
-
-		for _, protocols := range value {
-			for _, protocol := range strings.Split(protocols, ",") {
-				protocol = strings.TrimSpace(protocol)
-				// TODO: secure by stripping newlines & other invalid stuff
-				// "Impersonate-User" and "Impersonate-Group" and bridge specific (not a k8s thing)
-				if strings.HasPrefix(protocol, "Impersonate-User.") {
-					encodedProtocol := strings.TrimPrefix(protocol, "Impersonate-User.")
-					decodedProtocol, err := decodeSubprotocol(encodedProtocol)
-					if err != nil {
-						errMsg := fmt.Sprintf("Error decoding Impersonate-User subprotocol: %v", err)
-						http.Error(w, errMsg, http.StatusBadRequest)
-						return
-					}
-					proxiedHeader.Set("Impersonate-User", decodedProtocol)
-					subProtocol = protocol
-				} else if strings.HasPrefix(protocol, "Impersonate-Group.") {
-					encodedProtocol := strings.TrimPrefix(protocol, "Impersonate-Group.")
-					decodedProtocol, err := decodeSubprotocol(encodedProtocol)
-					if err != nil {
-						errMsg := fmt.Sprintf("Error decoding Impersonate-Group subprotocol: %v", err)
-						http.Error(w, errMsg, http.StatusBadRequest)
-						return
-					}
-					proxiedHeader.Set("Impersonate-User", string(decodedProtocol))
-					proxiedHeader.Set("Impersonate-Group", string(decodedProtocol))
-					subProtocol = protocol
-				} else {
-					proxiedHeader.Set("Sec-Websocket-Protocol", protocol)
-					subProtocol = protocol
-				}
-			}
-		}
+	if offered := r.Header.Values("Sec-Websocket-Protocol"); len(offered) > 0 {
+		offeredProtocols := strings.Split(offered[len(offered)-1], ",")
+		subProtocol = strings.TrimSpace(offeredProtocols[len(offeredProtocols)-1])
+	}
+	proxiedHeader := r.Header.Clone()
+	proxiedHeader.Del("Sec-Websocket-Protocol")
+	if len(protocols) > 0 {
+		subProtocol = protocols[len(protocols)-1]
+		proxiedHeader.Set("Sec-Websocket-Protocol", subProtocol)
 	}
 
 	// Filter websocket headers.
@@ -207,8 +286,51 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// required to supply an origin.
 	proxiedHeader.Add("Origin", "http://localhost")
 
+	upgrader := &websocket.Upgrader{
+		Subprotocols:      []string{subProtocol},
+		EnableCompression: p.config.Compression.websocketEnabled(),
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header["Origin"]
+			if p.config.Origin == "" {
+				log.Printf("CheckOrigin: Proxy has no configured Origin. Allowing origin %v to %v", origin, r.URL)
+				return true
+			}
+			if len(origin) == 0 {
+				log.Printf("CheckOrigin: No origin header. Denying request to %v", r.URL)
+				return false
+			}
+			if p.config.Origin == origin[0] {
+				return true
+			}
+			log.Printf("CheckOrigin '%v' != '%v'", p.config.Origin, origin[0])
+			return false
+		},
+	}
+
+	wsConfig := p.config.Websocket
+	var limiter *WebsocketLimiter
+	if wsConfig != nil {
+		limiter = wsConfig.Limiter
+	}
+	release, err := limiter.acquire(getUserKey(r))
+	if err != nil {
+		klog.Warningf("Rejecting websocket to %v: %v", r.URL.Path, err)
+		// Browsers can't read the status of a failed websocket handshake, so complete it and
+		// tell the client why with a close frame instead.
+		frontend, upgradeErr := upgrader.Upgrade(w, r, nil)
+		if upgradeErr != nil {
+			log.Printf("Failed to upgrade websocket to client: '%v'", upgradeErr)
+			return
+		}
+		closeWebsocket(frontend, nil, websocket.CloseTryAgainLater, err.Error(), wsConfig.timeout())
+		frontend.Close()
+		return
+	}
+	defer release()
+
 	dialer := &websocket.Dialer{
-		TLSClientConfig: p.config.TLSClientConfig,
+		TLSClientConfig:   p.config.TLSClientConfig,
+		EnableCompression: p.config.Compression.websocketEnabled(),
 	}
 
 	backend, resp, err := dialer.Dial(r.URL.String(), proxiedHeader)
@@ -230,32 +352,13 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer backend.Close()
 
-	upgrader := &websocket.Upgrader{
-		Subprotocols: []string{subProtocol},
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header["Origin"]
-			if p.config.Origin == "" {
-				log.Printf("CheckOrigin: Proxy has no configured Origin. Allowing origin %v to %v", origin, r.URL)
-				return true
-			}
-			if len(origin) == 0 {
-				log.Printf("CheckOrigin: No origin header. Denying request to %v", r.URL)
-				return false
-			}
-			if p.config.Origin == origin[0] {
-				return true
-			}
-			log.Printf("CheckOrigin '%v' != '%v'", p.config.Origin, origin[0])
-			return false
-		},
-	}
 	frontend, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade websocket to client: '%v'", err)
 		return
 	}
 
-	ticker := time.NewTicker(websocketPingInterval)
+	ticker := time.NewTicker(wsConfig.pingInterval())
 	var writeMutex sync.Mutex // Needed because ticker & copy are writing to frontend in separate goroutines
 
 	defer func() {
@@ -263,11 +366,39 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		frontend.Close()
 	}()
 
+	maxIdle, maxSessionDuration := wsConfig.sessionLimits(r)
+	var sessionTimeout <-chan time.Time
+	if maxSessionDuration > 0 {
+		sessionTimer := time.NewTimer(maxSessionDuration)
+		defer sessionTimer.Stop()
+		sessionTimeout = sessionTimer.C
+	}
+	var idleCheck <-chan time.Time
+	if maxIdle > 0 {
+		idleTicker := time.NewTicker(idleCheckInterval(maxIdle))
+		defer idleTicker.Stop()
+		idleCheck = idleTicker.C
+	}
+	lastActivity := time.Now().UnixNano()
+
+	var recordClient, recordBackend func(int, []byte)
+	if p.config.Recorder != nil {
+		if recording := p.config.Recorder.Record(r, backend.Subprotocol()); recording != nil {
+			defer recording.Close()
+			recordClient, recordBackend = recording.ClientMessage, recording.BackendMessage
+		}
+	}
+
 	errc := make(chan error, 2)
 
 	// Can't just use io.Copy here since browsers care about frame headers.
-	go func() { errc <- copyMsgs(nil, frontend, backend) }()
-	go func() { errc <- copyMsgs(&writeMutex, backend, frontend) }()
+	compressionMinSize := p.config.Compression.minSize()
+	go func() {
+		errc <- copyMsgs(nil, frontend, backend, compressionMinSize, &lastActivity, recordBackend)
+	}()
+	go func() {
+		errc <- copyMsgs(&writeMutex, backend, frontend, compressionMinSize, &lastActivity, recordClient)
+	}()
 
 	for {
 		select {
@@ -277,21 +408,54 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case <-ticker.C:
 			writeMutex.Lock()
 			// Send pings to client to prevent load balancers and other middlemen from closing the connection early
-			err := frontend.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(websocketTimeout))
+			err := frontend.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(wsConfig.timeout()))
 			writeMutex.Unlock()
 			if err != nil {
 				return
 			}
+		case <-idleCheck:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+			if idle >= maxIdle {
+				klog.Infof("Closing idle websocket session to %v after %v", r.URL.Path, idle.Round(time.Second))
+				consoleProxyWebsocketClosedTotal.WithLabelValues(closeReasonIdleTimeout).Inc()
+				closeWebsocket(frontend, &writeMutex, websocket.CloseNormalClosure, "session idle timeout", wsConfig.timeout())
+				return
+			}
+		case <-sessionTimeout:
+			klog.Infof("Closing websocket session to %v after the maximum session duration of %v", r.URL.Path, maxSessionDuration)
+			consoleProxyWebsocketClosedTotal.WithLabelValues(closeReasonMaxDuration).Inc()
+			closeWebsocket(frontend, &writeMutex, websocket.CloseNormalClosure, "maximum session duration reached", wsConfig.timeout())
+			return
 		}
 	}
 }
 
-func copyMsgs(writeMutex *sync.Mutex, dest, src *websocket.Conn) error {
+// idleCheckInterval checks often enough that sessions are closed at most a few seconds late.
+func idleCheckInterval(maxIdle time.Duration) time.Duration {
+	interval := maxIdle / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	return interval
+}
+
+// copyMsgs copies messages from src to dest, passing them to record if it is not nil, and records
+// the time of the last message in lastActivity. Messages smaller than compressionMinSize are sent
+// uncompressed, which is a no-op if permessage-deflate was not negotiated with the peer.
+func copyMsgs(writeMutex *sync.Mutex, dest, src *websocket.Conn, compressionMinSize int, lastActivity *int64, record func(int, []byte)) error {
 	for {
 		messageType, msg, err := src.ReadMessage()
 		if err != nil {
 			return err
 		}
+		atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+		if record != nil {
+			record(messageType, msg)
+		}
+		dest.EnableWriteCompression(len(msg) >= compressionMinSize)
 
 		if writeMutex == nil {
 			err = dest.WriteMessage(messageType, msg)
@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -63,6 +65,80 @@ func TestProxyHTTP(t *testing.T) {
 
 }
 
+func TestProxyRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	targetURL, _ := url.Parse(server.URL)
+	p := NewProxy(&Config{Endpoint: targetURL, Retries: 2})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || requests != 3 {
+		t.Errorf("expected success after %d requests, got %d after %d", 3, w.Code, requests)
+	}
+
+	requests = 0
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body")))
+	if w.Code != http.StatusServiceUnavailable || requests != 1 {
+		t.Errorf("expected POST requests not to be retried, got %d after %d requests", w.Code, requests)
+	}
+}
+
+func TestProxyMaxResponseBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer server.Close()
+	targetURL, _ := url.Parse(server.URL)
+	p := NewProxy(&Config{Endpoint: targetURL, MaxResponseBytes: 4})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?body=four", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "four" {
+		t.Errorf("expected a response at the limit to pass, got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?body=fives", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status == %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestProxyErrorHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	targetURL, _ := url.Parse(server.URL)
+
+	for _, tt := range []struct {
+		name         string
+		errorHandler func(http.ResponseWriter, *http.Request, error)
+		expectedCode int
+	}{
+		{name: "default", expectedCode: http.StatusBadGateway},
+		{name: "timeout", errorHandler: TimeoutErrorHandler, expectedCode: http.StatusGatewayTimeout},
+	} {
+		p := NewProxy(&Config{Endpoint: targetURL, ErrorHandler: tt.errorHandler})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		cancel()
+		if w.Code != tt.expectedCode {
+			t.Errorf("%s: status == %d, want %d", tt.name, w.Code, tt.expectedCode)
+		}
+	}
+}
+
 func TestProxyDecodeSubprotocol(t *testing.T) {
 	tests := []struct {
 		encoded string
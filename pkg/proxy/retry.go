@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const retryBackoff = 100 * time.Millisecond
+
+// retryTransport retries idempotent requests without a body, which can be sent again as they are.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if !retryable(req) {
+		return resp, err
+	}
+	for attempt := 1; attempt <= t.retries && shouldRetry(resp, err); attempt++ {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(time.Duration(attempt) * retryBackoff):
+		}
+		klog.V(4).Infof("Retrying %s %s, attempt %d of %d", req.Method, req.URL.Path, attempt, t.retries)
+		resp, err = t.next.RoundTrip(req)
+	}
+	return resp, err
+}
+
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultWebsocketPingInterval = 30 * time.Second
+	DefaultWebsocketTimeout      = 30 * time.Second
+
+	consoleProxyWebsocketConnectionsMetric   = "console_proxy_websocket_connections"
+	consoleProxyWebsocketRejectedTotalMetric = "console_proxy_websocket_rejected_total"
+	consoleProxyWebsocketClosedTotalMetric   = "console_proxy_websocket_closed_total"
+
+	consoleProxyWebsocketReasonLabel = "reason"
+
+	rejectReasonGlobalLimit  = "global_limit"
+	rejectReasonPerUserLimit = "per_user_limit"
+	closeReasonIdleTimeout   = "idle_timeout"
+	closeReasonMaxDuration   = "max_duration"
+)
+
+var (
+	consoleProxyWebsocketConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: consoleProxyWebsocketConnectionsMetric,
+			Help: "Number of currently open proxied websocket connections.",
+		},
+	)
+	consoleProxyWebsocketRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: consoleProxyWebsocketRejectedTotalMetric,
+			Help: "Number of proxied websocket connections rejected because a connection limit was reached, by limit.",
+		},
+		[]string{consoleProxyWebsocketReasonLabel},
+	)
+	consoleProxyWebsocketClosedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: consoleProxyWebsocketClosedTotalMetric,
+			Help: "Number of proxied websocket connections closed by the console because of a timeout, by reason.",
+		},
+		[]string{consoleProxyWebsocketReasonLabel},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(consoleProxyWebsocketConnections)
+	prometheus.MustRegister(consoleProxyWebsocketRejectedTotal)
+	prometheus.MustRegister(consoleProxyWebsocketClosedTotal)
+}
+
+var (
+	errGlobalWebsocketLimit  = errors.New("too many concurrent websocket connections")
+	errPerUserWebsocketLimit = errors.New("too many concurrent websocket connections for this user")
+)
+
+// WebsocketConfig holds the keepalive, timeout and connection limit settings for proxied websockets.
+type WebsocketConfig struct {
+	// PingInterval is how often pings are sent to the client to keep middlemen from closing the connection.
+	PingInterval time.Duration
+	// Timeout is the deadline for writing a ping to the client.
+	Timeout time.Duration
+	// MaxIdle closes exec/attach sessions without any traffic in either direction for this long. Zero disables it.
+	MaxIdle time.Duration
+	// MaxSessionDuration closes exec/attach sessions after this long. Zero disables it.
+	MaxSessionDuration time.Duration
+	// Limiter caps concurrent connections. It is shared across proxies so that the limits are global.
+	Limiter *WebsocketLimiter
+}
+
+func (c *WebsocketConfig) pingInterval() time.Duration {
+	if c == nil || c.PingInterval <= 0 {
+		return DefaultWebsocketPingInterval
+	}
+	return c.PingInterval
+}
+
+func (c *WebsocketConfig) timeout() time.Duration {
+	if c == nil || c.Timeout <= 0 {
+		return DefaultWebsocketTimeout
+	}
+	return c.Timeout
+}
+
+// sessionLimits returns the idle and total duration limits that apply to the request.
+// Only interactive exec and attach sessions are limited, watches are expected to be long-lived.
+func (c *WebsocketConfig) sessionLimits(r *http.Request) (time.Duration, time.Duration) {
+	if c == nil || !IsExecOrAttach(r) {
+		return 0, 0
+	}
+	return c.MaxIdle, c.MaxSessionDuration
+}
+
+// IsExecOrAttach reports whether the request targets the exec or attach subresource of a pod.
+func IsExecOrAttach(r *http.Request) bool {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if !strings.Contains(path, "/pods/") {
+		return false
+	}
+	return strings.HasSuffix(path, "/exec") || strings.HasSuffix(path, "/attach")
+}
+
+// WebsocketLimiter counts open websocket connections globally and per user.
+type WebsocketLimiter struct {
+	maxConnections        int
+	maxConnectionsPerUser int
+
+	mux     sync.Mutex
+	total   int
+	perUser map[string]int
+}
+
+// NewWebsocketLimiter creates a limiter. A limit of zero or less means unlimited.
+func NewWebsocketLimiter(maxConnections, maxConnectionsPerUser int) *WebsocketLimiter {
+	return &WebsocketLimiter{
+		maxConnections:        maxConnections,
+		maxConnectionsPerUser: maxConnectionsPerUser,
+		perUser:               make(map[string]int),
+	}
+}
+
+// acquire reserves a connection slot for the user and returns a function that releases it.
+// Connections without a user key only count against the global limit.
+func (l *WebsocketLimiter) acquire(user string) (func(), error) {
+	if l == nil {
+		consoleProxyWebsocketConnections.Inc()
+		return consoleProxyWebsocketConnections.Dec, nil
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.maxConnections > 0 && l.total >= l.maxConnections {
+		consoleProxyWebsocketRejectedTotal.WithLabelValues(rejectReasonGlobalLimit).Inc()
+		return nil, errGlobalWebsocketLimit
+	}
+	if user != "" && l.maxConnectionsPerUser > 0 && l.perUser[user] >= l.maxConnectionsPerUser {
+		consoleProxyWebsocketRejectedTotal.WithLabelValues(rejectReasonPerUserLimit).Inc()
+		return nil, errPerUserWebsocketLimit
+	}
+
+	l.total++
+	if user != "" {
+		l.perUser[user]++
+	}
+	consoleProxyWebsocketConnections.Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mux.Lock()
+			defer l.mux.Unlock()
+			l.total--
+			if user != "" {
+				l.perUser[user]--
+				if l.perUser[user] <= 0 {
+					delete(l.perUser, user)
+				}
+			}
+			consoleProxyWebsocketConnections.Dec()
+		})
+	}, nil
+}
+
+// WebsocketRecorder records the traffic of proxied websocket sessions.
+type WebsocketRecorder interface {
+	// Record is called once the backend connection is established with the negotiated subprotocol.
+	// It returns nil if the session should not be recorded.
+	Record(r *http.Request, subprotocol string) WebsocketRecording
+}
+
+// WebsocketRecording receives every message of a recorded session. Client and backend messages
+// are delivered from different goroutines.
+type WebsocketRecording interface {
+	ClientMessage(messageType int, data []byte)
+	BackendMessage(messageType int, data []byte)
+	Close()
+}
+
+type userKeyContextKey struct{}
+
+// WithUserKey returns a request that carries a stable identifier of the authenticated user,
+// used to enforce per-user websocket connection limits.
+func WithUserKey(r *http.Request, key string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKeyContextKey{}, key))
+}
+
+// getUserKey returns the user key set with WithUserKey, falling back to a hash of the bearer token.
+func getUserKey(r *http.Request) string {
+	if key, ok := r.Context().Value(userKeyContextKey{}).(string); ok && key != "" {
+		return key
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
+
+// closeWebsocket sends a close frame with the given code and reason before closing the connection,
+// so that clients can tell a policy close from a network failure.
+func closeWebsocket(conn *websocket.Conn, writeMutex *sync.Mutex, code int, reason string, timeout time.Duration) {
+	if writeMutex != nil {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(timeout))
+}
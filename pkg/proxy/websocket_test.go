@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIsExecOrAttach(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "/api/v1/namespaces/ns/pods/pod/exec", expected: true},
+		{path: "/api/v1/namespaces/ns/pods/pod/attach/", expected: true},
+		{path: "/api/v1/namespaces/ns/pods/pod/log", expected: false},
+		{path: "/api/v1/namespaces/ns/pods", expected: false},
+		{path: "/api/v1/namespaces/ns/configmaps/exec", expected: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if actual := IsExecOrAttach(r); actual != tt.expected {
+			t.Errorf("IsExecOrAttach(%q) == %v, want %v", tt.path, actual, tt.expected)
+		}
+	}
+}
+
+func TestWebsocketLimiter(t *testing.T) {
+	limiter := NewWebsocketLimiter(3, 2)
+
+	releaseA1, err := limiter.acquire("a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := limiter.acquire("a"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := limiter.acquire("a"); err != errPerUserWebsocketLimit {
+		t.Errorf("err == %v, want %v", err, errPerUserWebsocketLimit)
+	}
+	if _, err := limiter.acquire("b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := limiter.acquire("c"); err != errGlobalWebsocketLimit {
+		t.Errorf("err == %v, want %v", err, errGlobalWebsocketLimit)
+	}
+
+	// Releasing twice must only free a single slot.
+	releaseA1()
+	releaseA1()
+	if limiter.total != 2 || limiter.perUser["a"] != 1 {
+		t.Errorf("total == %d and perUser[a] == %d after release, want 2 and 1", limiter.total, limiter.perUser["a"])
+	}
+	if _, err := limiter.acquire("c"); err != nil {
+		t.Errorf("unexpected error after release: %v", err)
+	}
+}
+
+func TestProxyWebsocketLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/silent", silentServer)
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	proxyServer := httptest.NewServer(NewProxy(&Config{
+		Endpoint:  targetURL,
+		Websocket: &WebsocketConfig{Limiter: NewWebsocketLimiter(0, 1)},
+	}))
+	defer proxyServer.Close()
+
+	headers := http.Header{}
+	headers.Add("Origin", "http://localhost")
+	headers.Add("Authorization", "Bearer token")
+	ws, _, err := websocket.DefaultDialer.Dial(toWSScheme(proxyServer.URL)+"/silent", headers)
+	if err != nil {
+		t.Fatalf("error connecting to proxy as websocket: %v", err)
+	}
+	defer ws.Close()
+
+	rejected, _, err := websocket.DefaultDialer.Dial(toWSScheme(proxyServer.URL)+"/silent", headers)
+	if err != nil {
+		t.Fatalf("error connecting to proxy as websocket: %v", err)
+	}
+	defer rejected.Close()
+	_, _, err = rejected.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("expected close code %d, got %v", websocket.CloseTryAgainLater, err)
+	}
+}
+
+func TestProxyWebsocketIdleTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/ns/pods/pod/exec", silentServer)
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	proxyServer := httptest.NewServer(NewProxy(&Config{
+		Endpoint:  targetURL,
+		Websocket: &WebsocketConfig{MaxIdle: time.Second},
+	}))
+	defer proxyServer.Close()
+
+	headers := http.Header{}
+	headers.Add("Origin", "http://localhost")
+	ws, _, err := websocket.DefaultDialer.Dial(toWSScheme(proxyServer.URL)+"/api/v1/namespaces/ns/pods/pod/exec", headers)
+	if err != nil {
+		t.Fatalf("error connecting to proxy as websocket: %v", err)
+	}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected close code %d, got %v", websocket.CloseNormalClosure, err)
+	}
+}
+
+// silentServer accepts a websocket and never sends anything.
+func silentServer(w http.ResponseWriter, r *http.Request) {
+	upgrader := &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
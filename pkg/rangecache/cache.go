@@ -0,0 +1,185 @@
+package rangecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	consolePrometheusRangeCacheRequestsTotalMetric  = "console_prometheus_range_cache_requests_total"
+	consolePrometheusRangeCacheBytesMetric          = "console_prometheus_range_cache_bytes"
+	consolePrometheusRangeCacheEvictionsTotalMetric = "console_prometheus_range_cache_evictions_total"
+
+	consolePrometheusRangeCacheResultLabel = "result"
+
+	resultHit     = "hit"
+	resultPartial = "partial"
+	resultMiss    = "miss"
+	resultBypass  = "bypass"
+
+	// How long a token counts as authorized for a scope after the upstream accepted it.
+	verifiedTTL  = time.Minute
+	verifiedSize = 10000
+
+	// Rough per-sample and per-series overhead of the in-memory representation.
+	sampleOverhead = 32
+	seriesOverhead = 64
+)
+
+var (
+	consolePrometheusRangeCacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: consolePrometheusRangeCacheRequestsTotalMetric,
+			Help: "Number of Prometheus range queries by cache result: hit, partial, miss or bypass.",
+		},
+		[]string{consolePrometheusRangeCacheResultLabel},
+	)
+	consolePrometheusRangeCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: consolePrometheusRangeCacheBytesMetric,
+			Help: "Estimated memory used by cached Prometheus range query results.",
+		},
+	)
+	consolePrometheusRangeCacheEvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: consolePrometheusRangeCacheEvictionsTotalMetric,
+			Help: "Number of cached Prometheus range query buckets evicted to stay within the memory limit.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(consolePrometheusRangeCacheRequestsTotal)
+	prometheus.MustRegister(consolePrometheusRangeCacheBytes)
+	prometheus.MustRegister(consolePrometheusRangeCacheEvictionsTotal)
+}
+
+// sample is a value at a timestamp in milliseconds. The value is kept as the raw JSON string.
+type sample struct {
+	t     int64
+	value json.RawMessage
+}
+
+type series struct {
+	metric  json.RawMessage
+	samples []sample
+}
+
+// bucket holds the samples of all series of a query for one step-aligned time interval.
+// Series are keyed by their canonical label set.
+type bucket map[string]*series
+
+func (b bucket) size() int64 {
+	size := int64(0)
+	for key, s := range b {
+		size += int64(len(key)+len(s.metric)) + seriesOverhead
+		for _, sample := range s.samples {
+			size += int64(len(sample.value)) + sampleOverhead
+		}
+	}
+	return size
+}
+
+type entry struct {
+	key    string
+	bucket bucket
+	size   int64
+}
+
+// Cache is an LRU cache of range query buckets bounded by their estimated memory usage.
+type Cache struct {
+	maxBytes  int64
+	freshness time.Duration
+
+	mux      sync.Mutex
+	bytes    int64
+	entries  map[string]*list.Element
+	lru      *list.List
+	verified map[string]time.Time
+}
+
+// NewCache returns a cache that uses at most maxBytes. Samples newer than freshness are never cached,
+// since Prometheus may still ingest data for them.
+func NewCache(maxBytes int64, freshness time.Duration) *Cache {
+	return &Cache{
+		maxBytes:  maxBytes,
+		freshness: freshness,
+		entries:   map[string]*list.Element{},
+		lru:       list.New(),
+		verified:  map[string]time.Time{},
+	}
+}
+
+func (c *Cache) get(key string) (bucket, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*entry).bucket, true
+}
+
+func (c *Cache) put(key string, b bucket) {
+	size := b.size() + int64(len(key))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, bucket: b, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		consolePrometheusRangeCacheEvictionsTotal.Inc()
+	}
+	consolePrometheusRangeCacheBytes.Set(float64(c.bytes))
+}
+
+func (c *Cache) remove(element *list.Element) {
+	e := c.lru.Remove(element).(*entry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// isVerified returns whether the upstream recently accepted the token for the scope. Results are only
+// served completely from the cache to verified tokens, so that the upstream still authorizes every user.
+func (c *Cache) isVerified(token, scope string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	expires, ok := c.verified[verifiedKey(token, scope)]
+	return ok && time.Now().Before(expires)
+}
+
+func (c *Cache) setVerified(token, scope string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	now := time.Now()
+	if len(c.verified) >= verifiedSize {
+		for k, expires := range c.verified {
+			if now.After(expires) {
+				delete(c.verified, k)
+			}
+		}
+		if len(c.verified) >= verifiedSize {
+			c.verified = map[string]time.Time{}
+		}
+	}
+	c.verified[verifiedKey(token, scope)] = now.Add(verifiedTTL)
+}
+
+func verifiedKey(token, scope string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:]) + "\x00" + scope
+}
@@ -0,0 +1,409 @@
+package rangecache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/tenancy"
+)
+
+const (
+	queryRangePath  = "/api/v1/query_range"
+	formContentType = "application/x-www-form-urlencoded"
+
+	// Prometheus rejects range queries with more than 11000 points per series.
+	maxQueryPoints  = 11000
+	maxFetchPoints  = 10000
+	maxBucketPoints = 1000
+	bucketDuration  = 2 * time.Hour
+)
+
+// Handler serves Prometheus range queries from the cache and only requests the time ranges missing
+// from it from Next. Start and end are aligned to the step so that repeated queries hit the same buckets.
+type Handler struct {
+	Cache *Cache
+	// Scope separates the results of upstreams that answer the same query differently.
+	Scope string
+	// Namespaced adds the `namespace` query parameter of tenancy requests to the scope.
+	Namespaced bool
+	Next       http.Handler
+}
+
+type rangeQuery struct {
+	query string
+	// Start, end and step in milliseconds, start and end are aligned to the step.
+	start, end, step int64
+	// Parameters other than query, start, end, step and timeout, which are part of the cache key.
+	params   url.Values
+	timeout  string
+	urlQuery url.Values
+	scope    string
+	key      string
+}
+
+type matrixSeries struct {
+	Metric     map[string]string    `json:"metric"`
+	Values     [][2]json.RawMessage `json:"values"`
+	Histograms json.RawMessage      `json:"histograms,omitempty"`
+}
+
+type matrixResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string         `json:"resultType"`
+		Result     []matrixSeries `json:"result"`
+	} `json:"data"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type responseSeries struct {
+	Metric json.RawMessage  `json:"metric"`
+	Values [][2]interface{} `json:"values"`
+}
+
+// errUncacheable is returned for valid responses the cache cannot merge, like native histograms.
+var errUncacheable = fmt.Errorf("uncacheable response")
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != queryRangePath || (r.Method != http.MethodGet && r.Method != http.MethodPost) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	bypass := func() {
+		consolePrometheusRangeCacheRequestsTotal.WithLabelValues(resultBypass).Inc()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.Next.ServeHTTP(w, r)
+	}
+
+	q, err := h.parseQuery(r, body)
+	if err != nil {
+		// Let Prometheus report invalid queries.
+		klog.V(4).Infof("Not caching Prometheus range query: %v", err)
+		bypass()
+		return
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-h.Cache.freshness).UnixNano() / int64(time.Millisecond)
+	bucketSize := q.step * int64(math.Max(1, math.Min(maxBucketPoints, math.Ceil(float64(bucketDuration.Milliseconds())/float64(q.step)))))
+	starts := []int64{}
+	for start := q.start - q.start%bucketSize; start <= q.end; start += bucketSize {
+		starts = append(starts, start)
+	}
+
+	buckets := make([]bucket, len(starts))
+	found := 0
+	for i, start := range starts {
+		if start+bucketSize-q.step > cutoff {
+			continue
+		}
+		if b, ok := h.Cache.get(bucketKey(q.key, start)); ok {
+			buckets[i] = b
+			found++
+		}
+	}
+	token := r.Header.Get("Authorization")
+	if found == len(starts) && !h.Cache.isVerified(token, q.scope) {
+		// Let the upstream authorize the user before serving cached results.
+		buckets[len(buckets)-1] = nil
+		found--
+	}
+
+	warnings := []string{}
+	bucketsPerFetch := int(math.Max(1, float64(maxFetchPoints*q.step/bucketSize)))
+	for i := 0; i < len(starts); i++ {
+		if buckets[i] != nil {
+			continue
+		}
+		j := i
+		for j+1 < len(starts) && buckets[j+1] == nil && j+1-i < bucketsPerFetch {
+			j++
+		}
+		fetchStart, fetchEnd := starts[i], starts[j]+bucketSize-q.step
+		if fetchEnd > q.end && fetchEnd > cutoff {
+			fetchEnd = q.end
+		}
+
+		result, err := h.fetch(r, q, fetchStart, fetchEnd)
+		if err == errUncacheable {
+			bypass()
+			return
+		}
+		if err != nil {
+			klog.Errorf("Failed to read Prometheus range query response: %v", err)
+			http.Error(w, "Failed to read Prometheus range query response", http.StatusBadGateway)
+			return
+		}
+		if result.failed != nil {
+			result.failed.copyTo(w)
+			return
+		}
+		h.Cache.setVerified(token, q.scope)
+		warnings = append(warnings, result.warnings...)
+
+		for k := i; k <= j; k++ {
+			b := splitBucket(result.series, starts[k], starts[k]+bucketSize)
+			buckets[k] = b
+			if starts[k]+bucketSize-q.step <= cutoff && fetchEnd >= starts[k]+bucketSize-q.step && len(result.warnings) == 0 {
+				h.Cache.put(bucketKey(q.key, starts[k]), b)
+			}
+		}
+		i = j
+	}
+
+	switch found {
+	case len(starts):
+		consolePrometheusRangeCacheRequestsTotal.WithLabelValues(resultHit).Inc()
+	case 0:
+		consolePrometheusRangeCacheRequestsTotal.WithLabelValues(resultMiss).Inc()
+	default:
+		consolePrometheusRangeCacheRequestsTotal.WithLabelValues(resultPartial).Inc()
+	}
+	writeMatrix(w, buckets, q.start, q.end, warnings)
+}
+
+func (h *Handler) parseQuery(r *http.Request, body []byte) (*rangeQuery, error) {
+	params := r.URL.Query()
+	if r.Method == http.MethodPost && tenancy.IsFormContentType(r.Header.Get("Content-Type")) {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		// Prometheus prefers parameters from the body.
+		for key, values := range form {
+			params[key] = values
+		}
+	} else if len(body) > 0 {
+		return nil, fmt.Errorf("unsupported request body")
+	}
+
+	q := &rangeQuery{
+		query:    params.Get("query"),
+		timeout:  params.Get("timeout"),
+		urlQuery: url.Values{},
+		scope:    h.Scope,
+	}
+	if q.query == "" {
+		return nil, fmt.Errorf("missing query")
+	}
+	step, err := tenancy.ParseDuration(params.Get("step"))
+	if err != nil || step < time.Millisecond {
+		return nil, fmt.Errorf("invalid step %q", params.Get("step"))
+	}
+	start, err := tenancy.ParseTime(params.Get("start"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid start %q", params.Get("start"))
+	}
+	end, err := tenancy.ParseTime(params.Get("end"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid end %q", params.Get("end"))
+	}
+	q.step = step.Milliseconds()
+	q.start = start.UnixNano() / int64(time.Millisecond)
+	q.start -= q.start % q.step
+	q.end = end.UnixNano() / int64(time.Millisecond)
+	q.end -= q.end % q.step
+	if q.start <= 0 || q.end < q.start || (q.end-q.start)/q.step+1 > maxQueryPoints {
+		return nil, fmt.Errorf("invalid time range")
+	}
+
+	if h.Namespaced {
+		namespace := r.URL.Query().Get(tenancy.NamespaceLabel)
+		if namespace == "" {
+			return nil, fmt.Errorf("missing namespace")
+		}
+		q.urlQuery.Set(tenancy.NamespaceLabel, namespace)
+		q.scope += "/" + namespace
+	}
+
+	normalized, err := tenancy.NormalizeQuery(q.query)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"query", "start", "end", "step", "timeout", tenancy.NamespaceLabel} {
+		params.Del(key)
+	}
+	q.params = params
+	q.key = strings.Join([]string{q.scope, normalized, strconv.FormatInt(q.step, 10), params.Encode()}, "\x00")
+	return q, nil
+}
+
+type fetchResult struct {
+	series   []matrixSeries
+	warnings []string
+	// Set to the upstream response if it was not successful.
+	failed *bufferedResponseWriter
+}
+
+func (h *Handler) fetch(r *http.Request, q *rangeQuery, start, end int64) (*fetchResult, error) {
+	form := url.Values{}
+	for key, values := range q.params {
+		form[key] = values
+	}
+	form.Set("query", q.query)
+	form.Set("start", formatTimestamp(start))
+	form.Set("end", formatTimestamp(end))
+	form.Set("step", formatTimestamp(q.step))
+	if q.timeout != "" {
+		form.Set("timeout", q.timeout)
+	}
+	body := form.Encode()
+
+	upstreamRequest := r.Clone(r.Context())
+	upstreamRequest.Method = http.MethodPost
+	upstreamRequest.URL.RawQuery = q.urlQuery.Encode()
+	upstreamRequest.Body = ioutil.NopCloser(strings.NewReader(body))
+	upstreamRequest.ContentLength = int64(len(body))
+	upstreamRequest.Header.Set("Content-Type", formContentType)
+	upstreamRequest.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	// The response must be readable to merge it.
+	upstreamRequest.Header.Del("Accept-Encoding")
+
+	buffer := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+	h.Next.ServeHTTP(buffer, upstreamRequest)
+	if buffer.code != http.StatusOK {
+		return &fetchResult{failed: buffer}, nil
+	}
+
+	response := matrixResponse{}
+	if err := json.Unmarshal(buffer.body.Bytes(), &response); err != nil {
+		return nil, err
+	}
+	if response.Status != "success" || response.Data.ResultType != "matrix" {
+		return &fetchResult{failed: buffer}, nil
+	}
+	for _, s := range response.Data.Result {
+		if len(s.Histograms) > 0 {
+			return nil, errUncacheable
+		}
+	}
+	return &fetchResult{series: response.Data.Result, warnings: response.Warnings}, nil
+}
+
+// splitBucket returns the samples of the series from start (inclusive) to end (exclusive).
+func splitBucket(result []matrixSeries, start, end int64) bucket {
+	b := bucket{}
+	for _, s := range result {
+		metric, err := json.Marshal(s.Metric)
+		if err != nil {
+			continue
+		}
+		samples := []sample{}
+		for _, value := range s.Values {
+			seconds, err := strconv.ParseFloat(string(value[0]), 64)
+			if err != nil {
+				continue
+			}
+			t := int64(math.Round(seconds * 1000))
+			if t >= start && t < end {
+				samples = append(samples, sample{t: t, value: value[1]})
+			}
+		}
+		if len(samples) > 0 {
+			b[string(metric)] = &series{metric: metric, samples: samples}
+		}
+	}
+	return b
+}
+
+func writeMatrix(w http.ResponseWriter, buckets []bucket, start, end int64, warnings []string) {
+	merged := map[string]*responseSeries{}
+	for _, b := range buckets {
+		for key, s := range b {
+			rs, ok := merged[key]
+			if !ok {
+				rs = &responseSeries{Metric: s.metric, Values: [][2]interface{}{}}
+			}
+			for _, sample := range s.samples {
+				if sample.t >= start && sample.t <= end {
+					rs.Values = append(rs.Values, [2]interface{}{json.Number(formatTimestamp(sample.t)), sample.value})
+				}
+			}
+			if len(rs.Values) > 0 {
+				merged[key] = rs
+			}
+		}
+	}
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*responseSeries, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, merged[key])
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "matrix",
+			"result":     result,
+		},
+	}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		klog.Errorf("Failed to write cached Prometheus range query response: %v", err)
+	}
+}
+
+// formatTimestamp formats milliseconds as seconds like Prometheus does.
+func formatTimestamp(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
+
+func bucketKey(key string, start int64) string {
+	return key + "\x00" + strconv.FormatInt(start, 10)
+}
+
+// bufferedResponseWriter holds an upstream response so that it can be merged or sent as is.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	b.code = code
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponseWriter) copyTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.code)
+	if _, err := b.body.WriteTo(w); err != nil {
+		klog.V(4).Infof("Failed to write Prometheus response: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package rangecache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fetchedRange struct {
+	start, end string
+}
+
+// newTestUpstream returns a Prometheus stub with one series per namespace whose values are their timestamps.
+func newTestUpstream(t *testing.T, fetched *[]fetchedRange) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		if form.Get("query") == "" || r.Method != http.MethodPost {
+			t.Errorf("expected query in POST body, got %s %q", r.Method, body)
+		}
+		if form.Get("query") == "error" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":"error","errorType":"execution","error":"boom"}`))
+			return
+		}
+		*fetched = append(*fetched, fetchedRange{form.Get("start"), form.Get("end")})
+		start, _ := strconv.ParseFloat(form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(form.Get("step"), 64)
+		values := []string{}
+		for ts := start; ts <= end; ts += step {
+			values = append(values, fmt.Sprintf(`[%v,"%v"]`, ts, ts))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"namespace":%q},"values":[%s]}]}}`,
+			r.URL.Query().Get("namespace"), strings.Join(values, ","))
+	})
+}
+
+func rangeRequest(handler http.Handler, token string, query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, queryRangePath+"?"+query.Encode(), nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func decodeValues(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	response := matrixResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+	}
+	values := []string{}
+	for _, s := range response.Data.Result {
+		for _, value := range s.Values {
+			values = append(values, string(value[0]))
+		}
+	}
+	return values
+}
+
+func TestHandlerCachesBuckets(t *testing.T) {
+	fetched := []fetchedRange{}
+	handler := &Handler{
+		Cache: NewCache(1<<20, 5*time.Minute),
+		Scope: "prometheus",
+		Next:  newTestUpstream(t, &fetched),
+	}
+	// Two hours, which is one bucket with a step of one minute, starting at a bucket boundary.
+	query := url.Values{"query": {"up"}, "start": {"1600000200"}, "end": {"1600002000"}, "step": {"60"}}
+
+	w := rangeRequest(handler, "alice", query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	values := decodeValues(t, w)
+	if len(values) != 31 || values[0] != "1600000200" || values[30] != "1600002000" {
+		t.Errorf("values == %v, want 31 values from 1600000200 to 1600002000", values)
+	}
+	expected := []fetchedRange{{"1599998400", "1600005540"}}
+	if fmt.Sprint(fetched) != fmt.Sprint(expected) {
+		t.Errorf("fetched == %v, want the full bucket %v", fetched, expected)
+	}
+
+	// Unaligned start and end, formatting differences and another user are served from the same bucket.
+	query.Set("query", " up ")
+	query.Set("start", "1600000210.5")
+	fetched = fetched[:0]
+	if values := decodeValues(t, rangeRequest(handler, "alice", query)); len(values) != 31 || len(fetched) != 0 {
+		t.Errorf("expected a cache hit, got %d values and fetched %v", len(values), fetched)
+	}
+	// The upstream has to authorize other users once.
+	rangeRequest(handler, "bob", query)
+	rangeRequest(handler, "bob", query)
+	if len(fetched) != 1 {
+		t.Errorf("fetched == %v, want one request to authorize the user", fetched)
+	}
+
+	// Only the missing bucket is fetched for a longer range.
+	fetched = fetched[:0]
+	query.Set("end", "1600008000")
+	if values := decodeValues(t, rangeRequest(handler, "alice", query)); len(values) != 131 {
+		t.Errorf("values == %d, want 131", len(values))
+	}
+	expected = []fetchedRange{{"1600005600", "1600012740"}}
+	if fmt.Sprint(fetched) != fmt.Sprint(expected) {
+		t.Errorf("fetched == %v, want %v", fetched, expected)
+	}
+}
+
+func TestHandlerDoesNotCacheRecentSamples(t *testing.T) {
+	fetched := []fetchedRange{}
+	handler := &Handler{
+		Cache: NewCache(1<<20, 5*time.Minute),
+		Scope: "prometheus",
+		Next:  newTestUpstream(t, &fetched),
+	}
+	now := time.Now().Unix()
+	query := url.Values{"query": {"up"}, "start": {strconv.FormatInt(now-600, 10)}, "end": {strconv.FormatInt(now, 10)}, "step": {"60"}}
+	rangeRequest(handler, "alice", query)
+	rangeRequest(handler, "alice", query)
+	if len(fetched) != 2 {
+		t.Errorf("fetched == %v, want recent samples to be fetched every time", fetched)
+	}
+}
+
+func TestHandlerSeparatesNamespaces(t *testing.T) {
+	fetched := []fetchedRange{}
+	handler := &Handler{
+		Cache:      NewCache(1<<20, 5*time.Minute),
+		Scope:      "prometheus-tenancy",
+		Namespaced: true,
+		Next:       newTestUpstream(t, &fetched),
+	}
+	query := url.Values{"query": {"up"}, "start": {"1600000200"}, "end": {"1600002000"}, "step": {"60"}}
+	for _, namespace := range []string{"a", "b"} {
+		query.Set("namespace", namespace)
+		w := rangeRequest(handler, "alice", query)
+		if !strings.Contains(w.Body.String(), fmt.Sprintf(`"namespace":%q`, namespace)) {
+			t.Errorf("expected series of namespace %s, got %s", namespace, w.Body.String())
+		}
+	}
+	if len(fetched) != 2 {
+		t.Errorf("fetched == %v, want one request per namespace", fetched)
+	}
+}
+
+func TestHandlerPassesErrorsThrough(t *testing.T) {
+	fetched := []fetchedRange{}
+	handler := &Handler{
+		Cache: NewCache(1<<20, 5*time.Minute),
+		Scope: "prometheus",
+		Next:  newTestUpstream(t, &fetched),
+	}
+	query := url.Values{"query": {"error"}, "start": {"1600000200"}, "end": {"1600002000"}, "step": {"60"}}
+	w := rangeRequest(handler, "alice", query)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "boom") {
+		t.Errorf("expected the upstream error, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	b := bucket{`{"job":"a"}`: &series{metric: []byte(`{"job":"a"}`), samples: []sample{{t: 1, value: []byte(`"1"`)}}}}
+	size := b.size() + int64(len("a"))
+	cache := NewCache(2*size, time.Minute)
+	cache.put("a", b)
+	cache.put("b", b)
+	cache.get("a")
+	cache.put("c", b)
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("expected the least recently used bucket to be evicted")
+	}
+	if _, ok := cache.get("a"); !ok {
+		t.Errorf("expected a recently used bucket to be kept")
+	}
+	if cache.bytes > 2*size {
+		t.Errorf("cache uses %d bytes, limit is %d", cache.bytes, 2*size)
+	}
+}
+
+func TestParseQueryFormBody(t *testing.T) {
+	handler := &Handler{Scope: "prometheus"}
+	body := []byte("query=up&start=1600000200&end=1600002000&step=60")
+	r := httptest.NewRequest(http.MethodPost, queryRangePath+"?query=other", nil)
+	r.Header.Set("Content-Type", "Application/X-WWW-Form-Urlencoded; charset=utf-8")
+	q, err := handler.parseQuery(r, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The cache key must be the query the upstream runs, which prefers the body.
+	if q.query != "up" {
+		t.Errorf("query == %q, want %q", q.query, "up")
+	}
+
+	r.Header.Set("Content-Type", "text/plain")
+	if _, err := handler.parseQuery(r, body); err == nil {
+		t.Error("expected bodies that are not forms to be rejected")
+	}
+}
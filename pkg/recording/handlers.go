@@ -0,0 +1,126 @@
+package recording
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	authv1 "k8s.io/api/authorization/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+var userResource = schema.GroupVersionResource{
+	Group:    "user.openshift.io",
+	Version:  "v1",
+	Resource: "users",
+}
+
+// Handler serves the recordings admin API and resolves the user names written to recordings.
+type Handler struct {
+	Recorder *Recorder
+	Client   *http.Client
+	Endpoint string
+}
+
+// HandleRecordings lists recordings for an empty path and downloads the recording with the ID
+// given as path otherwise. Only users that can exec into pods in all namespaces have access,
+// since they could have run any of the recorded sessions themselves.
+func (h *Handler) HandleRecordings(user *auth.User, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Unsupported method, supported methods are GET"})
+		return
+	}
+
+	allowed, err := h.canAccessRecordings(r.Context(), user)
+	if err != nil {
+		klog.Errorf("Failed to check access to session recordings: %v", err)
+		serverutils.SendResponse(w, http.StatusBadGateway, serverutils.ApiError{Err: fmt.Sprintf("Failed to check access to session recordings: %v", err)})
+		return
+	}
+	if !allowed {
+		serverutils.SendResponse(w, http.StatusForbidden, serverutils.ApiError{Err: "Session recordings are only available to users who can exec into pods in all namespaces"})
+		return
+	}
+
+	id := strings.Trim(r.URL.Path, "/")
+	if id == "" {
+		recordings, err := h.Recorder.List()
+		if err != nil {
+			klog.Errorf("Failed to list session recordings: %v", err)
+			serverutils.SendResponse(w, http.StatusInternalServerError, serverutils.ApiError{Err: fmt.Sprintf("Failed to list session recordings: %v", err)})
+			return
+		}
+		serverutils.SendResponse(w, http.StatusOK, recordings)
+		return
+	}
+
+	rc, err := h.Recorder.Open(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			serverutils.SendResponse(w, http.StatusNotFound, serverutils.ApiError{Err: fmt.Sprintf("Recording %q not found", id)})
+			return
+		}
+		serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: err.Error()})
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+castExtension))
+	if _, err := io.Copy(w, rc); err != nil {
+		klog.Errorf("Failed to send session recording %s: %v", id, err)
+	}
+}
+
+// WithUser returns a request carrying the user's name for the recording. OpenShift OAuth does not
+// provide user info, so the name is looked up with the user's token in that case.
+func (h *Handler) WithUser(r *http.Request, user *auth.User, cluster string) *http.Request {
+	name := user.Username
+	if name == "" {
+		name = h.lookupUsername(r.Context(), user)
+	}
+	if name == "" {
+		name = user.ID
+	}
+	return WithUser(r, name, cluster)
+}
+
+func (h *Handler) lookupUsername(ctx context.Context, user *auth.User) string {
+	client, err := dynamic.NewForConfig(h.userConfig(user))
+	if err != nil {
+		klog.Errorf("Failed to create client to look up user for session recording: %v", err)
+		return ""
+	}
+	userInfo, err := client.Resource(userResource).Get(ctx, "~", meta.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("Failed to look up user for session recording: %v", err)
+		return ""
+	}
+	return userInfo.GetName()
+}
+
+func (h *Handler) canAccessRecordings(ctx context.Context, user *auth.User) (bool, error) {
+	return serverutils.SelfSubjectAccessReview(ctx, h.userConfig(user), authv1.ResourceAttributes{
+		Verb:        "create",
+		Resource:    "pods",
+		Subresource: "exec",
+	})
+}
+
+func (h *Handler) userConfig(user *auth.User) *rest.Config {
+	return &rest.Config{
+		Host:        h.Endpoint,
+		BearerToken: user.Token,
+		Transport:   h.Client.Transport,
+	}
+}
@@ -0,0 +1,428 @@
+package recording
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/proxy"
+)
+
+const (
+	// Kubernetes remote command streams, see k8s.io/apimachinery/pkg/util/remotecommand.
+	stdinChannel  = 0
+	stdoutChannel = 1
+	stderrChannel = 2
+	resizeChannel = 4
+
+	defaultWidth  = 80
+	defaultHeight = 24
+
+	// The longest header line that is read when listing recordings.
+	maxHeaderSize = 64 * 1024
+)
+
+var (
+	execPathPattern = regexp.MustCompile(`/namespaces/([^/]+)/pods/([^/]+)/(exec|attach)/?$`)
+	invalidIDChars  = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+)
+
+// SessionInfo describes who ran an exec or attach session and where.
+type SessionInfo struct {
+	User        string   `json:"user"`
+	Cluster     string   `json:"cluster"`
+	Namespace   string   `json:"namespace"`
+	Pod         string   `json:"pod"`
+	Container   string   `json:"container,omitempty"`
+	Subresource string   `json:"subresource"`
+	Command     []string `json:"command,omitempty"`
+}
+
+// Recording is a stored session as returned by the admin API.
+type Recording struct {
+	ID        string    `json:"id"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Size      int64     `json:"size"`
+	Active    bool      `json:"active"`
+	SessionInfo
+}
+
+// Retention limits how many recordings are kept. Zero values disable a limit.
+type Retention struct {
+	MaxAge        time.Duration
+	MaxRecordings int
+}
+
+// Recorder writes pod exec and attach sessions as asciinema v2 casts.
+type Recorder struct {
+	store     Store
+	retention Retention
+
+	mux    sync.Mutex
+	active map[string]bool
+}
+
+func NewRecorder(store Store, retention Retention) *Recorder {
+	return &Recorder{
+		store:     store,
+		retention: retention,
+		active:    make(map[string]bool),
+	}
+}
+
+// castHeader is the first line of an asciinema v2 cast. Players ignore the console metadata.
+type castHeader struct {
+	Version   int          `json:"version"`
+	Width     int          `json:"width"`
+	Height    int          `json:"height"`
+	Timestamp int64        `json:"timestamp"`
+	Title     string       `json:"title,omitempty"`
+	Console   *SessionInfo `json:"console,omitempty"`
+}
+
+type userContextKey struct{}
+
+type requestUser struct {
+	user    string
+	cluster string
+}
+
+// WithUser returns a request carrying the user and cluster that are written to the recording.
+func WithUser(r *http.Request, user, cluster string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, requestUser{user: user, cluster: cluster}))
+}
+
+func sessionInfoFromRequest(r *http.Request) SessionInfo {
+	info := SessionInfo{}
+	if u, ok := r.Context().Value(userContextKey{}).(requestUser); ok {
+		info.User = u.user
+		info.Cluster = u.cluster
+	}
+	if match := execPathPattern.FindStringSubmatch(r.URL.Path); match != nil {
+		info.Namespace = match[1]
+		info.Pod = match[2]
+		info.Subresource = match[3]
+	}
+	query := r.URL.Query()
+	info.Container = query.Get("container")
+	info.Command = query["command"]
+	return info
+}
+
+func newRecordingID(start time.Time, info SessionInfo) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	parts := []string{start.UTC().Format("20060102T150405Z"), info.Namespace, info.Pod, hex.EncodeToString(suffix)}
+	for i, part := range parts {
+		parts[i] = invalidIDChars.ReplaceAllString(part, "")
+	}
+	return strings.Join(parts, "_")
+}
+
+// Record starts a recording for exec and attach sessions and ignores all other websockets.
+func (rec *Recorder) Record(r *http.Request, subprotocol string) proxy.WebsocketRecording {
+	if !proxy.IsExecOrAttach(r) {
+		return nil
+	}
+
+	start := time.Now()
+	info := sessionInfoFromRequest(r)
+	id := newRecordingID(start, info)
+	w, err := rec.store.Create(id)
+	if err != nil {
+		klog.Errorf("Failed to create session recording for %s/%s: %v", info.Namespace, info.Pod, err)
+		return nil
+	}
+	klog.Infof("Recording %s session of user %q to pod %s/%s as %s", info.Subresource, info.User, info.Namespace, info.Pod, id)
+
+	rec.mux.Lock()
+	rec.active[id] = true
+	rec.mux.Unlock()
+
+	return &session{
+		recorder: rec,
+		id:       id,
+		info:     info,
+		start:    start,
+		channels: strings.HasSuffix(subprotocol, "channel.k8s.io"),
+		base64:   strings.Contains(subprotocol, "base64."),
+		w:        w,
+		width:    defaultWidth,
+		height:   defaultHeight,
+	}
+}
+
+// List returns all recordings, oldest first.
+func (rec *Recorder) List() ([]Recording, error) {
+	objects, err := rec.store.List()
+	if err != nil {
+		return nil, err
+	}
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	recordings := make([]Recording, 0, len(objects))
+	for _, object := range objects {
+		recording := Recording{
+			ID:      object.ID,
+			EndTime: object.ModTime,
+			Size:    object.Size,
+			Active:  rec.active[object.ID],
+		}
+		if header, err := rec.readHeader(object.ID); err == nil {
+			recording.StartTime = time.Unix(header.Timestamp, 0)
+			if header.Console != nil {
+				recording.SessionInfo = *header.Console
+			}
+		}
+		recordings = append(recordings, recording)
+	}
+	return recordings, nil
+}
+
+func (rec *Recorder) readHeader(id string) (*castHeader, error) {
+	rc, err := rec.store.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	line, err := bufio.NewReader(io.LimitReader(rc, maxHeaderSize)).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	header := &castHeader{}
+	if err := json.Unmarshal(line, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Open returns the cast of a recording.
+func (rec *Recorder) Open(id string) (io.ReadCloser, error) {
+	return rec.store.Open(id)
+}
+
+// Prune deletes recordings beyond the retention limits. Active recordings are never deleted.
+func (rec *Recorder) Prune() error {
+	if rec.retention.MaxAge <= 0 && rec.retention.MaxRecordings <= 0 {
+		return nil
+	}
+	objects, err := rec.store.List()
+	if err != nil {
+		return err
+	}
+
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+	cutoff := time.Now().Add(-rec.retention.MaxAge)
+	remaining := len(objects)
+	for _, object := range objects {
+		if rec.active[object.ID] {
+			continue
+		}
+		tooOld := rec.retention.MaxAge > 0 && object.ModTime.Before(cutoff)
+		tooMany := rec.retention.MaxRecordings > 0 && remaining > rec.retention.MaxRecordings
+		if !tooOld && !tooMany {
+			continue
+		}
+		if err := rec.store.Delete(object.ID); err != nil {
+			return fmt.Errorf("failed to delete recording %s: %v", object.ID, err)
+		}
+		klog.V(4).Infof("Deleted session recording %s", object.ID)
+		remaining--
+	}
+	return nil
+}
+
+func (rec *Recorder) finished(id string) {
+	rec.mux.Lock()
+	delete(rec.active, id)
+	rec.mux.Unlock()
+	if err := rec.Prune(); err != nil {
+		klog.Errorf("Failed to prune session recordings: %v", err)
+	}
+}
+
+// session writes the events of a single exec or attach session.
+type session struct {
+	recorder *Recorder
+	id       string
+	info     SessionInfo
+	start    time.Time
+	// channels is set for the Kubernetes remote command protocols, which prefix every message with a stream number.
+	channels bool
+	base64   bool
+
+	mux           sync.Mutex
+	w             io.WriteCloser
+	headerWritten bool
+	width, height int
+	// Trailing incomplete UTF-8 sequences, per stream.
+	partial [resizeChannel + 1][]byte
+}
+
+func (s *session) ClientMessage(messageType int, data []byte) {
+	channel, payload, ok := s.decode(messageType, data, stdinChannel)
+	if !ok {
+		return
+	}
+	switch channel {
+	case stdinChannel:
+		s.writeText(channel, "i", payload)
+	case resizeChannel:
+		s.resize(payload)
+	}
+}
+
+func (s *session) BackendMessage(messageType int, data []byte) {
+	channel, payload, ok := s.decode(messageType, data, stdoutChannel)
+	if !ok {
+		return
+	}
+	if channel == stdoutChannel || channel == stderrChannel {
+		s.writeText(channel, "o", payload)
+	}
+}
+
+// decode returns the stream and payload of a message. Messages of other protocols are attributed to defaultChannel.
+func (s *session) decode(messageType int, data []byte, defaultChannel byte) (byte, []byte, bool) {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return 0, nil, false
+	}
+	if !s.channels {
+		return defaultChannel, data, len(data) > 0
+	}
+	if len(data) < 2 {
+		// Kubernetes sends an empty message on every stream when the session starts.
+		return 0, nil, false
+	}
+	if !s.base64 {
+		return data[0], data[1:], true
+	}
+	payload, err := base64.StdEncoding.DecodeString(string(data[1:]))
+	if err != nil || data[0] < '0' {
+		return 0, nil, false
+	}
+	return data[0] - '0', payload, true
+}
+
+func (s *session) resize(payload []byte) {
+	size := struct {
+		Width  int
+		Height int
+	}{}
+	if err := json.Unmarshal(payload, &size); err != nil || size.Width <= 0 || size.Height <= 0 {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.headerWritten {
+		// The terminal reports its size right away, use it for the header instead of a resize event.
+		s.width, s.height = size.Width, size.Height
+		return
+	}
+	s.writeEvent("r", fmt.Sprintf("%dx%d", size.Width, size.Height))
+}
+
+func (s *session) writeText(channel byte, code string, payload []byte) {
+	if int(channel) >= len(s.partial) {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	data := append(s.partial[channel], payload...)
+	data, s.partial[channel] = splitIncompleteRune(data)
+	if len(data) > 0 {
+		s.writeEvent(code, string(data))
+	}
+}
+
+// writeEvent must be called with the lock held.
+func (s *session) writeEvent(code, data string) {
+	if s.w == nil {
+		return
+	}
+	if !s.writeHeader() {
+		return
+	}
+	event, _ := json.Marshal([]interface{}{
+		float64(time.Since(s.start).Microseconds()) / 1e6,
+		code,
+		data,
+	})
+	if _, err := s.w.Write(append(event, '\n')); err != nil {
+		s.fail(err)
+	}
+}
+
+// writeHeader must be called with the lock held.
+func (s *session) writeHeader() bool {
+	if s.headerWritten {
+		return true
+	}
+	s.headerWritten = true
+	info := s.info
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     s.width,
+		Height:    s.height,
+		Timestamp: s.start.Unix(),
+		Title:     fmt.Sprintf("%s %s/%s %s", info.Subresource, info.Namespace, info.Pod, info.Container),
+		Console:   &info,
+	})
+	if _, err := s.w.Write(append(header, '\n')); err != nil {
+		s.fail(err)
+		return false
+	}
+	return true
+}
+
+// fail stops the recording after a write error. It must be called with the lock held.
+func (s *session) fail(err error) {
+	klog.Errorf("Failed to write session recording %s, stopping the recording: %v", s.id, err)
+	s.w.Close()
+	s.w = nil
+}
+
+func (s *session) Close() {
+	s.mux.Lock()
+	if s.w != nil {
+		s.writeHeader()
+		if s.w != nil {
+			if err := s.w.Close(); err != nil {
+				klog.Errorf("Failed to close session recording %s: %v", s.id, err)
+			}
+			s.w = nil
+		}
+	}
+	s.mux.Unlock()
+	s.recorder.finished(s.id)
+}
+
+// splitIncompleteRune splits off a trailing incomplete UTF-8 sequence so that it can be prepended to
+// the next message of the stream instead of being replaced with U+FFFD.
+func splitIncompleteRune(data []byte) ([]byte, []byte) {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i], append([]byte{}, data[i:]...)
+			}
+			break
+		}
+	}
+	return data, nil
+}
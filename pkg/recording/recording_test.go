@@ -0,0 +1,177 @@
+package recording
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestRecorder(t *testing.T, retention Retention) (*Recorder, string) {
+	dir := t.TempDir()
+	store, err := NewDirectoryStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return NewRecorder(store, retention), dir
+}
+
+func readCast(t *testing.T, recorder *Recorder, id string) (castHeader, [][]interface{}) {
+	t.Helper()
+	rc, err := recorder.Open(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	header := castHeader{}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("invalid header %q: %v", lines[0], err)
+	}
+	events := [][]interface{}{}
+	for _, line := range lines[1:] {
+		event := []interface{}{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return header, events
+}
+
+func TestRecordBinaryChannelSession(t *testing.T) {
+	recorder, _ := newTestRecorder(t, Retention{})
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/ns/pods/pod/exec?container=c&command=sh&command=-i", nil)
+	r = WithUser(r, "alice", "local-cluster")
+
+	session := recorder.Record(r, "v4.channel.k8s.io")
+	if session == nil {
+		t.Fatalf("expected exec session to be recorded")
+	}
+	session.BackendMessage(websocket.BinaryMessage, []byte{stdoutChannel})
+	session.ClientMessage(websocket.BinaryMessage, append([]byte{resizeChannel}, `{"Width":120,"Height":40}`...))
+	session.BackendMessage(websocket.BinaryMessage, append([]byte{stdoutChannel}, "$ "...))
+	session.ClientMessage(websocket.BinaryMessage, append([]byte{stdinChannel}, "ls\r"...))
+	// A multi-byte character split across two messages.
+	euro := []byte("€")
+	session.BackendMessage(websocket.BinaryMessage, append([]byte{stdoutChannel}, euro[:1]...))
+	session.BackendMessage(websocket.BinaryMessage, append([]byte{stdoutChannel}, euro[1:]...))
+	session.ClientMessage(websocket.BinaryMessage, append([]byte{resizeChannel}, `{"Width":100,"Height":30}`...))
+	session.Close()
+
+	recordings, err := recorder.List()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recordings) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(recordings))
+	}
+	expectedInfo := SessionInfo{
+		User:        "alice",
+		Cluster:     "local-cluster",
+		Namespace:   "ns",
+		Pod:         "pod",
+		Container:   "c",
+		Subresource: "exec",
+		Command:     []string{"sh", "-i"},
+	}
+	if !reflect.DeepEqual(recordings[0].SessionInfo, expectedInfo) {
+		t.Errorf("session info == %+v, want %+v", recordings[0].SessionInfo, expectedInfo)
+	}
+	if recordings[0].Active {
+		t.Errorf("expected closed recording not to be active")
+	}
+
+	header, events := readCast(t, recorder, recordings[0].ID)
+	if header.Version != 2 || header.Width != 120 || header.Height != 40 {
+		t.Errorf("header == %+v, want version 2 and size 120x40", header)
+	}
+	actual := [][]string{}
+	for _, event := range events {
+		actual = append(actual, []string{event[1].(string), event[2].(string)})
+	}
+	expected := [][]string{{"o", "$ "}, {"i", "ls\r"}, {"o", "€"}, {"r", "100x30"}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("events == %v, want %v", actual, expected)
+	}
+}
+
+func TestRecordBase64ChannelSession(t *testing.T) {
+	recorder, _ := newTestRecorder(t, Retention{})
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/ns/pods/pod/attach", nil)
+
+	session := recorder.Record(r, "base64.channel.k8s.io")
+	session.BackendMessage(websocket.TextMessage, []byte("1"+base64.StdEncoding.EncodeToString([]byte("hello"))))
+	session.BackendMessage(websocket.TextMessage, []byte("2"+base64.StdEncoding.EncodeToString([]byte("oops"))))
+	session.Close()
+
+	recordings, _ := recorder.List()
+	_, events := readCast(t, recorder, recordings[0].ID)
+	if len(events) != 2 || events[0][2] != "hello" || events[1][2] != "oops" {
+		t.Errorf("events == %v, want stdout and stderr output", events)
+	}
+}
+
+func TestRecordIgnoresOtherWebsockets(t *testing.T) {
+	recorder, dir := newTestRecorder(t, Retention{})
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/ns/pods?watch=true", nil)
+	if session := recorder.Record(r, ""); session != nil {
+		t.Errorf("expected watch not to be recorded")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("expected no recordings, got %d files", len(files))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	recorder, dir := newTestRecorder(t, Retention{MaxAge: time.Hour, MaxRecordings: 2})
+	now := time.Now()
+	for i, age := range []time.Duration{3 * time.Hour, 30 * time.Minute, 20 * time.Minute, 10 * time.Minute} {
+		path := filepath.Join(dir, string(rune('a'+i))+castExtension)
+		if err := ioutil.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	// Active recordings must survive pruning.
+	recorder.active["b"] = true
+
+	if err := recorder.Prune(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	objects, _ := recorder.store.List()
+	actual := []string{}
+	for _, object := range objects {
+		actual = append(actual, object.ID)
+	}
+	expected := []string{"b", "d"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("remaining recordings == %v, want %v", actual, expected)
+	}
+}
+
+func TestDirectoryStoreRejectsInvalidIDs(t *testing.T) {
+	store, err := NewDirectoryStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range []string{"", "../secret", "a/b", ".hidden", "a..b"} {
+		if _, err := store.Open(id); err == nil || os.IsNotExist(err) {
+			t.Errorf("expected ID %q to be rejected, got %v", id, err)
+		}
+	}
+}
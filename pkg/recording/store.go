@@ -0,0 +1,100 @@
+package recording
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const castExtension = ".cast"
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Object describes a stored recording.
+type Object struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store persists recordings. DirectoryStore is the only implementation, other backends like
+// object stores only need to implement this interface.
+type Store interface {
+	Create(id string) (io.WriteCloser, error)
+	Open(id string) (io.ReadCloser, error)
+	List() ([]Object, error)
+	Delete(id string) error
+}
+
+// DirectoryStore stores every recording as a file in a local directory.
+type DirectoryStore struct {
+	dir string
+}
+
+// NewDirectoryStore creates the directory if it does not exist yet.
+func NewDirectoryStore(dir string) (*DirectoryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory %q: %v", dir, err)
+	}
+	return &DirectoryStore{dir: dir}, nil
+}
+
+func (s *DirectoryStore) path(id string) (string, error) {
+	if !validID.MatchString(id) || strings.Contains(id, "..") {
+		return "", fmt.Errorf("invalid recording ID %q", id)
+	}
+	return filepath.Join(s.dir, id+castExtension), nil
+}
+
+func (s *DirectoryStore) Create(id string) (io.WriteCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (s *DirectoryStore) Open(id string) (io.ReadCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// List returns the stored recordings, oldest first.
+func (s *DirectoryStore) List() ([]Object, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	objects := []Object{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), castExtension) {
+			continue
+		}
+		objects = append(objects, Object{
+			ID:      strings.TrimSuffix(file.Name(), castExtension),
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].ModTime.Before(objects[j].ModTime)
+	})
+	return objects, nil
+}
+
+func (s *DirectoryStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
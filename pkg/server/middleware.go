@@ -10,6 +10,9 @@ import (
 	"github.com/openshift/console/pkg/auth"
 	"github.com/openshift/console/pkg/serverutils"
 
+	authv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 )
 
@@ -70,6 +73,43 @@ func authMiddlewareWithUser(authers map[string]*auth.Authenticator, handlerFunc
 	})
 }
 
+// bearerTokenMiddleware passes requests with a bearer token in the Authorization header, like those of
+// prometheus-k8s, to hdlr if the token is allowed to get /metrics, and authenticates other requests
+// with their session cookie.
+func bearerTokenMiddleware(authers map[string]*auth.Authenticator, k8sEndpoint string, k8sClient *http.Client, hdlr http.HandlerFunc) http.Handler {
+	cookieHandler := authMiddleware(authers, hdlr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			cookieHandler.ServeHTTP(w, r)
+			return
+		}
+		allowed, err := serverutils.NonResourceSelfSubjectAccessReview(r.Context(), &rest.Config{
+			Host:        k8sEndpoint,
+			BearerToken: token,
+			Transport:   k8sClient.Transport,
+		}, authv1.NonResourceAttributes{
+			Path: "/metrics",
+			Verb: "get",
+		})
+		if apierrors.IsUnauthorized(err) {
+			klog.V(4).Infof("bearer token authentication failed: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			klog.Errorf("Failed to check access to metrics: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		hdlr.ServeHTTP(w, r)
+	})
+}
+
 type gzipResponseWriter struct {
 	io.Writer
 	http.ResponseWriter
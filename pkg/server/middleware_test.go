@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	authv1 "k8s.io/api/authorization/v1"
+
+	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+func TestBearerTokenMiddlewareWithEncryptedCookies(t *testing.T) {
+	var issuer string
+	oauthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer":"%s","authorization_endpoint":"%s/auth","token_endpoint":"%s/token"}`, issuer, issuer, issuer)
+	}))
+	defer oauthServer.Close()
+	issuer = oauthServer.URL
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	if err := ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	keyring, err := auth.NewCookieKeyring(keyFile, false)
+	if err != nil {
+		t.Fatalf("NewCookieKeyring error: %v", err)
+	}
+	authenticator, err := auth.NewAuthenticator(context.Background(), &auth.Config{
+		AuthSource:    auth.AuthSourceOpenShift,
+		ClientID:      "console",
+		IssuerURL:     issuer,
+		RedirectURL:   "https://console.example.com/auth/callback",
+		ErrorURL:      "https://console.example.com/error",
+		SuccessURL:    "https://console.example.com/",
+		CookiePath:    "/",
+		RefererPath:   "https://console.example.com/",
+		CookieKeyring: keyring,
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator error: %v", err)
+	}
+
+	// The API server allows the metrics token to get /metrics and rejects unknown tokens.
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		review := authv1.SelfSubjectAccessReview{}
+		json.NewDecoder(r.Body).Decode(&review)
+		switch r.Header.Get("Authorization") {
+		case "Bearer sha256~metrics":
+			attributes := review.Spec.NonResourceAttributes
+			review.Status.Allowed = attributes != nil && attributes.Path == "/metrics" && attributes.Verb == "get"
+		case "Bearer sha256~user":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Unauthorized","code":401}`))
+			return
+		}
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer apiServer.Close()
+
+	handler := bearerTokenMiddleware(map[string]*auth.Authenticator{serverutils.LocalClusterName: authenticator}, apiServer.URL, apiServer.Client(), func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		expectedCode  int
+	}{
+		{name: "bearer token", authorization: "Bearer sha256~metrics", expectedCode: http.StatusOK},
+		{name: "bearer token without access", authorization: "Bearer sha256~user", expectedCode: http.StatusForbidden},
+		{name: "invalid bearer token", authorization: "Bearer sha256~token", expectedCode: http.StatusUnauthorized},
+		{name: "no credentials", expectedCode: http.StatusUnauthorized},
+		{name: "basic credentials", authorization: "Basic dXNlcjpwYXNz", expectedCode: http.StatusUnauthorized},
+		{name: "empty bearer token", authorization: "Bearer ", expectedCode: http.StatusUnauthorized},
+		{name: "plaintext cookie", cookie: "sha256~token", expectedCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: auth.GetCookieName(serverutils.LocalClusterName), Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.expectedCode {
+				t.Errorf("status == %d, want %d", w.Code, tt.expectedCode)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"time"
 
@@ -20,13 +21,18 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/klog"
 
+	"github.com/openshift/console/pkg/alertmanager"
 	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/export"
 	"github.com/openshift/console/pkg/graphql/resolver"
 	helmhandlerspkg "github.com/openshift/console/pkg/helm/handlers"
 	"github.com/openshift/console/pkg/plugins"
 	"github.com/openshift/console/pkg/proxy"
+	"github.com/openshift/console/pkg/rangecache"
+	"github.com/openshift/console/pkg/recording"
 	"github.com/openshift/console/pkg/serverconfig"
 	"github.com/openshift/console/pkg/serverutils"
+	"github.com/openshift/console/pkg/tenancy"
 	"github.com/openshift/console/pkg/terminal"
 	"github.com/openshift/console/pkg/usersettings"
 	"github.com/openshift/console/pkg/version"
@@ -41,31 +47,33 @@ const (
 	tokenizerPageTemplateName          = "tokener.html"
 	multiclusterLogoutPageTemplateName = "multicluster-logout.html"
 
-	authLoginEndpoint                = "/auth/login"
-	AuthLoginCallbackEndpoint        = "/auth/callback"
-	AuthLoginSuccessEndpoint         = "/"
-	AuthLoginErrorEndpoint           = "/error"
-	authLogoutEndpoint               = "/auth/logout"
-	authLogoutMulticlusterEndpoint   = "/api/logout/multicluster"
-	k8sProxyEndpoint                 = "/api/kubernetes/"
-	graphQLEndpoint                  = "/api/graphql"
-	prometheusProxyEndpoint          = "/api/prometheus"
-	prometheusTenancyProxyEndpoint   = "/api/prometheus-tenancy"
-	alertManagerProxyEndpoint        = "/api/alertmanager"
-	alertManagerTenancyProxyEndpoint = "/api/alertmanager-tenancy"
-	meteringProxyEndpoint            = "/api/metering"
-	customLogoEndpoint               = "/custom-logo"
-	helmChartRepoProxyEndpoint       = "/api/helm/charts/"
-	gitopsEndpoint                   = "/api/gitops/"
-	devfileEndpoint                  = "/api/devfile/"
-	devfileSamplesEndpoint           = "/api/devfile/samples/"
-	pluginAssetsEndpoint             = "/api/plugins/"
-	pluginProxyEndpoint              = "/api/proxy/"
-	localesEndpoint                  = "/locales/resource.json"
-	updatesEndpoint                  = "/api/check-updates"
-	operandsListEndpoint             = "/api/list-operands/"
-	accountManagementEndpoint        = "/api/accounts_mgmt/"
-	sha256Prefix                     = "sha256~"
+	authLoginEndpoint              = "/auth/login"
+	AuthLoginCallbackEndpoint      = "/auth/callback"
+	AuthLoginSuccessEndpoint       = "/"
+	AuthLoginErrorEndpoint         = "/error"
+	authLogoutEndpoint             = "/auth/logout"
+	authLogoutMulticlusterEndpoint = "/api/logout/multicluster"
+	authBackChannelLogoutEndpoint  = "/auth/backchannel-logout"
+	k8sProxyEndpoint               = "/api/kubernetes/"
+	graphQLEndpoint                = "/api/graphql"
+	customLogoEndpoint             = "/custom-logo"
+	helmChartRepoProxyEndpoint     = "/api/helm/charts/"
+	devfileEndpoint                = "/api/devfile/"
+	devfileSamplesEndpoint         = "/api/devfile/samples/"
+	pluginAssetsEndpoint           = "/api/plugins/"
+	pluginProxyEndpoint            = "/api/proxy/"
+	localesEndpoint                = "/locales/resource.json"
+	bulkLocalesEndpoint            = "/locales/resources.json"
+	updatesEndpoint                = "/api/check-updates"
+	pluginsStatusEndpoint          = "/api/plugins-status"
+	operandsListEndpoint           = "/api/list-operands/"
+	accountManagementEndpoint      = "/api/accounts_mgmt/"
+	sessionRecordingsEndpoint      = "/api/console/recordings/"
+	sessionsEndpoint               = "/api/console/sessions"
+	silencesEndpoint               = "/api/console/silences"
+	alertStreamEndpoint            = "/api/console/alerts/stream"
+	prometheusExportEndpoint       = "/api/console/prometheus/export"
+	sha256Prefix                   = "sha256~"
 )
 
 type jsGlobals struct {
@@ -86,6 +94,8 @@ type jsGlobals struct {
 	PrometheusTenancyBaseURL   string                     `json:"prometheusTenancyBaseURL"`
 	AlertManagerBaseURL        string                     `json:"alertManagerBaseURL"`
 	MeteringBaseURL            string                     `json:"meteringBaseURL"`
+	LogsBaseURL                string                     `json:"logsBaseURL"`
+	LogsTenancyBaseURL         string                     `json:"logsTenancyBaseURL"`
 	Branding                   string                     `json:"branding"`
 	CustomProductName          string                     `json:"customProductName"`
 	CustomLogoURL              string                     `json:"customLogoURL"`
@@ -106,6 +116,7 @@ type jsGlobals struct {
 	UserSettingsLocation       string                     `json:"userSettingsLocation"`
 	AddPage                    string                     `json:"addPage"`
 	ConsolePlugins             []string                   `json:"consolePlugins"`
+	ConsolePluginIntegrity     map[string]string          `json:"consolePluginIntegrity"`
 	I18nNamespaces             []string                   `json:"i18nNamespaces"`
 	QuickStarts                string                     `json:"quickStarts"`
 	ProjectAccessClusterRoles  string                     `json:"projectAccessClusterRoles"`
@@ -113,6 +124,7 @@ type jsGlobals struct {
 	ControlPlaneTopology       string                     `json:"controlPlaneTopology"`
 	Telemetry                  serverconfig.MultiKeyValue `json:"telemetry"`
 	ReleaseVersion             string                     `json:"releaseVersion"`
+	UpstreamBaseURLs           map[string]string          `json:"upstreamBaseURLs"`
 }
 
 type Server struct {
@@ -138,20 +150,28 @@ type Server struct {
 	ReleaseVersion       string
 	// Map that contains list of enabled plugins and their endpoints.
 	EnabledConsolePlugins serverconfig.MultiKeyValue
-	I18nNamespaces        []string
-	PluginProxy           string
+	// Maps plugins that are served from local directories to the directory, for plugin development.
+	LocalConsolePlugins serverconfig.MultiKeyValue
+	I18nNamespaces      []string
+	PluginProxy         string
 	// Clients with the correct TLS setup for communicating with the API servers.
-	K8sClients                       map[string]*http.Client
-	ThanosProxyConfig                *proxy.Config
-	ThanosTenancyProxyConfig         *proxy.Config
-	ThanosTenancyProxyForRulesConfig *proxy.Config
-	AlertManagerProxyConfig          *proxy.Config
-	AlertManagerTenancyProxyConfig   *proxy.Config
-	MeteringProxyConfig              *proxy.Config
-	TerminalProxyTLSConfig           *tls.Config
-	PluginsProxyTLSConfig            *tls.Config
-	GitOpsProxyConfig                *proxy.Config
-	ClusterManagementProxyConfig     *proxy.Config
+	K8sClients                   map[string]*http.Client
+	TerminalProxyTLSConfig       *tls.Config
+	PluginsProxyTLSConfig        *tls.Config
+	ClusterManagementProxyConfig *proxy.Config
+	// Backend services like Thanos and Alertmanager proxied below their console path.
+	Upstreams []*Upstream
+	// Limits of namespace-scoped Prometheus queries.
+	PrometheusTenancyLimits tenancy.Limits
+	// Caches Prometheus range query results, nil disables caching.
+	RangeQueryCache *rangecache.Cache
+	// Maximum time silences created through the silences API can be active, 0 to not limit it.
+	SilenceMaxDuration time.Duration
+	// Limits of Prometheus query exports, 0 disables a limit.
+	PrometheusExportMaxRange  time.Duration
+	PrometheusExportMaxSeries int
+	// How often Alertmanager is polled while clients are connected to the alert stream, 0 disables the stream.
+	AlertStreamPollInterval time.Duration
 	// A lister for resource listing of a particular kind
 	MonitoringDashboardConfigMapLister ResourceLister
 	KnativeEventSourceCRDLister        ResourceLister
@@ -171,26 +191,33 @@ type Server struct {
 	AddPage                   string
 	ProjectAccessClusterRoles string
 	Telemetry                 serverconfig.MultiKeyValue
+	// Compression settings for proxied API responses and websockets, nil disables compression.
+	ProxyCompression *proxy.CompressionConfig
+	// Keepalive, timeout and connection limit settings for proxied websockets, nil uses the defaults.
+	WebsocketConfig *proxy.WebsocketConfig
+	// Records pod exec and attach sessions, nil disables recording.
+	SessionRecorder *recording.Recorder
+	// Checks for requests to the k8s proxy that impersonate another user.
+	ImpersonationConfig *proxy.ImpersonationConfig
+	// Enables plugins from ConsolePlugin resources in addition to EnabledConsolePlugins, nil disables discovery.
+	PluginDiscovery *plugins.Discovery
+	// Caches plugin assets, nil disables caching.
+	PluginAssetCache *plugins.AssetCache
+	// Pins the entry scripts of plugins, nil disables pinning.
+	PluginIntegrityPins *plugins.IntegrityPins
+	// How often plugin manifests are validated, 0 disables the checks and loads all enabled plugins.
+	PluginManifestCheckInterval time.Duration
+
+	pluginsHandler *plugins.PluginsHandler
 }
 
-func (s *Server) authDisabled() bool {
-	return s.getLocalAuther() == nil
-}
-
-func (s *Server) prometheusProxyEnabled() bool {
-	return len(s.K8sProxyConfigs) == 1 && s.ThanosTenancyProxyConfig != nil && s.ThanosTenancyProxyForRulesConfig != nil
+type discoveredProxyService struct {
+	service serverconfig.ProxyService
+	handler http.Handler
 }
 
-func (s *Server) alertManagerProxyEnabled() bool {
-	return s.AlertManagerProxyConfig != nil && s.AlertManagerTenancyProxyConfig != nil
-}
-
-func (s *Server) meteringProxyEnabled() bool {
-	return s.MeteringProxyConfig != nil
-}
-
-func (s *Server) gitopsProxyEnabled() bool {
-	return s.GitOpsProxyConfig != nil
+func (s *Server) authDisabled() bool {
+	return s.getLocalAuther() == nil
 }
 
 func (s *Server) getLocalAuther() *auth.Authenticator {
@@ -205,6 +232,13 @@ func (s *Server) getLocalK8sClient() *http.Client {
 	return s.K8sClients[serverutils.LocalClusterName]
 }
 
+// newProxy creates a proxy that uses the server's compression and websocket settings.
+func (s *Server) newProxy(config *proxy.Config) *proxy.Proxy {
+	config.Compression = s.ProxyCompression
+	config.Websocket = s.WebsocketConfig
+	return proxy.NewProxy(config)
+}
+
 func (s *Server) HTTPHandler() http.Handler {
 	mux := http.NewServeMux()
 
@@ -212,6 +246,10 @@ func (s *Server) HTTPHandler() http.Handler {
 		for cluster := range s.K8sProxyConfigs {
 			s.K8sProxyConfigs[cluster].Origin = fmt.Sprintf("%s://%s", s.BaseURL.Scheme, s.BaseURL.Host)
 		}
+		// Upstreams like the Loki tail endpoint accept websockets, which must come from the console.
+		for _, upstream := range s.Upstreams {
+			upstream.ProxyConfig.Origin = fmt.Sprintf("%s://%s", s.BaseURL.Scheme, s.BaseURL.Host)
+		}
 	}
 
 	localAuther := s.getLocalAuther()
@@ -219,7 +257,16 @@ func (s *Server) HTTPHandler() http.Handler {
 	localK8sClient := s.getLocalK8sClient()
 	k8sProxies := make(map[string]*proxy.Proxy)
 	for cluster, proxyConfig := range s.K8sProxyConfigs {
-		k8sProxies[cluster] = proxy.NewProxy(proxyConfig)
+		if s.SessionRecorder != nil {
+			proxyConfig.Recorder = s.SessionRecorder
+		}
+		proxyConfig.Impersonation = s.ImpersonationConfig
+		k8sProxies[cluster] = s.newProxy(proxyConfig)
+	}
+	recordingHandler := &recording.Handler{
+		Recorder: s.SessionRecorder,
+		Client:   localK8sClient,
+		Endpoint: localK8sProxyConfig.Endpoint.String(),
 	}
 
 	handle := func(path string, handler http.Handler) {
@@ -278,11 +325,13 @@ func (s *Server) HTTPHandler() http.Handler {
 		handleFunc(authLogoutEndpoint, localAuther.LogoutFunc)
 		handleFunc(authLogoutMulticlusterEndpoint, s.handleLogoutMulticluster)
 		handleFunc(AuthLoginCallbackEndpoint, localAuther.CallbackFunc(fn))
+		handleFunc(authBackChannelLogoutEndpoint, localAuther.BackChannelLogoutFunc)
 		handle("/api/openshift/delete-token", authHandlerWithUser(s.handleOpenShiftTokenDeletion))
 		for clusterName, clusterAuther := range s.Authers {
 			if clusterAuther != nil {
 				handleFunc(fmt.Sprintf("%s/%s", authLoginEndpoint, clusterName), clusterAuther.LoginFunc)
 				handleFunc(fmt.Sprintf("%s/%s", AuthLoginCallbackEndpoint, clusterName), clusterAuther.CallbackFunc(fn))
+				handleFunc(fmt.Sprintf("%s/%s", authBackChannelLogoutEndpoint, clusterName), clusterAuther.BackChannelLogoutFunc)
 			}
 		}
 	}
@@ -320,6 +369,14 @@ func (s *Server) HTTPHandler() http.Handler {
 			}
 
 			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
+			if s.SessionRecorder != nil && proxy.IsExecOrAttach(r) {
+				r = recordingHandler.WithUser(r, user, cluster)
+			}
+			if user.ID != "" {
+				r = proxy.WithUserKey(r, user.ID)
+			} else if user.Username != "" {
+				r = proxy.WithUserKey(r, user.Username)
+			}
 			k8sProxy.ServeHTTP(w, r)
 		})),
 	)
@@ -354,154 +411,98 @@ func (s *Server) HTTPHandler() http.Handler {
 		graphQLHandler(w, r.WithContext(ctx))
 	}))
 
-	if s.prometheusProxyEnabled() {
-		// Only proxy requests to the Prometheus API, not the UI.
-		var (
-			labelSourcePath      = prometheusProxyEndpoint + "/api/v1/label/"
-			rulesSourcePath      = prometheusProxyEndpoint + "/api/v1/rules"
-			querySourcePath      = prometheusProxyEndpoint + "/api/v1/query"
-			queryRangeSourcePath = prometheusProxyEndpoint + "/api/v1/query_range"
-			targetsSourcePath    = prometheusProxyEndpoint + "/api/v1/targets"
-			metadataSourcePath   = prometheusProxyEndpoint + "/api/v1/metadata"
-			seriesSourcePath     = prometheusProxyEndpoint + "/api/v1/series"
-			labelsSourcePath     = prometheusProxyEndpoint + "/api/v1/labels"
-			targetAPIPath        = prometheusProxyEndpoint + "/api/"
-
-			tenancyQuerySourcePath      = prometheusTenancyProxyEndpoint + "/api/v1/query"
-			tenancyQueryRangeSourcePath = prometheusTenancyProxyEndpoint + "/api/v1/query_range"
-			tenancyRulesSourcePath      = prometheusTenancyProxyEndpoint + "/api/v1/rules"
-			tenancyTargetAPIPath        = prometheusTenancyProxyEndpoint + "/api/"
-
-			thanosProxy                = proxy.NewProxy(s.ThanosProxyConfig)
-			thanosTenancyProxy         = proxy.NewProxy(s.ThanosTenancyProxyConfig)
-			thanosTenancyForRulesProxy = proxy.NewProxy(s.ThanosTenancyProxyForRulesConfig)
-		)
-
-		// global label, query, and query_range requests have to be proxied via thanos
-		handle(querySourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(queryRangeSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(labelSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(targetsSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(metadataSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(seriesSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(labelsSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-
-		// alerting (rules) are being proxied via thanos querier
-		// such that both in-cluster and user workload alerts appear in console.
-		handle(rulesSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, targetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosProxy.ServeHTTP(w, r)
-			})),
-		)
-
-		// tenancy queries and query ranges have to be proxied via thanos
-		handle(tenancyQuerySourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, tenancyTargetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosTenancyProxy.ServeHTTP(w, r)
-			})),
-		)
-		handle(tenancyQueryRangeSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, tenancyTargetAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosTenancyProxy.ServeHTTP(w, r)
-			})),
-		)
-		// tenancy rules have to be proxied via thanos
-		handle(tenancyRulesSourcePath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, tenancyTargetAPIPath),
+	for _, upstream := range s.enabledUpstreams() {
+		var upstreamProxy http.Handler = s.newProxy(upstream.ProxyConfig)
+		if upstream.CacheRangeQueries && s.RangeQueryCache != nil {
+			upstreamProxy = &rangecache.Handler{
+				Cache:      s.RangeQueryCache,
+				Scope:      upstream.Name,
+				Namespaced: upstream.PromQLTenancy,
+				Next:       upstreamProxy,
+			}
+		}
+		if upstream.PromQLTenancy {
+			upstreamProxy = &tenancy.PrometheusHandler{Limits: s.PrometheusTenancyLimits, Next: upstreamProxy}
+		}
+		if upstream.LogQLTenancy {
+			upstreamProxy = &tenancy.LokiHandler{Next: upstreamProxy}
+		}
+		forwardToken := upstream.ForwardToken
+		upstreamHandler := http.StripPrefix(
+			proxy.SingleJoiningSlash(s.BaseURL.Path, upstream.ConsolePath),
 			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				thanosTenancyForRulesProxy.ServeHTTP(w, r)
-			})),
+				if forwardToken {
+					r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
+				} else {
+					r.Header.Del("Authorization")
+				}
+				upstreamProxy.ServeHTTP(w, r)
+			}),
 		)
+		for _, upstreamPath := range upstream.HandlerPaths {
+			handle(upstreamPath, upstreamHandler)
+		}
 	}
 
-	if s.alertManagerProxyEnabled() {
-		var (
-			alertManagerProxyAPIPath        = alertManagerProxyEndpoint + "/api/"
-			alertManagerTenancyProxyAPIPath = alertManagerTenancyProxyEndpoint + "/api/"
-
-			alertManagerProxy        = proxy.NewProxy(s.AlertManagerProxyConfig)
-			alertManagerTenancyProxy = proxy.NewProxy(s.AlertManagerTenancyProxyConfig)
-		)
-
-		handle(alertManagerProxyAPIPath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, alertManagerProxyAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				alertManagerProxy.ServeHTTP(w, r)
-			})),
-		)
-
-		handle(alertManagerTenancyProxyAPIPath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, alertManagerTenancyProxyAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				alertManagerTenancyProxy.ServeHTTP(w, r)
-			})),
-		)
+	silenceHandler := &alertmanager.SilenceHandler{
+		MaxDuration: s.SilenceMaxDuration,
+		K8sClient:   localK8sClient,
+		K8sEndpoint: localK8sProxyConfig.Endpoint.String(),
+	}
+	for _, upstream := range s.enabledUpstreams() {
+		backend := &alertmanager.Backend{
+			Endpoint: upstream.ProxyConfig.Endpoint,
+			Client:   &http.Client{Transport: &http.Transport{TLSClientConfig: upstream.ProxyConfig.TLSClientConfig}},
+		}
+		switch upstream.Name {
+		case serverconfig.AlertmanagerUpstream:
+			silenceHandler.Alertmanager = backend
+		case serverconfig.AlertmanagerTenancyUpstream:
+			silenceHandler.AlertmanagerTenancy = backend
+		}
+	}
+	exportHandler := &export.Handler{
+		TenancyLimits: s.PrometheusTenancyLimits,
+		MaxRange:      s.PrometheusExportMaxRange,
+		MaxSeries:     s.PrometheusExportMaxSeries,
+	}
+	for _, upstream := range s.enabledUpstreams() {
+		exportUpstream := &export.Upstream{
+			Endpoint: upstream.ProxyConfig.Endpoint,
+			Client:   &http.Client{Transport: &http.Transport{TLSClientConfig: upstream.ProxyConfig.TLSClientConfig}},
+		}
+		switch upstream.Name {
+		case serverconfig.PrometheusUpstream:
+			exportHandler.Prometheus = exportUpstream
+		case serverconfig.PrometheusTenancyUpstream:
+			exportHandler.PrometheusTenancy = exportUpstream
+		}
+	}
+	if exportHandler.Prometheus != nil || exportHandler.PrometheusTenancy != nil {
+		handle(prometheusExportEndpoint, authHandlerWithUser(exportHandler.HandleExport))
 	}
 
-	if s.meteringProxyEnabled() {
-		meteringProxyAPIPath := meteringProxyEndpoint + "/api/"
-		meteringProxy := proxy.NewProxy(s.MeteringProxyConfig)
-		handle(meteringProxyAPIPath, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, meteringProxyAPIPath),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				meteringProxy.ServeHTTP(w, r)
-			})),
+	// Alertmanager is polled with the service account, which can read all alerts.
+	if silenceHandler.Alertmanager != nil && s.ServiceAccountToken != "" && s.AlertStreamPollInterval > 0 {
+		alertStream := &alertmanager.AlertStream{
+			Backend:      silenceHandler.Alertmanager,
+			Token:        s.ServiceAccountToken,
+			PollInterval: s.AlertStreamPollInterval,
+			K8sClient:    localK8sClient,
+			K8sEndpoint:  localK8sProxyConfig.Endpoint.String(),
+		}
+		handle(alertStreamEndpoint, authHandlerWithUser(alertStream.HandleStream))
+	}
+	if silenceHandler.Alertmanager != nil || silenceHandler.AlertmanagerTenancy != nil {
+		silencesHandler := http.StripPrefix(
+			proxy.SingleJoiningSlash(s.BaseURL.Path, silencesEndpoint),
+			authHandlerWithUser(silenceHandler.HandleSilences),
 		)
+		handle(silencesEndpoint, silencesHandler)
+		handle(silencesEndpoint+"/", silencesHandler)
 	}
 
-	clusterManagementProxy := proxy.NewProxy(s.ClusterManagementProxyConfig)
+	clusterManagementProxy := s.newProxy(s.ClusterManagementProxyConfig)
 	handle(accountManagementEndpoint, http.StripPrefix(
 		s.BaseURL.Path,
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -536,6 +537,17 @@ func (s *Server) HTTPHandler() http.Handler {
 	}
 	handle("/api/console/user-settings", authHandlerWithUser(userSettingHandler.HandleUserSettings))
 
+	if s.SessionRecorder != nil {
+		handle(sessionRecordingsEndpoint, http.StripPrefix(
+			proxy.SingleJoiningSlash(s.BaseURL.Path, sessionRecordingsEndpoint),
+			authHandlerWithUser(recordingHandler.HandleRecordings),
+		))
+	}
+
+	if !s.authDisabled() {
+		handle(sessionsEndpoint, authHandlerWithUser(s.handleRevokeSessions))
+	}
+
 	helmHandlers := helmhandlerspkg.New(localK8sProxyConfig.Endpoint.String(), localK8sClient.Transport, s)
 
 	pluginsHandler := plugins.NewPluginsHandler(
@@ -548,11 +560,18 @@ func (s *Server) HTTPHandler() http.Handler {
 		s.EnabledConsolePlugins,
 		s.PublicDir,
 	)
+	pluginsHandler.AssetCache = s.PluginAssetCache
+	pluginsHandler.ConsoleVersion = version.Version
+	pluginsHandler.LocalPlugins = s.LocalConsolePlugins
+	pluginsHandler.IntegrityPins = s.PluginIntegrityPins
+	s.pluginsHandler = pluginsHandler
 
 	handleFunc(localesEndpoint, func(w http.ResponseWriter, r *http.Request) {
 		pluginsHandler.HandleI18nResources(w, r)
 	})
 
+	handleFunc(bulkLocalesEndpoint, pluginsHandler.HandleI18nBulkResources)
+
 	handle(pluginAssetsEndpoint, http.StripPrefix(
 		proxy.SingleJoiningSlash(s.BaseURL.Path, pluginAssetsEndpoint),
 		authHandler(func(w http.ResponseWriter, r *http.Request) {
@@ -560,13 +579,22 @@ func (s *Server) HTTPHandler() http.Handler {
 		}),
 	))
 
+	pluginProxyServiceHandler := func(proxyServiceHandler *plugins.PluginsProxyServiceHandler) http.Handler {
+		serviceProxy := s.newProxy(proxyServiceHandler.ProxyConfig)
+		h := proxyServiceHandler.Handler(serviceProxy)
+		if proxyServiceHandler.Authorize {
+			h = authHandler(h.ServeHTTP)
+		}
+		return http.StripPrefix(proxy.SingleJoiningSlash(s.BaseURL.Path, proxyServiceHandler.ConsoleEndpoint), h)
+	}
+
 	if len(s.PluginProxy) != 0 {
 		proxyConfig, err := plugins.ParsePluginProxyConfig(s.PluginProxy)
 		if err != nil {
 			klog.Fatalf("Error parsing plugin proxy config: %s", err)
 			os.Exit(1)
 		}
-		proxyServiceHandlers, err := plugins.GetPluginProxyServiceHandlers(proxyConfig, s.PluginsProxyTLSConfig, pluginProxyEndpoint)
+		proxyServiceHandlers, err := plugins.GetPluginProxyServiceHandlers(proxyConfig, s.PluginsProxyTLSConfig, pluginProxyEndpoint, s.ServiceAccountToken)
 		if err != nil {
 			klog.Fatalf("Error getting plugin proxy handlers: %s", err)
 			os.Exit(1)
@@ -576,43 +604,73 @@ func (s *Server) HTTPHandler() http.Handler {
 		}
 		for _, proxyServiceHandler := range proxyServiceHandlers {
 			klog.Infof(" - %s -> %s\n", proxyServiceHandler.ConsoleEndpoint, proxyServiceHandler.ProxyConfig.Endpoint)
-			serviceProxy := proxy.NewProxy(proxyServiceHandler.ProxyConfig)
-			f := func(w http.ResponseWriter, r *http.Request) {
-				serviceProxy.ServeHTTP(w, r)
+			handle(proxyServiceHandler.ConsoleEndpoint, pluginProxyServiceHandler(proxyServiceHandler))
+		}
+	}
+
+	if s.PluginDiscovery != nil {
+		pluginProxyRouter := &plugins.ProxyRouter{}
+		handle(plugins.ProxyServicePathPrefix, pluginProxyRouter)
+		// Proxies are only recreated for changed services, so that unchanged ones keep their connections.
+		discoveredServices := map[string]discoveredProxyService{}
+		s.PluginDiscovery.OnChange = func(endpoints map[string]string, services []serverconfig.ProxyService) {
+			pluginsEndpointMap := map[string]string{}
+			for name, endpoint := range s.EnabledConsolePlugins {
+				pluginsEndpointMap[name] = endpoint
+			}
+			for name, endpoint := range endpoints {
+				pluginsEndpointMap[name] = endpoint
 			}
-			var h http.Handler
-			if proxyServiceHandler.Authorize {
-				h = authHandler(f)
-			} else {
-				h = http.HandlerFunc(f)
+			pluginsHandler.SetPluginsEndpointMap(pluginsEndpointMap)
+
+			routes := map[string]http.Handler{}
+			current := map[string]discoveredProxyService{}
+			for _, service := range services {
+				if previous, ok := discoveredServices[service.ConsoleAPIPath]; ok && reflect.DeepEqual(previous.service, service) {
+					current[service.ConsoleAPIPath] = previous
+					routes[proxy.SingleJoiningSlash(s.BaseURL.Path, service.ConsoleAPIPath)] = previous.handler
+					continue
+				}
+				proxyServiceHandlers, err := plugins.GetPluginProxyServiceHandlers(&serverconfig.Proxy{Services: []serverconfig.ProxyService{service}}, s.PluginsProxyTLSConfig, pluginProxyEndpoint, s.ServiceAccountToken)
+				if err != nil {
+					continue
+				}
+				klog.Infof("Proxying %s -> %s", service.ConsoleAPIPath, service.Endpoint)
+				h := pluginProxyServiceHandler(proxyServiceHandlers[0])
+				current[service.ConsoleAPIPath] = discoveredProxyService{service: service, handler: h}
+				routes[proxy.SingleJoiningSlash(s.BaseURL.Path, service.ConsoleAPIPath)] = h
 			}
-			handle(proxyServiceHandler.ConsoleEndpoint, http.StripPrefix(
-				proxy.SingleJoiningSlash(s.BaseURL.Path, proxyServiceHandler.ConsoleEndpoint),
-				h,
-			))
+			discoveredServices = current
+			pluginProxyRouter.SetRoutes(routes)
 		}
+		// Discovery runs for the lifetime of the process, like the server itself.
+		go s.PluginDiscovery.Run(context.Background())
 	}
 
-	handle(updatesEndpoint, authHandler(pluginsHandler.HandleCheckUpdates))
-
-	// Helm Endpoints
-	metricsHandler := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Requests from prometheus-k8s have the access token in headers instead of cookies.
-			// This allows metric requests with proper tokens in either headers or cookies.
-			if r.URL.Path == "/metrics" {
-				openshiftSessionCookieName := "openshift-session-token"
-				openshiftSessionCookieValue := r.Header.Get("Authorization")
-				r.AddCookie(&http.Cookie{Name: openshiftSessionCookieName, Value: openshiftSessionCookieValue})
+	if len(s.LocalConsolePlugins) > 0 {
+		go func() {
+			if err := pluginsHandler.WatchLocalPlugins(context.Background()); err != nil {
+				klog.Errorf("Failed to watch local plugins, changes won't reload the console: %v", err)
 			}
-			next.ServeHTTP(w, r)
-		})
+		}()
+	}
+	if s.PluginManifestCheckInterval > 0 {
+		go pluginsHandler.RunManifestChecks(context.Background(), s.PluginManifestCheckInterval)
 	}
 
-	handle("/metrics", metricsHandler(authHandler(func(w http.ResponseWriter, r *http.Request) {
-		promhttp.Handler().ServeHTTP(w, r)
-	})))
+	handle(updatesEndpoint, authHandler(pluginsHandler.HandleCheckUpdates))
+	handle(pluginsStatusEndpoint, authHandler(pluginsHandler.HandlePluginsStatus))
+
+	// Requests from prometheus-k8s have the access token in headers instead of cookies.
+	// This allows metric requests with proper tokens in either headers or cookies.
+	metricsHandler := promhttp.Handler().ServeHTTP
+	if s.authDisabled() {
+		handle("/metrics", authHandler(metricsHandler))
+	} else {
+		handle("/metrics", bearerTokenMiddleware(s.Authers, s.getLocalK8sProxyConfig().Endpoint.String(), s.getLocalK8sClient(), metricsHandler))
+	}
 
+	// Helm Endpoints
 	handle("/api/helm/template", authHandlerWithUser(helmHandlers.HandleHelmRenderManifests))
 	handle("/api/helm/releases", authHandlerWithUser(helmHandlers.HandleHelmList))
 	handle("/api/helm/chart", authHandlerWithUser(helmHandlers.HandleChartGet))
@@ -637,18 +695,6 @@ func (s *Server) HTTPHandler() http.Handler {
 		}
 	}))
 
-	// GitOps proxy endpoints
-	if s.gitopsProxyEnabled() {
-		gitopsProxy := proxy.NewProxy(s.GitOpsProxyConfig)
-		handle(gitopsEndpoint, http.StripPrefix(
-			proxy.SingleJoiningSlash(s.BaseURL.Path, gitopsEndpoint),
-			authHandlerWithUser(func(user *auth.User, w http.ResponseWriter, r *http.Request) {
-				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-				gitopsProxy.ServeHTTP(w, r)
-			})),
-		)
-	}
-
 	mux.HandleFunc(s.BaseURL.Path, s.indexHandler)
 
 	return securityHeadersMiddleware(http.Handler(mux))
@@ -672,11 +718,6 @@ func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	plugins := make([]string, 0, len(s.EnabledConsolePlugins))
-	for plugin := range s.EnabledConsolePlugins {
-		plugins = append(plugins, plugin)
-	}
-
 	clusters := make([]string, 0, len(s.K8sProxyConfigs))
 	for cluster := range s.K8sProxyConfigs {
 		clusters = append(clusters, cluster)
@@ -712,7 +753,8 @@ func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 		GraphQLBaseURL:             proxy.SingleJoiningSlash(s.BaseURL.Path, graphQLEndpoint),
 		DevCatalogCategories:       s.DevCatalogCategories,
 		UserSettingsLocation:       s.UserSettingsLocation,
-		ConsolePlugins:             plugins,
+		ConsolePlugins:             s.pluginsHandler.CompatiblePlugins(),
+		ConsolePluginIntegrity:     s.pluginsHandler.PluginIntegrity(),
 		I18nNamespaces:             s.I18nNamespaces,
 		QuickStarts:                s.QuickStarts,
 		AddPage:                    s.AddPage,
@@ -730,18 +772,7 @@ func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
 		jsg.KubeAdminLogoutURL = specialAuthURLs.KubeAdminLogout
 	}
 
-	if s.prometheusProxyEnabled() {
-		jsg.PrometheusBaseURL = proxy.SingleJoiningSlash(s.BaseURL.Path, prometheusProxyEndpoint)
-		jsg.PrometheusTenancyBaseURL = proxy.SingleJoiningSlash(s.BaseURL.Path, prometheusTenancyProxyEndpoint)
-	}
-
-	if s.alertManagerProxyEnabled() {
-		jsg.AlertManagerBaseURL = proxy.SingleJoiningSlash(s.BaseURL.Path, alertManagerProxyEndpoint)
-	}
-
-	if s.meteringProxyEnabled() {
-		jsg.MeteringBaseURL = proxy.SingleJoiningSlash(s.BaseURL.Path, meteringProxyEndpoint)
-	}
+	s.setUpstreamJSGlobals(jsg)
 
 	if !s.authDisabled() {
 		localAuther.SetCSRFCookie(s.BaseURL.Path, &w)
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/auth"
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+type revokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// handleRevokeSessions logs out all console sessions of the user given by the user query parameter.
+// Only users that can impersonate other users have access, since they could act as the user anyway.
+// Only this replica's cache is cleared: with Secret-backed sessions, other replicas accept the revoked
+// sessions until their cached copies expire a few seconds later, and with in-memory sessions, the
+// sessions held by other replicas aren't revoked at all.
+func (s *Server) handleRevokeSessions(user *auth.User, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		serverutils.SendResponse(w, http.StatusMethodNotAllowed, serverutils.ApiError{Err: "Unsupported method, supported methods are DELETE"})
+		return
+	}
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: "Missing user query parameter"})
+		return
+	}
+
+	cluster := serverutils.GetCluster(r)
+	auther, autherFound := s.Authers[cluster]
+	k8sProxy, k8sProxyFound := s.K8sProxyConfigs[cluster]
+	k8sClient, k8sClientFound := s.K8sClients[cluster]
+	if !autherFound || !k8sProxyFound || !k8sClientFound {
+		serverutils.SendResponse(w, http.StatusBadRequest, serverutils.ApiError{Err: fmt.Sprintf("Invalid cluster: %v", cluster)})
+		return
+	}
+
+	allowed, err := canImpersonateUsers(r.Context(), &rest.Config{
+		Host:        k8sProxy.Endpoint.String(),
+		BearerToken: user.Token,
+		Transport:   k8sClient.Transport,
+	})
+	if err != nil {
+		klog.Errorf("Failed to check access to revoke sessions: %v", err)
+		serverutils.SendResponse(w, http.StatusBadGateway, serverutils.ApiError{Err: fmt.Sprintf("Failed to check access to revoke sessions: %v", err)})
+		return
+	}
+	if !allowed {
+		serverutils.SendResponse(w, http.StatusForbidden, serverutils.ApiError{Err: "Revoking sessions is only allowed for users who can impersonate users"})
+		return
+	}
+
+	revoked, err := auther.RevokeUserSessions(userID)
+	if errors.Is(err, auth.ErrSessionsUnsupported) {
+		serverutils.SendResponse(w, http.StatusNotImplemented, serverutils.ApiError{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		klog.Errorf("Failed to revoke sessions of user %q: %v", userID, err)
+		serverutils.SendResponse(w, http.StatusInternalServerError, serverutils.ApiError{Err: fmt.Sprintf("Failed to revoke sessions: %v", err)})
+		return
+	}
+	serverutils.SendResponse(w, http.StatusOK, revokeSessionsResponse{Revoked: revoked})
+}
+
+func canImpersonateUsers(ctx context.Context, config *rest.Config) (bool, error) {
+	return serverutils.SelfSubjectAccessReview(ctx, config, authv1.ResourceAttributes{
+		Verb:     "impersonate",
+		Resource: "users",
+	})
+}
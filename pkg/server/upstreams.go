@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/openshift/console/pkg/proxy"
+)
+
+// Upstream is a backend service proxied below ConsolePath.
+type Upstream struct {
+	Name        string
+	ConsolePath string
+	// Paths below the base path that are proxied to the upstream.
+	HandlerPaths []string
+	// Send the user's bearer token to the upstream.
+	ForwardToken bool
+	// Key the console base URL of the upstream is exposed as in SERVER_FLAGS, empty to not expose it.
+	JSGlobal string
+	// The upstream only serves the local cluster and is disabled when managed clusters are configured.
+	DisableWithManagedClusters bool
+	// Restrict Prometheus API requests to the namespace given in the `namespace` query parameter.
+	PromQLTenancy bool
+	// Serve Prometheus range queries from the range query cache if it is enabled.
+	CacheRangeQueries bool
+	// Restrict Loki API requests to the namespace given in the `namespace` query parameter.
+	LogQLTenancy bool
+	ProxyConfig  *proxy.Config
+}
+
+func (s *Server) enabledUpstreams() []*Upstream {
+	upstreams := []*Upstream{}
+	for _, upstream := range s.Upstreams {
+		if upstream.DisableWithManagedClusters && len(s.K8sProxyConfigs) > 1 {
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
+
+func (s *Server) setUpstreamJSGlobals(jsg *jsGlobals) {
+	for _, upstream := range s.enabledUpstreams() {
+		if upstream.JSGlobal == "" {
+			continue
+		}
+		baseURL := proxy.SingleJoiningSlash(s.BaseURL.Path, upstream.ConsolePath)
+		// The frontend reads the base URLs of the default upstreams from dedicated flags.
+		switch upstream.JSGlobal {
+		case "prometheusBaseURL":
+			jsg.PrometheusBaseURL = baseURL
+		case "prometheusTenancyBaseURL":
+			jsg.PrometheusTenancyBaseURL = baseURL
+		case "alertManagerBaseURL":
+			jsg.AlertManagerBaseURL = baseURL
+		case "meteringBaseURL":
+			jsg.MeteringBaseURL = baseURL
+		case "logsBaseURL":
+			jsg.LogsBaseURL = baseURL
+		case "logsTenancyBaseURL":
+			jsg.LogsTenancyBaseURL = baseURL
+		default:
+			if jsg.UpstreamBaseURLs == nil {
+				jsg.UpstreamBaseURLs = map[string]string{}
+			}
+			jsg.UpstreamBaseURLs[upstream.JSGlobal] = baseURL
+		}
+	}
+}
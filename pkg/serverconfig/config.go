@@ -109,8 +109,12 @@ func SetFlagsFromConfig(fs *flag.FlagSet, config Config) (err error) {
 	addCustomization(fs, &config.Customization)
 	addProviders(fs, &config.Providers)
 	addMonitoringInfo(fs, &config.MonitoringInfo)
+	addLoggingInfo(fs, &config.LoggingInfo)
 	addHelmConfig(fs, &config.Helm)
 	addPlugins(fs, config.Plugins)
+	addPluginsDiscovery(fs, config.PluginsDiscovery)
+	addPluginAssetCache(fs, config.PluginAssetCacheSizeMB)
+	addPluginManifestCheckInterval(fs, config.PluginManifestCheckInterval)
 	addI18nNamespaces(fs, config.I18nNamespaces)
 	addManagedClusters(fs, config.ManagedClusterConfigFile)
 	err = addProxy(fs, &config.Proxy)
@@ -118,6 +122,13 @@ func SetFlagsFromConfig(fs *flag.FlagSet, config Config) (err error) {
 		return err
 	}
 	addTelemetry(fs, config.Telemetry)
+	addWebsocket(fs, &config.Websocket)
+	addSessionRecording(fs, &config.SessionRecording)
+	addPluginIntegrity(fs, &config.PluginIntegrity)
+	err = addUpstreams(fs, config.Upstreams)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -271,6 +282,39 @@ func addMonitoringInfo(fs *flag.FlagSet, monitoring *MonitoringInfo) {
 	if monitoring.ThanosPublicURL != "" {
 		fs.Set("thanos-public-url", monitoring.ThanosPublicURL)
 	}
+	if monitoring.TenancyMaxRange != "" {
+		fs.Set("prometheus-tenancy-max-range", monitoring.TenancyMaxRange)
+	}
+	if monitoring.TenancyMinStep != "" {
+		fs.Set("prometheus-tenancy-min-step", monitoring.TenancyMinStep)
+	}
+	if monitoring.TenancyQueryTimeout != "" {
+		fs.Set("prometheus-tenancy-query-timeout", monitoring.TenancyQueryTimeout)
+	}
+	if monitoring.RangeCacheSizeMB != 0 {
+		fs.Set("prometheus-range-cache-size", strconv.Itoa(monitoring.RangeCacheSizeMB))
+	}
+	if monitoring.RangeCacheFreshness != "" {
+		fs.Set("prometheus-range-cache-freshness", monitoring.RangeCacheFreshness)
+	}
+	if monitoring.ExportMaxRange != "" {
+		fs.Set("prometheus-export-max-range", monitoring.ExportMaxRange)
+	}
+	if monitoring.ExportMaxSeries != 0 {
+		fs.Set("prometheus-export-max-series", strconv.Itoa(monitoring.ExportMaxSeries))
+	}
+	if monitoring.SilenceMaxDuration != "" {
+		fs.Set("alertmanager-silence-max-duration", monitoring.SilenceMaxDuration)
+	}
+	if monitoring.AlertStreamPollInterval != "" {
+		fs.Set("alert-stream-poll-interval", monitoring.AlertStreamPollInterval)
+	}
+}
+
+func addLoggingInfo(fs *flag.FlagSet, logging *LoggingInfo) {
+	if logging.LokiGatewayURL != "" {
+		fs.Set("logs-gateway-url", logging.LokiGatewayURL)
+	}
 }
 
 func addCustomization(fs *flag.FlagSet, customization *Customization) {
@@ -341,12 +385,88 @@ func addPlugins(fs *flag.FlagSet, plugins MultiKeyValue) {
 	}
 }
 
+func addPluginsDiscovery(fs *flag.FlagSet, pluginsDiscovery bool) {
+	if pluginsDiscovery {
+		fs.Set("plugins-discovery", "true")
+	}
+}
+
+func addPluginAssetCache(fs *flag.FlagSet, sizeMB *int) {
+	if sizeMB != nil {
+		fs.Set("plugin-asset-cache-size", strconv.Itoa(*sizeMB))
+	}
+}
+
+func addPluginManifestCheckInterval(fs *flag.FlagSet, interval string) {
+	if interval != "" {
+		fs.Set("plugin-manifest-check-interval", interval)
+	}
+}
+
 func addTelemetry(fs *flag.FlagSet, telemetry MultiKeyValue) {
 	for key, value := range telemetry {
 		fs.Set("telemetry", fmt.Sprintf("%s=%s", key, value))
 	}
 }
 
+func addWebsocket(fs *flag.FlagSet, websocket *Websocket) {
+	if websocket.PingInterval != "" {
+		fs.Set("websocket-ping-interval", websocket.PingInterval)
+	}
+	if websocket.Timeout != "" {
+		fs.Set("websocket-timeout", websocket.Timeout)
+	}
+	if websocket.MaxIdle != "" {
+		fs.Set("websocket-max-idle", websocket.MaxIdle)
+	}
+	if websocket.MaxSessionDuration != "" {
+		fs.Set("websocket-max-session-duration", websocket.MaxSessionDuration)
+	}
+	if websocket.MaxConnectionsPerUser != 0 {
+		fs.Set("websocket-max-connections-per-user", strconv.Itoa(websocket.MaxConnectionsPerUser))
+	}
+	if websocket.MaxConnections != 0 {
+		fs.Set("websocket-max-connections", strconv.Itoa(websocket.MaxConnections))
+	}
+}
+
+func addSessionRecording(fs *flag.FlagSet, sessionRecording *SessionRecording) {
+	if sessionRecording.Directory != "" {
+		fs.Set("session-recording-dir", sessionRecording.Directory)
+	}
+	if sessionRecording.MaxAge != "" {
+		fs.Set("session-recording-max-age", sessionRecording.MaxAge)
+	}
+	if sessionRecording.MaxRecordings != 0 {
+		fs.Set("session-recording-max-recordings", strconv.Itoa(sessionRecording.MaxRecordings))
+	}
+}
+
+func addPluginIntegrity(fs *flag.FlagSet, pluginIntegrity *PluginIntegrity) {
+	if pluginIntegrity.Enabled {
+		fs.Set("plugin-integrity", "true")
+	}
+	if pluginIntegrity.PinsFile != "" {
+		fs.Set("plugin-integrity-pins-file", pluginIntegrity.PinsFile)
+	}
+	if len(pluginIntegrity.Repin) > 0 {
+		fs.Set("plugin-integrity-repin", strings.Join(pluginIntegrity.Repin, ","))
+	}
+}
+
+func addUpstreams(fs *flag.FlagSet, upstreams []Upstream) error {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	marshaledUpstreams, err := json.Marshal(upstreams)
+	if err != nil {
+		klog.Fatalf("Could not marshal ConsoleConfig 'upstreams' field: %v", err)
+		return err
+	}
+	fs.Set("upstreams", string(marshaledUpstreams))
+	return nil
+}
+
 func addI18nNamespaces(fs *flag.FlagSet, i18nNamespaces []string) {
 	fs.Set("i18n-namespaces", strings.Join(i18nNamespaces, ","))
 }
@@ -299,6 +299,69 @@ func TestSetFlagsFromConfig(t *testing.T) {
 			},
 			expectedError: nil,
 		},
+		{
+			name: "Should apply websocket configuration",
+			config: Config{
+				APIVersion: "console.openshift.io/v1",
+				Kind:       "ConsoleConfig",
+				Websocket: Websocket{
+					PingInterval:          "15s",
+					MaxIdle:               "10m",
+					MaxConnectionsPerUser: 10,
+				},
+			},
+			expectedFlagValues: map[string]string{
+				"websocket-ping-interval":            "15s",
+				"websocket-max-idle":                 "10m0s",
+				"websocket-max-connections-per-user": "10",
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Should apply upstreams configuration",
+			config: Config{
+				APIVersion: "console.openshift.io/v1",
+				Kind:       "ConsoleConfig",
+				Upstreams: []Upstream{
+					{
+						Name:         "loki",
+						ConsolePath:  "/api/logs",
+						Endpoint:     "https://loki.openshift-logging.svc:8080",
+						AllowedPaths: []string{"/loki/api/v1/"},
+					},
+				},
+			},
+			expectedFlagValues: map[string]string{
+				"upstreams": `[{"name":"loki","consolePath":"/api/logs","endpoint":"https://loki.openshift-logging.svc:8080","allowedPaths":["/loki/api/v1/"]}]`,
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Should apply logging configuration",
+			config: Config{
+				APIVersion: "console.openshift.io/v1",
+				Kind:       "ConsoleConfig",
+				LoggingInfo: LoggingInfo{
+					LokiGatewayURL: "https://logging-loki-gateway-http.openshift-logging.svc:8080",
+				},
+			},
+			expectedFlagValues: map[string]string{
+				"logs-gateway-url": "https://logging-loki-gateway-http.openshift-logging.svc:8080",
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Should disable the plugin asset cache",
+			config: Config{
+				APIVersion:             "console.openshift.io/v1",
+				Kind:                   "ConsoleConfig",
+				PluginAssetCacheSizeMB: new(int),
+			},
+			expectedFlagValues: map[string]string{
+				"plugin-asset-cache-size": "0",
+			},
+			expectedError: nil,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -306,6 +369,12 @@ func TestSetFlagsFromConfig(t *testing.T) {
 			fs.String("config", "", "")
 			fs.Var(&MultiKeyValue{}, "plugins", "")
 			fs.Var(&MultiKeyValue{}, "telemetry", "")
+			fs.Duration("websocket-ping-interval", 0, "")
+			fs.Duration("websocket-max-idle", 0, "")
+			fs.Int("websocket-max-connections-per-user", 0, "")
+			fs.String("upstreams", "", "")
+			fs.String("logs-gateway-url", "", "")
+			fs.Int("plugin-asset-cache-size", 50, "")
 
 			actualError := SetFlagsFromConfig(fs, test.config)
 			actual := make(map[string]string)
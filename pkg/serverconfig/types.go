@@ -10,31 +10,117 @@ import (
 
 // Config is the top-level console server cli configuration.
 type Config struct {
-	APIVersion               string `yaml:"apiVersion"`
-	Kind                     string `yaml:"kind"`
-	ServingInfo              `yaml:"servingInfo"`
-	ClusterInfo              `yaml:"clusterInfo"`
-	Auth                     `yaml:"auth"`
-	Customization            `yaml:"customization"`
-	Providers                `yaml:"providers"`
-	Helm                     `yaml:"helm"`
-	MonitoringInfo           `yaml:"monitoringInfo,omitempty"`
-	Plugins                  MultiKeyValue `yaml:"plugins,omitempty"`
-	I18nNamespaces           []string      `yaml:"i18nNamespaces,omitempty"`
-	ManagedClusterConfigFile string        `yaml:"managedClusterConfigFile,omitempty"`
-	Proxy                    Proxy         `yaml:"proxy,omitempty"`
-	Telemetry                MultiKeyValue `yaml:"telemetry,omitempty"`
+	APIVersion             string `yaml:"apiVersion"`
+	Kind                   string `yaml:"kind"`
+	ServingInfo            `yaml:"servingInfo"`
+	ClusterInfo            `yaml:"clusterInfo"`
+	Auth                   `yaml:"auth"`
+	Customization          `yaml:"customization"`
+	Providers              `yaml:"providers"`
+	Helm                   `yaml:"helm"`
+	MonitoringInfo         `yaml:"monitoringInfo,omitempty"`
+	LoggingInfo            `yaml:"loggingInfo,omitempty"`
+	Plugins                MultiKeyValue `yaml:"plugins,omitempty"`
+	PluginsDiscovery       bool          `yaml:"pluginsDiscovery,omitempty"`
+	PluginAssetCacheSizeMB *int          `yaml:"pluginAssetCacheSizeMB,omitempty"` // Unset keeps the default, 0 disables the cache.
+	// PluginManifestCheckInterval is a duration, e.g. 10m.
+	PluginManifestCheckInterval string           `yaml:"pluginManifestCheckInterval,omitempty"`
+	I18nNamespaces              []string         `yaml:"i18nNamespaces,omitempty"`
+	ManagedClusterConfigFile    string           `yaml:"managedClusterConfigFile,omitempty"`
+	Proxy                       Proxy            `yaml:"proxy,omitempty"`
+	Telemetry                   MultiKeyValue    `yaml:"telemetry,omitempty"`
+	Websocket                   Websocket        `yaml:"websocket,omitempty"`
+	SessionRecording            SessionRecording `yaml:"sessionRecording,omitempty"`
+	PluginIntegrity             PluginIntegrity  `yaml:"pluginIntegrity,omitempty"`
+	Upstreams                   []Upstream       `yaml:"upstreams,omitempty"`
 }
 
 type Proxy struct {
 	Services []ProxyService `yaml:"services,omitempty"`
 }
 
+// ProxyService is a service proxied for plugins below ConsoleAPIPath. Services with Authorize only accept
+// authenticated users, whose token is forwarded as bearer token in the Authorization header, or as is in
+// AuthorizationHeader if it is set. ServiceAccountToken sends the console service account token instead.
+// Headers are set on every request. The first PathRewrites entry with a matching prefix replaces it in
+// the path below ConsoleAPIPath. Empty AllowedMethods allow all methods. Zero limits and timeouts are
+// not enforced, Retries only apply to GET, HEAD and OPTIONS requests without a body.
 type ProxyService struct {
-	Endpoint       string `yaml:"endpoint"`
-	ConsoleAPIPath string `yaml:"consoleAPIPath"`
-	CACertificate  string `yaml:"caCertificate"`
-	Authorize      bool   `yaml:"authorize"`
+	Endpoint            string                    `yaml:"endpoint"`
+	ConsoleAPIPath      string                    `yaml:"consoleAPIPath"`
+	CACertificate       string                    `yaml:"caCertificate"`
+	Authorize           bool                      `yaml:"authorize"`
+	AuthorizationHeader string                    `yaml:"authorizationHeader,omitempty"`
+	ServiceAccountToken bool                      `yaml:"serviceAccountToken,omitempty"`
+	Headers             []ProxyServiceHeader      `yaml:"headers,omitempty"`
+	PathRewrites        []ProxyServicePathRewrite `yaml:"pathRewrites,omitempty"`
+	AllowedMethods      []string                  `yaml:"allowedMethods,omitempty"`
+	MaxRequestBytes     int64                     `yaml:"maxRequestBytes,omitempty"`
+	MaxResponseBytes    int64                     `yaml:"maxResponseBytes,omitempty"`
+	TimeoutSeconds      int                       `yaml:"timeoutSeconds,omitempty"`
+	Retries             int                       `yaml:"retries,omitempty"`
+}
+
+// ProxyServiceHeader is a header set on proxied requests. The value is either given inline or read from
+// ValueFile when the console starts, e.g. from a mounted secret.
+type ProxyServiceHeader struct {
+	Name      string `yaml:"name"`
+	Value     string `yaml:"value,omitempty"`
+	ValueFile string `yaml:"valueFile,omitempty"`
+}
+
+type ProxyServicePathRewrite struct {
+	Prefix      string `yaml:"prefix"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Websocket holds keepalive, timeout and connection limit settings for proxied websockets.
+// Durations are duration strings like "30s". Empty and zero values keep the defaults.
+type Websocket struct {
+	PingInterval          string `yaml:"pingInterval,omitempty"`
+	Timeout               string `yaml:"timeout,omitempty"`
+	MaxIdle               string `yaml:"maxIdle,omitempty"`
+	MaxSessionDuration    string `yaml:"maxSessionDuration,omitempty"`
+	MaxConnectionsPerUser int    `yaml:"maxConnectionsPerUser,omitempty"`
+	MaxConnections        int    `yaml:"maxConnections,omitempty"`
+}
+
+// SessionRecording holds configuration for recording pod exec and attach sessions.
+// MaxAge is a duration string like "720h".
+type SessionRecording struct {
+	Directory     string `yaml:"directory,omitempty"`
+	MaxAge        string `yaml:"maxAge,omitempty"`
+	MaxRecordings int    `yaml:"maxRecordings,omitempty"`
+}
+
+// PluginIntegrity holds configuration for pinning the entry scripts of plugins. Repin lists the plugins
+// whose pins are dropped on startup, "*" drops all pins.
+type PluginIntegrity struct {
+	Enabled  bool     `yaml:"enabled,omitempty"`
+	PinsFile string   `yaml:"pinsFile,omitempty"`
+	Repin    []string `yaml:"repin,omitempty"`
+}
+
+// Upstream is a backend service proxied by the console below ConsolePath. Upstreams named like one of
+// the default upstreams replace it. Only AllowedPaths below ConsolePath are proxied, paths ending with a
+// slash match all paths below them. Auth is either "user" (the default) to forward the user's token or
+// "none". JSGlobal is the name of the SERVER_FLAGS key the console base URL is exposed as. PromQLTenancy
+// restricts Prometheus API requests to the namespace given in the `namespace` query parameter and
+// CacheRangeQueries serves Prometheus range queries from the range query cache if it is enabled.
+// LogQLTenancy does the same as PromQLTenancy for Loki API requests.
+type Upstream struct {
+	Name                       string   `yaml:"name" json:"name"`
+	ConsolePath                string   `yaml:"consolePath,omitempty" json:"consolePath,omitempty"`
+	Endpoint                   string   `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	CAFile                     string   `yaml:"caFile,omitempty" json:"caFile,omitempty"`
+	AllowedPaths               []string `yaml:"allowedPaths,omitempty" json:"allowedPaths,omitempty"`
+	Auth                       string   `yaml:"auth,omitempty" json:"auth,omitempty"`
+	JSGlobal                   string   `yaml:"jsGlobal,omitempty" json:"jsGlobal,omitempty"`
+	DisableWithManagedClusters bool     `yaml:"disableWithManagedClusters,omitempty" json:"disableWithManagedClusters,omitempty"`
+	PromQLTenancy              bool     `yaml:"promQLTenancy,omitempty" json:"promQLTenancy,omitempty"`
+	CacheRangeQueries          bool     `yaml:"cacheRangeQueries,omitempty" json:"cacheRangeQueries,omitempty"`
+	LogQLTenancy               bool     `yaml:"logQLTenancy,omitempty" json:"logQLTenancy,omitempty"`
+	Disabled                   bool     `yaml:"disabled,omitempty" json:"disabled,omitempty"`
 }
 
 // ServingInfo holds configuration for serving HTTP.
@@ -63,6 +149,26 @@ type MonitoringInfo struct {
 	GrafanaPublicURL      string `yaml:"grafanaPublicURL,omitempty"`
 	PrometheusPublicURL   string `yaml:"prometheusPublicURL,omitempty"`
 	ThanosPublicURL       string `yaml:"thanosPublicURL,omitempty"`
+	// Limits of namespace-scoped queries as duration strings like "720h".
+	TenancyMaxRange     string `yaml:"tenancyMaxRange,omitempty"`
+	TenancyMinStep      string `yaml:"tenancyMinStep,omitempty"`
+	TenancyQueryTimeout string `yaml:"tenancyQueryTimeout,omitempty"`
+	// Size of the Prometheus range query cache in MiB, 0 disables the cache.
+	RangeCacheSizeMB    int    `yaml:"rangeCacheSizeMB,omitempty"`
+	RangeCacheFreshness string `yaml:"rangeCacheFreshness,omitempty"`
+	// Limits of Prometheus query exports.
+	ExportMaxRange  string `yaml:"exportMaxRange,omitempty"`
+	ExportMaxSeries int    `yaml:"exportMaxSeries,omitempty"`
+	// Maximum time silences created through the console can be active, e.g. "720h".
+	SilenceMaxDuration string `yaml:"silenceMaxDuration,omitempty"`
+	// How often Alertmanager is polled for the alert stream, e.g. "30s". "0s" disables the stream.
+	AlertStreamPollInterval string `yaml:"alertStreamPollInterval,omitempty"`
+}
+
+// LoggingInfo holds URLs for logging related services
+type LoggingInfo struct {
+	// URL of the LokiStack gateway, e.g. https://logging-loki-gateway-http.openshift-logging.svc:8080.
+	LokiGatewayURL string `yaml:"lokiGatewayURL,omitempty"`
 }
 
 // ClusterInfo holds information the about the cluster such as master public URL and console public URL.
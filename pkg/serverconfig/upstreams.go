@@ -0,0 +1,273 @@
+package serverconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// UpstreamAuthUser forwards the user's bearer token to the upstream. This is the default.
+	UpstreamAuthUser = "user"
+	// UpstreamAuthNone requires a console session but does not send any credentials to the upstream.
+	UpstreamAuthNone = "none"
+
+	PrometheusUpstream             = "prometheus"
+	PrometheusTenancyUpstream      = "prometheus-tenancy"
+	PrometheusTenancyRulesUpstream = "prometheus-tenancy-rules"
+	AlertmanagerUpstream           = "alertmanager"
+	AlertmanagerTenancyUpstream    = "alertmanager-tenancy"
+	MeteringUpstream               = "metering"
+	GitOpsUpstream                 = "gitops"
+	LogsUpstream                   = "logs"
+	LogsTenancyUpstream            = "logs-tenancy"
+)
+
+// DefaultUpstreamEndpoints holds the URLs of the backends the console proxies by default.
+// Upstreams with an empty URL are not proxied.
+type DefaultUpstreamEndpoints struct {
+	Thanos                string
+	ThanosTenancy         string
+	ThanosTenancyForRules string
+	Alertmanager          string
+	AlertmanagerTenancy   string
+	Metering              string
+	GitOps                string
+	// The LokiStack gateway, which serves the Loki API of each tenant below /api/logs/v1/<tenant>.
+	LokiGateway string
+}
+
+// InClusterUpstreamEndpoints returns the well-known service URLs of the default upstreams on OpenShift.
+// They are only accessible in-cluster.
+func InClusterUpstreamEndpoints(monitoringNamespace string) DefaultUpstreamEndpoints {
+	return DefaultUpstreamEndpoints{
+		// Thanos proxies requests to both cluster monitoring and user workload monitoring prometheus instances.
+		Thanos: "https://thanos-querier." + monitoringNamespace + ".svc:9091",
+		// The tenant aware Thanos service exposing the query, query_range, series and labels endpoints.
+		ThanosTenancy: "https://thanos-querier." + monitoringNamespace + ".svc:9092",
+		// The tenant aware Thanos service exposing the rules endpoint, which includes Thanos ruler instances.
+		ThanosTenancyForRules: "https://thanos-querier." + monitoringNamespace + ".svc:9093",
+		Alertmanager:          "https://monitoring-alertmanager." + monitoringNamespace + ".svc:9094",
+		AlertmanagerTenancy:   "https://monitoring-alertmanager." + monitoringNamespace + ".svc:9092",
+		Metering:              "https://reporting-operator.openshift-metering.svc:8080",
+		GitOps:                "https://cluster.openshift-gitops.svc:8080",
+	}
+}
+
+// Only requests to the Prometheus API are proxied, not the UI.
+var prometheusAllowedPaths = []string{
+	"/api/v1/label/",
+	"/api/v1/labels",
+	"/api/v1/metadata",
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/rules",
+	"/api/v1/series",
+	"/api/v1/targets",
+}
+
+// Only the query, labels and tail endpoints of the Loki API are proxied.
+var lokiAllowedPaths = []string{
+	"/loki/api/v1/labels",
+	"/loki/api/v1/query",
+	"/loki/api/v1/query_range",
+	"/loki/api/v1/tail",
+}
+
+// Tenants of the LokiStack gateway in openshift-logging mode.
+var lokiTenants = []string{"application", "infrastructure", "audit"}
+
+// DefaultUpstreams returns the monitoring, logging, metering and GitOps upstreams.
+func DefaultUpstreams(endpoints DefaultUpstreamEndpoints) []Upstream {
+	lokiTenantsEndpoint := ""
+	lokiApplicationEndpoint := ""
+	if endpoints.LokiGateway != "" {
+		lokiTenantsEndpoint = strings.TrimSuffix(endpoints.LokiGateway, "/") + "/api/logs/v1"
+		lokiApplicationEndpoint = lokiTenantsEndpoint + "/application"
+	}
+	// Cluster-wide users can query all tenants, e.g. /api/logs/audit/loki/api/v1/query_range.
+	lokiTenantPaths := []string{}
+	for _, tenant := range lokiTenants {
+		for _, path := range lokiAllowedPaths {
+			lokiTenantPaths = append(lokiTenantPaths, "/"+tenant+path)
+		}
+	}
+
+	defaults := []Upstream{
+		{
+			Name:                       PrometheusUpstream,
+			ConsolePath:                "/api/prometheus",
+			Endpoint:                   endpoints.Thanos,
+			AllowedPaths:               prometheusAllowedPaths,
+			JSGlobal:                   "prometheusBaseURL",
+			DisableWithManagedClusters: true,
+			CacheRangeQueries:          true,
+		},
+		{
+			Name:                       PrometheusTenancyUpstream,
+			ConsolePath:                "/api/prometheus-tenancy",
+			Endpoint:                   endpoints.ThanosTenancy,
+			AllowedPaths:               []string{"/api/v1/labels", "/api/v1/query", "/api/v1/query_range", "/api/v1/series"},
+			JSGlobal:                   "prometheusTenancyBaseURL",
+			DisableWithManagedClusters: true,
+			PromQLTenancy:              true,
+			CacheRangeQueries:          true,
+		},
+		{
+			Name:                       PrometheusTenancyRulesUpstream,
+			ConsolePath:                "/api/prometheus-tenancy",
+			Endpoint:                   endpoints.ThanosTenancyForRules,
+			AllowedPaths:               []string{"/api/v1/rules"},
+			DisableWithManagedClusters: true,
+			PromQLTenancy:              true,
+		},
+		{
+			Name:         AlertmanagerUpstream,
+			ConsolePath:  "/api/alertmanager",
+			Endpoint:     endpoints.Alertmanager,
+			AllowedPaths: []string{"/api/"},
+			JSGlobal:     "alertManagerBaseURL",
+		},
+		{
+			Name:         AlertmanagerTenancyUpstream,
+			ConsolePath:  "/api/alertmanager-tenancy",
+			Endpoint:     endpoints.AlertmanagerTenancy,
+			AllowedPaths: []string{"/api/"},
+		},
+		{
+			Name:                       LogsUpstream,
+			ConsolePath:                "/api/logs",
+			Endpoint:                   lokiTenantsEndpoint,
+			AllowedPaths:               lokiTenantPaths,
+			JSGlobal:                   "logsBaseURL",
+			DisableWithManagedClusters: true,
+		},
+		{
+			// Namespace-scoped users can only read application logs of the namespace.
+			Name:                       LogsTenancyUpstream,
+			ConsolePath:                "/api/logs-tenancy",
+			Endpoint:                   lokiApplicationEndpoint,
+			AllowedPaths:               lokiAllowedPaths,
+			JSGlobal:                   "logsTenancyBaseURL",
+			DisableWithManagedClusters: true,
+			LogQLTenancy:               true,
+		},
+		{
+			Name:         MeteringUpstream,
+			ConsolePath:  "/api/metering",
+			Endpoint:     endpoints.Metering,
+			AllowedPaths: []string{"/api/"},
+			JSGlobal:     "meteringBaseURL",
+		},
+		{
+			Name:        GitOpsUpstream,
+			ConsolePath: "/api/gitops",
+			Endpoint:    endpoints.GitOps,
+		},
+	}
+
+	upstreams := []Upstream{}
+	for _, upstream := range defaults {
+		if upstream.Endpoint != "" {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams
+}
+
+// ParseUpstreams parses the JSON value of the upstreams flag.
+func ParseUpstreams(value string) ([]Upstream, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var upstreams []Upstream
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&upstreams); err != nil {
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+// MergeUpstreams replaces default upstreams with configured upstreams of the same name and appends
+// all other configured upstreams. Disabled upstreams are dropped.
+func MergeUpstreams(defaults, configured []Upstream) []Upstream {
+	overrides := map[string]Upstream{}
+	for _, upstream := range configured {
+		overrides[upstream.Name] = upstream
+	}
+
+	merged := []Upstream{}
+	for _, upstream := range defaults {
+		if override, ok := overrides[upstream.Name]; ok {
+			upstream = override
+			delete(overrides, upstream.Name)
+		}
+		if !upstream.Disabled {
+			merged = append(merged, upstream)
+		}
+	}
+	for _, upstream := range configured {
+		if _, ok := overrides[upstream.Name]; ok && !upstream.Disabled {
+			merged = append(merged, upstream)
+		}
+	}
+	return merged
+}
+
+// ValidateUpstreams checks that the upstreams can be registered without conflicts.
+func ValidateUpstreams(upstreams []Upstream) error {
+	names := map[string]bool{}
+	paths := map[string]string{}
+	for i, upstream := range upstreams {
+		if upstream.Name == "" {
+			return fmt.Errorf("upstream at index %d must have a name", i)
+		}
+		if names[upstream.Name] {
+			return fmt.Errorf("upstream %q is defined more than once", upstream.Name)
+		}
+		names[upstream.Name] = true
+		if upstream.Disabled {
+			continue
+		}
+
+		if !strings.HasPrefix(upstream.ConsolePath, "/api/") || strings.HasSuffix(upstream.ConsolePath, "/") {
+			return fmt.Errorf("consolePath %q of upstream %q must start with /api/ and must not end with a slash", upstream.ConsolePath, upstream.Name)
+		}
+		endpoint, err := url.Parse(upstream.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("endpoint %q of upstream %q must be an absolute http or https URL", upstream.Endpoint, upstream.Name)
+		}
+		switch upstream.Auth {
+		case "", UpstreamAuthUser, UpstreamAuthNone:
+		default:
+			return fmt.Errorf("auth of upstream %q must be one of: %s, %s", upstream.Name, UpstreamAuthUser, UpstreamAuthNone)
+		}
+		for _, allowedPath := range upstream.AllowedPaths {
+			if !strings.HasPrefix(allowedPath, "/") {
+				return fmt.Errorf("allowed path %q of upstream %q must start with a slash", allowedPath, upstream.Name)
+			}
+		}
+		for _, path := range upstream.HandlerPaths() {
+			if other, ok := paths[path]; ok {
+				return fmt.Errorf("path %q of upstream %q is already proxied to upstream %q", path, upstream.Name, other)
+			}
+			paths[path] = upstream.Name
+		}
+	}
+	return nil
+}
+
+// HandlerPaths returns the console paths to register for the upstream. Allowed paths ending in a slash
+// match all paths below them, all others only match exactly.
+func (u *Upstream) HandlerPaths() []string {
+	if len(u.AllowedPaths) == 0 {
+		return []string{u.ConsolePath + "/"}
+	}
+	paths := make([]string, 0, len(u.AllowedPaths))
+	for _, allowedPath := range u.AllowedPaths {
+		paths = append(paths, u.ConsolePath+allowedPath)
+	}
+	return paths
+}
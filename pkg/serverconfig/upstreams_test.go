@@ -0,0 +1,181 @@
+package serverconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func upstreamNames(upstreams []Upstream) []string {
+	names := []string{}
+	for _, upstream := range upstreams {
+		names = append(names, upstream.Name)
+	}
+	return names
+}
+
+func TestDefaultUpstreamsSkipsMissingEndpoints(t *testing.T) {
+	upstreams := DefaultUpstreams(DefaultUpstreamEndpoints{
+		Alertmanager: "https://alertmanager.example.com",
+		GitOps:       "https://gitops.example.com",
+	})
+	expected := []string{AlertmanagerUpstream, GitOpsUpstream}
+	if actual := upstreamNames(upstreams); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("upstreams == %v, want %v", actual, expected)
+	}
+}
+
+func TestInClusterDefaultUpstreamsAreValid(t *testing.T) {
+	upstreams := DefaultUpstreams(InClusterUpstreamEndpoints("openshift-monitoring"))
+	if len(upstreams) != 7 {
+		t.Errorf("expected 7 default upstreams, got %d", len(upstreams))
+	}
+	if err := ValidateUpstreams(upstreams); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDefaultLogsUpstreams(t *testing.T) {
+	endpoints := InClusterUpstreamEndpoints("openshift-monitoring")
+	endpoints.LokiGateway = "https://logging-loki-gateway-http.openshift-logging.svc:8080/"
+	upstreams := DefaultUpstreams(endpoints)
+	if err := ValidateUpstreams(upstreams); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var logs, logsTenancy *Upstream
+	for i := range upstreams {
+		switch upstreams[i].Name {
+		case LogsUpstream:
+			logs = &upstreams[i]
+		case LogsTenancyUpstream:
+			logsTenancy = &upstreams[i]
+		}
+	}
+	if logs == nil || logsTenancy == nil {
+		t.Fatalf("expected logs upstreams, got %v", upstreamNames(upstreams))
+	}
+	if expected := "https://logging-loki-gateway-http.openshift-logging.svc:8080/api/logs/v1"; logs.Endpoint != expected {
+		t.Errorf("logs endpoint == %q, want %q", logs.Endpoint, expected)
+	}
+	if len(logs.AllowedPaths) != 12 || logs.AllowedPaths[0] != "/application/loki/api/v1/labels" {
+		t.Errorf("expected the Loki endpoints of all tenants, got %v", logs.AllowedPaths)
+	}
+	if expected := logs.Endpoint + "/application"; logsTenancy.Endpoint != expected || !logsTenancy.LogQLTenancy {
+		t.Errorf("expected namespace-scoped logs upstream for %q, got %+v", expected, logsTenancy)
+	}
+}
+
+func TestMergeUpstreams(t *testing.T) {
+	defaults := DefaultUpstreams(DefaultUpstreamEndpoints{
+		Thanos:       "https://thanos.example.com",
+		Alertmanager: "https://alertmanager.example.com",
+		Metering:     "https://metering.example.com",
+	})
+	configured, err := ParseUpstreams(`[
+		{"name": "alertmanager", "consolePath": "/api/alertmanager", "endpoint": "https://am.example.com", "allowedPaths": ["/api/"]},
+		{"name": "metering", "disabled": true},
+		{"name": "loki", "consolePath": "/api/logs", "endpoint": "https://loki.example.com", "jsGlobal": "logsBaseURL"}
+	]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	merged := MergeUpstreams(defaults, configured)
+	expected := []string{PrometheusUpstream, AlertmanagerUpstream, "loki"}
+	if actual := upstreamNames(merged); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("upstreams == %v, want %v", actual, expected)
+	}
+	if merged[1].Endpoint != "https://am.example.com" {
+		t.Errorf("alertmanager endpoint == %q, want the configured endpoint", merged[1].Endpoint)
+	}
+	if err := ValidateUpstreams(merged); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseUpstreamsRejectsUnknownFields(t *testing.T) {
+	if _, err := ParseUpstreams(`[{"name": "loki", "url": "https://loki.example.com"}]`); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	valid := Upstream{Name: "loki", ConsolePath: "/api/logs", Endpoint: "https://loki.example.com"}
+	tests := []struct {
+		name      string
+		upstreams []Upstream
+		expectErr bool
+	}{
+		{
+			name:      "valid",
+			upstreams: []Upstream{valid},
+		},
+		{
+			name:      "missing name",
+			upstreams: []Upstream{{ConsolePath: "/api/logs", Endpoint: "https://loki.example.com"}},
+			expectErr: true,
+		},
+		{
+			name:      "duplicate name",
+			upstreams: []Upstream{valid, {Name: "loki", ConsolePath: "/api/other", Endpoint: "https://other.example.com"}},
+			expectErr: true,
+		},
+		{
+			name:      "console path outside of /api",
+			upstreams: []Upstream{{Name: "loki", ConsolePath: "/auth", Endpoint: "https://loki.example.com"}},
+			expectErr: true,
+		},
+		{
+			name:      "relative endpoint",
+			upstreams: []Upstream{{Name: "loki", ConsolePath: "/api/logs", Endpoint: "loki:8080"}},
+			expectErr: true,
+		},
+		{
+			name:      "unknown auth",
+			upstreams: []Upstream{{Name: "loki", ConsolePath: "/api/logs", Endpoint: "https://loki.example.com", Auth: "basic"}},
+			expectErr: true,
+		},
+		{
+			name:      "allowed path without leading slash",
+			upstreams: []Upstream{{Name: "loki", ConsolePath: "/api/logs", Endpoint: "https://loki.example.com", AllowedPaths: []string{"loki/"}}},
+			expectErr: true,
+		},
+		{
+			name: "conflicting paths",
+			upstreams: []Upstream{
+				{Name: "a", ConsolePath: "/api/metrics", Endpoint: "https://a.example.com", AllowedPaths: []string{"/api/v1/query"}},
+				{Name: "b", ConsolePath: "/api/metrics", Endpoint: "https://b.example.com", AllowedPaths: []string{"/api/v1/query"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "shared console path with distinct paths",
+			upstreams: []Upstream{
+				{Name: "a", ConsolePath: "/api/metrics", Endpoint: "https://a.example.com", AllowedPaths: []string{"/api/v1/query"}},
+				{Name: "b", ConsolePath: "/api/metrics", Endpoint: "https://b.example.com", AllowedPaths: []string{"/api/v1/rules"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateUpstreams(tt.upstreams)
+			if tt.expectErr && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpstreamHandlerPaths(t *testing.T) {
+	upstream := Upstream{ConsolePath: "/api/gitops"}
+	if actual := upstream.HandlerPaths(); !reflect.DeepEqual(actual, []string{"/api/gitops/"}) {
+		t.Errorf("handler paths == %v, want %v", actual, []string{"/api/gitops/"})
+	}
+	upstream = Upstream{ConsolePath: "/api/prometheus", AllowedPaths: []string{"/api/v1/label/", "/api/v1/query"}}
+	expected := []string{"/api/prometheus/api/v1/label/", "/api/prometheus/api/v1/query"}
+	if actual := upstream.HandlerPaths(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("handler paths == %v, want %v", actual, expected)
+	}
+}
@@ -0,0 +1,39 @@
+package serverutils
+
+import (
+	"context"
+
+	authv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// SelfSubjectAccessReview reports whether the user the config authenticates as is allowed to
+// access the resource described by the attributes.
+func SelfSubjectAccessReview(ctx context.Context, config *rest.Config, attributes authv1.ResourceAttributes) (bool, error) {
+	return selfSubjectAccessReview(ctx, config, authv1.SelfSubjectAccessReviewSpec{
+		ResourceAttributes: &attributes,
+	})
+}
+
+// NonResourceSelfSubjectAccessReview reports whether the user the config authenticates as is allowed
+// to access the non-resource URL described by the attributes, e.g. `/metrics`.
+func NonResourceSelfSubjectAccessReview(ctx context.Context, config *rest.Config, attributes authv1.NonResourceAttributes) (bool, error) {
+	return selfSubjectAccessReview(ctx, config, authv1.SelfSubjectAccessReviewSpec{
+		NonResourceAttributes: &attributes,
+	})
+}
+
+func selfSubjectAccessReview(ctx context.Context, config *rest.Config, spec authv1.SelfSubjectAccessReviewSpec) (bool, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return false, err
+	}
+	sar := &authv1.SelfSubjectAccessReview{Spec: spec}
+	res, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return res.Status.Allowed, nil
+}
@@ -0,0 +1,336 @@
+package tenancy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/openshift/console/pkg/serverutils"
+)
+
+const (
+	queryPath      = "/api/v1/query"
+	queryRangePath = "/api/v1/query_range"
+	seriesPath     = "/api/v1/series"
+	labelsPath     = "/api/v1/labels"
+	rulesPath      = "/api/v1/rules"
+
+	formContentType = "application/x-www-form-urlencoded"
+)
+
+// Limits restricts the cost of namespace-scoped Prometheus queries. Zero values disable a limit.
+type Limits struct {
+	// Maximum time range of range queries, series requests and range selectors.
+	MaxRange time.Duration
+	// Minimum resolution step of range queries.
+	MinStep time.Duration
+	// Maximum evaluation timeout. Requests without timeout or with a longer timeout get this one.
+	QueryTimeout time.Duration
+}
+
+// prometheusError is the error format of the Prometheus HTTP API, which the frontend already handles.
+type prometheusError struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// PrometheusHandler enforces the `namespace` request parameter on queries to the Prometheus API in the
+// style of prom-label-proxy, so that namespace-scoped users cannot read series of other namespaces even
+// if the upstream does not check it. Requests must be relative to the Prometheus API root.
+type PrometheusHandler struct {
+	Limits Limits
+	Next   http.Handler
+}
+
+func (h *PrometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get(NamespaceLabel)
+	if err := ValidateNamespace(namespace); err != nil {
+		sendError(w, err)
+		return
+	}
+
+	params, err := readRequestParams(r)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	switch r.URL.Path {
+	case queryPath:
+		err = h.enforceQuery(params, namespace, false)
+	case queryRangePath:
+		err = h.enforceQuery(params, namespace, true)
+	case seriesPath:
+		err = h.enforceMatchers(params, namespace, true)
+	case labelsPath:
+		err = h.enforceMatchers(params, namespace, false)
+	case rulesPath:
+		h.filterRules(w, r, namespace)
+		return
+	default:
+		serverutils.SendResponse(w, http.StatusNotFound, prometheusError{Status: "error", ErrorType: "not_found", Error: fmt.Sprintf("%s is not supported for namespace-scoped queries", r.URL.Path)})
+		return
+	}
+	if err != nil {
+		klog.V(4).Infof("Rejecting namespace-scoped Prometheus request for namespace %s: %v", namespace, err)
+		sendError(w, err)
+		return
+	}
+
+	params.apply(r)
+	h.Next.ServeHTTP(w, r)
+}
+
+func (h *PrometheusHandler) enforceQuery(params *requestParams, namespace string, isRange bool) error {
+	query := params.get("query")
+	if query == "" {
+		return fmt.Errorf("the %q parameter is required", "query")
+	}
+	enforced, err := EnforceNamespace(query, namespace, h.Limits.MaxRange)
+	if err != nil {
+		return err
+	}
+	params.set("query", enforced)
+
+	if isRange {
+		if err := h.checkRange(params, true); err != nil {
+			return err
+		}
+		step, err := ParseDuration(params.get("step"))
+		if err != nil {
+			return fmt.Errorf("invalid step %q", params.get("step"))
+		}
+		if step <= 0 {
+			return fmt.Errorf("step must be positive")
+		}
+		if h.Limits.MinStep > 0 && step < h.Limits.MinStep {
+			return fmt.Errorf("step %s is below the minimum of %s", step, h.Limits.MinStep)
+		}
+	}
+
+	if h.Limits.QueryTimeout > 0 {
+		timeout, err := ParseDuration(params.get("timeout"))
+		if err != nil || timeout <= 0 || timeout > h.Limits.QueryTimeout {
+			params.set("timeout", strconv.FormatFloat(h.Limits.QueryTimeout.Seconds(), 'f', -1, 64))
+		}
+	}
+	return nil
+}
+
+// enforceMatchers enforces the namespace on all `match[]` selectors. Requests without selectors are
+// rejected if required, otherwise they are limited to the namespace.
+func (h *PrometheusHandler) enforceMatchers(params *requestParams, namespace string, required bool) error {
+	for _, values := range []url.Values{params.query, params.form} {
+		if values == nil {
+			continue
+		}
+		for i, match := range values["match[]"] {
+			enforced, err := EnforceNamespace(match, namespace, h.Limits.MaxRange)
+			if err != nil {
+				return err
+			}
+			values["match[]"][i] = enforced
+		}
+	}
+	if len(params.query["match[]"]) == 0 && len(params.form["match[]"]) == 0 {
+		if required {
+			return fmt.Errorf("at least one %q parameter is required for namespace-scoped queries", "match[]")
+		}
+		params.query.Set("match[]", fmt.Sprintf("{%s=%q}", NamespaceLabel, namespace))
+	}
+	return h.checkRange(params, false)
+}
+
+// checkRange validates start and end against the maximum range. Both are required for range queries.
+func (h *PrometheusHandler) checkRange(params *requestParams, required bool) error {
+	rawStart, rawEnd := params.get("start"), params.get("end")
+	if !required && (rawStart == "" || rawEnd == "") {
+		return nil
+	}
+	start, err := ParseTime(rawStart)
+	if err != nil {
+		return fmt.Errorf("invalid start %q", rawStart)
+	}
+	end, err := ParseTime(rawEnd)
+	if err != nil {
+		return fmt.Errorf("invalid end %q", rawEnd)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("end must not be before start")
+	}
+	if h.Limits.MaxRange > 0 && end.Sub(start) > h.Limits.MaxRange {
+		return fmt.Errorf("time range of %s exceeds the maximum of %s", end.Sub(start), h.Limits.MaxRange)
+	}
+	return nil
+}
+
+// filterRules removes rules without the namespace label from rules responses.
+func (h *PrometheusHandler) filterRules(w http.ResponseWriter, r *http.Request, namespace string) {
+	// The response must be readable to filter it.
+	r.Header.Del("Accept-Encoding")
+	buffer := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+	h.Next.ServeHTTP(buffer, r)
+	if buffer.code != http.StatusOK {
+		buffer.copyTo(w)
+		return
+	}
+
+	rules := map[string]interface{}{}
+	if err := json.Unmarshal(buffer.body.Bytes(), &rules); err != nil {
+		klog.Errorf("Failed to decode Prometheus rules response: %v", err)
+		serverutils.SendResponse(w, http.StatusBadGateway, prometheusError{Status: "error", ErrorType: "bad_response", Error: "Failed to decode Prometheus rules response"})
+		return
+	}
+	data, _ := rules["data"].(map[string]interface{})
+	groups, _ := data["groups"].([]interface{})
+	filteredGroups := []interface{}{}
+	for _, group := range groups {
+		groupMap, _ := group.(map[string]interface{})
+		groupRules, _ := groupMap["rules"].([]interface{})
+		filteredRules := []interface{}{}
+		for _, rule := range groupRules {
+			ruleMap, _ := rule.(map[string]interface{})
+			labels, _ := ruleMap["labels"].(map[string]interface{})
+			if labels[NamespaceLabel] == namespace {
+				filteredRules = append(filteredRules, rule)
+			}
+		}
+		if len(filteredRules) > 0 {
+			groupMap["rules"] = filteredRules
+			filteredGroups = append(filteredGroups, groupMap)
+		}
+	}
+	if data != nil {
+		data["groups"] = filteredGroups
+	}
+
+	body, err := json.Marshal(rules)
+	if err != nil {
+		klog.Errorf("Failed to encode Prometheus rules response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buffer.body.Reset()
+	buffer.body.Write(body)
+	buffer.header.Del("Content-Length")
+	buffer.copyTo(w)
+}
+
+// bufferedResponseWriter holds a response so that it can be modified before it is sent.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	b.code = code
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponseWriter) copyTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.code)
+	if _, err := b.body.WriteTo(w); err != nil {
+		klog.V(4).Infof("Failed to write Prometheus response: %v", err)
+	}
+}
+
+func sendError(w http.ResponseWriter, err error) {
+	serverutils.SendResponse(w, http.StatusBadRequest, prometheusError{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+}
+
+// requestParams are the URL query and form body parameters of a request. Prometheus reads both.
+type requestParams struct {
+	query url.Values
+	form  url.Values
+}
+
+// readRequestParams reads the URL query and the form body of the request. Other request bodies are
+// rejected, since the upstream might read parameters from them that weren't checked.
+func readRequestParams(r *http.Request) (*requestParams, error) {
+	params := &requestParams{query: r.URL.Query()}
+	if r.Body == nil {
+		return params, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return params, nil
+	}
+	if r.Method != http.MethodPost || !IsFormContentType(r.Header.Get("Content-Type")) {
+		return nil, fmt.Errorf("unsupported request body, only POST requests with %s bodies are supported", formContentType)
+	}
+	if params.form, err = url.ParseQuery(string(body)); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+	return params, nil
+}
+
+// IsFormContentType reports whether the Content-Type header is the form media type. Media types are
+// case-insensitive, as they are for the upstreams parsing the form.
+func IsFormContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == formContentType
+}
+
+// apply replaces the URL query and form body of the request with the parameters.
+func (p *requestParams) apply(r *http.Request) {
+	r.URL.RawQuery = p.query.Encode()
+	if p.form != nil {
+		body := p.form.Encode()
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
+
+func (p *requestParams) get(key string) string {
+	if p.form != nil {
+		if value := p.form.Get(key); value != "" {
+			return value
+		}
+	}
+	return p.query.Get(key)
+}
+
+func (p *requestParams) set(key, value string) {
+	if p.form != nil && p.form.Get(key) != "" {
+		p.form.Set(key, value)
+		p.query.Del(key)
+		return
+	}
+	p.query.Set(key, value)
+}
+
+// ParseTime parses Prometheus timestamps, which are either RFC 3339 or Unix seconds.
+func ParseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
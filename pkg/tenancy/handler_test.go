@@ -0,0 +1,215 @@
+package tenancy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	var upstreamRequest *http.Request
+	var upstreamBody string
+	handler := &PrometheusHandler{
+		Limits: Limits{MaxRange: 24 * time.Hour, MinStep: 15 * time.Second, QueryTimeout: 30 * time.Second},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamRequest = r
+			body, _ := ioutil.ReadAll(r.Body)
+			upstreamBody = string(body)
+			w.Write([]byte(`{"status":"success"}`))
+		}),
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		contentType   string
+		expectedCode  int
+		expectedQuery url.Values
+		expectedForm  url.Values
+	}{
+		{
+			name:         "instant query",
+			path:         "/api/v1/query?namespace=ns&query=up&timeout=5m",
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"query":     {`up{namespace="ns"}`},
+				"timeout":   {"30"},
+			},
+		},
+		{
+			name:         "range query in form body",
+			method:       http.MethodPost,
+			path:         "/api/v1/query_range?namespace=ns",
+			body:         "query=sum(rate(up[5m]))&start=1600000000&end=1600003600&step=60&timeout=10s",
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+			},
+			expectedForm: url.Values{
+				"query":   {`sum(rate(up{namespace="ns"}[5m]))`},
+				"start":   {"1600000000"},
+				"end":     {"1600003600"},
+				"step":    {"60"},
+				"timeout": {"10s"},
+			},
+		},
+		{
+			name:         "labels without match",
+			path:         "/api/v1/labels?namespace=ns",
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"match[]":   {`{namespace="ns"}`},
+			},
+		},
+		{
+			name:         "series",
+			path:         "/api/v1/series?namespace=ns&match[]=up&match[]=kube_pod_info",
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"match[]":   {`up{namespace="ns"}`, `kube_pod_info{namespace="ns"}`},
+			},
+		},
+		{
+			name:         "missing namespace",
+			path:         "/api/v1/query?query=up",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "other namespace",
+			path:         "/api/v1/query?namespace=ns&query=" + url.QueryEscape(`up{namespace="kube-system"}`),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "query in URL and form body",
+			method:       http.MethodPost,
+			path:         "/api/v1/query?namespace=ns&query=up",
+			body:         "query=" + url.QueryEscape(`up{namespace!="ns"}`),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "mixed-case form content type",
+			method:       http.MethodPost,
+			path:         "/api/v1/query?namespace=ns&query=" + url.QueryEscape(`up{namespace="ns"}`),
+			body:         "query=up",
+			contentType:  "Application/X-WWW-Form-Urlencoded; charset=UTF-8",
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"timeout":   {"30"},
+			},
+			expectedForm: url.Values{
+				"query": {`up{namespace="ns"}`},
+			},
+		},
+		{
+			name:         "body that is not a form",
+			method:       http.MethodPost,
+			path:         "/api/v1/query?namespace=ns&query=up",
+			body:         `{"query":"up"}`,
+			contentType:  "application/json",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "series without match",
+			path:         "/api/v1/series?namespace=ns",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "range above the maximum",
+			path:         "/api/v1/query_range?namespace=ns&query=up&start=2020-01-01T00:00:00Z&end=2020-01-03T00:00:00Z&step=60",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "step below the minimum",
+			path:         "/api/v1/query_range?namespace=ns&query=up&start=1600000000&end=1600003600&step=1s",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "unsupported path",
+			path:         "/api/v1/status/config?namespace=ns",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamRequest, upstreamBody = nil, ""
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			} else if tt.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedCode {
+				t.Fatalf("status == %d, want %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+			if tt.expectedCode != http.StatusOK {
+				if upstreamRequest != nil {
+					t.Errorf("expected request not to be proxied")
+				}
+				response := prometheusError{}
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Status != "error" || response.Error == "" {
+					t.Errorf("expected a Prometheus API error, got %s", w.Body.String())
+				}
+				return
+			}
+			if actual := upstreamRequest.URL.Query(); !reflect.DeepEqual(actual, tt.expectedQuery) {
+				t.Errorf("query == %v, want %v", actual, tt.expectedQuery)
+			}
+			if tt.expectedForm != nil {
+				form, _ := url.ParseQuery(upstreamBody)
+				if !reflect.DeepEqual(form, tt.expectedForm) {
+					t.Errorf("form == %v, want %v", form, tt.expectedForm)
+				}
+			}
+		})
+	}
+}
+
+func TestPrometheusHandlerFiltersRules(t *testing.T) {
+	handler := &PrometheusHandler{
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept-Encoding") != "" {
+				t.Errorf("expected Accept-Encoding to be removed")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"success","data":{"groups":[
+				{"name":"mixed","rules":[
+					{"name":"a","labels":{"namespace":"ns"}},
+					{"name":"b","labels":{"namespace":"other"}},
+					{"name":"c"}
+				]},
+				{"name":"other","rules":[{"name":"d","labels":{"namespace":"other"}}]}
+			]}}`))
+		}),
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/rules?namespace=ns", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d", w.Code, http.StatusOK)
+	}
+	expected := `{"data":{"groups":[{"name":"mixed","rules":[{"labels":{"namespace":"ns"},"name":"a"}]}]},"status":"success"}`
+	if w.Body.String() != expected {
+		t.Errorf("body == %s, want %s", w.Body.String(), expected)
+	}
+}
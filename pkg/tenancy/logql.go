@@ -0,0 +1,35 @@
+package tenancy
+
+import (
+	"fmt"
+)
+
+// LogNamespaceLabel is the stream label OpenShift Logging sets to the namespace of container logs.
+const LogNamespaceLabel = "kubernetes_namespace_name"
+
+// EnforceLogNamespace returns the LogQL query with a `kubernetes_namespace_name="<namespace>"` matcher
+// added to every stream selector that does not have it. Queries with other matchers for the label are
+// rejected. Unlike PromQL, every selector of a LogQL query is enclosed in braces, so label filters in
+// pipelines are left as they are.
+func EnforceLogNamespace(query, namespace string) (string, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return "", err
+	}
+	selectors := []selector{}
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].value != "{" {
+			continue
+		}
+		matchers, end, err := parseMatchers(tokens, i)
+		if err != nil {
+			return "", err
+		}
+		selectors = append(selectors, selector{nameEnd: tokens[i].pos, braceStart: tokens[i].pos, matchers: matchers})
+		i = end
+	}
+	if len(selectors) == 0 {
+		return "", fmt.Errorf("the query must have a stream selector")
+	}
+	return enforceSelectors(query, selectors, LogNamespaceLabel, namespace)
+}
@@ -0,0 +1,77 @@
+package tenancy
+
+import (
+	"testing"
+)
+
+func TestEnforceLogNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "stream selector",
+			query:    `{app="a"}`,
+			expected: `{kubernetes_namespace_name="ns",app="a"}`,
+		},
+		{
+			name:     "line filters and parsers",
+			query:    `{app="a"} |= "error" != "debug" | json | level="error" | line_format "{{.msg}}"`,
+			expected: `{kubernetes_namespace_name="ns",app="a"} |= "error" != "debug" | json | level="error" | line_format "{{.msg}}"`,
+		},
+		{
+			name:     "metric query",
+			query:    `sum by (level) (count_over_time({app="a"} |~ "err|warn" [5m]))`,
+			expected: `sum by (level) (count_over_time({kubernetes_namespace_name="ns",app="a"} |~ "err|warn" [5m]))`,
+		},
+		{
+			name:     "binary operation",
+			query:    `rate({app="a"}[1m]) / rate({app="b"}[1m])`,
+			expected: `rate({kubernetes_namespace_name="ns",app="a"}[1m]) / rate({kubernetes_namespace_name="ns",app="b"}[1m])`,
+		},
+		{
+			name:     "existing namespace matcher",
+			query:    `{kubernetes_namespace_name="ns"}`,
+			expected: `{kubernetes_namespace_name="ns"}`,
+		},
+		{
+			name:      "other namespace",
+			query:     `{kubernetes_namespace_name="kube-system"}`,
+			expectErr: true,
+		},
+		{
+			name:      "namespace regexp",
+			query:     `{kubernetes_namespace_name=~".+"}`,
+			expectErr: true,
+		},
+		{
+			name:      "no stream selector",
+			query:     `vector(1)`,
+			expectErr: true,
+		},
+		{
+			name:      "unterminated string",
+			query:     `{app="a}`,
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := EnforceLogNamespace(tt.query, "ns")
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("query == %q, want %q", actual, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package tenancy
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/klog"
+)
+
+const (
+	lokiQueryPath      = "/loki/api/v1/query"
+	lokiQueryRangePath = "/loki/api/v1/query_range"
+	lokiLabelsPath     = "/loki/api/v1/labels"
+	lokiTailPath       = "/loki/api/v1/tail"
+)
+
+// LokiHandler enforces the `namespace` request parameter on LogQL queries to the Loki API, so that
+// namespace-scoped users can only read logs of that namespace. Requests must be relative to the
+// Loki API root of a LokiStack gateway tenant. Tail requests are websocket upgrades with the query in
+// the URL, so the handler must not consume the connection.
+type LokiHandler struct {
+	Next http.Handler
+}
+
+func (h *LokiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get(NamespaceLabel)
+	if err := ValidateNamespace(namespace); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params, err := readRequestParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case lokiQueryPath, lokiQueryRangePath, lokiTailPath:
+		err = enforceLogQuery(params, namespace, true)
+	case lokiLabelsPath:
+		err = enforceLogQuery(params, namespace, false)
+	default:
+		http.Error(w, fmt.Sprintf("%s is not supported for namespace-scoped queries", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		klog.V(4).Infof("Rejecting namespace-scoped Loki request for namespace %s: %v", namespace, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params.apply(r)
+	h.Next.ServeHTTP(w, r)
+}
+
+// enforceLogQuery enforces the namespace on the `query` parameter. Requests without query are rejected
+// if it is required, otherwise they are limited to the namespace.
+func enforceLogQuery(params *requestParams, namespace string, required bool) error {
+	query := params.get("query")
+	if query == "" {
+		if required {
+			return fmt.Errorf("the %q parameter is required", "query")
+		}
+		params.query.Set("query", fmt.Sprintf("{%s=%q}", LogNamespaceLabel, namespace))
+		return nil
+	}
+	enforced, err := EnforceLogNamespace(query, namespace)
+	if err != nil {
+		return err
+	}
+	params.set("query", enforced)
+	return nil
+}
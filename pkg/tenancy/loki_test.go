@@ -0,0 +1,128 @@
+package tenancy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLokiHandler(t *testing.T) {
+	var upstreamRequest *http.Request
+	handler := &LokiHandler{
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamRequest = r
+		}),
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		expectedCode  int
+		expectedQuery url.Values
+	}{
+		{
+			name:         "range query",
+			path:         "/loki/api/v1/query_range?namespace=ns&limit=100&query=" + url.QueryEscape(`{app="a"} |= "error"`),
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"limit":     {"100"},
+				"query":     {`{kubernetes_namespace_name="ns",app="a"} |= "error"`},
+			},
+		},
+		{
+			name:         "tail",
+			path:         "/loki/api/v1/tail?namespace=ns&query=" + url.QueryEscape(`{app="a"}`),
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"query":     {`{kubernetes_namespace_name="ns",app="a"}`},
+			},
+		},
+		{
+			name:         "labels without query",
+			path:         "/loki/api/v1/labels?namespace=ns",
+			expectedCode: http.StatusOK,
+			expectedQuery: url.Values{
+				"namespace": {"ns"},
+				"query":     {`{kubernetes_namespace_name="ns"}`},
+			},
+		},
+		{
+			name:         "missing namespace",
+			path:         "/loki/api/v1/query?query=" + url.QueryEscape(`{app="a"}`),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "missing query",
+			path:         "/loki/api/v1/query?namespace=ns",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "other namespace",
+			path:         "/loki/api/v1/query?namespace=ns&query=" + url.QueryEscape(`{kubernetes_namespace_name!="ns"}`),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "unsupported path",
+			path:         "/loki/api/v1/series?namespace=ns",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamRequest = nil
+			r := httptest.NewRequest(http.MethodGet, tt.path, strings.NewReader(""))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedCode {
+				t.Fatalf("status == %d, want %d: %s", w.Code, tt.expectedCode, w.Body.String())
+			}
+			if tt.expectedCode != http.StatusOK {
+				if upstreamRequest != nil {
+					t.Errorf("expected request not to be proxied")
+				}
+				return
+			}
+			if actual := upstreamRequest.URL.Query(); !reflect.DeepEqual(actual, tt.expectedQuery) {
+				t.Errorf("query == %v, want %v", actual, tt.expectedQuery)
+			}
+		})
+	}
+}
+
+func TestLokiHandlerFormBody(t *testing.T) {
+	var upstreamBody string
+	handler := &LokiHandler{
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			upstreamBody = string(body)
+		}),
+	}
+
+	// The upstream prefers the body over the URL, whatever the case of the media type.
+	r := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query?namespace=ns&query="+url.QueryEscape(`{kubernetes_namespace_name="ns"}`), strings.NewReader(`query={app="a"}`))
+	r.Header.Set("Content-Type", "Application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status == %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if form, _ := url.ParseQuery(upstreamBody); form.Get("query") != `{kubernetes_namespace_name="ns",app="a"}` {
+		t.Errorf("expected the namespace to be enforced on the body, got %v", form)
+	}
+
+	upstreamBody = ""
+	r = httptest.NewRequest(http.MethodPost, "/loki/api/v1/query?namespace=ns&query="+url.QueryEscape(`{app="a"}`), strings.NewReader(`query={app="a"}`))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || upstreamBody != "" {
+		t.Errorf("expected bodies that are not forms to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,401 @@
+package tenancy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// NamespaceLabel is the label all series of a namespace-scoped query must match.
+const NamespaceLabel = "namespace"
+
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Keywords that are followed by a parenthesized list of label names instead of an expression.
+var labelListKeywords = map[string]bool{
+	"by":          true,
+	"without":     true,
+	"on":          true,
+	"ignoring":    true,
+	"group_left":  true,
+	"group_right": true,
+}
+
+// Keywords and number literals that look like metric names.
+var reservedIdentifiers = map[string]bool{
+	"and":    true,
+	"or":     true,
+	"unless": true,
+	"atan2":  true,
+	"bool":   true,
+	"offset": true,
+	"inf":    true,
+	"nan":    true,
+}
+
+type tokenKind int
+
+const (
+	tokenIdentifier tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenPunctuation
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type matcher struct {
+	name  string
+	op    string
+	value string
+}
+
+// selector is a vector selector like `metric{label="value"}`. braceStart is the offset of the opening
+// brace or -1 if the selector has no label matchers, nameEnd is the offset after the metric name.
+type selector struct {
+	nameEnd    int
+	braceStart int
+	matchers   []matcher
+}
+
+// ValidateNamespace checks that namespace is a valid namespace name, so that it can be used in matchers.
+func ValidateNamespace(namespace string) error {
+	if namespace == "" {
+		return fmt.Errorf("the %q parameter is required", NamespaceLabel)
+	}
+	if len(namespace) > 63 || !namespaceRegexp.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return nil
+}
+
+// EnforceNamespace returns the query with a `namespace="<namespace>"` matcher added to every vector
+// selector that does not have it. Queries with other namespace matchers are rejected, since they could
+// select series of other namespaces. Range selectors and subqueries longer than maxRange are rejected
+// if maxRange is not zero.
+func EnforceNamespace(query, namespace string, maxRange time.Duration) (string, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return "", err
+	}
+	selectors, err := parseSelectors(tokens, maxRange)
+	if err != nil {
+		return "", err
+	}
+	return enforceSelectors(query, selectors, NamespaceLabel, namespace)
+}
+
+// NormalizeQuery returns the query with comments removed and single spaces between tokens, so that
+// queries that only differ in formatting are equal.
+func NormalizeQuery(query string) (string, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return "", err
+	}
+	values := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		values = append(values, t.value)
+	}
+	return strings.Join(values, " "), nil
+}
+
+// enforceSelectors adds a `<label>="<namespace>"` matcher to all selectors that do not have it and
+// rejects selectors with other matchers for the label.
+func enforceSelectors(query string, selectors []selector, label, namespace string) (string, error) {
+	type insertion struct {
+		pos  int
+		text string
+	}
+	insertions := []insertion{}
+	namespaceMatcher := label + "=" + strconv.Quote(namespace)
+	for _, s := range selectors {
+		enforced := false
+		for _, m := range s.matchers {
+			if m.name != label {
+				continue
+			}
+			if m.op != "=" || m.value != namespace {
+				return "", fmt.Errorf("only the matcher %s is allowed for the %q label, got %s%s%q", namespaceMatcher, label, m.name, m.op, m.value)
+			}
+			enforced = true
+		}
+		switch {
+		case enforced:
+		case s.braceStart < 0:
+			insertions = append(insertions, insertion{pos: s.nameEnd, text: "{" + namespaceMatcher + "}"})
+		case len(s.matchers) == 0:
+			insertions = append(insertions, insertion{pos: s.braceStart + 1, text: namespaceMatcher})
+		default:
+			insertions = append(insertions, insertion{pos: s.braceStart + 1, text: namespaceMatcher + ","})
+		}
+	}
+
+	sort.Slice(insertions, func(i, j int) bool { return insertions[i].pos > insertions[j].pos })
+	for _, i := range insertions {
+		query = query[:i.pos] + i.text + query[i.pos:]
+	}
+	return query, nil
+}
+
+func parseSelectors(tokens []token, maxRange time.Duration) ([]selector, error) {
+	selectors := []selector{}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		next := func(offset int) *token {
+			if i+offset < len(tokens) {
+				return &tokens[i+offset]
+			}
+			return nil
+		}
+
+		switch {
+		case t.kind == tokenIdentifier && labelListKeywords[strings.ToLower(t.value)]:
+			if n := next(1); n != nil && n.value == "(" {
+				end, err := skipLabelList(tokens, i+1)
+				if err != nil {
+					return nil, err
+				}
+				i = end
+			}
+		case t.kind == tokenIdentifier && reservedIdentifiers[strings.ToLower(t.value)]:
+		case t.kind == tokenIdentifier:
+			n := next(1)
+			// Function calls and aggregations with a `by` or `without` clause before their arguments.
+			if n != nil && (n.value == "(" || (n.kind == tokenIdentifier && labelListKeywords[strings.ToLower(n.value)])) {
+				continue
+			}
+			s := selector{nameEnd: t.pos + len(t.value), braceStart: -1}
+			if n != nil && n.value == "{" {
+				matchers, end, err := parseMatchers(tokens, i+1)
+				if err != nil {
+					return nil, err
+				}
+				s.braceStart = n.pos
+				s.matchers = matchers
+				i = end
+			}
+			selectors = append(selectors, s)
+		case t.value == "{":
+			matchers, end, err := parseMatchers(tokens, i)
+			if err != nil {
+				return nil, err
+			}
+			selectors = append(selectors, selector{nameEnd: t.pos, braceStart: t.pos, matchers: matchers})
+			i = end
+		case t.value == "[":
+			n := next(1)
+			if n == nil || n.kind != tokenNumber {
+				return nil, fmt.Errorf("expected duration after %q at position %d", "[", t.pos)
+			}
+			d, err := ParseDuration(n.value)
+			if err != nil {
+				return nil, err
+			}
+			if maxRange > 0 && d > maxRange {
+				return nil, fmt.Errorf("range %s exceeds the maximum of %s", n.value, maxRange)
+			}
+		}
+	}
+	return selectors, nil
+}
+
+// skipLabelList returns the index of the closing parenthesis of the label list starting at start.
+func skipLabelList(tokens []token, start int) (int, error) {
+	for i := start + 1; i < len(tokens); i++ {
+		switch {
+		case tokens[i].value == ")":
+			return i, nil
+		case tokens[i].kind != tokenIdentifier && tokens[i].kind != tokenString && tokens[i].value != ",":
+			return 0, fmt.Errorf("unexpected %q in label list at position %d", tokens[i].value, tokens[i].pos)
+		}
+	}
+	return 0, fmt.Errorf("unclosed label list at position %d", tokens[start].pos)
+}
+
+// parseMatchers parses the label matchers starting at the opening brace at start and returns the
+// index of the closing brace.
+func parseMatchers(tokens []token, start int) ([]matcher, int, error) {
+	matchers := []matcher{}
+	i := start + 1
+	for i < len(tokens) {
+		if tokens[i].value == "}" {
+			return matchers, i, nil
+		}
+		if i+2 >= len(tokens) || tokens[i].kind != tokenIdentifier {
+			break
+		}
+		name, op, value := tokens[i], tokens[i+1], tokens[i+2]
+		switch op.value {
+		case "=", "!=", "=~", "!~":
+		default:
+			return nil, 0, fmt.Errorf("unexpected %q in label matcher at position %d", op.value, op.pos)
+		}
+		if value.kind != tokenString {
+			return nil, 0, fmt.Errorf("expected string in label matcher at position %d", value.pos)
+		}
+		unquoted, err := unquote(value.value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid string %s at position %d: %v", value.value, value.pos, err)
+		}
+		matchers = append(matchers, matcher{name: name.value, op: op.value, value: unquoted})
+		i += 3
+		if i < len(tokens) && tokens[i].value == "," {
+			i++
+		}
+	}
+	return nil, 0, fmt.Errorf("invalid label matchers at position %d", tokens[start].pos)
+}
+
+func tokenize(query string) ([]token, error) {
+	tokens := []token{}
+	// Inside brackets a colon separates the range and the resolution of a subquery.
+	inBrackets := false
+	for pos := 0; pos < len(query); {
+		c := query[pos]
+		start := pos
+		switch {
+		case c == ':' && inBrackets:
+			pos++
+			tokens = append(tokens, token{kind: tokenPunctuation, value: ":", pos: start})
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case c == '#':
+			for pos < len(query) && query[pos] != '\n' {
+				pos++
+			}
+			continue
+		case isIdentifierStart(c):
+			for pos < len(query) && isIdentifierChar(query[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, value: query[start:pos], pos: start})
+		case isDigit(c) || (c == '.' && pos+1 < len(query) && isDigit(query[pos+1])):
+			for pos < len(query) {
+				ch := query[pos]
+				exponentSign := (ch == '+' || ch == '-') && pos > start && (query[pos-1] == 'e' || query[pos-1] == 'E') &&
+					!strings.HasPrefix(strings.ToLower(query[start:pos]), "0x")
+				if (!isIdentifierChar(ch) || ch == ':') && ch != '.' && !exponentSign {
+					break
+				}
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: query[start:pos], pos: start})
+		case c == '"' || c == '\'' || c == '`':
+			pos++
+			for pos < len(query) && query[pos] != c {
+				if query[pos] == '\\' && c != '`' {
+					pos++
+				}
+				pos++
+			}
+			if pos >= len(query) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			pos++
+			tokens = append(tokens, token{kind: tokenString, value: query[start:pos], pos: start})
+		case strings.IndexByte("(){}[],:@", c) >= 0:
+			if c == '[' || c == ']' {
+				inBrackets = c == '['
+			}
+			pos++
+			tokens = append(tokens, token{kind: tokenPunctuation, value: query[start:pos], pos: start})
+		case strings.IndexByte("=!~<>+-*/%^|", c) >= 0:
+			pos++
+			if pos < len(query) && (query[pos] == '=' || query[pos] == '~') && c != '~' {
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokenPunctuation, value: query[start:pos], pos: start})
+		default:
+			r, _ := utf8.DecodeRuneInString(query[pos:])
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, pos)
+		}
+	}
+	return tokens, nil
+}
+
+func unquote(s string) (string, error) {
+	quote := s[0]
+	s = s[1 : len(s)-1]
+	if quote == '`' {
+		return s, nil
+	}
+	var b strings.Builder
+	for len(s) > 0 {
+		r, _, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return "", err
+		}
+		b.WriteRune(r)
+		s = tail
+	}
+	return b.String(), nil
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+var durationUnits = []struct {
+	unit     string
+	duration time.Duration
+}{
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// ParseDuration parses Prometheus durations like `1h30m` as well as plain seconds like `90` or `1.5`.
+func ParseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	var d time.Duration
+	rest := s
+	for rest != "" {
+		end := 0
+		for end < len(rest) && isDigit(rest[end]) {
+			end++
+		}
+		if end == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		value, _ := strconv.Atoi(rest[:end])
+		rest = rest[end:]
+		found := false
+		for _, u := range durationUnits {
+			// "m" must not match the prefix of "ms".
+			if strings.HasPrefix(rest, u.unit) && !(u.unit == "m" && strings.HasPrefix(rest, "ms")) {
+				d += time.Duration(value) * u.duration
+				rest = rest[len(u.unit):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,169 @@
+package tenancy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnforceNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "metric name",
+			query:    "up",
+			expected: `up{namespace="ns"}`,
+		},
+		{
+			name:     "metric with matchers",
+			query:    `up{job="a", pod=~"p.*"}`,
+			expected: `up{namespace="ns",job="a", pod=~"p.*"}`,
+		},
+		{
+			name:     "empty matchers",
+			query:    `up{}`,
+			expected: `up{namespace="ns"}`,
+		},
+		{
+			name:     "selector without metric name",
+			query:    `{__name__="up"}`,
+			expected: `{namespace="ns",__name__="up"}`,
+		},
+		{
+			name:     "existing namespace matcher",
+			query:    `up{namespace="ns"}`,
+			expected: `up{namespace="ns"}`,
+		},
+		{
+			name:     "functions, aggregations and binary operators",
+			query:    `sum by (pod) (rate(container_cpu_usage_seconds_total{container!=""}[5m])) / on(pod) group_left(node) kube_pod_info`,
+			expected: `sum by (pod) (rate(container_cpu_usage_seconds_total{namespace="ns",container!=""}[5m])) / on(pod) group_left(node) kube_pod_info{namespace="ns"}`,
+		},
+		{
+			name:     "aggregation with trailing by clause",
+			query:    `count(up) by (job) > bool 1 and on() vector(1)`,
+			expected: `count(up{namespace="ns"}) by (job) > bool 1 and on() vector(1)`,
+		},
+		{
+			name:     "strings, numbers and modifiers",
+			query:    `label_replace(up offset 5m, "dst", "$1", "src", "(.*)") * 1e+3 + up @ start()`,
+			expected: `label_replace(up{namespace="ns"} offset 5m, "dst", "$1", "src", "(.*)") * 1e+3 + up{namespace="ns"} @ start()`,
+		},
+		{
+			name:     "subquery",
+			query:    `max_over_time(rate(http_requests_total[5m])[1h:1m])`,
+			expected: `max_over_time(rate(http_requests_total{namespace="ns"}[5m])[1h:1m])`,
+		},
+		{
+			name:     "braces in strings",
+			query:    `up{job="}{"}`,
+			expected: `up{namespace="ns",job="}{"}`,
+		},
+		{
+			name:      "other namespace",
+			query:     `up{namespace="other"}`,
+			expectErr: true,
+		},
+		{
+			name:      "namespace regex",
+			query:     `up{namespace=~".+"}`,
+			expectErr: true,
+		},
+		{
+			name:      "escaped namespace in single quotes",
+			query:     `up{namespace='n\x73'} or up{namespace!="ns"}`,
+			expectErr: true,
+		},
+		{
+			name:      "range above the maximum",
+			query:     `rate(up[2d])`,
+			expectErr: true,
+		},
+		{
+			name:      "subquery above the maximum",
+			query:     `max_over_time(up[1w:1h])`,
+			expectErr: true,
+		},
+		{
+			name:      "unterminated matchers",
+			query:     `up{job="a"`,
+			expectErr: true,
+		},
+		{
+			name:      "unterminated string",
+			query:     `up{job="a}`,
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := EnforceNamespace(tt.query, "ns", 24*time.Hour)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("query == %q, want %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateNamespace(t *testing.T) {
+	for _, namespace := range []string{"", "Upper", "ns\"}", "-ns"} {
+		if err := ValidateNamespace(namespace); err == nil {
+			t.Errorf("expected namespace %q to be invalid", namespace)
+		}
+	}
+	if err := ValidateNamespace("openshift-monitoring"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90":     90 * time.Second,
+		"1.5":    1500 * time.Millisecond,
+		"5m":     5 * time.Minute,
+		"1h30m":  90 * time.Minute,
+		"100ms":  100 * time.Millisecond,
+		"2d":     48 * time.Hour,
+		"1w1d1h": 193 * time.Hour,
+	}
+	for input, expected := range tests {
+		actual, err := ParseDuration(input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", input, err)
+		} else if actual != expected {
+			t.Errorf("ParseDuration(%q) == %v, want %v", input, actual, expected)
+		}
+	}
+	for _, input := range []string{"5x", "m", "1h-"} {
+		if _, err := ParseDuration(input); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	a, err := NormalizeQuery("sum(rate(up{job=\"a  b\"}[5m]))  # comment\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ := NormalizeQuery(`sum( rate( up{ job="a  b" }[5m] ) )`)
+	if a != b {
+		t.Errorf("normalized queries differ: %q and %q", a, b)
+	}
+	c, _ := NormalizeQuery(`sum(rate(up{job="a b"}[5m]))`)
+	if a == c {
+		t.Errorf("expected whitespace in strings to be kept, got %q", c)
+	}
+}
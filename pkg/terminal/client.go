@@ -2,7 +2,6 @@ package terminal
 
 import (
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
@@ -20,15 +19,6 @@ func (p *Proxy) createDynamicClient(token string) (dynamic.Interface, error) {
 	return client, nil
 }
 
-func (p *Proxy) createTypedClient(token string) (*kubernetes.Clientset, error) {
-	config, err := p.getConfig(token)
-	if err != nil {
-		return nil, err
-	}
-
-	return kubernetes.NewForConfig(config)
-}
-
 func (p *Proxy) getConfig(token string) (*rest.Config, error) {
 	var tlsClientConfig rest.TLSClientConfig
 	if p.TLSClientConfig.InsecureSkipVerify {